@@ -0,0 +1,483 @@
+package client
+
+import (
+	"errors"
+	"github.com/jakewins/reactivesocket-go/pkg/rs"
+	"math"
+	"math/rand"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Requests fail with this when the balancer has no addresses
+var ErrNoSockets = errors.New("No sockets to balance requests over.")
+
+// Connects to the given address, eg. a closure around tcp.Dial
+type AddressDialer func(address string) (rs.ClosableSocket, error)
+
+// A socket in a Balancer, with the statistics strategies pick by
+type Member interface {
+	Address() string
+	// Requests sent that have not terminated yet
+	Outstanding() int
+	// Moving average of the time to first response; zero until measured
+	Latency() time.Duration
+	// See rs.Availability; members with none are only picked if all are
+	Availability() float64
+}
+
+// Picks the member to send a request to
+type Strategy interface {
+	// members is never empty
+	Pick(members []Member) Member
+}
+
+// How long removed addresses get to finish their requests, by default
+const DefaultDrainTimeout = 30 * time.Second
+
+// A ReactiveSocket that spreads requests over connections to a set of
+// addresses, which may change at any time. Each address is kept connected by
+// a ReconnectingSocket; requests go to connected ones where possible.
+type Balancer struct {
+	// Once an address is removed, no new requests go to it, and its
+	// connection is closed when the requests on it are done, or after this
+	// long. Set before adding addresses.
+	DrainTimeout time.Duration
+	// If set, each address gets a circuit breaker with these options, so
+	// failing servers are avoided. Set before adding addresses.
+	CircuitBreaker []BreakerOption
+	// Called with the errors of watched resolvers, if set; the addresses
+	// known stay in use. Set before watching.
+	OnResolveError func(error)
+
+	dial     AddressDialer
+	strategy Strategy
+	// For when strategy picks something other than one of our members
+	fallback roundRobin
+	options  []ReconnectOption
+
+	lock     sync.Mutex
+	members  map[string]*member
+	watching []func()
+	closed   bool
+	done     chan struct{}
+}
+
+func NewBalancer(dial AddressDialer, strategy Strategy, opts ...ReconnectOption) *Balancer {
+	return &Balancer{
+		DrainTimeout: DefaultDrainTimeout,
+		dial:         dial,
+		strategy:     strategy,
+		options:      opts,
+		members:      make(map[string]*member),
+		done:         make(chan struct{}),
+	}
+}
+
+// Start balancing over address, if not already
+func (b *Balancer) Add(address string) error {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	if b.closed {
+		return rs.ErrSocketClosed
+	}
+	if _, ok := b.members[address]; ok {
+		return nil
+	}
+	socket, err := NewReconnectingSocket(func() (rs.ClosableSocket, error) {
+		return b.dial(address)
+	}, b.options...)
+	if err != nil {
+		return err
+	}
+	m := &member{address: address, socket: socket, requests: socket}
+	if b.CircuitBreaker != nil {
+		if m.requests, err = NewCircuitBreaker(socket, b.CircuitBreaker...); err != nil {
+			socket.Close()
+			return err
+		}
+	}
+	b.members[address] = m
+	return nil
+}
+
+// Stop balancing over address, draining its connection
+func (b *Balancer) Remove(address string) {
+	b.lock.Lock()
+	m, ok := b.members[address]
+	delete(b.members, address)
+	b.lock.Unlock()
+	if ok {
+		m.drain(b.DrainTimeout)
+	}
+}
+
+// Keep the addresses in step with resolver, until the balancer is closed
+func (b *Balancer) Watch(resolver Resolver) {
+	stop := resolver.Watch(func(update Update) {
+		if update.Err != nil && b.OnResolveError != nil {
+			b.OnResolveError(update.Err)
+		}
+		for _, address := range update.Removed {
+			b.Remove(address)
+		}
+		for _, address := range update.Added {
+			// Only fails once closed, or if the options are invalid, which
+			// they are for every address alike
+			b.Add(address)
+		}
+	})
+	b.lock.Lock()
+	if b.closed {
+		b.lock.Unlock()
+		stop()
+		return
+	}
+	b.watching = append(b.watching, stop)
+	b.lock.Unlock()
+}
+
+// Balance over exactly these addresses, adding and removing as needed
+func (b *Balancer) SetAddresses(addresses []string) error {
+	wanted := make(map[string]bool)
+	for _, address := range addresses {
+		wanted[address] = true
+		if err := b.Add(address); err != nil {
+			return err
+		}
+	}
+	for _, address := range b.Addresses() {
+		if !wanted[address] {
+			b.Remove(address)
+		}
+	}
+	return nil
+}
+
+// The addresses balanced over, sorted
+func (b *Balancer) Addresses() []string {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	addresses := make([]string, 0, len(b.members))
+	for address := range b.members {
+		addresses = append(addresses, address)
+	}
+	sort.Strings(addresses)
+	return addresses
+}
+
+// Close all connections; requests fail from here on
+func (b *Balancer) Close() error {
+	b.lock.Lock()
+	if b.closed {
+		b.lock.Unlock()
+		return nil
+	}
+	b.closed = true
+	members, watching := b.members, b.watching
+	b.members, b.watching = make(map[string]*member), nil
+	close(b.done)
+	b.lock.Unlock()
+
+	for _, stop := range watching {
+		stop()
+	}
+	for _, m := range members {
+		m.socket.Close()
+	}
+	return nil
+}
+
+func (b *Balancer) Done() <-chan struct{} {
+	return b.done
+}
+
+// That of the most available member
+func (b *Balancer) Availability() float64 {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	best := 0.0
+	for _, m := range b.members {
+		best = math.Max(best, m.Availability())
+	}
+	return best
+}
+
+func (b *Balancer) Err() error {
+	select {
+	case <-b.done:
+		return rs.ErrSocketClosed
+	default:
+		return nil
+	}
+}
+
+// Only requests answered by the remote's handler say anything of its latency;
+// fire and forget completes locally, subscriptions answer when there is
+// something to publish, and channels answer at the requester's pace.
+func (b *Balancer) FireAndForget(p rs.Payload) rs.Publisher {
+	return b.request(false, func(s rs.ReactiveSocket) rs.Publisher { return s.FireAndForget(p) })
+}
+func (b *Balancer) RequestResponse(p rs.Payload) rs.Publisher {
+	return b.request(true, func(s rs.ReactiveSocket) rs.Publisher { return s.RequestResponse(p) })
+}
+func (b *Balancer) RequestStream(p rs.Payload) rs.Publisher {
+	return b.request(true, func(s rs.ReactiveSocket) rs.Publisher { return s.RequestStream(p) })
+}
+func (b *Balancer) RequestSubscription(p rs.Payload) rs.Publisher {
+	return b.request(false, func(s rs.ReactiveSocket) rs.Publisher { return s.RequestSubscription(p) })
+}
+func (b *Balancer) RequestChannel(payloads rs.Publisher) rs.Publisher {
+	return b.request(false, func(s rs.ReactiveSocket) rs.Publisher { return s.RequestChannel(payloads) })
+}
+
+// Like RequestResponse, but sent to an address not in tried, unless all are;
+// see RetryingSocket
+func (b *Balancer) requestResponseExcluding(p rs.Payload, tried map[string]bool) (rs.Publisher, string) {
+	m, err := b.pick(tried)
+	if err != nil {
+		return rs.NewErrorPublisher(err), ""
+	}
+	return m.track(m.requests.RequestResponse(p), true), m.address
+}
+
+// Send request to a member, timing its first response if timed is set
+func (b *Balancer) request(timed bool, request func(rs.ReactiveSocket) rs.Publisher) rs.Publisher {
+	m, err := b.pick(nil)
+	if err != nil {
+		return rs.NewErrorPublisher(err)
+	}
+	return m.track(request(m.requests), timed)
+}
+
+// Pick a member, leaving out those with addresses in excluded unless that
+// leaves none
+func (b *Balancer) pick(excluded map[string]bool) (*member, error) {
+	b.lock.Lock()
+	if b.closed {
+		b.lock.Unlock()
+		return nil, rs.ErrSocketClosed
+	}
+	var all, others []Member
+	for _, m := range b.members {
+		all = append(all, m)
+		if !excluded[m.address] {
+			others = append(others, m)
+		}
+	}
+	b.lock.Unlock()
+
+	if len(all) == 0 {
+		return nil, ErrNoSockets
+	}
+	if len(others) > 0 {
+		all = others
+	}
+	var available []Member
+	for _, m := range all {
+		if m.Availability() > 0 {
+			available = append(available, m)
+		}
+	}
+	// Map iteration order is random; strategies expect a stable order
+	candidates := available
+	if len(candidates) == 0 {
+		// Let the sockets' own policies decide, eg. to queue until connected
+		candidates = all
+	}
+	sort.Sort(byAddress(candidates))
+	if m, ok := b.strategy.Pick(candidates).(*member); ok {
+		return m, nil
+	}
+	return b.fallback.Pick(candidates).(*member), nil
+}
+
+type byAddress []Member
+
+func (a byAddress) Len() int           { return len(a) }
+func (a byAddress) Swap(i, j int)      { a[i], a[j] = a[j], a[i] }
+func (a byAddress) Less(i, j int) bool { return a[i].Address() < a[j].Address() }
+
+// Weight of the newest sample in the latency moving average
+const latencyDecay = 0.2
+
+type member struct {
+	address string
+	socket  *ReconnectingSocket
+	// The socket, or a circuit breaker around it
+	requests    rs.ReactiveSocket
+	outstanding int64
+	draining    int32
+	lock        sync.Mutex
+	latency     time.Duration
+}
+
+// Close the socket once nothing is outstanding on it, or after timeout. The
+// member must no longer be pickable.
+func (m *member) drain(timeout time.Duration) {
+	atomic.StoreInt32(&m.draining, 1)
+	if atomic.LoadInt64(&m.outstanding) == 0 {
+		m.socket.Close()
+		return
+	}
+	time.AfterFunc(timeout, func() { m.socket.Close() })
+}
+
+func (m *member) Address() string {
+	return m.address
+}
+
+func (m *member) Outstanding() int {
+	return int(atomic.LoadInt64(&m.outstanding))
+}
+
+func (m *member) Availability() float64 {
+	return rs.Availability(m.requests)
+}
+
+func (m *member) Latency() time.Duration {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	return m.latency
+}
+
+func (m *member) observe(latency time.Duration) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	if m.latency == 0 {
+		m.latency = latency
+		return
+	}
+	m.latency = time.Duration(float64(m.latency)*(1-latencyDecay) + float64(latency)*latencyDecay)
+}
+
+// Count the request as outstanding from subscription until it terminates,
+// and, if timed is set, time its first response
+func (m *member) track(pub rs.Publisher, timed bool) rs.Publisher {
+	return rs.NewPublisher(func(s rs.Subscriber) {
+		atomic.AddInt64(&m.outstanding, 1)
+		t := &trackedRequest{member: m, subscriber: s, start: time.Now(), timed: timed}
+		pub.Subscribe(t)
+	})
+}
+
+type trackedRequest struct {
+	member     *member
+	subscriber rs.Subscriber
+	start      time.Time
+	timed      bool
+	responded  int32
+	finished   int32
+}
+
+// Record the latency on the first signal, and drop the request from the
+// outstanding count on the last
+func (t *trackedRequest) respond() {
+	if t.timed && atomic.CompareAndSwapInt32(&t.responded, 0, 1) {
+		t.member.observe(time.Since(t.start))
+	}
+}
+
+func (t *trackedRequest) finish() {
+	if atomic.CompareAndSwapInt32(&t.finished, 0, 1) {
+		m := t.member
+		if atomic.AddInt64(&m.outstanding, -1) == 0 && atomic.LoadInt32(&m.draining) == 1 {
+			m.socket.Close()
+		}
+	}
+}
+
+func (t *trackedRequest) OnSubscribe(s rs.Subscription) {
+	t.subscriber.OnSubscribe(rs.NewSubscription(s.Request, func() {
+		t.finish()
+		s.Cancel()
+	}))
+}
+func (t *trackedRequest) OnNext(p rs.Payload) {
+	t.respond()
+	t.subscriber.OnNext(p)
+}
+func (t *trackedRequest) OnError(err error) {
+	t.respond()
+	t.finish()
+	t.subscriber.OnError(err)
+}
+func (t *trackedRequest) OnComplete() {
+	t.respond()
+	t.finish()
+	t.subscriber.OnComplete()
+}
+
+// Take turns
+func RoundRobin() Strategy {
+	return &roundRobin{}
+}
+
+type roundRobin struct {
+	next uint32
+}
+
+func (r *roundRobin) Pick(members []Member) Member {
+	return members[int((atomic.AddUint32(&r.next, 1)-1)%uint32(len(members)))]
+}
+
+// Pick the member with the fewest outstanding requests; ties go to the
+// first
+func LeastOutstanding() Strategy {
+	return leastOutstanding{}
+}
+
+type leastOutstanding struct{}
+
+func (leastOutstanding) Pick(members []Member) Member {
+	best := members[0]
+	for _, m := range members[1:] {
+		if m.Outstanding() < best.Outstanding() {
+			best = m
+		}
+	}
+	return best
+}
+
+// Power of two choices: pick two members at random, and send to the one with
+// the lower expected wait, its latency weighted by how busy and how available
+// it is. Cheap, and avoids herding onto whichever member looks best at the
+// moment.
+func WeightedLatency() Strategy {
+	return &weightedLatency{random: rand.New(rand.NewSource(time.Now().UnixNano()))}
+}
+
+type weightedLatency struct {
+	lock   sync.Mutex
+	random *rand.Rand
+}
+
+func (w *weightedLatency) Pick(members []Member) Member {
+	if len(members) == 1 {
+		return members[0]
+	}
+	w.lock.Lock()
+	i := w.random.Intn(len(members))
+	j := w.random.Intn(len(members) - 1)
+	w.lock.Unlock()
+	if j >= i {
+		j++
+	}
+	a, b := members[i], members[j]
+	if cost(b) < cost(a) {
+		return b
+	}
+	return a
+}
+
+// Members without a latency yet cost nothing, so new ones get tried. Less
+// available members cost more.
+func cost(m Member) float64 {
+	availability := m.Availability()
+	if availability <= 0 {
+		return math.MaxFloat64
+	}
+	return float64(m.Latency()) * float64(m.Outstanding()+1) / availability
+}
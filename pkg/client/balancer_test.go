@@ -0,0 +1,308 @@
+package client
+
+import (
+	"errors"
+	"github.com/jakewins/reactivesocket-go/pkg/rs"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestBalancerRoundRobinsOverAddresses(t *testing.T) {
+	dialer := newAddressDialer()
+	b := NewBalancer(dialer.dial, RoundRobin())
+	defer b.Close()
+	b.SetAddresses([]string{"a", "b", "c"})
+	awaitConnected(t, b, 3)
+
+	var got []string
+	for i := 0; i < 6; i++ {
+		got = append(got, requestResponse(b))
+	}
+	if expected := []string{"a", "b", "c", "a", "b", "c"}; !equalStrings(got, expected) {
+		t.Errorf("Expected %v, got %v", expected, got)
+	}
+}
+
+func TestBalancerFollowsAddressChanges(t *testing.T) {
+	dialer := newAddressDialer()
+	b := NewBalancer(dialer.dial, RoundRobin())
+	defer b.Close()
+	b.SetAddresses([]string{"a", "b"})
+	awaitConnected(t, b, 2)
+
+	b.SetAddresses([]string{"b", "c"})
+	if got := b.Addresses(); !equalStrings(got, []string{"b", "c"}) {
+		t.Errorf("Expected addresses [b c], got %v", got)
+	}
+	select {
+	case <-dialer.socket("a").Done():
+	case <-time.After(5 * time.Second):
+		t.Error("Expected the connection to the removed address to be closed")
+	}
+	awaitConnected(t, b, 2)
+	for i := 0; i < 4; i++ {
+		if got := requestResponse(b); got == "a" {
+			t.Fatal("Expected no requests to the removed address")
+		}
+	}
+}
+
+func TestBalancerFailsWithoutAddresses(t *testing.T) {
+	b := NewBalancer(newAddressDialer().dial, RoundRobin())
+	if got := requestResponse(b); got != ErrNoSockets.Error() {
+		t.Errorf("Expected %s, got %s", ErrNoSockets, got)
+	}
+	b.Close()
+	if got := requestResponse(b); got != rs.ErrSocketClosed.Error() {
+		t.Errorf("Expected %s, got %s", rs.ErrSocketClosed, got)
+	}
+}
+
+func TestBalancerTracksOutstandingRequests(t *testing.T) {
+	dialer := newAddressDialer()
+	dialer.hold = true
+	b := NewBalancer(dialer.dial, LeastOutstanding())
+	defer b.Close()
+	b.SetAddresses([]string{"a", "b"})
+	awaitConnected(t, b, 2)
+
+	// Held requests stay outstanding, so they should spread evenly
+	for i := 0; i < 4; i++ {
+		b.RequestResponse(rs.NewPayload(nil, nil)).Subscribe(rs.NewSubscriber(func(s rs.Subscription) {
+			s.Request(1)
+		}, func(rs.Payload) {}, func(error) {}, func() {}))
+	}
+	for _, m := range members(b) {
+		if m.Outstanding() != 2 {
+			t.Errorf("Expected 2 outstanding requests on %s, got %d", m.Address(), m.Outstanding())
+		}
+	}
+
+	dialer.release()
+	for _, m := range members(b) {
+		if m.Outstanding() != 0 {
+			t.Errorf("Expected no outstanding requests on %s, got %d", m.Address(), m.Outstanding())
+		}
+		if m.Latency() <= 0 {
+			t.Errorf("Expected latency to be measured on %s", m.Address())
+		}
+	}
+}
+
+func TestBalancerFallsBackWhenStrategyPicksForeignMember(t *testing.T) {
+	b := NewBalancer(newAddressDialer().dial, foreignMember{})
+	defer b.Close()
+	b.SetAddresses([]string{"a", "b"})
+	awaitConnected(t, b, 2)
+
+	var got []string
+	for i := 0; i < 2; i++ {
+		got = append(got, requestResponse(b))
+	}
+	if expected := []string{"a", "b"}; !equalStrings(got, expected) {
+		t.Errorf("Expected to round robin instead, got %v", got)
+	}
+}
+
+func TestBalancerOnlyTimesAnsweredRequests(t *testing.T) {
+	b := NewBalancer(newAddressDialer().dial, RoundRobin())
+	defer b.Close()
+	b.SetAddresses([]string{"a"})
+	awaitConnected(t, b, 1)
+
+	b.FireAndForget(rs.NewPayload(nil, nil)).Subscribe(rs.NewSubscriber(func(s rs.Subscription) {
+		s.Request(1)
+	}, func(rs.Payload) {}, func(error) {}, func() {}))
+	if latency := members(b)[0].Latency(); latency != 0 {
+		t.Errorf("Expected fire and forget not to be timed, got %s", latency)
+	}
+	published := make(chan struct{}, 1)
+	b.RequestSubscription(rs.NewPayload(nil, nil)).Subscribe(rs.NewSubscriber(func(s rs.Subscription) {
+		s.Request(1)
+	}, func(rs.Payload) { published <- struct{}{} }, func(error) {}, func() {}))
+	<-published
+	if latency := members(b)[0].Latency(); latency != 0 {
+		t.Errorf("Expected subscriptions not to be timed, got %s", latency)
+	}
+	requestResponse(b)
+	if latency := members(b)[0].Latency(); latency <= 0 {
+		t.Errorf("Expected request response to be timed")
+	}
+}
+
+func TestLeastOutstandingPicksIdlest(t *testing.T) {
+	members := []Member{
+		&fakeMember{"a", 3, 0, 1},
+		&fakeMember{"b", 1, 0, 1},
+		&fakeMember{"c", 2, 0, 1},
+	}
+	if got := LeastOutstanding().Pick(members).Address(); got != "b" {
+		t.Errorf("Expected b, got %s", got)
+	}
+}
+
+func TestWeightedLatencyPrefersFasterOfTwo(t *testing.T) {
+	members := []Member{
+		&fakeMember{"slow", 0, 100 * time.Millisecond, 1},
+		&fakeMember{"fast", 0, time.Millisecond, 1},
+	}
+	strategy := WeightedLatency()
+	for i := 0; i < 10; i++ {
+		if got := strategy.Pick(members).Address(); got != "fast" {
+			t.Fatalf("Expected fast, got %s", got)
+		}
+	}
+
+	// Busy enough, the fast one loses out
+	members[1] = &fakeMember{"fast", 200, time.Millisecond, 1}
+	if got := strategy.Pick(members).Address(); got != "slow" {
+		t.Errorf("Expected slow, got %s", got)
+	}
+
+	// As does one that is hardly available
+	members[1] = &fakeMember{"fast", 0, time.Millisecond, 0.001}
+	if got := strategy.Pick(members).Address(); got != "slow" {
+		t.Errorf("Expected slow, got %s", got)
+	}
+}
+
+func awaitConnected(t *testing.T, b *Balancer, n int) {
+	deadline := time.Now().Add(5 * time.Second)
+	for time.Now().Before(deadline) {
+		connected := 0
+		for _, m := range members(b) {
+			if m.socket.State() == StateConnected {
+				connected++
+			}
+		}
+		if connected == n {
+			return
+		}
+		time.Sleep(time.Millisecond)
+	}
+	t.Fatalf("Expected %d connected members", n)
+}
+
+func members(b *Balancer) []*member {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	var members []*member
+	for _, m := range b.members {
+		members = append(members, m)
+	}
+	return members
+}
+
+func equalStrings(a, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+type fakeMember struct {
+	address      string
+	outstanding  int
+	latency      time.Duration
+	availability float64
+}
+
+func (m *fakeMember) Address() string        { return m.address }
+func (m *fakeMember) Outstanding() int       { return m.outstanding }
+func (m *fakeMember) Latency() time.Duration { return m.latency }
+func (m *fakeMember) Availability() float64  { return m.availability }
+
+// Picks a member of its own making, rather than one of those given
+type foreignMember struct{}
+
+func (foreignMember) Pick(members []Member) Member {
+	return &fakeMember{"elsewhere", 0, 0, 1}
+}
+
+// Dials sockets that answer requests with their address, fail them if it is
+// the failing one, or never answer if it is the stalling one. With hold set,
+// responses wait for release.
+type addressDialer struct {
+	lock     sync.Mutex
+	hold     bool
+	failing  string
+	stalling string
+	sockets  map[string]*addressSocket
+	released chan struct{}
+	pending  sync.WaitGroup
+	held     int
+}
+
+func newAddressDialer() *addressDialer {
+	return &addressDialer{sockets: make(map[string]*addressSocket), released: make(chan struct{})}
+}
+
+func (d *addressDialer) dial(address string) (rs.ClosableSocket, error) {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	s := &addressSocket{fakeSocket: fakeSocket{done: make(chan struct{})}, address: address, dialer: d}
+	d.sockets[address] = s
+	return s, nil
+}
+
+func (d *addressDialer) socket(address string) *addressSocket {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	return d.sockets[address]
+}
+
+func (d *addressDialer) holding() int {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	return d.held
+}
+
+// Answer held requests, and wait for them to complete
+func (d *addressDialer) release() {
+	close(d.released)
+	d.pending.Wait()
+}
+
+type addressSocket struct {
+	fakeSocket
+	address string
+	dialer  *addressDialer
+}
+
+func (s *addressSocket) RequestResponse(rs.Payload) rs.Publisher {
+	return rs.NewPublisher(func(sub rs.Subscriber) {
+		sub.OnSubscribe(rs.NewSubscription(func(n int) {
+			if s.address == s.dialer.stalling {
+				return
+			}
+			respond := func() {
+				time.Sleep(time.Millisecond)
+				if s.address == s.dialer.failing {
+					sub.OnError(errors.New("Connection reset"))
+					return
+				}
+				sub.OnNext(rs.NewPayload(nil, []byte(s.address)))
+				sub.OnComplete()
+			}
+			if !s.dialer.hold {
+				respond()
+				return
+			}
+			s.dialer.lock.Lock()
+			s.dialer.held++
+			s.dialer.pending.Add(1)
+			s.dialer.lock.Unlock()
+			go func() {
+				defer s.dialer.pending.Done()
+				<-s.dialer.released
+				respond()
+			}()
+		}, func() {}))
+	})
+}
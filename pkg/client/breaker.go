@@ -0,0 +1,326 @@
+package client
+
+import (
+	"errors"
+	"fmt"
+	"github.com/jakewins/reactivesocket-go/pkg/rs"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Requests fail with this while a circuit breaker is open
+var ErrCircuitOpen = errors.New("Circuit breaker is open.")
+
+type BreakerState int
+
+const (
+	// Requests go through
+	BreakerClosed BreakerState = iota
+	// Requests fail straight away
+	BreakerOpen
+	// A few probe requests go through, to see if things are better
+	BreakerHalfOpen
+)
+
+func (s BreakerState) String() string {
+	switch s {
+	case BreakerClosed:
+		return "Closed"
+	case BreakerOpen:
+		return "Open"
+	case BreakerHalfOpen:
+		return "HalfOpen"
+	}
+	return fmt.Sprintf("BreakerState(%d)", int(s))
+}
+
+type BreakerOptions struct {
+	// Open once this fraction of requests in a window failed, out of at
+	// least MinRequests
+	FailureRatio float64
+	MinRequests  int
+	Window       time.Duration
+	// Requests slower than this to respond count as failed; zero turns it off
+	SlowThreshold time.Duration
+	// How long to stay open before probing
+	OpenTimeout time.Duration
+	// Probe requests to let through when half-open; the breaker closes once
+	// they all succeed, and opens again if any fails
+	Probes int
+	// Whether an error counts as a failure; by default any error but
+	// application errors, which mean the server is doing its job
+	IsFailure func(error) bool
+	// Called on every state change
+	OnStateChange func(BreakerState)
+}
+
+type BreakerOption func(*BreakerOptions)
+
+// Open once ratio of the requests in a window failed, out of at least
+// minRequests
+func WithFailureThreshold(ratio float64, minRequests int, window time.Duration) BreakerOption {
+	return func(o *BreakerOptions) {
+		o.FailureRatio, o.MinRequests, o.Window = ratio, minRequests, window
+	}
+}
+
+// Count requests slower than threshold to respond as failed
+func WithSlowThreshold(threshold time.Duration) BreakerOption {
+	return func(o *BreakerOptions) {
+		o.SlowThreshold = threshold
+	}
+}
+
+// Stay open for timeout, then let probes through
+func WithOpenTimeout(timeout time.Duration, probes int) BreakerOption {
+	return func(o *BreakerOptions) {
+		o.OpenTimeout, o.Probes = timeout, probes
+	}
+}
+
+// Decide which errors count as failures
+func WithFailureClassifier(isFailure func(error) bool) BreakerOption {
+	return func(o *BreakerOptions) {
+		o.IsFailure = isFailure
+	}
+}
+
+// Call listener on every breaker state change
+func WithBreakerStateListener(listener func(BreakerState)) BreakerOption {
+	return func(o *BreakerOptions) {
+		o.OnStateChange = listener
+	}
+}
+
+func isFailure(err error) bool {
+	if e, ok := err.(*rs.Error); ok {
+		return e.Code != rs.ErrorCodeApplicationError
+	}
+	return true
+}
+
+// A ReactiveSocket that stops sending requests to a socket that keeps
+// failing them, giving it time to recover.
+type CircuitBreaker struct {
+	socket  rs.ReactiveSocket
+	options BreakerOptions
+
+	lock        sync.Mutex
+	state       BreakerState
+	windowStart time.Time
+	requests    int
+	failures    int
+	// When the breaker last opened, or started probing
+	since   time.Time
+	probing int
+	probed  int
+}
+
+func NewCircuitBreaker(socket rs.ReactiveSocket, opts ...BreakerOption) (*CircuitBreaker, error) {
+	o := BreakerOptions{
+		FailureRatio: 0.5,
+		MinRequests:  20,
+		Window:       10 * time.Second,
+		OpenTimeout:  5 * time.Second,
+		Probes:       1,
+		IsFailure:    isFailure,
+	}
+	for _, opt := range opts {
+		opt(&o)
+	}
+	if o.FailureRatio <= 0 || o.FailureRatio > 1 {
+		return nil, fmt.Errorf("Failure ratio must be above 0 and at most 1, got %f.", o.FailureRatio)
+	}
+	if o.MinRequests < 1 || o.Probes < 1 {
+		return nil, fmt.Errorf("Minimum requests and probes must be at least 1, got %d and %d.", o.MinRequests, o.Probes)
+	}
+	if o.Window <= 0 || o.OpenTimeout <= 0 || o.SlowThreshold < 0 {
+		return nil, fmt.Errorf("Window and open timeout must be positive, got %s and %s.", o.Window, o.OpenTimeout)
+	}
+	return &CircuitBreaker{socket: socket, options: o, windowStart: time.Now()}, nil
+}
+
+func (b *CircuitBreaker) State() BreakerState {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	return b.state
+}
+
+// The wrapped socket's availability, scaled down by the failure rate. None
+// while open, and little while probing.
+func (b *CircuitBreaker) Availability() float64 {
+	b.lock.Lock()
+	// See allow for when probes go out
+	waited := time.Since(b.since) >= b.options.OpenTimeout
+	state, probesLeft := b.state, b.probing < b.options.Probes || waited
+	if state == BreakerOpen && waited {
+		state = BreakerHalfOpen
+	}
+	score := 1.0
+	if b.requests > 0 && time.Since(b.windowStart) < b.options.Window {
+		score = 1 - float64(b.failures)/float64(b.requests)
+	}
+	b.lock.Unlock()
+
+	switch state {
+	case BreakerOpen:
+		return 0
+	case BreakerHalfOpen:
+		if !probesLeft {
+			return 0
+		}
+		// Enough to get picked for a probe, rarely over healthy sockets
+		score = 0.1
+	}
+	return score * rs.Availability(b.socket)
+}
+
+func (b *CircuitBreaker) FireAndForget(p rs.Payload) rs.Publisher {
+	return b.request(func() rs.Publisher { return b.socket.FireAndForget(p) })
+}
+func (b *CircuitBreaker) RequestResponse(p rs.Payload) rs.Publisher {
+	return b.request(func() rs.Publisher { return b.socket.RequestResponse(p) })
+}
+func (b *CircuitBreaker) RequestStream(p rs.Payload) rs.Publisher {
+	return b.request(func() rs.Publisher { return b.socket.RequestStream(p) })
+}
+func (b *CircuitBreaker) RequestSubscription(p rs.Payload) rs.Publisher {
+	return b.request(func() rs.Publisher { return b.socket.RequestSubscription(p) })
+}
+func (b *CircuitBreaker) RequestChannel(payloads rs.Publisher) rs.Publisher {
+	return b.request(func() rs.Publisher { return b.socket.RequestChannel(payloads) })
+}
+
+func (b *CircuitBreaker) request(request func() rs.Publisher) rs.Publisher {
+	allowed, probe := b.allow()
+	if !allowed {
+		return rs.NewErrorPublisher(ErrCircuitOpen)
+	}
+	pub := request()
+	return rs.NewPublisher(func(s rs.Subscriber) {
+		pub.Subscribe(&breakerRequest{breaker: b, subscriber: s, probe: probe, start: time.Now()})
+	})
+}
+
+// Whether a request may go through, and if so whether it is a probe
+func (b *CircuitBreaker) allow() (allowed, probe bool) {
+	b.lock.Lock()
+	var changed bool
+	switch b.state {
+	case BreakerClosed:
+		b.lock.Unlock()
+		return true, false
+	case BreakerOpen:
+		if time.Since(b.since) < b.options.OpenTimeout {
+			b.lock.Unlock()
+			return false, false
+		}
+		b.setState(BreakerHalfOpen)
+		changed = true
+	case BreakerHalfOpen:
+		if b.probing >= b.options.Probes && time.Since(b.since) >= b.options.OpenTimeout {
+			// Probes that never reported back, eg. never subscribed to; try again
+			b.since, b.probing, b.probed = time.Now(), 0, 0
+		}
+	}
+	if b.probing < b.options.Probes {
+		b.probing++
+		allowed, probe = true, true
+	}
+	b.lock.Unlock()
+	if changed {
+		b.notify(BreakerHalfOpen)
+	}
+	return allowed, probe
+}
+
+// Record how a request went; failed is nil if we can't tell, eg. because it
+// was cancelled before any response
+func (b *CircuitBreaker) record(probe bool, failed *bool) {
+	b.lock.Lock()
+	state := b.state
+	switch {
+	case state == BreakerHalfOpen && probe:
+		if failed == nil {
+			b.probing--
+		} else if *failed {
+			b.setState(BreakerOpen)
+		} else if b.probed++; b.probed >= b.options.Probes {
+			b.setState(BreakerClosed)
+		}
+	case state == BreakerClosed && failed != nil:
+		if time.Since(b.windowStart) >= b.options.Window {
+			b.windowStart, b.requests, b.failures = time.Now(), 0, 0
+		}
+		b.requests++
+		if *failed {
+			b.failures++
+		}
+		if b.requests >= b.options.MinRequests && float64(b.failures) >= b.options.FailureRatio*float64(b.requests) {
+			b.setState(BreakerOpen)
+		}
+	}
+	changed := b.state != state
+	state = b.state
+	b.lock.Unlock()
+	if changed {
+		b.notify(state)
+	}
+}
+
+// Must hold the lock
+func (b *CircuitBreaker) setState(state BreakerState) {
+	b.state, b.since, b.probing, b.probed = state, time.Now(), 0, 0
+	if state == BreakerClosed {
+		b.windowStart, b.requests, b.failures = time.Now(), 0, 0
+	}
+}
+
+func (b *CircuitBreaker) notify(state BreakerState) {
+	if b.options.OnStateChange != nil {
+		b.options.OnStateChange(state)
+	}
+}
+
+// Reports the outcome of a request to its breaker, going by the first
+// signal: a response means the socket is working, unless it was too slow.
+type breakerRequest struct {
+	breaker    *CircuitBreaker
+	subscriber rs.Subscriber
+	probe      bool
+	start      time.Time
+	recorded   int32
+}
+
+func (r *breakerRequest) record(err error, cancelled bool) {
+	if !atomic.CompareAndSwapInt32(&r.recorded, 0, 1) {
+		return
+	}
+	if cancelled {
+		r.breaker.record(r.probe, nil)
+		return
+	}
+	slow := r.breaker.options.SlowThreshold > 0 && time.Since(r.start) > r.breaker.options.SlowThreshold
+	failed := slow || (err != nil && r.breaker.options.IsFailure(err))
+	r.breaker.record(r.probe, &failed)
+}
+
+func (r *breakerRequest) OnSubscribe(s rs.Subscription) {
+	r.subscriber.OnSubscribe(rs.NewSubscription(s.Request, func() {
+		r.record(nil, true)
+		s.Cancel()
+	}))
+}
+func (r *breakerRequest) OnNext(p rs.Payload) {
+	r.record(nil, false)
+	r.subscriber.OnNext(p)
+}
+func (r *breakerRequest) OnError(err error) {
+	r.record(err, false)
+	r.subscriber.OnError(err)
+}
+func (r *breakerRequest) OnComplete() {
+	r.record(nil, false)
+	r.subscriber.OnComplete()
+}
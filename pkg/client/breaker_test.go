@@ -0,0 +1,187 @@
+package client
+
+import (
+	"errors"
+	"github.com/jakewins/reactivesocket-go/pkg/rs"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestBreakerOpensOnFailures(t *testing.T) {
+	socket := &scriptedSocket{err: errors.New("Connection reset")}
+	breaker, _ := NewCircuitBreaker(socket, WithFailureThreshold(0.5, 4, time.Hour), WithOpenTimeout(time.Hour, 1))
+
+	for i := 0; i < 4; i++ {
+		requestResponse(breaker)
+	}
+	if breaker.State() != BreakerOpen {
+		t.Fatalf("Expected breaker to open, got %s", breaker.State())
+	}
+	if got := requestResponse(breaker); got != ErrCircuitOpen.Error() {
+		t.Errorf("Expected %s, got %s", ErrCircuitOpen, got)
+	}
+	if socket.count() != 4 {
+		t.Errorf("Expected no requests to reach the socket while open, got %d", socket.count()-4)
+	}
+	if breaker.Availability() != 0 {
+		t.Errorf("Expected no availability while open, got %f", breaker.Availability())
+	}
+}
+
+func TestBreakerScoresFailureRate(t *testing.T) {
+	socket := &scriptedSocket{}
+	breaker, _ := NewCircuitBreaker(socket, WithFailureThreshold(0.5, 10, time.Hour))
+
+	requestResponse(breaker)
+	socket.setErr(errors.New("Connection reset"))
+	requestResponse(breaker)
+	if breaker.Availability() != 0.5 {
+		t.Errorf("Expected availability 0.5, got %f", breaker.Availability())
+	}
+}
+
+func TestBreakerIgnoresApplicationErrors(t *testing.T) {
+	socket := &scriptedSocket{err: rs.NewError(rs.ErrorCodeApplicationError, "No such user")}
+	breaker, _ := NewCircuitBreaker(socket, WithFailureThreshold(0.5, 2, time.Hour))
+
+	for i := 0; i < 4; i++ {
+		requestResponse(breaker)
+	}
+	if breaker.State() != BreakerClosed {
+		t.Errorf("Expected breaker to stay closed, got %s", breaker.State())
+	}
+}
+
+func TestBreakerCountsSlowResponses(t *testing.T) {
+	socket := &scriptedSocket{delay: 5 * time.Millisecond}
+	breaker, _ := NewCircuitBreaker(socket, WithFailureThreshold(1, 2, time.Hour), WithSlowThreshold(time.Millisecond))
+
+	requestResponse(breaker)
+	requestResponse(breaker)
+	if breaker.State() != BreakerOpen {
+		t.Errorf("Expected slow responses to open the breaker, got %s", breaker.State())
+	}
+}
+
+func TestBreakerProbesWhenHalfOpen(t *testing.T) {
+	socket := &scriptedSocket{err: errors.New("Connection reset")}
+	states := make(chan BreakerState, 10)
+	breaker, _ := NewCircuitBreaker(socket, WithFailureThreshold(1, 1, time.Hour),
+		WithOpenTimeout(10*time.Millisecond, 1), WithBreakerStateListener(func(s BreakerState) { states <- s }))
+
+	requestResponse(breaker)
+	expectBreakerStates(t, states, BreakerOpen)
+
+	// A failed probe opens it again
+	time.Sleep(10 * time.Millisecond)
+	if breaker.Availability() <= 0 {
+		t.Error("Expected some availability once ready to probe")
+	}
+	requestResponse(breaker)
+	expectBreakerStates(t, states, BreakerHalfOpen, BreakerOpen)
+
+	// Only one probe at a time
+	time.Sleep(10 * time.Millisecond)
+	socket.setErr(nil)
+	socket.hold()
+	probe := make(chan string, 1)
+	go func() { probe <- requestResponse(breaker) }()
+	expectBreakerStates(t, states, BreakerHalfOpen)
+	if got := requestResponse(breaker); got != ErrCircuitOpen.Error() {
+		t.Errorf("Expected %s while probing, got %s", ErrCircuitOpen, got)
+	}
+
+	socket.release()
+	<-probe
+	expectBreakerStates(t, states, BreakerClosed)
+}
+
+func TestBalancerAvoidsOpenBreakers(t *testing.T) {
+	dialer := newAddressDialer()
+	dialer.failing = "a"
+	b := NewBalancer(dialer.dial, RoundRobin())
+	b.CircuitBreaker = []BreakerOption{WithFailureThreshold(1, 1, time.Hour), WithOpenTimeout(time.Hour, 1)}
+	defer b.Close()
+	b.SetAddresses([]string{"a", "b"})
+	awaitConnected(t, b, 2)
+
+	if got := requestResponse(b); got != "Connection reset" {
+		t.Fatalf("Expected the first request to fail on a, got %s", got)
+	}
+	for i := 0; i < 4; i++ {
+		if got := requestResponse(b); got != "b" {
+			t.Fatalf("Expected requests to avoid the open breaker, got %s", got)
+		}
+	}
+}
+
+func expectBreakerStates(t *testing.T, states chan BreakerState, expected ...BreakerState) {
+	for _, state := range expected {
+		select {
+		case s := <-states:
+			if s != state {
+				t.Fatalf("Expected state %s, got %s", state, s)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatalf("Expected state %s, got nothing", state)
+		}
+	}
+}
+
+// Answers requests with err if set, or an empty payload, after delay. While
+// held, answers wait for release.
+type scriptedSocket struct {
+	fakeSocket
+	lock     sync.Mutex
+	err      error
+	delay    time.Duration
+	requests int
+	held     chan struct{}
+}
+
+func (s *scriptedSocket) setErr(err error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.err = err
+}
+
+func (s *scriptedSocket) hold() {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.held = make(chan struct{})
+}
+
+func (s *scriptedSocket) release() {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	close(s.held)
+	s.held = nil
+}
+
+func (s *scriptedSocket) count() int {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return s.requests
+}
+
+func (s *scriptedSocket) RequestResponse(rs.Payload) rs.Publisher {
+	s.lock.Lock()
+	s.requests++
+	err, delay, held := s.err, s.delay, s.held
+	s.lock.Unlock()
+	return rs.NewPublisher(func(sub rs.Subscriber) {
+		sub.OnSubscribe(rs.NewSubscription(func(n int) {
+			if held != nil {
+				<-held
+			}
+			time.Sleep(delay)
+			if err != nil {
+				sub.OnError(err)
+				return
+			}
+			sub.OnNext(rs.NewPayload(nil, nil))
+			sub.OnComplete()
+		}, func() {}))
+	})
+}
@@ -0,0 +1,233 @@
+package client
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// How often DNS and file resolvers check for changes, by default
+const DefaultPollInterval = 30 * time.Second
+
+// A change to the set of addresses a service is reachable at
+type Update struct {
+	Added   []string
+	Removed []string
+	// Why looking the addresses up failed, in which case nothing is added or
+	// removed
+	Err error
+}
+
+// Finds the addresses of a service, and pushes changes to them
+type Resolver interface {
+	// Start calling listener with changes, the first of which adds the
+	// addresses known at the time. Updates stop once stop returns.
+	Watch(listener func(Update)) (stop func())
+}
+
+// A fixed list of addresses
+func NewStaticResolver(addresses ...string) Resolver {
+	return staticResolver(addresses)
+}
+
+type staticResolver []string
+
+func (r staticResolver) Watch(listener func(Update)) func() {
+	if len(r) > 0 {
+		listener(Update{Added: append([]string(nil), r...)})
+	}
+	return func() {}
+}
+
+// The lookups DNS resolvers make; *net.Resolver does these
+type DNSLookup interface {
+	LookupSRV(ctx context.Context, service, proto, name string) (string, []*net.SRV, error)
+	LookupHost(ctx context.Context, host string) ([]string, error)
+}
+
+type DNSOption func(*dnsResolver)
+
+// Check DNS for changes every interval, which must be positive
+func WithPollInterval(interval time.Duration) DNSOption {
+	return func(r *dnsResolver) {
+		r.interval = interval
+	}
+}
+
+// Look records up with lookup, rather than net.DefaultResolver
+func WithLookup(lookup DNSLookup) DNSOption {
+	return func(r *dnsResolver) {
+		r.lookup = lookup
+	}
+}
+
+// Resolve the targets of SRV records, eg. ("rs", "tcp", "example.com") for
+// _rs._tcp.example.com, as per net.LookupSRV.
+func NewSRVResolver(service, proto, name string, opts ...DNSOption) (Resolver, error) {
+	r, err := newDNSResolver(opts)
+	if err != nil {
+		return nil, err
+	}
+	r.resolve = func(ctx context.Context) ([]string, error) {
+		_, records, err := r.lookup.LookupSRV(ctx, service, proto, name)
+		if err != nil {
+			return nil, err
+		}
+		addresses := make([]string, 0, len(records))
+		for _, srv := range records {
+			host := strings.TrimSuffix(srv.Target, ".")
+			addresses = append(addresses, net.JoinHostPort(host, strconv.Itoa(int(srv.Port))))
+		}
+		return addresses, nil
+	}
+	return r, nil
+}
+
+// Resolve the A and AAAA records of host, all reachable at port
+func NewHostResolver(host string, port int, opts ...DNSOption) (Resolver, error) {
+	r, err := newDNSResolver(opts)
+	if err != nil {
+		return nil, err
+	}
+	r.resolve = func(ctx context.Context) ([]string, error) {
+		ips, err := r.lookup.LookupHost(ctx, host)
+		if err != nil {
+			return nil, err
+		}
+		addresses := make([]string, 0, len(ips))
+		for _, ip := range ips {
+			addresses = append(addresses, net.JoinHostPort(ip, strconv.Itoa(port)))
+		}
+		return addresses, nil
+	}
+	return r, nil
+}
+
+type dnsResolver struct {
+	lookup   DNSLookup
+	interval time.Duration
+	resolve  func(context.Context) ([]string, error)
+}
+
+func newDNSResolver(opts []DNSOption) (*dnsResolver, error) {
+	r := &dnsResolver{lookup: net.DefaultResolver, interval: DefaultPollInterval}
+	for _, opt := range opts {
+		opt(r)
+	}
+	if err := checkPollInterval(r.interval); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+func (r *dnsResolver) Watch(listener func(Update)) func() {
+	return poll(r.interval, listener, func() ([]string, error) {
+		ctx, cancel := context.WithTimeout(context.Background(), r.interval)
+		defer cancel()
+		return r.resolve(ctx)
+	})
+}
+
+// Read addresses from a file, one per line, re-reading it whenever it
+// changes, checking every interval. Blank lines and lines starting with #
+// are ignored.
+func NewFileResolver(path string, interval time.Duration) (Resolver, error) {
+	if err := checkPollInterval(interval); err != nil {
+		return nil, err
+	}
+	return &fileResolver{path: path, interval: interval}, nil
+}
+
+type fileResolver struct {
+	path     string
+	interval time.Duration
+}
+
+func (r *fileResolver) Watch(listener func(Update)) func() {
+	return poll(r.interval, listener, func() ([]string, error) {
+		content, err := ioutil.ReadFile(r.path)
+		if err != nil {
+			return nil, err
+		}
+		var addresses []string
+		scanner := bufio.NewScanner(bytes.NewReader(content))
+		for scanner.Scan() {
+			line := strings.TrimSpace(scanner.Text())
+			if line == "" || strings.HasPrefix(line, "#") {
+				continue
+			}
+			addresses = append(addresses, line)
+		}
+		return addresses, scanner.Err()
+	})
+}
+
+func checkPollInterval(interval time.Duration) error {
+	if interval <= 0 {
+		return fmt.Errorf("Poll interval must be positive, got %s.", interval)
+	}
+	return nil
+}
+
+// Call resolve every interval, telling listener about any difference from
+// the last successful result. Failed lookups keep the addresses we have,
+// rather than dropping every connection over a DNS hiccup, and are passed on
+// as an update with just Err set.
+func poll(interval time.Duration, listener func(Update), resolve func() ([]string, error)) func() {
+	stop := make(chan struct{})
+	stopped := make(chan struct{})
+	go func() {
+		defer close(stopped)
+		current := make(map[string]bool)
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			addresses, err := resolve()
+			if err != nil {
+				listener(Update{Err: err})
+			} else if update := diff(current, addresses); len(update.Added) > 0 || len(update.Removed) > 0 {
+				listener(update)
+			}
+			select {
+			case <-ticker.C:
+			case <-stop:
+				return
+			}
+		}
+	}()
+	var once sync.Once
+	return func() {
+		once.Do(func() { close(stop) })
+		<-stopped
+	}
+}
+
+// Work out the change from current to addresses, and apply it to current
+func diff(current map[string]bool, addresses []string) Update {
+	var update Update
+	wanted := make(map[string]bool, len(addresses))
+	for _, address := range addresses {
+		wanted[address] = true
+		if !current[address] {
+			current[address] = true
+			update.Added = append(update.Added, address)
+		}
+	}
+	for address := range current {
+		if !wanted[address] {
+			delete(current, address)
+			update.Removed = append(update.Removed, address)
+		}
+	}
+	sort.Strings(update.Added)
+	sort.Strings(update.Removed)
+	return update
+}
@@ -0,0 +1,277 @@
+package client
+
+import (
+	"context"
+	"errors"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestStaticResolverAddsAddressesOnce(t *testing.T) {
+	updates := make(chan Update, 10)
+	stop := NewStaticResolver("a:1", "b:2").Watch(func(u Update) { updates <- u })
+	defer stop()
+
+	expectUpdate(t, updates, Update{Added: []string{"a:1", "b:2"}})
+	expectNoUpdate(t, updates)
+}
+
+func TestSRVResolverPushesChanges(t *testing.T) {
+	lookup := &fakeLookup{}
+	lookup.setSRV(&net.SRV{Target: "a.example.com.", Port: 7878}, &net.SRV{Target: "b.example.com.", Port: 7878})
+	updates := make(chan Update, 10)
+	resolver, err := NewSRVResolver("rs", "tcp", "example.com", WithLookup(lookup), WithPollInterval(time.Millisecond))
+	if err != nil {
+		t.Fatal(err)
+	}
+	stop := resolver.Watch(func(u Update) { updates <- u })
+	defer stop()
+
+	expectUpdate(t, updates, Update{Added: []string{"a.example.com:7878", "b.example.com:7878"}})
+
+	// Failed lookups keep what we have
+	failure := errors.New("SERVFAIL")
+	lookup.setErr(failure)
+	expectUpdate(t, updates, Update{Err: failure})
+
+	lookup.setSRV(&net.SRV{Target: "b.example.com.", Port: 7878}, &net.SRV{Target: "c.example.com.", Port: 7979})
+	expectUpdateAfterErrors(t, updates, Update{Added: []string{"c.example.com:7979"}, Removed: []string{"a.example.com:7878"}})
+}
+
+func TestHostResolverUsesPort(t *testing.T) {
+	lookup := &fakeLookup{hosts: []string{"10.0.0.1", "::1"}}
+	updates := make(chan Update, 10)
+	resolver, err := NewHostResolver("example.com", 7878, WithLookup(lookup), WithPollInterval(time.Millisecond))
+	if err != nil {
+		t.Fatal(err)
+	}
+	stop := resolver.Watch(func(u Update) { updates <- u })
+	defer stop()
+
+	expectUpdate(t, updates, Update{Added: []string{"10.0.0.1:7878", "[::1]:7878"}})
+}
+
+func TestResolversPassOnLookupErrors(t *testing.T) {
+	lookup := &fakeLookup{hosts: []string{"10.0.0.1"}}
+	failures := make(chan error, 10)
+	b := NewBalancer(newAddressDialer().dial, RoundRobin())
+	defer b.Close()
+	b.OnResolveError = func(err error) {
+		select {
+		case failures <- err:
+		default:
+		}
+	}
+	resolver, _ := NewHostResolver("example.com", 1, WithLookup(lookup), WithPollInterval(time.Millisecond))
+	b.Watch(resolver)
+	awaitConnected(t, b, 1)
+
+	lookup.setErr(errors.New("No such host."))
+	select {
+	case err := <-failures:
+		if err.Error() != "No such host." {
+			t.Errorf("Expected the lookup error, got %s", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Expected the lookup error to be passed on")
+	}
+	if !equalStrings(b.Addresses(), []string{"10.0.0.1:1"}) {
+		t.Errorf("Expected the known addresses to stay, got %v", b.Addresses())
+	}
+}
+
+func TestFileResolverFollowsFile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "resolver")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "servers")
+	writeFile(t, path, "# Servers\na:1\n\nb:2\n")
+
+	updates := make(chan Update, 10)
+	resolver, err := NewFileResolver(path, time.Millisecond)
+	if err != nil {
+		t.Fatal(err)
+	}
+	stop := resolver.Watch(func(u Update) { updates <- u })
+	defer stop()
+
+	expectUpdate(t, updates, Update{Added: []string{"a:1", "b:2"}})
+	writeFile(t, path, "b:2\nc:3\n")
+	expectUpdate(t, updates, Update{Added: []string{"c:3"}, Removed: []string{"a:1"}})
+}
+
+func TestBalancerDrainsRemovedAddresses(t *testing.T) {
+	dialer := newAddressDialer()
+	dialer.hold = true
+	b := NewBalancer(dialer.dial, RoundRobin())
+	defer b.Close()
+	lookup := &fakeLookup{hosts: []string{"a"}}
+	resolver, _ := NewHostResolver("example.com", 1, WithLookup(lookup), WithPollInterval(time.Millisecond))
+	b.Watch(resolver)
+	awaitConnected(t, b, 1)
+
+	response := make(chan string, 1)
+	go func() { response <- requestResponse(b) }()
+	for dialer.holding() == 0 {
+		time.Sleep(time.Millisecond)
+	}
+
+	lookup.setHosts("b")
+	awaitConnected(t, b, 1)
+	for !equalStrings(b.Addresses(), []string{"b:1"}) {
+		time.Sleep(time.Millisecond)
+	}
+	if dialer.socket("a:1").isClosed() {
+		t.Fatal("Expected the removed address to stay open while its request is outstanding")
+	}
+
+	dialer.release()
+	if got := <-response; got != "a:1" {
+		t.Errorf("Expected the outstanding request to complete, got %s", got)
+	}
+	select {
+	case <-dialer.socket("a:1").Done():
+	case <-time.After(5 * time.Second):
+		t.Error("Expected the removed address to be closed once drained")
+	}
+}
+
+func TestResolversRejectNonPositivePollIntervals(t *testing.T) {
+	if _, err := NewFileResolver("servers", 0); err == nil {
+		t.Error("Expected a file resolver polling every 0s to be rejected")
+	}
+	if _, err := NewHostResolver("example.com", 1, WithPollInterval(-time.Second)); err == nil {
+		t.Error("Expected a host resolver polling every -1s to be rejected")
+	}
+	if _, err := NewSRVResolver("rs", "tcp", "example.com", WithPollInterval(0)); err == nil {
+		t.Error("Expected an SRV resolver polling every 0s to be rejected")
+	}
+}
+
+func TestBalancerAppliesRemovalsWhenAddsFail(t *testing.T) {
+	b := NewBalancer(newAddressDialer().dial, RoundRobin())
+	defer b.Close()
+	b.SetAddresses([]string{"a"})
+	// Makes every add fail from here on
+	b.CircuitBreaker = []BreakerOption{WithOpenTimeout(0, 0)}
+
+	updates := make(chan Update, 1)
+	b.Watch(updateResolver(updates))
+	updates <- Update{Added: []string{"b"}, Removed: []string{"a"}}
+	for deadline := time.Now().Add(5 * time.Second); len(b.Addresses()) != 0; time.Sleep(time.Millisecond) {
+		if time.Now().After(deadline) {
+			t.Fatalf("Expected the removed address to be dropped, got %v", b.Addresses())
+		}
+	}
+}
+
+// Pushes whatever updates are sent to it
+type updateResolver chan Update
+
+func (r updateResolver) Watch(listener func(Update)) func() {
+	stop := make(chan struct{})
+	go func() {
+		for {
+			select {
+			case u := <-r:
+				listener(u)
+			case <-stop:
+				return
+			}
+		}
+	}()
+	return func() { close(stop) }
+}
+
+func expectUpdate(t *testing.T, updates chan Update, expected Update) {
+	select {
+	case u := <-updates:
+		if !reflect.DeepEqual(u, expected) {
+			t.Fatalf("Expected %+v, got %+v", expected, u)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("Expected %+v, got nothing", expected)
+	}
+}
+
+// Like expectUpdate, skipping any updates that only carry errors
+func expectUpdateAfterErrors(t *testing.T, updates chan Update, expected Update) {
+	deadline := time.After(5 * time.Second)
+	for {
+		select {
+		case u := <-updates:
+			if u.Err != nil && len(u.Added) == 0 && len(u.Removed) == 0 {
+				continue
+			}
+			if !reflect.DeepEqual(u, expected) {
+				t.Fatalf("Expected %+v, got %+v", expected, u)
+			}
+			return
+		case <-deadline:
+			t.Fatalf("Expected %+v, got nothing", expected)
+		}
+	}
+}
+
+func expectNoUpdate(t *testing.T, updates chan Update) {
+	select {
+	case u := <-updates:
+		t.Fatalf("Expected no update, got %+v", u)
+	case <-time.After(20 * time.Millisecond):
+	}
+}
+
+func writeFile(t *testing.T, path, content string) {
+	// Write and rename, so the resolver never sees half a file
+	if err := ioutil.WriteFile(path+".tmp", []byte(content), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Rename(path+".tmp", path); err != nil {
+		t.Fatal(err)
+	}
+}
+
+type fakeLookup struct {
+	lock  sync.Mutex
+	srv   []*net.SRV
+	hosts []string
+	err   error
+}
+
+func (l *fakeLookup) LookupSRV(ctx context.Context, service, proto, name string) (string, []*net.SRV, error) {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	return "", l.srv, l.err
+}
+
+func (l *fakeLookup) LookupHost(ctx context.Context, host string) ([]string, error) {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	return l.hosts, l.err
+}
+
+func (l *fakeLookup) setSRV(records ...*net.SRV) {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	l.srv, l.err = records, nil
+}
+
+func (l *fakeLookup) setHosts(hosts ...string) {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	l.hosts, l.err = hosts, nil
+}
+
+func (l *fakeLookup) setErr(err error) {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	l.err = err
+}
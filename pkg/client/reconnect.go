@@ -0,0 +1,373 @@
+// Client side building blocks layered over the sockets transports Dial.
+package client
+
+import (
+	"errors"
+	"fmt"
+	"github.com/jakewins/reactivesocket-go/pkg/rs"
+	"math/rand"
+	"sync"
+	"time"
+)
+
+// Requests made while disconnected fail with this, unless queued
+var ErrDisconnected = errors.New("Not connected.")
+
+// Connects a new socket, including sending SETUP; eg. a closure around
+// tcp.Dial.
+type Dialer func() (rs.ClosableSocket, error)
+
+type ConnectionState int
+
+const (
+	// Dialing
+	StateConnecting ConnectionState = iota
+	StateConnected
+	// Waiting to dial again
+	StateDisconnected
+	// Closed by the application, for good
+	StateClosed
+)
+
+func (s ConnectionState) String() string {
+	switch s {
+	case StateConnecting:
+		return "Connecting"
+	case StateConnected:
+		return "Connected"
+	case StateDisconnected:
+		return "Disconnected"
+	case StateClosed:
+		return "Closed"
+	}
+	return fmt.Sprintf("ConnectionState(%d)", int(s))
+}
+
+type ReconnectOptions struct {
+	// Delay before the first retry, growing by Multiplier with each failed
+	// attempt up to MaxBackoff
+	MinBackoff time.Duration
+	MaxBackoff time.Duration
+	Multiplier float64
+	// Fraction of each delay to randomise by, so clients that lost the same
+	// server don't all come back at once
+	Jitter float64
+	// Queue requests made while disconnected, rather than failing them
+	Queue bool
+	// How long a queued request waits for a connection before failing; zero
+	// waits until the socket is closed
+	QueueTimeout time.Duration
+	// Most requests to queue; more fail straight away
+	MaxQueued int
+	// Called from a single goroutine on every state change, in order
+	OnStateChange func(ConnectionState)
+}
+
+type ReconnectOption func(*ReconnectOptions)
+
+// Back off between min and max, multiplying the delay by multiplier on each
+// failed attempt
+func WithBackoff(min, max time.Duration, multiplier float64) ReconnectOption {
+	return func(o *ReconnectOptions) {
+		o.MinBackoff, o.MaxBackoff, o.Multiplier = min, max, multiplier
+	}
+}
+
+// Randomise each delay by up to fraction of it, in either direction
+func WithJitter(fraction float64) ReconnectOption {
+	return func(o *ReconnectOptions) {
+		o.Jitter = fraction
+	}
+}
+
+// Hold requests made while disconnected until connected again, for up to
+// timeout. At most max requests are held.
+func WithQueueWhileDisconnected(timeout time.Duration, max int) ReconnectOption {
+	return func(o *ReconnectOptions) {
+		o.Queue, o.QueueTimeout, o.MaxQueued = true, timeout, max
+	}
+}
+
+// Call listener on every connection state change
+func WithStateListener(listener func(ConnectionState)) ReconnectOption {
+	return func(o *ReconnectOptions) {
+		o.OnStateChange = listener
+	}
+}
+
+// A ReactiveSocket that keeps a connection open, dialing a new one whenever
+// the current one fails. Streams open on a failed connection fail with it;
+// only new requests go to the new connection. For streams that survive a
+// reconnect, see transport.WithResumption.
+type ReconnectingSocket struct {
+	dial    Dialer
+	options ReconnectOptions
+	closed  chan struct{}
+	once    sync.Once
+
+	lock    sync.Mutex
+	state   ConnectionState
+	current rs.ClosableSocket // Nil unless connected
+	// Closed and replaced on every state change, to wake queued requests
+	changed chan struct{}
+	queued  int
+}
+
+// Start connecting with dial, in the background
+func NewReconnectingSocket(dial Dialer, opts ...ReconnectOption) (*ReconnectingSocket, error) {
+	o := ReconnectOptions{
+		MinBackoff: 100 * time.Millisecond,
+		MaxBackoff: 30 * time.Second,
+		Multiplier: 2,
+		Jitter:     0.2,
+		MaxQueued:  1024,
+	}
+	for _, opt := range opts {
+		opt(&o)
+	}
+	if o.MinBackoff <= 0 || o.MaxBackoff < o.MinBackoff {
+		return nil, fmt.Errorf("Backoff must be positive, and max at least min, got %s to %s.", o.MinBackoff, o.MaxBackoff)
+	}
+	if o.Multiplier < 1 {
+		return nil, fmt.Errorf("Backoff multiplier must be at least 1, got %f.", o.Multiplier)
+	}
+	if o.Jitter < 0 || o.Jitter > 1 {
+		return nil, fmt.Errorf("Jitter must be between 0 and 1, got %f.", o.Jitter)
+	}
+	r := &ReconnectingSocket{
+		dial:    dial,
+		options: o,
+		closed:  make(chan struct{}),
+		changed: make(chan struct{}),
+	}
+	go r.run()
+	return r, nil
+}
+
+func (r *ReconnectingSocket) State() ConnectionState {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	return r.state
+}
+
+// That of the current connection; none while disconnected
+func (r *ReconnectingSocket) Availability() float64 {
+	r.lock.Lock()
+	current := r.current
+	r.lock.Unlock()
+	if current == nil {
+		return 0
+	}
+	return rs.Availability(current)
+}
+
+// Close the current connection and stop reconnecting
+func (r *ReconnectingSocket) Close() error {
+	r.once.Do(func() {
+		r.lock.Lock()
+		current := r.current
+		r.state, r.current = StateClosed, nil
+		close(r.closed)
+		close(r.changed)
+		r.changed = make(chan struct{})
+		r.lock.Unlock()
+		if current != nil {
+			current.Close()
+		}
+	})
+	return nil
+}
+
+func (r *ReconnectingSocket) Done() <-chan struct{} {
+	return r.closed
+}
+
+func (r *ReconnectingSocket) Err() error {
+	select {
+	case <-r.closed:
+		return rs.ErrSocketClosed
+	default:
+		return nil
+	}
+}
+
+func (r *ReconnectingSocket) FireAndForget(p rs.Payload) rs.Publisher {
+	return r.withSocket(rs.CopyPayload(p), func(s rs.ReactiveSocket, p rs.Payload) rs.Publisher {
+		return s.FireAndForget(p)
+	})
+}
+func (r *ReconnectingSocket) RequestResponse(p rs.Payload) rs.Publisher {
+	return r.withSocket(rs.CopyPayload(p), func(s rs.ReactiveSocket, p rs.Payload) rs.Publisher {
+		return s.RequestResponse(p)
+	})
+}
+func (r *ReconnectingSocket) RequestStream(p rs.Payload) rs.Publisher {
+	return r.withSocket(rs.CopyPayload(p), func(s rs.ReactiveSocket, p rs.Payload) rs.Publisher {
+		return s.RequestStream(p)
+	})
+}
+func (r *ReconnectingSocket) RequestSubscription(p rs.Payload) rs.Publisher {
+	return r.withSocket(rs.CopyPayload(p), func(s rs.ReactiveSocket, p rs.Payload) rs.Publisher {
+		return s.RequestSubscription(p)
+	})
+}
+func (r *ReconnectingSocket) RequestChannel(payloads rs.Publisher) rs.Publisher {
+	return r.withSocket(nil, func(s rs.ReactiveSocket, _ rs.Payload) rs.Publisher {
+		return s.RequestChannel(payloads)
+	})
+}
+
+// Make a request on the current socket, or deal with it per the disconnected
+// policy if there is none. p is owned by the request, since it may need to
+// outlive the call.
+func (r *ReconnectingSocket) withSocket(p rs.Payload, request func(rs.ReactiveSocket, rs.Payload) rs.Publisher) rs.Publisher {
+	r.lock.Lock()
+	current, state := r.current, r.state
+	if current != nil {
+		r.lock.Unlock()
+		return request(current, p)
+	}
+	if state == StateClosed {
+		r.lock.Unlock()
+		return rs.NewErrorPublisher(rs.ErrSocketClosed)
+	}
+	if !r.options.Queue || r.queued >= r.options.MaxQueued {
+		r.lock.Unlock()
+		return rs.NewErrorPublisher(ErrDisconnected)
+	}
+	r.queued++
+	r.lock.Unlock()
+
+	// Fire and forget goes out right away, rather than on subscribe. The
+	// publisher is set before ready is closed, and shared by all subscribers.
+	var pub rs.Publisher
+	ready := make(chan struct{})
+	go func() {
+		defer close(ready)
+		socket, err := r.await()
+		if err != nil {
+			pub = rs.NewErrorPublisher(err)
+			return
+		}
+		pub = request(socket, p)
+	}()
+	return rs.NewPublisher(func(s rs.Subscriber) {
+		go func() {
+			<-ready
+			pub.Subscribe(s)
+		}()
+	})
+}
+
+// Wait for a connection, for a queued request
+func (r *ReconnectingSocket) await() (rs.ReactiveSocket, error) {
+	defer func() {
+		r.lock.Lock()
+		r.queued--
+		r.lock.Unlock()
+	}()
+	var timeout <-chan time.Time
+	if r.options.QueueTimeout > 0 {
+		timer := time.NewTimer(r.options.QueueTimeout)
+		defer timer.Stop()
+		timeout = timer.C
+	}
+	for {
+		r.lock.Lock()
+		current, state, changed := r.current, r.state, r.changed
+		r.lock.Unlock()
+		if current != nil {
+			return current, nil
+		}
+		if state == StateClosed {
+			return nil, rs.ErrSocketClosed
+		}
+		select {
+		case <-changed:
+		case <-timeout:
+			return nil, ErrDisconnected
+		}
+	}
+}
+
+// The connection loop
+func (r *ReconnectingSocket) run() {
+	attempt := 0
+	for {
+		select {
+		case <-r.closed:
+			r.setState(StateClosed, nil)
+			return
+		default:
+		}
+		r.setState(StateConnecting, nil)
+		socket, err := r.dial()
+		if err == nil {
+			connectedAt := time.Now()
+			r.setState(StateConnected, socket)
+			select {
+			case <-socket.Done():
+			case <-r.closed:
+				// Close took care of the socket
+				r.setState(StateClosed, nil)
+				return
+			}
+			if time.Since(connectedAt) >= r.options.MaxBackoff {
+				// The connection was healthy for a while, start over. Otherwise
+				// keep backing off, eg. if the server rejects our setup.
+				attempt = 0
+			}
+		}
+
+		r.setState(StateDisconnected, nil)
+		select {
+		case <-time.After(r.backoff(attempt)):
+		case <-r.closed:
+			r.setState(StateClosed, nil)
+			return
+		}
+		attempt++
+	}
+}
+
+// Delay before the given retry; the first is immediate
+func (r *ReconnectingSocket) backoff(attempt int) time.Duration {
+	return backoff(attempt, r.options.MinBackoff, r.options.MaxBackoff, r.options.Multiplier, r.options.Jitter)
+}
+
+// Exponential backoff with jitter, for retry number attempt; zero is immediate
+func backoff(attempt int, min, max time.Duration, multiplier, jitter float64) time.Duration {
+	if attempt == 0 {
+		return 0
+	}
+	delay := float64(min)
+	for i := 1; i < attempt && delay < float64(max); i++ {
+		delay *= multiplier
+	}
+	if delay > float64(max) {
+		delay = float64(max)
+	}
+	delay *= 1 + jitter*(2*rand.Float64()-1)
+	return time.Duration(delay)
+}
+
+// Move to state, unless closed in the meantime; a socket connected after
+// Close is closed straight away
+func (r *ReconnectingSocket) setState(state ConnectionState, current rs.ClosableSocket) {
+	r.lock.Lock()
+	if r.state == StateClosed && state != StateClosed {
+		r.lock.Unlock()
+		if current != nil {
+			current.Close()
+		}
+		return
+	}
+	r.state, r.current = state, current
+	close(r.changed)
+	r.changed = make(chan struct{})
+	r.lock.Unlock()
+
+	if r.options.OnStateChange != nil {
+		r.options.OnStateChange(state)
+	}
+}
@@ -0,0 +1,234 @@
+package client
+
+import (
+	"errors"
+	"github.com/jakewins/reactivesocket-go/pkg/rs"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestReconnectsWhenConnectionFails(t *testing.T) {
+	dialer := &fakeDialer{}
+	states := make(chan ConnectionState, 10)
+	socket, err := NewReconnectingSocket(dialer.dial, WithBackoff(time.Millisecond, 10*time.Millisecond, 2),
+		WithStateListener(func(s ConnectionState) { states <- s }))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer socket.Close()
+
+	expectStates(t, states, StateConnecting, StateConnected)
+	dialer.last().fail()
+	expectStates(t, states, StateDisconnected, StateConnecting, StateConnected)
+
+	if got := requestResponse(socket); got != "2" {
+		t.Errorf("Expected request to go to the new connection, got %s", got)
+	}
+}
+
+func TestFailsRequestsWhileDisconnected(t *testing.T) {
+	dialer := &fakeDialer{err: errors.New("Connection refused")}
+	socket, _ := NewReconnectingSocket(dialer.dial, WithBackoff(time.Hour, time.Hour, 1))
+	defer socket.Close()
+
+	if got := requestResponse(socket); got != ErrDisconnected.Error() {
+		t.Errorf("Expected request to fail with %s, got %s", ErrDisconnected, got)
+	}
+}
+
+func TestQueuesRequestsWhileDisconnected(t *testing.T) {
+	dialer := &fakeDialer{err: errors.New("Connection refused")}
+	socket, _ := NewReconnectingSocket(dialer.dial, WithBackoff(10*time.Millisecond, 10*time.Millisecond, 1),
+		WithQueueWhileDisconnected(0, 10))
+	defer socket.Close()
+
+	response := make(chan string, 1)
+	go func() { response <- requestResponse(socket) }()
+	time.Sleep(20 * time.Millisecond)
+	dialer.setErr(nil)
+
+	select {
+	case got := <-response:
+		if got == ErrDisconnected.Error() {
+			t.Errorf("Expected queued request to be sent once connected, got %s", got)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Expected queued request to complete")
+	}
+}
+
+func TestQueuedRequestsAnswerEverySubscriber(t *testing.T) {
+	dialer := &fakeDialer{err: errors.New("Connection refused")}
+	socket, _ := NewReconnectingSocket(dialer.dial, WithBackoff(10*time.Millisecond, 10*time.Millisecond, 1),
+		WithQueueWhileDisconnected(0, 10))
+	defer socket.Close()
+
+	pub := socket.RequestResponse(rs.NewPayload(nil, nil))
+	responses := make(chan string, 2)
+	for i := 0; i < 2; i++ {
+		pub.Subscribe(rs.NewSubscriber(func(s rs.Subscription) {
+			s.Request(1)
+		}, func(p rs.Payload) {
+			responses <- string(p.Data())
+		}, func(err error) {
+			responses <- err.Error()
+		}, func() {}))
+	}
+	time.Sleep(20 * time.Millisecond)
+	dialer.setErr(nil)
+
+	for i := 0; i < 2; i++ {
+		select {
+		case got := <-responses:
+			if got != "1" {
+				t.Errorf("Expected every subscriber to get the response, got %s", got)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatalf("Expected %d subscribers to get the response, %d did", 2, i)
+		}
+	}
+}
+
+func TestQueuedRequestsTimeOut(t *testing.T) {
+	dialer := &fakeDialer{err: errors.New("Connection refused")}
+	socket, _ := NewReconnectingSocket(dialer.dial, WithBackoff(time.Hour, time.Hour, 1),
+		WithQueueWhileDisconnected(10*time.Millisecond, 10))
+	defer socket.Close()
+
+	if got := requestResponse(socket); got != ErrDisconnected.Error() {
+		t.Errorf("Expected queued request to time out with %s, got %s", ErrDisconnected, got)
+	}
+}
+
+func TestClosingFailsRequests(t *testing.T) {
+	dialer := &fakeDialer{}
+	states := make(chan ConnectionState, 10)
+	socket, _ := NewReconnectingSocket(dialer.dial, WithStateListener(func(s ConnectionState) { states <- s }))
+	expectStates(t, states, StateConnecting, StateConnected)
+
+	socket.Close()
+	if !dialer.last().isClosed() {
+		t.Error("Expected the connection to be closed by the time Close returns")
+	}
+	if socket.Err() == nil {
+		t.Error("Expected the socket to report being closed")
+	}
+	expectStates(t, states, StateClosed)
+	if got := requestResponse(socket); got != rs.ErrSocketClosed.Error() {
+		t.Errorf("Expected request to fail with %s, got %s", rs.ErrSocketClosed, got)
+	}
+}
+
+func TestBackoffGrowsWithinBounds(t *testing.T) {
+	socket := &ReconnectingSocket{options: ReconnectOptions{
+		MinBackoff: 100 * time.Millisecond,
+		MaxBackoff: time.Second,
+		Multiplier: 2,
+		Jitter:     0.5,
+	}}
+	if socket.backoff(0) != 0 {
+		t.Errorf("Expected first retry to be immediate, got %s", socket.backoff(0))
+	}
+	for attempt, base := range []time.Duration{100, 200, 400, 800, 1000, 1000} {
+		base *= time.Millisecond
+		for i := 0; i < 100; i++ {
+			delay := socket.backoff(attempt + 1)
+			if delay < base/2 || delay > base*3/2 {
+				t.Fatalf("Expected attempt %d to wait %s give or take half, got %s", attempt+1, base, delay)
+			}
+		}
+	}
+}
+
+func requestResponse(socket rs.ReactiveSocket) string {
+	result := make(chan string, 1)
+	socket.RequestResponse(rs.NewPayload(nil, nil)).Subscribe(rs.NewSubscriber(func(s rs.Subscription) {
+		s.Request(1)
+	}, func(p rs.Payload) {
+		result <- string(p.Data())
+	}, func(err error) {
+		result <- err.Error()
+	}, func() {}))
+	return <-result
+}
+
+func expectStates(t *testing.T, states chan ConnectionState, expected ...ConnectionState) {
+	for _, state := range expected {
+		select {
+		case s := <-states:
+			if s != state {
+				t.Fatalf("Expected state %s, got %s", state, s)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatalf("Expected state %s, got nothing", state)
+		}
+	}
+}
+
+// Dials fake sockets that answer requests with their number, starting at 1
+type fakeDialer struct {
+	lock    sync.Mutex
+	err     error
+	sockets []*fakeSocket
+}
+
+func (d *fakeDialer) dial() (rs.ClosableSocket, error) {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	if d.err != nil {
+		return nil, d.err
+	}
+	s := &fakeSocket{id: len(d.sockets) + 1, done: make(chan struct{})}
+	d.sockets = append(d.sockets, s)
+	return s, nil
+}
+
+func (d *fakeDialer) setErr(err error) {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	d.err = err
+}
+
+func (d *fakeDialer) last() *fakeSocket {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	return d.sockets[len(d.sockets)-1]
+}
+
+type fakeSocket struct {
+	id   int
+	done chan struct{}
+	once sync.Once
+}
+
+func (s *fakeSocket) respond() rs.Publisher {
+	return rs.NewPublisher(func(sub rs.Subscriber) {
+		sub.OnSubscribe(rs.NewSubscription(func(n int) {
+			sub.OnNext(rs.NewPayload(nil, []byte{byte('0' + s.id)}))
+			sub.OnComplete()
+		}, func() {}))
+	})
+}
+
+func (s *fakeSocket) fail() {
+	s.once.Do(func() { close(s.done) })
+}
+
+func (s *fakeSocket) isClosed() bool {
+	select {
+	case <-s.done:
+		return true
+	default:
+		return false
+	}
+}
+
+func (s *fakeSocket) FireAndForget(rs.Payload) rs.Publisher       { return rs.NewEmptyPublisher() }
+func (s *fakeSocket) RequestResponse(rs.Payload) rs.Publisher     { return s.respond() }
+func (s *fakeSocket) RequestStream(rs.Payload) rs.Publisher       { return s.respond() }
+func (s *fakeSocket) RequestSubscription(rs.Payload) rs.Publisher { return s.respond() }
+func (s *fakeSocket) RequestChannel(rs.Publisher) rs.Publisher    { return s.respond() }
+func (s *fakeSocket) Close() error                                { s.fail(); return nil }
+func (s *fakeSocket) Done() <-chan struct{}                       { return s.done }
+func (s *fakeSocket) Err() error                                  { return nil }
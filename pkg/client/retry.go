@@ -0,0 +1,408 @@
+package client
+
+import (
+	"fmt"
+	"github.com/jakewins/reactivesocket-go/pkg/rs"
+	"sort"
+	"sync"
+	"time"
+)
+
+// Latencies kept to work out when to hedge
+const hedgeSamples = 128
+
+type RetryOptions struct {
+	// Attempts per call, including the first and any hedge
+	MaxAttempts int
+	// Delay before each retry, growing by Multiplier up to MaxBackoff
+	MinBackoff time.Duration
+	MaxBackoff time.Duration
+	Multiplier float64
+	Jitter     float64
+	// Error codes worth retrying; see IsRetryable
+	RetryableCodes []uint32
+	// Whether a failed attempt may be retried; by default, errors with one
+	// of RetryableCodes, and errors from requests that never left, like
+	// ErrDisconnected and ErrCircuitOpen
+	IsRetryable func(error) bool
+	// No retries start this long after the call; zero for no limit
+	Budget time.Duration
+	// If set, send a second attempt when the first takes longer than this
+	// percentile of recent latencies, and take whichever answers first
+	HedgePercentile float64
+	// Never hedge sooner than this; also used until there are enough
+	// latencies to go by
+	MinHedgeDelay time.Duration
+}
+
+type RetryOption func(*RetryOptions)
+
+// Make up to attempts attempts, backing off between min and max
+func WithRetries(attempts int, min, max time.Duration) RetryOption {
+	return func(o *RetryOptions) {
+		o.MaxAttempts, o.MinBackoff, o.MaxBackoff = attempts, min, max
+	}
+}
+
+// Retry errors with these codes
+func WithRetryableCodes(codes ...uint32) RetryOption {
+	return func(o *RetryOptions) {
+		o.RetryableCodes = codes
+	}
+}
+
+// Decide which errors to retry, overriding the codes
+func WithRetryable(isRetryable func(error) bool) RetryOption {
+	return func(o *RetryOptions) {
+		o.IsRetryable = isRetryable
+	}
+}
+
+// Stop retrying once budget has passed since the call
+func WithRetryBudget(budget time.Duration) RetryOption {
+	return func(o *RetryOptions) {
+		o.Budget = budget
+	}
+}
+
+// Hedge requests slower than percentile of recent ones, eg. 0.95, but never
+// sooner than minDelay
+func WithHedging(percentile float64, minDelay time.Duration) RetryOption {
+	return func(o *RetryOptions) {
+		o.HedgePercentile, o.MinHedgeDelay = percentile, minDelay
+	}
+}
+
+// A ReactiveSocket that retries failed RequestResponse calls, and optionally
+// hedges slow ones; only use it for requests that are safe to repeat.
+// Wrapping a Balancer, each attempt goes to a server the call has not tried
+// yet, while there are any. Other interactions are passed through as-is.
+type RetryingSocket struct {
+	socket  rs.ReactiveSocket
+	options RetryOptions
+
+	lock      sync.Mutex
+	latencies []time.Duration
+	next      int
+}
+
+func NewRetryingSocket(socket rs.ReactiveSocket, opts ...RetryOption) (*RetryingSocket, error) {
+	o := RetryOptions{
+		MaxAttempts:    3,
+		MinBackoff:     50 * time.Millisecond,
+		MaxBackoff:     time.Second,
+		Multiplier:     2,
+		Jitter:         0.2,
+		RetryableCodes: []uint32{rs.ErrorCodeRejected},
+	}
+	for _, opt := range opts {
+		opt(&o)
+	}
+	if o.MaxAttempts < 1 {
+		return nil, fmt.Errorf("Max attempts must be at least 1, got %d.", o.MaxAttempts)
+	}
+	if o.MinBackoff < 0 || o.MaxBackoff < o.MinBackoff || o.Multiplier < 1 {
+		return nil, fmt.Errorf("Backoff must not be negative, with max at least min and a multiplier of at least 1.")
+	}
+	if o.HedgePercentile < 0 || o.HedgePercentile >= 1 {
+		return nil, fmt.Errorf("Hedge percentile must be between 0 and 1, got %f.", o.HedgePercentile)
+	}
+	if o.IsRetryable == nil {
+		o.IsRetryable = retryableCodes(o.RetryableCodes)
+	}
+	return &RetryingSocket{socket: socket, options: o}, nil
+}
+
+// Sockets that spread requests over several servers, like Balancer, so
+// attempts can avoid those already tried
+type excludingSocket interface {
+	// Send to a server other than those in tried, if there is one; returns
+	// the one picked
+	requestResponseExcluding(p rs.Payload, tried map[string]bool) (rs.Publisher, string)
+}
+
+func retryableCodes(codes []uint32) func(error) bool {
+	return func(err error) bool {
+		if err == ErrDisconnected || err == ErrCircuitOpen {
+			return true
+		}
+		if e, ok := err.(*rs.Error); ok {
+			for _, code := range codes {
+				if e.Code == code {
+					return true
+				}
+			}
+		}
+		return false
+	}
+}
+
+func (r *RetryingSocket) FireAndForget(p rs.Payload) rs.Publisher {
+	return r.socket.FireAndForget(p)
+}
+func (r *RetryingSocket) RequestStream(p rs.Payload) rs.Publisher {
+	return r.socket.RequestStream(p)
+}
+func (r *RetryingSocket) RequestSubscription(p rs.Payload) rs.Publisher {
+	return r.socket.RequestSubscription(p)
+}
+func (r *RetryingSocket) RequestChannel(payloads rs.Publisher) rs.Publisher {
+	return r.socket.RequestChannel(payloads)
+}
+
+func (r *RetryingSocket) RequestResponse(p rs.Payload) rs.Publisher {
+	// Attempts may outlive this call
+	p = rs.CopyPayload(p)
+	return rs.NewPublisher(func(s rs.Subscriber) {
+		c := &retryCall{
+			socket:     r,
+			payload:    p,
+			subscriber: s,
+			inFlight:   make(map[*retryAttempt]bool),
+			tried:      make(map[string]bool),
+		}
+		s.OnSubscribe(rs.NewSubscription(func(n int) {
+			if n > 0 {
+				c.begin()
+			}
+		}, c.cancel))
+	})
+}
+
+// That of the wrapped socket
+func (r *RetryingSocket) Availability() float64 {
+	return rs.Availability(r.socket)
+}
+
+func (r *RetryingSocket) observe(latency time.Duration) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	if len(r.latencies) < hedgeSamples {
+		r.latencies = append(r.latencies, latency)
+		return
+	}
+	r.latencies[r.next] = latency
+	r.next = (r.next + 1) % hedgeSamples
+}
+
+// How long to wait before hedging
+func (r *RetryingSocket) hedgeDelay() time.Duration {
+	r.lock.Lock()
+	if len(r.latencies) < hedgeSamples/4 {
+		r.lock.Unlock()
+		return r.options.MinHedgeDelay
+	}
+	sorted := make([]time.Duration, len(r.latencies))
+	copy(sorted, r.latencies)
+	r.lock.Unlock()
+
+	sort.Sort(durations(sorted))
+	delay := sorted[int(r.options.HedgePercentile*float64(len(sorted)))]
+	if delay < r.options.MinHedgeDelay {
+		return r.options.MinHedgeDelay
+	}
+	return delay
+}
+
+type durations []time.Duration
+
+func (d durations) Len() int           { return len(d) }
+func (d durations) Swap(i, j int)      { d[i], d[j] = d[j], d[i] }
+func (d durations) Less(i, j int) bool { return d[i] < d[j] }
+
+// One RequestResponse call, over however many attempts it takes. The first
+// attempt to answer wins, and the others are cancelled.
+type retryCall struct {
+	socket     *RetryingSocket
+	payload    rs.Payload
+	subscriber rs.Subscriber
+	start      time.Time
+
+	lock     sync.Mutex
+	begun    bool
+	done     bool
+	hedged   bool
+	attempts int
+	inFlight map[*retryAttempt]bool
+	// Servers attempts went to, if the socket spreads them
+	tried map[string]bool
+	timer *time.Timer
+}
+
+func (c *retryCall) begin() {
+	c.lock.Lock()
+	if c.begun || c.done {
+		c.lock.Unlock()
+		return
+	}
+	c.begun, c.start = true, time.Now()
+	c.lock.Unlock()
+	c.attempt()
+
+	if c.socket.options.HedgePercentile == 0 || c.socket.options.MaxAttempts < 2 {
+		return
+	}
+	delay := c.socket.hedgeDelay()
+	c.lock.Lock()
+	// Unless the first attempt is already over, one way or the other
+	if !c.done && len(c.inFlight) > 0 {
+		c.timer = time.AfterFunc(delay, c.hedge)
+	}
+	c.lock.Unlock()
+}
+
+func (c *retryCall) attempt() {
+	c.lock.Lock()
+	if c.done || c.attempts >= c.socket.options.MaxAttempts {
+		c.lock.Unlock()
+		return
+	}
+	c.attempts++
+	a := &retryAttempt{call: c, start: time.Now()}
+	c.inFlight[a] = true
+	tried := make(map[string]bool, len(c.tried))
+	for server := range c.tried {
+		tried[server] = true
+	}
+	c.lock.Unlock()
+
+	socket, ok := c.socket.socket.(excludingSocket)
+	if !ok {
+		c.socket.socket.RequestResponse(c.payload).Subscribe(a)
+		return
+	}
+	pub, server := socket.requestResponseExcluding(c.payload, tried)
+	c.lock.Lock()
+	if c.tried != nil {
+		c.tried[server] = true
+	}
+	c.lock.Unlock()
+	pub.Subscribe(a)
+}
+
+// Send another attempt alongside a slow one
+func (c *retryCall) hedge() {
+	c.lock.Lock()
+	if c.done || c.hedged || len(c.inFlight) == 0 || c.attempts >= c.socket.options.MaxAttempts {
+		c.lock.Unlock()
+		return
+	}
+	c.hedged = true
+	c.lock.Unlock()
+	c.attempt()
+}
+
+func (c *retryCall) cancel() {
+	for _, a := range c.finish(nil) {
+		a.cancel()
+	}
+}
+
+// Mark the call done, returning the attempts still in flight other than
+// winner, which should be cancelled. Returns nil if already done.
+func (c *retryCall) finish(winner *retryAttempt) []*retryAttempt {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	if c.done {
+		return nil
+	}
+	c.done = true
+	if c.timer != nil {
+		c.timer.Stop()
+	}
+	losers := make([]*retryAttempt, 0, len(c.inFlight))
+	for a := range c.inFlight {
+		if a != winner {
+			losers = append(losers, a)
+		}
+	}
+	c.inFlight = nil
+	return losers
+}
+
+func (c *retryCall) succeeded(a *retryAttempt, p rs.Payload) {
+	losers := c.finish(a)
+	if losers == nil {
+		return
+	}
+	for _, loser := range losers {
+		loser.cancel()
+	}
+	c.socket.observe(time.Since(a.start))
+	if p != nil {
+		c.subscriber.OnNext(p)
+	}
+	c.subscriber.OnComplete()
+}
+
+func (c *retryCall) failed(a *retryAttempt, err error) {
+	c.lock.Lock()
+	if c.done {
+		c.lock.Unlock()
+		return
+	}
+	delete(c.inFlight, a)
+	if len(c.inFlight) > 0 {
+		// A hedge is still going, and may yet answer
+		c.lock.Unlock()
+		return
+	}
+	o := c.socket.options
+	if c.attempts < o.MaxAttempts && o.IsRetryable(err) {
+		delay := backoff(c.attempts, o.MinBackoff, o.MaxBackoff, o.Multiplier, o.Jitter)
+		if o.Budget == 0 || time.Since(c.start)+delay < o.Budget {
+			if c.timer != nil {
+				// A hedge that has not fired yet
+				c.timer.Stop()
+			}
+			c.timer = time.AfterFunc(delay, c.attempt)
+			c.lock.Unlock()
+			return
+		}
+	}
+	c.lock.Unlock()
+
+	if c.finish(nil) != nil {
+		c.subscriber.OnError(err)
+	}
+}
+
+type retryAttempt struct {
+	call  *retryCall
+	start time.Time
+
+	lock         sync.Mutex
+	subscription rs.Subscription
+	cancelled    bool
+}
+
+func (a *retryAttempt) cancel() {
+	a.lock.Lock()
+	s := a.subscription
+	a.cancelled = true
+	a.lock.Unlock()
+	if s != nil {
+		s.Cancel()
+	}
+}
+
+func (a *retryAttempt) OnSubscribe(s rs.Subscription) {
+	a.lock.Lock()
+	a.subscription = s
+	cancelled := a.cancelled
+	a.lock.Unlock()
+	if cancelled {
+		s.Cancel()
+		return
+	}
+	s.Request(1)
+}
+func (a *retryAttempt) OnNext(p rs.Payload) {
+	a.call.succeeded(a, p)
+}
+func (a *retryAttempt) OnError(err error) {
+	a.call.failed(a, err)
+}
+func (a *retryAttempt) OnComplete() {
+	a.call.succeeded(a, nil)
+}
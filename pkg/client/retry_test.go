@@ -0,0 +1,163 @@
+package client
+
+import (
+	"github.com/jakewins/reactivesocket-go/pkg/rs"
+	"sync"
+	"testing"
+	"time"
+)
+
+var rejected = rs.NewError(rs.ErrorCodeRejected, "Too busy")
+
+func TestRetriesRejectedRequests(t *testing.T) {
+	socket := &sequenceSocket{answers: []interface{}{rejected, rejected, "ok"}}
+	retrying, _ := NewRetryingSocket(socket, WithRetries(3, time.Millisecond, time.Millisecond))
+
+	if got := requestResponse(retrying); got != "ok" {
+		t.Errorf("Expected ok, got %s", got)
+	}
+	if socket.count() != 3 {
+		t.Errorf("Expected 3 attempts, got %d", socket.count())
+	}
+}
+
+func TestGivesUpAfterMaxAttempts(t *testing.T) {
+	socket := &sequenceSocket{answers: []interface{}{rejected, rejected, rejected, "ok"}}
+	retrying, _ := NewRetryingSocket(socket, WithRetries(3, time.Millisecond, time.Millisecond))
+
+	if got := requestResponse(retrying); got != rejected.Error() {
+		t.Errorf("Expected %s, got %s", rejected, got)
+	}
+	if socket.count() != 3 {
+		t.Errorf("Expected 3 attempts, got %d", socket.count())
+	}
+}
+
+func TestDoesNotRetryOtherErrors(t *testing.T) {
+	failed := rs.NewError(rs.ErrorCodeApplicationError, "No such user")
+	socket := &sequenceSocket{answers: []interface{}{failed, "ok"}}
+	retrying, _ := NewRetryingSocket(socket, WithRetries(3, time.Millisecond, time.Millisecond))
+
+	if got := requestResponse(retrying); got != failed.Error() {
+		t.Errorf("Expected %s, got %s", failed, got)
+	}
+	if socket.count() != 1 {
+		t.Errorf("Expected 1 attempt, got %d", socket.count())
+	}
+}
+
+func TestRetriesStopWhenOverBudget(t *testing.T) {
+	socket := &sequenceSocket{answers: []interface{}{rejected, "ok"}}
+	retrying, _ := NewRetryingSocket(socket, WithRetries(3, 50*time.Millisecond, 50*time.Millisecond),
+		WithRetryBudget(10*time.Millisecond))
+
+	if got := requestResponse(retrying); got != rejected.Error() {
+		t.Errorf("Expected %s, got %s", rejected, got)
+	}
+}
+
+func TestHedgesSlowRequests(t *testing.T) {
+	socket := &sequenceSocket{answers: []interface{}{nil, "hedged"}}
+	retrying, _ := NewRetryingSocket(socket, WithHedging(0.95, 10*time.Millisecond))
+
+	if got := requestResponse(retrying); got != "hedged" {
+		t.Errorf("Expected the hedge to answer, got %s", got)
+	}
+	if socket.count() != 2 || socket.cancelled() != 1 {
+		t.Errorf("Expected the slow attempt to be cancelled, got %d attempts and %d cancelled",
+			socket.count(), socket.cancelled())
+	}
+}
+
+func TestHedgesGoToAnotherServer(t *testing.T) {
+	dialer := newAddressDialer()
+	dialer.stalling = "a"
+	b := NewBalancer(dialer.dial, firstMember{})
+	defer b.Close()
+	b.SetAddresses([]string{"a", "b"})
+	awaitConnected(t, b, 2)
+	retrying, _ := NewRetryingSocket(b, WithHedging(0.95, 10*time.Millisecond))
+
+	if got := requestResponse(retrying); got != "b" {
+		t.Errorf("Expected the hedge to route around the stalled server, got %s", got)
+	}
+}
+
+func TestFailedAttemptsHedgeDoesNotFire(t *testing.T) {
+	// The first attempt fails before its hedge is due, and the retry stalls
+	socket := &sequenceSocket{answers: []interface{}{rs.NewError(rs.ErrorCodeRejected, "Busy."), nil, "hedged"}}
+	retrying, _ := NewRetryingSocket(socket, WithRetries(3, time.Millisecond, time.Millisecond),
+		WithHedging(0.95, 20*time.Millisecond))
+
+	retrying.RequestResponse(rs.NewPayload(nil, nil)).Subscribe(rs.NewSubscriber(func(s rs.Subscription) {
+		s.Request(1)
+	}, func(rs.Payload) {}, func(error) {}, func() {}))
+	time.Sleep(50 * time.Millisecond)
+	if socket.count() != 2 {
+		t.Errorf("Expected only the first attempt and its retry, got %d attempts", socket.count())
+	}
+}
+
+func TestCancellingStopsAttempts(t *testing.T) {
+	socket := &sequenceSocket{answers: []interface{}{nil}}
+	retrying, _ := NewRetryingSocket(socket)
+
+	retrying.RequestResponse(rs.NewPayload(nil, nil)).Subscribe(rs.NewSubscriber(func(s rs.Subscription) {
+		s.Request(1)
+		s.Cancel()
+	}, nil, nil, nil))
+	if socket.cancelled() != 1 {
+		t.Errorf("Expected the attempt to be cancelled, got %d", socket.cancelled())
+	}
+}
+
+// Always picks the first member, so only excluding others moves requests
+type firstMember struct{}
+
+func (firstMember) Pick(members []Member) Member {
+	return members[0]
+}
+
+// Answers each request with the next answer: a string to respond with, an
+// error to fail with, or nil to never answer.
+type sequenceSocket struct {
+	fakeSocket
+	lock     sync.Mutex
+	answers  []interface{}
+	attempts int
+	cancels  int
+}
+
+func (s *sequenceSocket) count() int {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return s.attempts
+}
+
+func (s *sequenceSocket) cancelled() int {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return s.cancels
+}
+
+func (s *sequenceSocket) RequestResponse(rs.Payload) rs.Publisher {
+	s.lock.Lock()
+	answer := s.answers[s.attempts]
+	s.attempts++
+	s.lock.Unlock()
+	return rs.NewPublisher(func(sub rs.Subscriber) {
+		sub.OnSubscribe(rs.NewSubscription(func(n int) {
+			switch a := answer.(type) {
+			case string:
+				sub.OnNext(rs.NewPayload(nil, []byte(a)))
+				sub.OnComplete()
+			case error:
+				sub.OnError(a)
+			}
+		}, func() {
+			s.lock.Lock()
+			s.cancels++
+			s.lock.Unlock()
+		}))
+	})
+}
@@ -14,7 +14,9 @@ const (
 	ECInvalidSetup     uint32 = 0x0001
 	ECUnsupportedSetup        = 0x0002
 	ECRejectedSetup           = 0x0003
+	ECRejectedResume          = 0x0004
 	ECConnectionError         = 0x0101
+	ECConnectionClose         = 0x0102
 	ECApplicationError        = 0x0201
 	ECRejected                = 0x0202
 	ECCancel                  = 0x0203
@@ -7,6 +7,7 @@ import (
 // Common for all frames
 
 const (
+	SizeOfLong          = 8
 	SizeOfInt           = 4
 	SizeOfShort         = 2
 	typeFieldOffset     = 0
@@ -22,6 +23,12 @@ const (
 	FlagResponseComplete              = 1 << 12
 	FlagRequestChannelComplete        = 1 << 12
 	FlagRequestChannelInitialN        = 1 << 11
+	// Request and Response frames only; more fragments of this frame follow
+	FlagFollows = 1 << 13
+	// Response and Request Channel frames only; the frame carries a value. Only
+	// needed to tell an empty final value apart from a bare completion, see
+	// response.IsNext.
+	FlagNext = 1 << 10
 )
 
 const (
@@ -43,6 +50,9 @@ const (
 	FTError    = 0x0C
 	// Requester & Responder
 	FTMetadataPush = 0x0D
+	// Resumption
+	FTResume   = 0x0E
+	FTResumeOK = 0x0F
 )
 
 func computeMetadataLength(metadataPayloadLength int) int {
@@ -141,6 +151,10 @@ func PutUint32(b []byte, offset int, v uint32) {
 	binary.BigEndian.PutUint32(b[offset:], v)
 }
 
+func PutUint64(b []byte, offset int, v uint64) {
+	binary.BigEndian.PutUint64(b[offset:], v)
+}
+
 func Uint16(b []byte, offset int) uint16 {
 	return binary.BigEndian.Uint16(b[offset:])
 }
@@ -149,6 +163,10 @@ func Uint32(b []byte, offset int) uint32 {
 	return binary.BigEndian.Uint32(b[offset:])
 }
 
+func Uint64(b []byte, offset int) uint64 {
+	return binary.BigEndian.Uint64(b[offset:])
+}
+
 // Ensure the given pointer refers to a slice with at least the specified capacity,
 // allocating a new underlying array for the slice to point to if not
 // Returns the resized slice.
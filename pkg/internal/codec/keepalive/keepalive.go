@@ -1,9 +1,12 @@
 package keepalive
 
 import (
+	"fmt"
 	"github.com/jakewins/reactivesocket-go/pkg/internal/codec/header"
 )
 
+const positionFieldOffset = header.FrameHeaderLength
+
 func Encode(bufPtr *[]byte, respond bool) {
 	var flags uint16
 	buf := header.ResizeSlice(bufPtr, header.ComputeLength(0, 0))
@@ -14,9 +17,34 @@ func Encode(bufPtr *[]byte, respond bool) {
 	header.EncodeHeader(buf, flags, header.FTKeepAlive, 0)
 }
 
+// Encode a keepalive that tells the remote the implied position of the last
+// frame we received from it, see trans/session.go
+func EncodeWithPosition(bufPtr *[]byte, respond bool, position uint64) {
+	var flags uint16
+	buf := header.ResizeSlice(bufPtr, header.ComputeLength(0, header.SizeOfLong))
+
+	if respond {
+		flags |= header.FlagKeepaliveRespond
+	}
+	header.EncodeHeader(buf, flags, header.FTKeepAlive, 0)
+	header.PutUint64(buf, positionFieldOffset, position)
+}
+
+// The last received position, or 0 if the keepalive does not carry one
+func Position(b []byte) uint64 {
+	if len(b) < positionFieldOffset+header.SizeOfLong {
+		return 0
+	}
+	return header.Uint64(b, positionFieldOffset)
+}
+
 func Describe(buf []byte) string {
+	respond := "no"
 	if header.Flags(buf)&header.FlagKeepaliveRespond != 0 {
-		return "KeepAlive{respond=yes}"
+		respond = "yes"
+	}
+	if len(buf) < positionFieldOffset+header.SizeOfLong {
+		return fmt.Sprintf("KeepAlive{respond=%s}", respond)
 	}
-	return "KeepAlive{respond=no}"
+	return fmt.Sprintf("KeepAlive{respond=%s, position=%d}", respond, Position(buf))
 }
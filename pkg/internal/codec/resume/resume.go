@@ -0,0 +1,91 @@
+// RESUME and RESUME_OK frames, used to pick up a session on a new
+// connection. Their bodies have the same layout as in RSocket 1.0.
+package resume
+
+import (
+	"fmt"
+	"github.com/jakewins/reactivesocket-go/pkg/internal/codec/header"
+)
+
+const (
+	versionFieldOffset           = header.FrameHeaderLength
+	resumeTokenLengthFieldOffset = versionFieldOffset + header.SizeOfInt
+	// RESUME_OK only
+	okPositionFieldOffset = header.FrameHeaderLength
+)
+
+// Encode a RESUME frame. lastReceived is the implied position of the last
+// frame received from the server, firstAvailable the position of the oldest
+// frame we can still send again.
+func Encode(bufPtr *[]byte, version uint32, resumeToken []byte, lastReceived, firstAvailable uint64) {
+	length := resumeTokenLengthFieldOffset + header.SizeOfShort + len(resumeToken) + 2*header.SizeOfLong
+	buf := header.ResizeSlice(bufPtr, length)
+	header.EncodeHeader(buf, 0, header.FTResume, 0)
+	header.PutUint32(buf, versionFieldOffset, version)
+	header.PutUint16(buf, resumeTokenLengthFieldOffset, uint16(len(resumeToken)))
+	offset := resumeTokenLengthFieldOffset + header.SizeOfShort
+	offset += copy(buf[offset:], resumeToken)
+	header.PutUint64(buf, offset, lastReceived)
+	header.PutUint64(buf, offset+header.SizeOfLong, firstAvailable)
+}
+
+func EncodeOK(bufPtr *[]byte, lastReceived uint64) {
+	buf := header.ResizeSlice(bufPtr, okPositionFieldOffset+header.SizeOfLong)
+	header.EncodeHeader(buf, 0, header.FTResumeOK, 0)
+	header.PutUint64(buf, okPositionFieldOffset, lastReceived)
+}
+
+// Whether b is long enough to hold the fields it claims to
+func IsWellFormed(b []byte) bool {
+	switch header.FrameType(b) {
+	case header.FTResume:
+		if len(b) < resumeTokenLengthFieldOffset+header.SizeOfShort {
+			return false
+		}
+		return len(b) >= positionsOffset(b)+2*header.SizeOfLong
+	case header.FTResumeOK:
+		return len(b) >= okPositionFieldOffset+header.SizeOfLong
+	}
+	return false
+}
+
+func Version(b []byte) uint32 {
+	return header.Uint32(b, versionFieldOffset)
+}
+
+func ResumeToken(b []byte) []byte {
+	offset := resumeTokenLengthFieldOffset + header.SizeOfShort
+	return b[offset:positionsOffset(b)]
+}
+
+// Implied position of the last frame the client received
+func LastReceivedPosition(b []byte) uint64 {
+	return header.Uint64(b, positionsOffset(b))
+}
+
+// Implied position of the oldest frame the client can send again
+func FirstAvailablePosition(b []byte) uint64 {
+	return header.Uint64(b, positionsOffset(b)+header.SizeOfLong)
+}
+
+// Implied position of the last frame the server received, from RESUME_OK
+func OKPosition(b []byte) uint64 {
+	return header.Uint64(b, okPositionFieldOffset)
+}
+
+// RESUME body after the header; the same in both wire formats
+func Body(b []byte) []byte {
+	return b[header.FrameHeaderLength:]
+}
+
+func positionsOffset(b []byte) int {
+	return resumeTokenLengthFieldOffset + header.SizeOfShort + int(header.Uint16(b, resumeTokenLengthFieldOffset))
+}
+
+func Describe(buf []byte) string {
+	if header.FrameType(buf) == header.FTResumeOK {
+		return fmt.Sprintf("ResumeOK{position=%d}", OKPosition(buf))
+	}
+	return fmt.Sprintf("Resume{token=% x, lastReceived=%d, firstAvailable=%d}",
+		ResumeToken(buf), LastReceivedPosition(buf), FirstAvailablePosition(buf))
+}
@@ -7,6 +7,9 @@ import (
 const (
 	SetupFlagWillHonorLease       = 1 << 13
 	SetupFlagStrictInterpretation = 1 << 12
+	// The client wants to be able to resume the session; the frame carries
+	// a resume token after the max lifetime field
+	SetupFlagResumeEnable = 1 << 11
 )
 
 const (
@@ -15,12 +18,18 @@ const (
 	versionFieldOffset           = header.FrameHeaderLength
 	keepaliveIntervalFieldOffset = versionFieldOffset + sizeOfInt
 	maxLifetimeFieldOffset       = keepaliveIntervalFieldOffset + sizeOfInt
-	metadataMimeTypeLengthOffset = maxLifetimeFieldOffset + sizeOfInt
+	resumeTokenLengthOffset      = maxLifetimeFieldOffset + sizeOfInt
 )
 
-func computeFrameLength(metadataMimeType, dataMimeType string, metadata, data []byte) int {
+// RSocket 1.0; major version in the high 16 bits, minor in the low
+const Version1 = 0x00010000
+
+func computeFrameLength(resumeToken []byte, metadataMimeType, dataMimeType string, metadata, data []byte) int {
 	length := header.ComputeLength(len(metadata), len(data))
 	length += sizeOfInt * 3
+	if resumeToken != nil {
+		length += header.SizeOfShort + len(resumeToken)
+	}
 	length += 1 + len(metadataMimeType)
 	length += 1 + len(dataMimeType)
 	return length
@@ -29,10 +38,23 @@ func computeFrameLength(metadataMimeType, dataMimeType string, metadata, data []
 func Encode(bufPtr *[]byte, flags uint16, keepaliveInterval, maxLifetime uint32,
 	metadataMimeType, dataMimeType string,
 	metadata, data []byte) {
-	buf := header.ResizeSlice(bufPtr, computeFrameLength(metadataMimeType, dataMimeType, metadata, data))
+	EncodeResumable(bufPtr, flags, keepaliveInterval, maxLifetime, nil, metadataMimeType, dataMimeType, metadata, data)
+}
+
+// Encode a setup frame asking for a resumable session identified by
+// resumeToken. A nil token is the same as Encode.
+func EncodeResumable(bufPtr *[]byte, flags uint16, keepaliveInterval, maxLifetime uint32,
+	resumeToken []byte, metadataMimeType, dataMimeType string,
+	metadata, data []byte) {
+	buf := header.ResizeSlice(bufPtr, computeFrameLength(resumeToken, metadataMimeType, dataMimeType, metadata, data))
 	if len(metadata) > 0 {
 		flags |= header.FlagHasMetadata
 	}
+	if resumeToken != nil {
+		flags |= SetupFlagResumeEnable
+	} else {
+		flags &^= SetupFlagResumeEnable
+	}
 
 	header.EncodeHeader(buf, flags, header.FTSetup, 0)
 	header.PutUint32(buf, versionFieldOffset, currentVersion)
@@ -41,6 +63,11 @@ func Encode(bufPtr *[]byte, flags uint16, keepaliveInterval, maxLifetime uint32,
 
 	offset := header.FrameHeaderLength
 	offset += sizeOfInt * 3 // The three ints we write above
+	if resumeToken != nil {
+		header.PutUint16(buf, offset, uint16(len(resumeToken)))
+		offset += header.SizeOfShort
+		offset += copy(buf[offset:], resumeToken)
+	}
 	offset += header.PutMimeType(buf, offset, metadataMimeType)
 	offset += header.PutMimeType(buf, offset, dataMimeType)
 
@@ -48,13 +75,37 @@ func Encode(bufPtr *[]byte, flags uint16, keepaliveInterval, maxLifetime uint32,
 }
 
 func Flags(b []byte) uint16 {
-	return header.Flags(b) & (SetupFlagWillHonorLease | SetupFlagStrictInterpretation)
+	return header.Flags(b) & (SetupFlagWillHonorLease | SetupFlagStrictInterpretation | SetupFlagResumeEnable)
+}
+
+// The token identifying the session, or nil if the client did not ask for
+// resumption
+func ResumeToken(b []byte) []byte {
+	if header.Flags(b)&SetupFlagResumeEnable == 0 {
+		return nil
+	}
+	length := int(header.Uint16(b, resumeTokenLengthOffset))
+	offset := resumeTokenLengthOffset + header.SizeOfShort
+	return b[offset : offset+length]
+}
+
+// Offset of the metadata mime type, which follows the resume token if there
+// is one
+func mimeTypesOffset(b []byte) int {
+	if header.Flags(b)&SetupFlagResumeEnable == 0 {
+		return resumeTokenLengthOffset
+	}
+	return resumeTokenLengthOffset + header.SizeOfShort + int(header.Uint16(b, resumeTokenLengthOffset))
 }
 
 func Version(b []byte) uint32 {
 	return header.Uint32(b, versionFieldOffset)
 }
 
+func SetVersion(b []byte, version uint32) {
+	header.PutUint32(b, versionFieldOffset, version)
+}
+
 func KeepaliveInterval(b []byte) uint32 {
 	return header.Uint32(b, keepaliveIntervalFieldOffset)
 }
@@ -64,17 +115,46 @@ func MaxLifetime(b []byte) uint32 {
 }
 
 func MetadataMimeType(b []byte) string {
-	return header.MimeType(b, metadataMimeTypeLengthOffset)
+	return header.MimeType(b, mimeTypesOffset(b))
 }
 
 func DataMimeType(b []byte) string {
-	offset := int(metadataMimeTypeLengthOffset)
+	offset := mimeTypesOffset(b)
 	offset += 1 + int(b[offset])
 	return header.MimeType(b, offset)
 }
 
+// Whether b is long enough to hold the fields it claims to. Only frames that
+// are well formed are safe to read with the other functions here.
+func IsWellFormed(b []byte) bool {
+	if len(b) < resumeTokenLengthOffset {
+		return false
+	}
+	if header.Flags(b)&SetupFlagResumeEnable != 0 && len(b) < resumeTokenLengthOffset+header.SizeOfShort {
+		return false
+	}
+	offset := mimeTypesOffset(b)
+	for i := 0; i < 2; i++ {
+		if offset >= len(b) {
+			return false
+		}
+		offset += 1 + int(b[offset])
+	}
+	if offset > len(b) {
+		return false
+	}
+	if header.Flags(b)&header.FlagHasMetadata != 0 {
+		if offset+sizeOfInt > len(b) {
+			return false
+		}
+		length := int(header.Uint32(b, offset))
+		return length >= sizeOfInt && offset+length <= len(b)
+	}
+	return true
+}
+
 func PayloadOffset(b []byte) int {
-	offset := metadataMimeTypeLengthOffset
+	offset := mimeTypesOffset(b)
 
 	metadataMimeTypeLength := int(b[offset])
 	offset += 1 + metadataMimeTypeLength
@@ -0,0 +1,190 @@
+// Splitting of large frames into fragments, and reassembly of fragments back
+// into whole frames.
+//
+// A fragmented frame is sent as a run of frames with the same type and stream
+// id, all but the last carrying FlagFollows. The first fragment carries any
+// type-specific fields (like initial request N) and the last carries the
+// completion flag, if any. The metadata of the original frame is spread over
+// the fragments first, followed by its data; each fragment carries its share
+// encoded as a regular frame would.
+package fragment
+
+import (
+	"fmt"
+	"github.com/jakewins/reactivesocket-go/pkg/internal/codec/header"
+	"github.com/jakewins/reactivesocket-go/pkg/internal/frame"
+)
+
+// Smallest MTU we'll fragment to; leaves room for the largest fixed frame
+// prefix, a metadata length field and some payload.
+const MinMTU = 64
+
+// Only these frame types carry user payloads that may be fragmented
+func IsFragmentable(frameType uint16) bool {
+	switch frameType {
+	case header.FTRequestResponse, header.FTFireAndForget, header.FTRequestStream,
+		header.FTRequestSubscription, header.FTRequestChannel, header.FTResponse:
+		return true
+	}
+	return false
+}
+
+func follows(f *frame.Frame) bool {
+	return IsFragmentable(f.Type()) && f.Flags()&header.FlagFollows != 0
+}
+
+// Split f into fragments no longer than mtu bytes, handing each to emit in
+// order. Frames that fit, or can't be fragmented, are passed to emit as-is.
+// Ownership of f passes to Split; each fragment passed to emit is a new
+// pooled frame, owned by emit.
+func Split(f *frame.Frame, mtu int, emit func(*frame.Frame) error) error {
+	if len(f.Buf) <= mtu || !IsFragmentable(f.Type()) {
+		return emit(f)
+	}
+	if mtu < MinMTU {
+		f.Release()
+		return fmt.Errorf("Cannot fragment to an MTU of %d, the minimum is %d.", mtu, MinMTU)
+	}
+	defer f.Release()
+
+	prefix := f.Buf[:f.PayloadOffset()]
+	metadata, data := f.Metadata(), f.Data()
+	completeFlag := f.Flags() & header.FlagResponseComplete
+	firstFlags := f.Flags() &^ (header.FlagHasMetadata | header.FlagResponseComplete | header.FlagFollows)
+
+	for {
+		var flags uint16
+		var fragmentPrefix []byte
+		if prefix != nil {
+			fragmentPrefix, flags = prefix, firstFlags
+			prefix = nil
+		} else {
+			fragmentPrefix = f.Buf[:header.FrameHeaderLength]
+		}
+
+		room := mtu - len(fragmentPrefix)
+		var m, d []byte
+		if len(metadata) > 0 {
+			m, metadata = take(metadata, room-header.SizeOfInt)
+			room -= header.SizeOfInt + len(m)
+			flags |= header.FlagHasMetadata
+		}
+		d, data = take(data, room)
+
+		if len(metadata) == 0 && len(data) == 0 {
+			flags |= completeFlag
+		} else {
+			flags |= header.FlagFollows
+		}
+
+		if err := emit(encode(frame.Get(), fragmentPrefix, flags, m, d)); err != nil {
+			return err
+		}
+		if flags&header.FlagFollows == 0 {
+			return nil
+		}
+	}
+}
+
+func take(b []byte, max int) ([]byte, []byte) {
+	if len(b) <= max {
+		return b, nil
+	}
+	return b[:max], b[max:]
+}
+
+// Encode a frame made up of the given header and type-specific prefix, with
+// the flags replaced, followed by metadata and data.
+func encode(target *frame.Frame, prefix []byte, flags uint16, metadata, data []byte) *frame.Frame {
+	length := len(prefix) + len(data)
+	if flags&header.FlagHasMetadata != 0 {
+		length += header.SizeOfInt + len(metadata)
+	}
+	buf := header.ResizeSlice(&target.Buf, length)
+	copy(buf, prefix)
+	header.EncodeHeader(buf, flags, header.FrameType(prefix), header.StreamID(prefix))
+	header.EncodeMetaDataAndData(buf, metadata, data, len(prefix), flags)
+	return target
+}
+
+// Reassembles fragmented frames, buffering at most a fixed number of bytes
+// across all streams. Not goroutine safe; meant to be driven by the goroutine
+// reading frames off a connection.
+type Reassembler struct {
+	max      int
+	buffered int
+	partials map[uint32]*partial
+}
+
+type partial struct {
+	prefix   []byte
+	metadata []byte
+	data     []byte
+}
+
+func NewReassembler(maxBuffered int) *Reassembler {
+	return &Reassembler{
+		max:      maxBuffered,
+		partials: make(map[uint32]*partial),
+	}
+}
+
+// Feed an inbound frame. If it completes a frame, that frame is returned; it is
+// either f itself or, for reassembled frames, a new pooled frame the caller
+// must Release. The caller keeps ownership of f in either case. Returns nil if
+// more fragments are needed. Fails if buffering the
+// fragment would exceed the limit given to NewReassembler.
+func (r *Reassembler) Reassemble(f *frame.Frame) (*frame.Frame, error) {
+	streamId := f.StreamID()
+	p := r.partials[streamId]
+	if p == nil {
+		if !follows(f) {
+			return f, nil
+		}
+		p = &partial{prefix: append([]byte(nil), f.Buf[:f.PayloadOffset()]...)}
+		r.partials[streamId] = p
+		r.buffered += len(p.prefix)
+	} else if f.Type() == header.FTCancel || f.Type() == header.FTError {
+		// The stream is being torn down mid-fragment
+		r.discard(streamId, p)
+		return f, nil
+	} else if !IsFragmentable(f.Type()) {
+		// Eg. REQUEST_N flowing the other way on a channel
+		return f, nil
+	} else if f.Type() != header.FrameType(p.prefix) {
+		r.discard(streamId, p)
+		return nil, fmt.Errorf("Expected fragment of type %d on stream %d, got %s",
+			header.FrameType(p.prefix), streamId, f.Describe())
+	}
+
+	metadata, data := f.Metadata(), f.Data()
+	if r.buffered+len(metadata)+len(data) > r.max {
+		r.discard(streamId, p)
+		return nil, fmt.Errorf("Reassembling fragments on stream %d would exceed the %d byte limit.", streamId, r.max)
+	}
+	r.buffered += len(metadata) + len(data)
+	p.metadata = append(p.metadata, metadata...)
+	p.data = append(p.data, data...)
+
+	if follows(f) {
+		return nil, nil
+	}
+
+	r.discard(streamId, p)
+	flags := header.Flags(p.prefix)&^(header.FlagFollows|header.FlagHasMetadata) |
+		f.Flags()&header.FlagResponseComplete
+	if len(p.metadata) > 0 {
+		flags |= header.FlagHasMetadata
+	}
+	return encode(frame.Get(), p.prefix, flags, p.metadata, p.data), nil
+}
+
+// Bytes currently buffered in partially reassembled frames
+func (r *Reassembler) Buffered() int {
+	return r.buffered
+}
+
+func (r *Reassembler) discard(streamId uint32, p *partial) {
+	r.buffered -= len(p.prefix) + len(p.metadata) + len(p.data)
+	delete(r.partials, streamId)
+}
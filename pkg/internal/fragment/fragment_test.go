@@ -0,0 +1,155 @@
+package fragment_test
+
+import (
+	"bytes"
+	"github.com/jakewins/reactivesocket-go/pkg/internal/codec/header"
+	"github.com/jakewins/reactivesocket-go/pkg/internal/fragment"
+	"github.com/jakewins/reactivesocket-go/pkg/internal/frame"
+	"github.com/jakewins/reactivesocket-go/pkg/internal/frame/request"
+	"testing"
+)
+
+func blob(n int, seed byte) []byte {
+	b := make([]byte, n)
+	for i := range b {
+		b[i] = seed + byte(i)
+	}
+	return b
+}
+
+func split(t *testing.T, f *frame.Frame, mtu int) []*frame.Frame {
+	var out []*frame.Frame
+	err := fragment.Split(f, mtu, func(f *frame.Frame) error {
+		if len(f.Buf) > mtu {
+			t.Errorf("Expected fragments no larger than %d, got %d bytes", mtu, len(f.Buf))
+		}
+		out = append(out, f)
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return out
+}
+
+func TestSplitAndReassembleRequest(t *testing.T) {
+	metadata, data := blob(300, 1), blob(1000, 7)
+	fragments := split(t, frame.RequestWithInitialN(3, 42, header.FlagRequestChannelComplete,
+		header.FTRequestChannel, metadata, data), fragment.MinMTU)
+
+	if len(fragments) < 2 {
+		t.Fatalf("Expected frame to be fragmented, got %d frames", len(fragments))
+	}
+	r := fragment.NewReassembler(1 << 20)
+	var whole *frame.Frame
+	for i, f := range fragments {
+		out, err := r.Reassemble(f)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if i < len(fragments)-1 && out != nil {
+			t.Fatalf("Expected fragment %d to be buffered, got %s", i, out.Describe())
+		}
+		whole = out
+	}
+
+	if whole == nil {
+		t.Fatal("Expected last fragment to complete the frame")
+	}
+	if whole.Type() != header.FTRequestChannel || whole.StreamID() != 3 {
+		t.Errorf("Expected REQUEST_CHANNEL on stream 3, got %s", whole.Describe())
+	}
+	if n := request.InitialRequestN(whole); n != 42 {
+		t.Errorf("Expected initial request N of 42, got %d", n)
+	}
+	if whole.Flags()&header.FlagFollows != 0 || !request.IsCompleteStream(whole) {
+		t.Errorf("Expected complete flag without follows, got flags %b", whole.Flags())
+	}
+	if !bytes.Equal(whole.Metadata(), metadata) || !bytes.Equal(whole.Data(), data) {
+		t.Error("Expected reassembled payload to match the original")
+	}
+	if r.Buffered() != 0 {
+		t.Errorf("Expected nothing left buffered, found %d bytes", r.Buffered())
+	}
+}
+
+func TestFramesThatFitAreNotSplit(t *testing.T) {
+	f := frame.Response(1, header.FlagResponseComplete, nil, blob(10, 0))
+	fragments := split(t, f, fragment.MinMTU)
+
+	if len(fragments) != 1 || fragments[0] != f {
+		t.Errorf("Expected the frame to be passed through as-is, got %d frames", len(fragments))
+	}
+}
+
+func TestInterleavedStreamsReassembleIndependently(t *testing.T) {
+	a := split(t, frame.Response(1, 0, nil, blob(500, 1)), fragment.MinMTU)
+	b := split(t, frame.Response(3, 0, blob(200, 2), nil), fragment.MinMTU)
+	r := fragment.NewReassembler(1 << 20)
+
+	var done []*frame.Frame
+	for len(a) > 0 || len(b) > 0 {
+		for _, queue := range []*[]*frame.Frame{&a, &b} {
+			if len(*queue) == 0 {
+				continue
+			}
+			out, err := r.Reassemble((*queue)[0])
+			if err != nil {
+				t.Fatal(err)
+			}
+			*queue = (*queue)[1:]
+			if out != nil {
+				done = append(done, out)
+			}
+			// Control traffic passes straight through mid-fragment
+			n := frame.RequestN(1, 8)
+			if out, _ := r.Reassemble(n); out != n {
+				t.Fatal("Expected REQUEST_N to pass through the reassembler")
+			}
+		}
+	}
+
+	if len(done) != 2 {
+		t.Fatalf("Expected two reassembled frames, got %d", len(done))
+	}
+	for _, f := range done {
+		if f.StreamID() == 1 && !bytes.Equal(f.Data(), blob(500, 1)) {
+			t.Error("Expected stream 1 data to survive interleaving")
+		}
+		if f.StreamID() == 3 && !bytes.Equal(f.Metadata(), blob(200, 2)) {
+			t.Error("Expected stream 3 metadata to survive interleaving")
+		}
+	}
+}
+
+func TestCancelDiscardsPartialFrame(t *testing.T) {
+	fragments := split(t, frame.Request(1, 0, header.FTRequestResponse, nil, blob(500, 0)), fragment.MinMTU)
+	r := fragment.NewReassembler(1 << 20)
+	r.Reassemble(fragments[0])
+
+	cancel := frame.Cancel(1)
+	if out, err := r.Reassemble(cancel); err != nil || out != cancel {
+		t.Errorf("Expected CANCEL to pass through, got %v, %v", out, err)
+	}
+	if r.Buffered() != 0 {
+		t.Errorf("Expected partial frame to be discarded, found %d bytes", r.Buffered())
+	}
+}
+
+func TestReassemblyBeyondLimitFails(t *testing.T) {
+	fragments := split(t, frame.Response(1, 0, nil, blob(1000, 0)), fragment.MinMTU)
+	r := fragment.NewReassembler(256)
+
+	var err error
+	for _, f := range fragments {
+		if _, err = r.Reassemble(f); err != nil {
+			break
+		}
+	}
+	if err == nil {
+		t.Error("Expected reassembly to fail once the limit was exceeded")
+	}
+	if r.Buffered() != 0 {
+		t.Errorf("Expected partial frame to be discarded, found %d bytes", r.Buffered())
+	}
+}
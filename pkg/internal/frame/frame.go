@@ -9,6 +9,7 @@ import (
 	"github.com/jakewins/reactivesocket-go/pkg/internal/codec/request"
 	"github.com/jakewins/reactivesocket-go/pkg/internal/codec/requestn"
 	"github.com/jakewins/reactivesocket-go/pkg/internal/codec/response"
+	"github.com/jakewins/reactivesocket-go/pkg/internal/codec/resume"
 	"github.com/jakewins/reactivesocket-go/pkg/internal/codec/setup"
 	"io"
 )
@@ -19,9 +20,14 @@ import (
 // the ability to determine the type of the frame), most read operations
 // are performed via the frame type-specific packages below this level,
 // like `frame/setup`.
+//
+// Frames obtained from Get are reference counted, see Retain and Release.
 type Frame struct {
 	// This is a slice that is sized to fit the current frame
 	Buf []byte
+
+	pooled bool
+	refs   int32
 }
 
 func (f *Frame) Type() uint16 {
@@ -34,10 +40,10 @@ func (f *Frame) Flags() uint16 {
 	return header.Flags(f.Buf)
 }
 func (f *Frame) Data() []byte {
-	return header.Data(f.Buf, f.payloadOffset())
+	return header.Data(f.Buf, f.PayloadOffset())
 }
 func (f *Frame) Metadata() []byte {
-	return header.Metadata(f.Buf, f.payloadOffset())
+	return header.Metadata(f.Buf, f.PayloadOffset())
 }
 
 // Make a copy of this frame. If target is provided, it will be
@@ -77,12 +83,15 @@ func (f *Frame) Describe() string {
 		return errorc.Describe(f.Buf)
 	case header.FTCancel:
 		return cancel.Describe(f.Buf)
+	case header.FTResume, header.FTResumeOK:
+		return resume.Describe(f.Buf)
 	default:
 		return fmt.Sprintf("UnknownFrame{type=%d, contents=% x}", f.Type(), f.Buf)
 	}
 }
 
-func (f *Frame) payloadOffset() int {
+// Offset into Buf where the metadata and data of this frame start
+func (f *Frame) PayloadOffset() int {
 	switch f.Type() {
 	case header.FTSetup:
 		return setup.PayloadOffset(f.Buf)
@@ -114,7 +123,7 @@ func (f *Frame) payloadOffset() int {
 }
 
 func (f *Frame) metadataFieldLength() int {
-	return header.MetadataFieldLength(f.Buf, f.payloadOffset())
+	return header.MetadataFieldLength(f.Buf, f.PayloadOffset())
 }
 
 // Message creation
@@ -129,10 +138,27 @@ func EncodeSetup(f *Frame, flags uint16, keepaliveInterval, maxLifetime uint32,
 	setup.Encode(&f.Buf, flags, keepaliveInterval, maxLifetime, metadataMimeType, dataMimeType, metadata, data)
 	return f
 }
+func EncodeResumableSetup(f *Frame, flags uint16, keepaliveInterval, maxLifetime uint32,
+	resumeToken []byte, metadataMimeType, dataMimeType string, metadata, data []byte) *Frame {
+	setup.EncodeResumable(&f.Buf, flags, keepaliveInterval, maxLifetime, resumeToken, metadataMimeType, dataMimeType, metadata, data)
+	return f
+}
 func EncodeKeepalive(f *Frame, respond bool) *Frame {
 	keepalive.Encode(&f.Buf, respond)
 	return f
 }
+func EncodeKeepaliveWithPosition(f *Frame, respond bool, position uint64) *Frame {
+	keepalive.EncodeWithPosition(&f.Buf, respond, position)
+	return f
+}
+func EncodeResume(f *Frame, version uint32, resumeToken []byte, lastReceived, firstAvailable uint64) *Frame {
+	resume.Encode(&f.Buf, version, resumeToken, lastReceived, firstAvailable)
+	return f
+}
+func EncodeResumeOK(f *Frame, lastReceived uint64) *Frame {
+	resume.EncodeOK(&f.Buf, lastReceived)
+	return f
+}
 func EncodeRequest(f *Frame, streamId uint32, flags, frameType uint16, metadata, data []byte) *Frame {
 	request.Encode(&f.Buf, streamId, flags, frameType, metadata, data)
 	return f
@@ -164,6 +190,15 @@ func Response(streamId uint32, flags uint16, metadata, data []byte) *Frame {
 func Keepalive(respond bool) *Frame {
 	return EncodeKeepalive(&Frame{}, respond)
 }
+func KeepaliveWithPosition(respond bool, position uint64) *Frame {
+	return EncodeKeepaliveWithPosition(&Frame{}, respond, position)
+}
+func Resume(version uint32, resumeToken []byte, lastReceived, firstAvailable uint64) *Frame {
+	return EncodeResume(&Frame{}, version, resumeToken, lastReceived, firstAvailable)
+}
+func ResumeOK(lastReceived uint64) *Frame {
+	return EncodeResumeOK(&Frame{}, lastReceived)
+}
 func Request(streamId uint32, flags, frameType uint16, metadata, data []byte) *Frame {
 	return EncodeRequest(&Frame{}, streamId, flags, frameType, metadata, data)
 }
@@ -182,8 +217,40 @@ func Cancel(streamId uint32) *Frame {
 
 // Frame encoder/decoder below should be moved out of here
 
+// Reads frames off a connection, in whatever wire format it speaks
+type Decoder interface {
+	Read(target *Frame) error
+}
+
+// Writes frames to a connection, in whatever wire format it speaks
+type Encoder interface {
+	Write(frame *Frame) error
+}
+
+// Largest frame, not counting the length prefix, that decoders accept unless
+// told otherwise.
+const DefaultMaxFrameSize = 16 * 1024 * 1024
+
+// Smallest valid length prefix; the prefix itself plus a frame header
+const minFrameLength = header.SizeOfInt + header.FrameHeaderLength
+
+// Returned by FrameDecoder when a length prefix is out of bounds. There is no
+// way to find the next frame after this, so the connection must be failed.
+type MalformedFrameError struct {
+	Length       uint32
+	MaxFrameSize int
+}
+
+func (e *MalformedFrameError) Error() string {
+	if e.Length < minFrameLength {
+		return fmt.Sprintf("Malformed frame: length prefix %d is shorter than a frame header.", e.Length)
+	}
+	return fmt.Sprintf("Malformed frame: length prefix %d exceeds the max frame size of %d.", e.Length, e.MaxFrameSize)
+}
+
 type FrameDecoder struct {
-	source io.Reader
+	source       io.Reader
+	maxFrameSize int
 }
 
 func (d *FrameDecoder) Read(target *Frame) error {
@@ -194,11 +261,11 @@ func (d *FrameDecoder) Read(target *Frame) error {
 	header.ResizeSlice(&target.Buf, frameLength)
 
 	_, err = io.ReadFull(d.source, target.Buf)
-	if err != nil {
-		return err
+	if err == io.EOF {
+		// The length prefix promised more than we got
+		err = io.ErrUnexpectedEOF
 	}
-
-	return nil
+	return err
 }
 
 func (d *FrameDecoder) readFrameLength(target *Frame) (int, error) {
@@ -210,12 +277,21 @@ func (d *FrameDecoder) readFrameLength(target *Frame) (int, error) {
 		return 0, err
 	}
 
-	frameLength := int(header.Uint32(target.Buf, 0) - header.SizeOfInt)
-	return frameLength, nil
+	prefix := header.Uint32(target.Buf, 0)
+	if prefix < minFrameLength || uint64(prefix-header.SizeOfInt) > uint64(d.maxFrameSize) {
+		return 0, &MalformedFrameError{prefix, d.maxFrameSize}
+	}
+	return int(prefix - header.SizeOfInt), nil
 }
 
 func NewFrameDecoder(source io.Reader) *FrameDecoder {
-	return &FrameDecoder{source}
+	return NewLimitedFrameDecoder(source, DefaultMaxFrameSize)
+}
+
+// Decoder that fails on frames larger than maxFrameSize bytes, not counting
+// the length prefix.
+func NewLimitedFrameDecoder(source io.Reader, maxFrameSize int) *FrameDecoder {
+	return &FrameDecoder{source, maxFrameSize}
 }
 
 type FrameEncoder struct {
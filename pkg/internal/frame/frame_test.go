@@ -1,8 +1,14 @@
 package frame_test
 
 import (
+	"bufio"
 	"bytes"
+	"encoding/binary"
+	"fmt"
+	"github.com/jakewins/reactivesocket-go/pkg/internal/codec/header"
 	"github.com/jakewins/reactivesocket-go/pkg/internal/frame"
+	"io"
+	"math"
 	"testing"
 )
 
@@ -29,3 +35,143 @@ func TestDecodeFrame(t *testing.T) {
 
 	}
 }
+
+func TestReleasingMoreThanRetainedPanics(t *testing.T) {
+	f := frame.Get()
+	f.Retain()
+	f.Release()
+	f.Release()
+
+	defer func() {
+		if recover() == nil {
+			t.Error("Expected over-release to panic")
+		}
+	}()
+	f.Release()
+}
+
+func TestReleaseIsNoopForUnpooledFrames(t *testing.T) {
+	f := frame.Cancel(1)
+	f.Retain()
+	f.Release()
+	f.Release()
+
+	if f.StreamID() != 1 {
+		t.Errorf("Expected unpooled frame to be left alone, found %s", f.Describe())
+	}
+}
+
+func TestDecoderRejectsMalformedLengths(t *testing.T) {
+	for _, length := range []uint32{0, 3, 4, 11, 4 + 1024 + 1, math.MaxUint32} {
+		prefix := make([]byte, 4)
+		binary.BigEndian.PutUint32(prefix, length)
+		decoder := frame.NewLimitedFrameDecoder(bytes.NewReader(prefix), 1024)
+
+		err := decoder.Read(&frame.Frame{})
+		if _, ok := err.(*frame.MalformedFrameError); !ok {
+			t.Errorf("Expected length prefix %d to be rejected, got %v", length, err)
+		}
+	}
+}
+
+func TestDecoderAcceptsFramesUpToTheLimit(t *testing.T) {
+	buffer := &bytes.Buffer{}
+	written := frame.Response(1, 0, nil, make([]byte, 1024-header.FrameHeaderLength))
+	frame.NewFrameEncoder(buffer).Write(written)
+
+	read := &frame.Frame{}
+	if err := frame.NewLimitedFrameDecoder(buffer, 1024).Read(read); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(read.Buf, written.Buf) {
+		t.Errorf("Expected %s, got %s", written.Describe(), read.Describe())
+	}
+}
+
+func TestDecoderReportsTruncatedFrame(t *testing.T) {
+	buffer := &bytes.Buffer{}
+	frame.NewFrameEncoder(buffer).Write(frame.Response(1, 0, nil, []byte{1, 2, 3}))
+	buffer.Truncate(buffer.Len() - 1)
+
+	if err := frame.NewFrameDecoder(buffer).Read(&frame.Frame{}); err != io.ErrUnexpectedEOF {
+		t.Errorf("Expected truncated frame to fail with unexpected EOF, got %v", err)
+	}
+}
+
+func FuzzFrameDecoder(f *testing.F) {
+	for _, seed := range []*frame.Frame{
+		frame.Cancel(1),
+		frame.RequestN(3, 8),
+		frame.Response(1, 0, []byte{1}, []byte{2, 3}),
+		frame.Setup(0, 60, 60, "test/test+meta", "test/test+data", nil, []byte{1}),
+	} {
+		buffer := &bytes.Buffer{}
+		frame.NewFrameEncoder(buffer).Write(seed)
+		f.Add(buffer.Bytes())
+	}
+	f.Add([]byte{0, 0, 0, 0})
+	f.Add([]byte{0xff, 0xff, 0xff, 0xff})
+
+	const maxFrameSize = 4096
+	f.Fuzz(func(t *testing.T, input []byte) {
+		decoder := frame.NewLimitedFrameDecoder(bytes.NewReader(input), maxFrameSize)
+		target := &frame.Frame{}
+		for {
+			err := decoder.Read(target)
+			if cap(target.Buf) > maxFrameSize {
+				t.Fatalf("Decoder allocated %d bytes, beyond the max frame size", cap(target.Buf))
+			}
+			if err == io.EOF {
+				return
+			}
+			if err != nil {
+				if _, ok := err.(*frame.MalformedFrameError); !ok && err != io.ErrUnexpectedEOF {
+					t.Fatalf("Unexpected error: %v", err)
+				}
+				return
+			}
+			if len(target.Buf) < header.FrameHeaderLength {
+				t.Fatalf("Decoded frame of %d bytes, shorter than a frame header", len(target.Buf))
+			}
+			target.StreamID()
+			target.Flags()
+		}
+	})
+}
+
+func BenchmarkDecodeFrame(b *testing.B) {
+	for _, size := range []int{16, 1024} {
+		b.Run(fmt.Sprintf("%dB", size), func(b *testing.B) {
+			encoded := &bytes.Buffer{}
+			frame.NewFrameEncoder(encoded).Write(frame.Response(1, 0, nil, make([]byte, size)))
+			decoder := frame.NewFrameDecoder(bufio.NewReader(&repeatingReader{buf: encoded.Bytes()}))
+
+			b.ReportAllocs()
+			b.SetBytes(int64(encoded.Len()))
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				f := frame.Get()
+				if err := decoder.Read(f); err != nil {
+					b.Fatal(err)
+				}
+				f.Release()
+			}
+		})
+	}
+}
+
+// Endlessly yields the same bytes, like a connection streaming the same frame
+type repeatingReader struct {
+	buf    []byte
+	offset int
+}
+
+func (r *repeatingReader) Read(p []byte) (int, error) {
+	n := 0
+	for n < len(p) {
+		copied := copy(p[n:], r.buf[r.offset:])
+		n += copied
+		r.offset = (r.offset + copied) % len(r.buf)
+	}
+	return n, nil
+}
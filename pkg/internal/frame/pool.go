@@ -0,0 +1,63 @@
+package frame
+
+import (
+	"os"
+	"sync"
+	"sync/atomic"
+)
+
+// Debug mode for catching use of borrowed payloads after they've been handed
+// back; set REACTIVESOCKET_POISON_PAYLOADS to turn it on. When on, released
+// frames are overwritten with PoisonByte and never reused, so anything still
+// holding on to one sees garbage (or panics decoding it) rather than silently
+// reading whatever frame happened to be read into the buffer next.
+var Poison = os.Getenv("REACTIVESOCKET_POISON_PAYLOADS") != ""
+
+const PoisonByte = 0xDE
+
+var pool = sync.Pool{
+	New: func() interface{} {
+		return &Frame{pooled: true}
+	},
+}
+
+// Get a frame from the shared pool, with a reference count of one. Every
+// Retain must be matched by a Release; once the count drops to zero the
+// frame goes back to the pool to be reused, and must not be touched again.
+// Frames that are never released are simply garbage collected.
+func Get() *Frame {
+	f := pool.Get().(*Frame)
+	f.refs = 1
+	return f
+}
+
+// Take an additional reference to this frame, keeping it from being reused
+// until a matching Release. Has no effect on frames not obtained from Get.
+func (f *Frame) Retain() {
+	if !f.pooled {
+		return
+	}
+	if atomic.AddInt32(&f.refs, 1) <= 1 {
+		panic("Frame retained after it was released back to the pool.")
+	}
+}
+
+// Drop a reference to this frame, returning it to the shared pool when it was
+// the last one. Has no effect on frames not obtained from Get.
+func (f *Frame) Release() {
+	if !f.pooled {
+		return
+	}
+	refs := atomic.AddInt32(&f.refs, -1)
+	if refs == 0 {
+		if Poison {
+			for i := range f.Buf {
+				f.Buf[i] = PoisonByte
+			}
+			return
+		}
+		pool.Put(f)
+	} else if refs < 0 {
+		panic("Frame released more times than it was retained.")
+	}
+}
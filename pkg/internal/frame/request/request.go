@@ -13,3 +13,11 @@ func InitialRequestN(f *frame.Frame) uint32 {
 func IsCompleteStream(f *frame.Frame) bool {
 	return f.Flags()&header.FlagRequestChannelComplete != 0
 }
+
+// Whether a channel frame carries a value, see response.IsNext
+func IsNext(f *frame.Frame) bool {
+	if f.Flags()&(header.FlagRequestChannelComplete|header.FlagNext) != header.FlagRequestChannelComplete {
+		return true
+	}
+	return len(f.Metadata()) > 0 || len(f.Data()) > 0
+}
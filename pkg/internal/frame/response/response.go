@@ -8,3 +8,13 @@ import (
 func IsCompleteStream(f *frame.Frame) bool {
 	return f.Flags()&header.FlagResponseComplete != 0
 }
+
+// Whether f carries a value. Frames that don't complete the stream always do;
+// completing frames do if flagged so, or if they carry a payload, which is how
+// legacy peers send a final value.
+func IsNext(f *frame.Frame) bool {
+	if f.Flags()&(header.FlagResponseComplete|header.FlagNext) != header.FlagResponseComplete {
+		return true
+	}
+	return len(f.Metadata()) > 0 || len(f.Data()) > 0
+}
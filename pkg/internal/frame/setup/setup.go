@@ -8,8 +8,11 @@ import (
 const (
 	FlagWillHonorLease       = setup.SetupFlagWillHonorLease
 	FlagStrictInterpretation = setup.SetupFlagStrictInterpretation
+	FlagResumeEnable         = setup.SetupFlagResumeEnable
 )
 
+const Version1 = setup.Version1
+
 func Flags(f *frame.Frame) uint16 {
 	return setup.Flags(f.Buf)
 }
@@ -18,6 +21,10 @@ func Version(f *frame.Frame) uint32 {
 	return setup.Version(f.Buf)
 }
 
+func ResumeToken(f *frame.Frame) []byte {
+	return setup.ResumeToken(f.Buf)
+}
+
 func KeepaliveInterval(f *frame.Frame) uint32 {
 	return setup.KeepaliveInterval(f.Buf)
 }
@@ -55,3 +55,24 @@ func TestSetupFrameEncoding(t *testing.T) {
 		t.Errorf("Expected frame length to be %d but found %d", 60, len(f.Buf))
 	}
 }
+
+func TestResumableSetupFrameEncoding(t *testing.T) {
+	token := []byte{1, 2, 3, 4}
+	f := frame.EncodeResumableSetup(&frame.Frame{}, 0, 1, 2, token, "a/b", "c/d", []byte{5}, []byte{6})
+
+	if setup.Flags(f)&setup.FlagResumeEnable == 0 {
+		t.Error("Expected frame to have the resume flag set")
+	}
+	if !bytes.Equal(setup.ResumeToken(f), token) {
+		t.Errorf("Expected resume token to be `% x` but found `% x`", token, setup.ResumeToken(f))
+	}
+	if setup.MetadataMimeType(f) != "a/b" || setup.DataMimeType(f) != "c/d" {
+		t.Errorf("Expected mime types after the token, found %s and %s", setup.MetadataMimeType(f), setup.DataMimeType(f))
+	}
+	if !bytes.Equal(f.Metadata(), []byte{5}) || !bytes.Equal(f.Data(), []byte{6}) {
+		t.Errorf("Expected payload after the mime types, found `% x` and `% x`", f.Metadata(), f.Data())
+	}
+	if setup.ResumeToken(frame.Setup(0, 1, 2, "a/b", "c/d", nil, nil)) != nil {
+		t.Error("Expected no resume token on a regular setup frame")
+	}
+}
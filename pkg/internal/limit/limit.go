@@ -0,0 +1,113 @@
+// Counting semaphores, for bounding connections and streams.
+package limit
+
+import (
+	"sync"
+	"time"
+)
+
+// Up to max slots, handed out to waiters in the order they asked once freed.
+// A nil *Limit has unlimited slots.
+type Limit struct {
+	lock    sync.Mutex
+	max     int
+	used    int
+	waiters []chan struct{}
+}
+
+// A limit of max slots; nil if max is zero
+func New(max int) *Limit {
+	if max == 0 {
+		return nil
+	}
+	return &Limit{max: max}
+}
+
+// Take a slot if one is free
+func (l *Limit) TryAcquire() bool {
+	return l.Acquire(0, nil)
+}
+
+// Take a slot, waiting up to timeout for one to free up, or until cancel
+// closes. Returns false if none was taken.
+func (l *Limit) Acquire(timeout time.Duration, cancel <-chan struct{}) bool {
+	if l == nil {
+		return true
+	}
+	l.lock.Lock()
+	if l.used < l.max && len(l.waiters) == 0 {
+		l.used++
+		l.lock.Unlock()
+		return true
+	}
+	if timeout <= 0 {
+		l.lock.Unlock()
+		return false
+	}
+	granted := make(chan struct{})
+	l.waiters = append(l.waiters, granted)
+	l.lock.Unlock()
+
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+	select {
+	case <-granted:
+		return true
+	case <-timer.C:
+	case <-cancel:
+	}
+
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	for i, w := range l.waiters {
+		if w == granted {
+			l.waiters = append(l.waiters[:i], l.waiters[i+1:]...)
+			return false
+		}
+	}
+	// Released to us as we gave up; keep it
+	return true
+}
+
+// Free a slot taken with Acquire, handing it to the longest waiter if any
+func (l *Limit) Release() {
+	if l == nil {
+		return
+	}
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	if len(l.waiters) > 0 {
+		close(l.waiters[0])
+		l.waiters = l.waiters[1:]
+		return
+	}
+	l.used--
+}
+
+// Slots taken
+func (l *Limit) InUse() int {
+	if l == nil {
+		return 0
+	}
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	return l.used
+}
+
+// Take a slot in each of limits, within timeout overall, or none at all
+func AcquireAll(limits []*Limit, timeout time.Duration, cancel <-chan struct{}) bool {
+	deadline := time.Now().Add(timeout)
+	for i, l := range limits {
+		if !l.Acquire(deadline.Sub(time.Now()), cancel) {
+			ReleaseAll(limits[:i])
+			return false
+		}
+	}
+	return true
+}
+
+func ReleaseAll(limits []*Limit) {
+	for _, l := range limits {
+		l.Release()
+	}
+}
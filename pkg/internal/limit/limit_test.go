@@ -0,0 +1,103 @@
+package limit
+
+import (
+	"testing"
+	"time"
+)
+
+func TestNilLimitIsUnlimited(t *testing.T) {
+	var l *Limit = New(0)
+	for i := 0; i < 100; i++ {
+		if !l.TryAcquire() {
+			t.Fatalf("Expected a nil limit to always have room")
+		}
+	}
+	l.Release()
+}
+
+func TestTryAcquireUpToMax(t *testing.T) {
+	l := New(2)
+	if !l.TryAcquire() || !l.TryAcquire() {
+		t.Fatalf("Expected two slots")
+	}
+	if l.TryAcquire() {
+		t.Errorf("Expected no third slot")
+	}
+	l.Release()
+	if !l.TryAcquire() {
+		t.Errorf("Expected the released slot to be free again")
+	}
+	if l.InUse() != 2 {
+		t.Errorf("Expected 2 in use, got %d", l.InUse())
+	}
+}
+
+func TestReleaseHandsSlotToWaitersInOrder(t *testing.T) {
+	l := New(1)
+	l.TryAcquire()
+
+	order := make(chan int, 2)
+	for i := 0; i < 2; i++ {
+		go func(i int) {
+			if l.Acquire(time.Minute, nil) {
+				order <- i
+			}
+		}(i)
+		awaitWaiters(t, l, i+1)
+	}
+	if l.TryAcquire() {
+		t.Fatalf("Expected waiters to go before new arrivals")
+	}
+
+	l.Release()
+	if first := <-order; first != 0 {
+		t.Errorf("Expected the first waiter to get the slot, got %d", first)
+	}
+	l.Release()
+	if second := <-order; second != 1 {
+		t.Errorf("Expected the second waiter to get the slot, got %d", second)
+	}
+}
+
+func TestAcquireGivesUpOnTimeoutOrCancel(t *testing.T) {
+	l := New(1)
+	l.TryAcquire()
+
+	if l.Acquire(time.Millisecond, nil) {
+		t.Errorf("Expected acquire to time out")
+	}
+	cancel := make(chan struct{})
+	close(cancel)
+	if l.Acquire(time.Minute, cancel) {
+		t.Errorf("Expected acquire to be cancelled")
+	}
+	if l.InUse() != 1 || len(l.waiters) != 0 {
+		t.Errorf("Expected nothing left behind, got %d in use and %d waiting", l.InUse(), len(l.waiters))
+	}
+}
+
+func TestAcquireAllRollsBackOnFailure(t *testing.T) {
+	free, full := New(1), New(1)
+	full.TryAcquire()
+
+	if AcquireAll([]*Limit{free, full}, 0, nil) {
+		t.Fatalf("Expected acquire to fail")
+	}
+	if free.InUse() != 0 {
+		t.Errorf("Expected the slot taken before failing to be released")
+	}
+}
+
+func awaitWaiters(t *testing.T, l *Limit, n int) {
+	for deadline := time.Now().Add(5 * time.Second); ; time.Sleep(time.Millisecond) {
+		l.lock.Lock()
+		waiting := len(l.waiters)
+		l.lock.Unlock()
+		if waiting == n {
+			return
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("Expected %d waiters, got %d", n, waiting)
+		}
+	}
+}
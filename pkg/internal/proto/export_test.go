@@ -0,0 +1,8 @@
+package proto
+
+// Lets tests run out of stream ids without opening billions of streams
+func SetMaxStreamId(p *Protocol, max uint32) {
+	p.lock.Lock()
+	p.maxStreamId = max
+	p.lock.Unlock()
+}
@@ -8,15 +8,26 @@ import (
 	"github.com/jakewins/reactivesocket-go/pkg/internal/frame/request"
 	"github.com/jakewins/reactivesocket-go/pkg/internal/frame/requestn"
 	"github.com/jakewins/reactivesocket-go/pkg/internal/frame/response"
+	"github.com/jakewins/reactivesocket-go/pkg/internal/limit"
 	"github.com/jakewins/reactivesocket-go/pkg/rs"
 	"sync"
-	"sync/atomic"
+	"time"
 )
 
 // Note, there are two constituents to consider in dealing with concurrency here,
 // one is the Transport side, which calls methods on Protocol.Handler.
 // The other is the Application side. The Application side is sneaky, it trickles into
 // many places; try and note entry point methods for Application goroutines.
+//
+// All stream state is guarded by Protocol.lock. The lock is only ever held while
+// reading or mutating that state, never while calling out to Application code,
+// so Application callbacks are free to call back into the protocol.
+
+// Stream ids are 31 bits on the wire
+const MaxStreamId = 1<<31 - 1
+
+// New requests fail with this while every stream id of ours is in use
+var ErrStreamIdsExhausted = rs.NewError(rs.ErrorCodeRejected, "No stream ids available, too many streams open.")
 
 type Protocol struct {
 	// This is the application-provided description of behavior;
@@ -24,29 +35,100 @@ type Protocol struct {
 	// decides what messages to send and how to handle received ones.
 	Handler *rs.RequestHandler
 
+	// Bounds on the streams the remote may have open at once, eg. on this
+	// connection and across a server; a request is only handled if all of
+	// them have room. Fire and forget requests are not counted. Set before
+	// any frames are handled.
+	StreamLimits []*limit.Limit
+	// How long requests over the limits wait for room, before being rejected
+	// with ERROR[REJECTED]. Zero rejects them straight away.
+	AdmissionTimeout time.Duration
+	// Attached to the payloads handed to Handler, and to the Publisher handed
+	// to HandleChannel, if set. Set before any frames are handled.
+	Context rs.ConnectionContext
+	// Fail the connection when the remote deviates from the protocol, as
+	// asked for with the strict interpretation SETUP flag, rather than just
+	// logging it. Set before any frames are handled.
+	Strict bool
+	// Mark an empty value that completes a response with the NEXT flag, so it
+	// can be told apart from completing without one. Only the RSocket 1.0
+	// wire format has the flag. Set before any frames are handled.
+	MarkNext bool
+	// Print frames the remote should not have sent, which are otherwise
+	// dropped quietly. Off by default, so a misbehaving remote can't flood
+	// stdout. Set before any frames are handled.
+	Trace bool
+
 	out *output
 
-	localSubscribers   map[uint32]rs.Subscriber
-	localSubscriptions map[uint32]rs.Subscription
+	// All streams with at least one open half, by stream id
+	lock    sync.Mutex
+	streams map[uint32]*stream
+	// Frames of remote requests waiting for room under StreamLimits, by
+	// stream id
+	queued map[uint32][]*frame.Frame
+	// Streams closed lately, whose late frames are dropped
+	closed *tombstones
+	// Set once the protocol is terminated; new requests fail with it
+	err error
+	// Closed once the protocol is terminated
+	done       chan struct{}
+	terminated bool
 
-	nextStreamId uint32
+	// Ids of the streams we open; guarded by lock
+	firstStreamId uint32
+	nextStreamId  uint32
+	maxStreamId   uint32
+}
+
+// Local state for a single stream. A stream has up to two halves; the inbound
+// half delivers frames from the remote to a local Subscriber, the outbound half
+// sends what a local Subscription produces to the remote. Request/Response and
+// streams have one half on each side, channels have both. Once both halves
+// have terminated, the stream is forgotten. Fields are guarded by Protocol.lock.
+type stream struct {
+	id           uint32
+	subscriber   rs.Subscriber
+	subscription rs.Subscription
+	inbound      bool
+	outbound     bool
+	// Opened by the remote, holding a slot in each of Protocol.StreamLimits
+	limited bool
+	// Payloads the subscriber of the inbound half asked for and is yet to
+	// get; from maxDemand on, there is no bound
+	demand int64
 }
 
 func NewProtocol(h *rs.RequestHandler, firstStreamId uint32, send func(*frame.Frame) error) *Protocol {
 	if h == nil {
 		panic("Cannot create protocol instance with a nil RequestHandler, please provice a non-nil handler.")
 	}
-	return &Protocol{
-		Handler:            h,
-		out:                &output{send: send, f: &frame.Frame{}},
-		localSubscribers:   make(map[uint32]rs.Subscriber),
-		localSubscriptions: make(map[uint32]rs.Subscription),
-		nextStreamId:       firstStreamId,
+	p := &Protocol{
+		Handler:       h,
+		out:           &output{send: send},
+		streams:       make(map[uint32]*stream),
+		queued:        make(map[uint32][]*frame.Frame),
+		closed:        newTombstones(maxTombstones),
+		done:          make(chan struct{}),
+		firstStreamId: firstStreamId,
+		nextStreamId:  firstStreamId,
+		maxStreamId:   MaxStreamId,
 	}
+	p.out.failed = p.sendFailed
+	return p
 }
 
-// This method is not goroutine safe
+// This method must only be called by one goroutine at a time, the Transport
+// reading frames off the connection. It is safe to call concurrently with
+// Application calls into the protocol.
 func (p *Protocol) HandleFrame(f *frame.Frame) {
+	if !p.validate(f) || p.enqueue(f) || (p.isNewRemoteRequest(f) && !p.admit(f)) {
+		return
+	}
+	p.dispatch(f)
+}
+
+func (p *Protocol) dispatch(f *frame.Frame) {
 	switch f.Type() {
 	case header.FTRequestChannel:
 		p.handleRequestChannel(f)
@@ -61,9 +143,9 @@ func (p *Protocol) HandleFrame(f *frame.Frame) {
 	case header.FTRequestResponse:
 		p.handleRequestResponse(f)
 	case header.FTRequestSubscription:
-		p.handleRequestStream(f, p.Handler.HandleRequestSubscription(f))
+		p.handleRequestStream(f, p.Handler.HandleRequestSubscription)
 	case header.FTRequestStream:
-		p.handleRequestStream(f, p.Handler.HandleRequestStream(f))
+		p.handleRequestStream(f, p.Handler.HandleRequestStream)
 	case header.FTMetadataPush:
 		p.handleMetadataPush(f)
 	case header.FTError:
@@ -74,70 +156,152 @@ func (p *Protocol) HandleFrame(f *frame.Frame) {
 		panic(fmt.Sprintf("Unknown frame: %s", f.Describe()))
 	}
 }
+
+// Terminate all streams, signalling err to local subscribers and cancelling
+// local subscriptions. All stream state is released, and requests made after
+// this fail with the err given on the first call.
 func (p *Protocol) Terminate(err error) {
-	for streamId, s := range p.localSubscribers {
-		s.OnError(err)
-		delete(p.localSubscribers, streamId)
+	var subscriptions []rs.Subscription
+	var subscribers []rs.Subscriber
+
+	p.lock.Lock()
+	if p.err == nil {
+		p.err = err
+	}
+	if !p.terminated {
+		p.terminated = true
+		close(p.done)
 	}
-	for streamId, s := range p.localSubscriptions {
+	for streamId, frames := range p.queued {
+		delete(p.queued, streamId)
+		for _, f := range frames {
+			f.Release()
+		}
+	}
+	for streamId, s := range p.streams {
+		delete(p.streams, streamId)
+		if s.limited {
+			limit.ReleaseAll(p.StreamLimits)
+		}
+		if s.outbound && s.subscription != nil {
+			subscriptions = append(subscriptions, s.subscription)
+		}
+		if s.inbound && s.subscriber != nil {
+			subscribers = append(subscribers, s.subscriber)
+		}
+		s.inbound, s.outbound = false, false
+	}
+	p.lock.Unlock()
+
+	for _, s := range subscriptions {
 		s.Cancel()
-		delete(p.localSubscriptions, streamId)
 	}
+	for _, s := range subscribers {
+		s.OnError(err)
+	}
+}
+
+// Closed once the protocol is terminated
+func (p *Protocol) Done() <-chan struct{} {
+	return p.done
+}
+
+// The error the protocol was terminated with, nil while it is running
+func (p *Protocol) Err() error {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	return p.err
+}
+
+// Number of streams this protocol currently holds state for.
+func (p *Protocol) ActiveStreams() int {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	return len(p.streams)
 }
 
 func (p *Protocol) FireAndForget(initial rs.Payload) rs.Publisher {
-	streamId := p.generateStreamId()
+	p.lock.Lock()
+	err := p.err
+	var streamId uint32
+	if err == nil {
+		streamId, err = p.generateStreamId()
+	}
+	p.lock.Unlock()
+	if err != nil {
+		return rs.NewErrorPublisher(err)
+	}
 	p.out.sendRequest(streamId, header.FTFireAndForget, initial)
 	return rs.NewEmptyPublisher()
 }
 func (p *Protocol) RequestStream(initial rs.Payload) rs.Publisher {
-	streamId := p.generateStreamId()
+	s := &stream{inbound: true}
 	initial = rs.CopyPayload(initial)
-	return p.createPublisherForRemoteStream(streamId, func(n int, sub rs.Subscriber) int {
-		p.out.sendRequestWithInitialN(streamId, uint32(n), header.FTRequestStream, initial)
+	return p.createPublisherForRemoteStream(s, true, func(n int, sub rs.Subscriber) int {
+		p.out.sendRequestWithInitialN(s.id, uint32(n), header.FTRequestStream, initial)
 		return 0
 	})
 }
 func (p *Protocol) RequestSubscription(initial rs.Payload) rs.Publisher {
-	streamId := p.generateStreamId()
+	s := &stream{inbound: true}
 	initial = rs.CopyPayload(initial)
-	return p.createPublisherForRemoteStream(streamId, func(n int, sub rs.Subscriber) int {
-		p.out.sendRequestWithInitialN(streamId, uint32(n), header.FTRequestSubscription, initial)
+	return p.createPublisherForRemoteStream(s, true, func(n int, sub rs.Subscriber) int {
+		p.out.sendRequestWithInitialN(s.id, uint32(n), header.FTRequestSubscription, initial)
 		return 0
 	})
 }
 func (p *Protocol) RequestResponse(initial rs.Payload) rs.Publisher {
-	streamId := p.generateStreamId()
+	s := &stream{inbound: true}
 	initial = rs.CopyPayload(initial)
-	return p.createPublisherForRemoteStream(streamId, func(n int, sub rs.Subscriber) int {
-		p.out.sendRequest(streamId, header.FTRequestResponse, initial)
+	return p.createPublisherForRemoteStream(s, true, func(n int, sub rs.Subscriber) int {
+		p.out.sendRequest(s.id, header.FTRequestResponse, initial)
 		return 0
 	})
 }
 func (p *Protocol) RequestChannel(payloads rs.Publisher) rs.Publisher {
-	streamId := p.generateStreamId()
-	return p.createPublisherForRemoteStream(streamId, func(n int, sub rs.Subscriber) int {
+	s := &stream{inbound: true, outbound: true}
+	return p.createPublisherForRemoteStream(s, true, func(n int, sub rs.Subscriber) int {
 		payloads.Subscribe(&requesterRemoteSubscriber{
-			streamId:           streamId,
-			localSubscriptions: p.localSubscriptions,
-			out:                p.out,
-			initialRequestN:    uint32(n),
-			isFirstPayload:     true,
+			p:               p,
+			stream:          s,
+			initialRequestN: uint32(n),
+			isFirstPayload:  true,
 		})
 		return 0
 	})
 }
-func (p *Protocol) generateStreamId() uint32 {
-	for {
-		candidate := p.nextStreamId
-		if atomic.CompareAndSwapUint32(&p.nextStreamId, candidate, candidate+2) {
-			return candidate
+
+// The next of our stream ids not in use. Ids wrap around to the first once
+// past maxStreamId, skipping those of streams still open, and those of
+// streams closed lately unless there is nothing else. Must hold lock.
+func (p *Protocol) generateStreamId() (uint32, error) {
+	var fallback uint32
+	ids := (p.maxStreamId-p.firstStreamId)/2 + 1
+	for i := uint32(0); i < ids; i++ {
+		id := p.nextStreamId
+		p.nextStreamId += 2
+		if p.nextStreamId > p.maxStreamId {
+			p.nextStreamId = p.firstStreamId
+		}
+		if p.streams[id] != nil {
+			continue
+		}
+		if !p.closed.has(id) {
+			return id, nil
+		}
+		if fallback == 0 {
+			fallback = id
 		}
 	}
+	if fallback != 0 {
+		p.closed.remove(fallback)
+		return fallback, nil
+	}
+	return 0, ErrStreamIdsExhausted
 }
 
 func (p *Protocol) handleFireAndForget(f *frame.Frame) {
-	p.Handler.HandleFireAndForget(f)
+	p.Handler.HandleFireAndForget(p.withContext(f))
 }
 func (p *Protocol) handleKeepAlive(f *frame.Frame) {
 	if f.Flags()&header.FlagKeepaliveRespond != 0 {
@@ -145,293 +309,733 @@ func (p *Protocol) handleKeepAlive(f *frame.Frame) {
 	}
 }
 func (p *Protocol) handleResponse(f *frame.Frame) {
-	var s = p.localSubscribers[f.StreamID()]
+	var s = p.lookup(f.StreamID())
 	if s == nil {
-		// TODO: need to sort out protocol deal here
+		p.handleUnknownStream(f)
 		return
 	}
+	if response.IsNext(f) {
+		if sub := p.inboundSubscriber(s); sub != nil && p.takeDemand(s, f) {
+			sub.OnNext(f)
+		}
+	}
 	if response.IsCompleteStream(f) {
-		s.OnComplete()
-		delete(p.localSubscribers, f.StreamID())
-	} else {
-		s.OnNext(f)
+		if sub := p.closeInbound(s); sub != nil {
+			sub.OnComplete()
+		}
 	}
 }
 func (p *Protocol) handleRequestN(f *frame.Frame) {
-	var s = p.localSubscriptions[f.StreamID()]
+	var s = p.lookup(f.StreamID())
 	if s == nil {
-		// TODO: need to sort out protocol deal here
+		p.handleUnknownStream(f)
 		return
 	}
-	s.Request(int(requestn.RequestN(f)))
+	if sub := p.outboundSubscription(s); sub != nil {
+		sub.Request(int(requestn.RequestN(f)))
+	}
 }
 func (p *Protocol) handleError(f *frame.Frame) {
-	var s = p.localSubscribers[f.StreamID()]
+	err := rs.NewError(errorc.ErrorCode(f.Buf), string(f.Data()))
+	if f.StreamID() == 0 {
+		// Errors on stream 0 are about the connection as a whole, eg. the
+		// remote rejecting our setup
+		p.Terminate(err)
+		return
+	}
+	var s = p.lookup(f.StreamID())
 	if s == nil {
-		// TODO: need to sort out protocol deal here
-		fmt.Printf("%s", f.Describe())
+		p.handleUnknownStream(f)
 		return
 	}
-	s.OnError(fmt.Errorf("Error %d: %s", errorc.ErrorCode(f.Buf), string(f.Data())))
+	// An error terminates both halves of the stream
+	if sub, ok := p.closeOutbound(s); ok && sub != nil {
+		sub.Cancel()
+	}
+	if sub := p.closeInbound(s); sub != nil {
+		sub.OnError(err)
+	}
 }
 func (p *Protocol) handleCancel(f *frame.Frame) {
-	var s = p.localSubscriptions[f.StreamID()]
+	var s = p.lookup(f.StreamID())
 	if s == nil {
-		// TODO: need to sort out protocol deal here
-		fmt.Printf("%s", f.Describe())
+		p.handleUnknownStream(f)
 		return
 	}
-	s.Cancel()
+	if sub, ok := p.closeOutbound(s); ok && sub != nil {
+		sub.Cancel()
+	}
 }
 func (p *Protocol) handleMetadataPush(f *frame.Frame) {
-	p.Handler.HandleMetadataPush(f)
+	p.Handler.HandleMetadataPush(p.withContext(f))
 }
 func (p *Protocol) handleRequestResponse(f *frame.Frame) {
-	streamId := f.StreamID()
-	out := p.Handler.HandleRequestResponse(f)
+	s := p.openStream(f.StreamID(), false, true)
+	if s == nil {
+		p.refuseOpenStream(f.StreamID())
+		return
+	}
+	out := p.Handler.HandleRequestResponse(p.withContext(f))
 	out.Subscribe(&remoteRequestResponseSubscriber{
-		streamId: streamId,
-		out:      p.out,
+		p:      p,
+		stream: s,
 	})
 }
-func (p *Protocol) handleRequestStream(f *frame.Frame, pub rs.Publisher) {
+func (p *Protocol) handleRequestStream(f *frame.Frame, handle func(rs.Payload) rs.Publisher) {
 	var streamId = f.StreamID()
-	var s = p.localSubscriptions[f.StreamID()]
+	s := p.openStream(streamId, false, true)
 	if s == nil {
-		pub.Subscribe(&responderRemoteSubscriber{
-			streamId:           streamId,
-			localSubscriptions: p.localSubscriptions,
-			out:                p.out,
-		})
-		s = p.localSubscriptions[f.StreamID()]
-
-		if s == nil {
-			panic("Programming error: Provided RequestHandler#HandleXXX(..) returned a Publisher " +
-				"that did not call OnSubscribe when Subscribed to. This is not supported.")
-		}
-
-		if n := request.InitialRequestN(f); n > 0 {
-			s.Request(int(n))
-		}
+		p.refuseOpenStream(streamId)
 		return
-	} else {
-		panic(fmt.Sprintf("Protocol violation: %d is already a stream in use.", streamId))
 	}
+	p.subscribeRemote(f, s, handle(p.withContext(f)))
 }
 func (p *Protocol) handleRequestChannel(f *frame.Frame) {
 	var streamId = f.StreamID()
-	var subscription = p.localSubscriptions[streamId]
-	var subscriber = p.localSubscribers[streamId]
-	if subscriber == nil && subscription == nil {
-		firstMessage := rs.CopyPayload(f)
-		p.handleRequestStream(f, p.Handler.HandleChannel(
-			p.createPublisherForRemoteStream(streamId, func(n int, sub rs.Subscriber) int {
-				sub.OnNext(firstMessage)
+	var s = p.lookup(streamId)
+	if s == nil {
+		// Held until the application asks for it
+		s = p.openStream(streamId, true, true)
+		if s == nil {
+			p.refuseOpenStream(streamId)
+			return
+		}
+		f.Retain()
+		p.subscribeRemote(f, s, p.Handler.HandleChannel(p.withPublisherContext(
+			p.createPublisherForRemoteStream(s, false, func(n int, sub rs.Subscriber) int {
+				complete := request.IsCompleteStream(f)
+				// Within what was asked for, as that's what brought us here
+				p.takeDemand(s, f)
+				sub.OnNext(p.withContext(f))
+				f.Release()
+				if complete {
+					// The requester sent its only value along with the request
+					if sub := p.closeInbound(s); sub != nil {
+						sub.OnComplete()
+					}
+					return 0
+				}
 				return n - 1
-			})))
+			}))))
 		return
 	}
 
+	if request.IsNext(f) {
+		if sub := p.inboundSubscriber(s); sub != nil && p.takeDemand(s, f) {
+			sub.OnNext(f)
+		}
+	}
 	if request.IsCompleteStream(f) {
-		subscriber.OnComplete()
-		delete(p.localSubscribers, streamId)
-	} else {
-		subscriber.OnNext(f)
+		if sub := p.closeInbound(s); sub != nil {
+			sub.OnComplete()
+		}
 	}
 }
-func (p *Protocol) createPublisherForRemoteStream(streamId uint32, onFirstRequestN func(int, rs.Subscriber) int) rs.Publisher {
-	return rs.NewPublisher(func(s rs.Subscriber) {
-		p.localSubscribers[streamId] = s
-		s.OnSubscribe(&subscriptionToRemoteStream{
-			streamId:        streamId,
+
+// The payload of f as handed to the application
+func (p *Protocol) withContext(f *frame.Frame) rs.Payload {
+	if p.Context == nil {
+		return f
+	}
+	return rs.WithContext(f, p.Context)
+}
+
+func (p *Protocol) withPublisherContext(pub rs.Publisher) rs.Publisher {
+	if p.Context == nil {
+		return pub
+	}
+	return rs.WithPublisherContext(pub, p.Context)
+}
+
+// Subscribe the remote requester of stream s to the local publisher pub
+func (p *Protocol) subscribeRemote(f *frame.Frame, s *stream, pub rs.Publisher) {
+	pub.Subscribe(&responderRemoteSubscriber{
+		p:      p,
+		stream: s,
+	})
+
+	p.lock.Lock()
+	subscribed, sub := s.subscription != nil, s.subscription
+	if !s.outbound {
+		sub = nil
+	}
+	p.lock.Unlock()
+
+	if !subscribed {
+		panic("Programming error: Provided RequestHandler#HandleXXX(..) returned a Publisher " +
+			"that did not call OnSubscribe when Subscribed to. This is not supported.")
+	}
+
+	if n := request.InitialRequestN(f); n > 0 && sub != nil {
+		sub.Request(int(n))
+	}
+}
+
+// Pending means the remote does not yet know about this stream; it learns about
+// it when the local subscriber first requests values.
+func (p *Protocol) createPublisherForRemoteStream(s *stream, pending bool, onFirstRequestN func(int, rs.Subscriber) int) rs.Publisher {
+	return rs.NewPublisher(func(sub rs.Subscriber) {
+		p.lock.Lock()
+		err := p.err
+		if err == nil && pending {
+			// Ours; ids are given out as streams open, so no two open
+			// streams share one once ids wrap around
+			s.id, err = p.generateStreamId()
+		}
+		if err != nil {
+			p.lock.Unlock()
+			rs.NewErrorPublisher(err).Subscribe(sub)
+			return
+		}
+		s.subscriber = sub
+		if s.inbound {
+			p.streams[s.id] = s
+		}
+		p.lock.Unlock()
+		sub.OnSubscribe(&subscriptionToRemoteStream{
+			p:               p,
+			stream:          s,
+			pending:         pending,
 			onFirstRequestN: onFirstRequestN,
-			subscriber:      s,
-			out:             p.out,
 		})
 	})
 }
 
+func (p *Protocol) lookup(streamId uint32) *stream {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	return p.streams[streamId]
+}
+
+// Register a stream initiated by the remote, returns nil if the id is in use
+func (p *Protocol) openStream(streamId uint32, inbound, outbound bool) *stream {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	if p.streams[streamId] != nil {
+		return nil
+	}
+	// Streams the remote opens were admitted under the limits
+	s := &stream{id: streamId, inbound: inbound, outbound: outbound, limited: len(p.StreamLimits) > 0}
+	p.streams[streamId] = s
+	p.closed.remove(streamId)
+	return s
+}
+
+// The subscriber of the inbound half of s, or nil if there is none or the
+// half has terminated
+func (p *Protocol) inboundSubscriber(s *stream) rs.Subscriber {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	if !s.inbound {
+		return nil
+	}
+	return s.subscriber
+}
+
+// The subscription feeding the outbound half of s, or nil if there is none or
+// the half has terminated
+func (p *Protocol) outboundSubscription(s *stream) rs.Subscription {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	if !s.outbound {
+		return nil
+	}
+	return s.subscription
+}
+
+func (p *Protocol) isInboundOpen(s *stream) bool {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	return s.inbound
+}
+
+func (p *Protocol) isOutboundOpen(s *stream) bool {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	return s.outbound
+}
+
+// Terminate the inbound half of s, returning the subscriber to signal the
+// terminal event to, or nil if the half was already terminated.
+func (p *Protocol) closeInbound(s *stream) rs.Subscriber {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	if !s.inbound {
+		return nil
+	}
+	s.inbound = false
+	p.release(s)
+	return s.subscriber
+}
+
+// Terminate the outbound half of s, returning the subscription feeding it, and
+// false if the half was already terminated.
+func (p *Protocol) closeOutbound(s *stream) (rs.Subscription, bool) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	if !s.outbound {
+		return nil, false
+	}
+	s.outbound = false
+	p.release(s)
+	return s.subscription, true
+}
+
+// Terminate both halves of s because the local side failed with err; the
+// remote is told via an ERROR frame.
+func (p *Protocol) failStream(s *stream, err error) {
+	_, outbound := p.closeOutbound(s)
+	sub := p.closeInbound(s)
+	if outbound || sub != nil {
+		p.out.sendError(s.id, err)
+	}
+	if sub != nil {
+		sub.OnError(err)
+	}
+}
+
+// A frame for streamId could not be sent, eg. as the connection is gone. The
+// stream can't go on, so it fails locally; there's no telling the remote.
+func (p *Protocol) sendFailed(streamId uint32, err error) {
+	s := p.lookup(streamId)
+	if s == nil {
+		return
+	}
+	if sub, ok := p.closeOutbound(s); ok && sub != nil {
+		sub.Cancel()
+	}
+	if sub := p.closeInbound(s); sub != nil {
+		sub.OnError(err)
+	}
+}
+
+// Attach the subscription feeding the outbound half of s; if the half has
+// already terminated, the subscription is cancelled straight away.
+func (p *Protocol) attachSubscription(s *stream, sub rs.Subscription) bool {
+	p.lock.Lock()
+	s.subscription = sub
+	open := s.outbound
+	p.lock.Unlock()
+
+	if !open {
+		sub.Cancel()
+	}
+	return open
+}
+
+// Must be called with p.lock held
+func (p *Protocol) release(s *stream) {
+	if !s.inbound && !s.outbound && p.streams[s.id] == s {
+		delete(p.streams, s.id)
+		p.closed.add(s.id)
+		if s.limited {
+			limit.ReleaseAll(p.StreamLimits)
+		}
+	}
+}
+
+// Check the remote may send f on its stream, answering it if not; returns
+// false if f must not be handled any further. Frames arriving once the
+// protocol is terminated are dropped.
+func (p *Protocol) validate(f *frame.Frame) bool {
+	if !p.conforms(f) {
+		return false
+	}
+	streamId := f.StreamID()
+	switch f.Type() {
+	case header.FTKeepAlive, header.FTMetadataPush:
+		if streamId != 0 {
+			p.failConnection(fmt.Sprintf("Expected %s on stream 0.", f.Describe()))
+			return false
+		}
+		return p.Err() == nil
+	case header.FTError:
+		// On stream 0 it ends the connection, otherwise just the stream
+		return p.Err() == nil
+	}
+	if streamId == 0 {
+		p.failConnection(fmt.Sprintf("Unexpected %s on stream 0.", f.Describe()))
+		return false
+	}
+
+	p.lock.Lock()
+	if p.err != nil {
+		p.lock.Unlock()
+		return false
+	}
+	s := p.streams[streamId]
+	_, queued := p.queued[streamId]
+	switch f.Type() {
+	case header.FTRequestChannel:
+		if s != nil || queued {
+			// The next payload of an open channel
+			p.lock.Unlock()
+			return streamId%2 != p.firstStreamId%2 ||
+				p.deviation(fmt.Sprintf("%s is on a stream we opened.", f.Describe()))
+		}
+		if p.closed.has(streamId) {
+			// Sent before the remote learned the channel had closed
+			p.lock.Unlock()
+			return false
+		}
+	case header.FTRequestResponse, header.FTRequestStream, header.FTRequestSubscription, header.FTFireAndForget:
+	default:
+		p.lock.Unlock()
+		return true
+	}
+	p.lock.Unlock()
+
+	// A new request
+	if streamId%2 == p.firstStreamId%2 {
+		p.rejectRequest(streamId, rs.NewError(rs.ErrorCodeInvalid,
+			fmt.Sprintf("Stream id %d is not one the remote may open.", streamId)))
+		return false
+	}
+	if s != nil || queued {
+		p.rejectRequest(streamId, rs.NewError(rs.ErrorCodeInvalid,
+			fmt.Sprintf("Stream id %d is already in use.", streamId)))
+		return false
+	}
+	if f.Flags()&header.FlagRequestChannelInitialN != 0 {
+		if n := request.InitialRequestN(f); n == 0 || n > maxDemand {
+			return p.deviation(fmt.Sprintf("%s must ask for 1 to %d payloads.", f.Describe(), maxDemand))
+		}
+	}
+	return true
+}
+
+// Refuse the request on streamId with err, ending whatever stream already
+// uses the id; the remote ends it too once it sees the error.
+func (p *Protocol) rejectRequest(streamId uint32, err *rs.Error) {
+	p.lock.Lock()
+	s := p.streams[streamId]
+	frames := p.queued[streamId]
+	delete(p.queued, streamId)
+	p.closed.add(streamId)
+	p.lock.Unlock()
+
+	for _, f := range frames {
+		f.Release()
+	}
+	p.out.sendError(streamId, err)
+	if s == nil {
+		return
+	}
+	if sub, ok := p.closeOutbound(s); ok && sub != nil {
+		sub.Cancel()
+	}
+	if sub := p.closeInbound(s); sub != nil {
+		sub.OnError(err)
+	}
+}
+
+// An admitted request whose id turned out to be in use after all
+func (p *Protocol) refuseOpenStream(streamId uint32) {
+	limit.ReleaseAll(p.StreamLimits)
+	p.rejectRequest(streamId, rs.NewError(rs.ErrorCodeInvalid,
+		fmt.Sprintf("Stream id %d is already in use.", streamId)))
+}
+
+// Deal with f, sent on a stream that isn't open. Frames for streams closed
+// lately were sent before the remote learned of the close, and are dropped;
+// anything else is for a stream that never existed.
+func (p *Protocol) handleUnknownStream(f *frame.Frame) {
+	p.lock.Lock()
+	late := p.closed.has(f.StreamID())
+	p.lock.Unlock()
+	if late {
+		return
+	}
+	switch f.Type() {
+	case header.FTError, header.FTCancel:
+		// Ending a stream that isn't there needs no answer
+		if p.Trace {
+			fmt.Printf("Ignoring %s, the stream is not open.\n", f.Describe())
+		}
+	default:
+		p.out.sendError(f.StreamID(), rs.NewError(rs.ErrorCodeInvalid,
+			fmt.Sprintf("Stream %d is not open.", f.StreamID())))
+	}
+}
+
+// End the connection, because the remote broke the protocol in a way that
+// leaves it unusable
+func (p *Protocol) failConnection(msg string) {
+	if p.Err() != nil {
+		return
+	}
+	err := rs.NewError(rs.ErrorCodeConnectionError, msg)
+	p.out.sendError(0, err)
+	p.Terminate(err)
+}
+
+// Whether f opens a stream from the remote; fire and forget doesn't count,
+// as it holds no stream state
+func (p *Protocol) isNewRemoteRequest(f *frame.Frame) bool {
+	switch f.Type() {
+	case header.FTRequestResponse, header.FTRequestStream, header.FTRequestSubscription:
+		return true
+	case header.FTRequestChannel:
+		return p.lookup(f.StreamID()) == nil
+	}
+	return false
+}
+
+// Take a slot under each stream limit for the request f, returning false if
+// it must not be dispatched now; it is then either rejected or queued.
+func (p *Protocol) admit(f *frame.Frame) bool {
+	if len(p.StreamLimits) == 0 || limit.AcquireAll(p.StreamLimits, 0, nil) {
+		return true
+	}
+	if p.AdmissionTimeout <= 0 {
+		p.out.sendError(f.StreamID(), errTooManyStreams)
+		p.lock.Lock()
+		p.closed.add(f.StreamID())
+		p.lock.Unlock()
+		return false
+	}
+	f.Retain()
+	p.lock.Lock()
+	p.queued[f.StreamID()] = []*frame.Frame{f}
+	p.lock.Unlock()
+	go p.awaitAdmission(f.StreamID())
+	return false
+}
+
+var errTooManyStreams = rs.NewError(rs.ErrorCodeRejected, "Too many concurrent streams.")
+
+// Hold f back if its stream is waiting for admission, so the stream's frames
+// are handled in order once it is admitted
+func (p *Protocol) enqueue(f *frame.Frame) bool {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	frames, ok := p.queued[f.StreamID()]
+	if !ok {
+		return false
+	}
+	f.Retain()
+	p.queued[f.StreamID()] = append(frames, f)
+	return true
+}
+
+// Wait for room for the queued request on streamId, then dispatch its frames
+// in order, or reject it if there is no room in time.
+func (p *Protocol) awaitAdmission(streamId uint32) {
+	admitted := limit.AcquireAll(p.StreamLimits, p.AdmissionTimeout, p.done)
+	for first := true; ; first = false {
+		p.lock.Lock()
+		frames, ok := p.queued[streamId]
+		if !ok {
+			// Terminated meanwhile
+			p.lock.Unlock()
+			if admitted {
+				limit.ReleaseAll(p.StreamLimits)
+			}
+			return
+		}
+		if len(frames) == 0 {
+			delete(p.queued, streamId)
+			p.lock.Unlock()
+			return
+		}
+		f := frames[0]
+		p.queued[streamId] = frames[1:]
+		p.lock.Unlock()
+
+		if admitted {
+			p.dispatch(f)
+		} else if first {
+			p.out.sendError(streamId, errTooManyStreams)
+			p.lock.Lock()
+			p.closed.add(streamId)
+			p.lock.Unlock()
+		}
+		f.Release()
+	}
+}
+
 // This is the applications subscription to the remote stream
 type subscriptionToRemoteStream struct {
-	streamId        uint32
+	p               *Protocol
+	stream          *stream
+	pending         bool
 	onFirstRequestN func(int, rs.Subscriber) int
-	subscriber      rs.Subscriber
-	out             *output
 }
 
 // Called by Application
 func (r *subscriptionToRemoteStream) Request(n int) {
+	if !r.p.isInboundOpen(r.stream) {
+		return
+	}
+	if n > 0 {
+		r.p.addDemand(r.stream, n)
+	}
 	// A bit precarious here; for efficiencies sake, the first payload
 	// in a channel is bundled with the Request to start the channel.
 	// Hence, the first req the App makes is immediately fulfilled.
 	if r.onFirstRequestN != nil {
 		onFirstRequest := r.onFirstRequestN
 		r.onFirstRequestN = nil
-		n = onFirstRequest(n, r.subscriber)
+		r.pending = false
+		n = onFirstRequest(n, r.p.inboundSubscriber(r.stream))
 	}
-	if n > 0 {
-		r.out.sendRequestN(r.streamId, uint32(n))
+	if n > 0 && r.p.isInboundOpen(r.stream) {
+		r.p.out.sendRequestN(r.stream.id, uint32(n))
 	}
 }
 
 // Called by Application
 func (r *subscriptionToRemoteStream) Cancel() {
-	r.out.sendCancel(r.streamId)
+	if r.pending {
+		// Nothing has been sent yet, so just forget the stream
+		r.p.closeOutbound(r.stream)
+		r.p.closeInbound(r.stream)
+		return
+	}
+	if r.p.closeInbound(r.stream) != nil {
+		r.p.out.sendCancel(r.stream.id)
+	}
 }
 
 // Represents the remote subscriber - sending messages to this will have them delivered over
 // the trans.
 type responderRemoteSubscriber struct {
-	streamId           uint32
-	localSubscriptions map[uint32]rs.Subscription
-	out                *output
+	p      *Protocol
+	stream *stream
 }
 
 func (s *responderRemoteSubscriber) OnSubscribe(subscription rs.Subscription) {
-	s.localSubscriptions[s.streamId] = subscription
+	s.p.attachSubscription(s.stream, subscription)
 }
 func (s *responderRemoteSubscriber) OnNext(val rs.Payload) {
-	s.out.sendResponse(s.streamId, val)
+	if s.p.isOutboundOpen(s.stream) {
+		s.p.out.sendResponse(s.stream.id, val)
+	}
 }
 func (s *responderRemoteSubscriber) OnError(err error) {
-	s.out.sendError(s.streamId, err)
-	delete(s.localSubscriptions, s.streamId)
+	s.p.failStream(s.stream, err)
 }
 func (s *responderRemoteSubscriber) OnComplete() {
-	s.out.sendResponseComplete(s.streamId)
-	delete(s.localSubscriptions, s.streamId)
+	if _, ok := s.p.closeOutbound(s.stream); ok {
+		s.p.out.sendResponseComplete(s.stream.id)
+	}
 }
 
 type requesterRemoteSubscriber struct {
-	streamId           uint32
-	localSubscriptions map[uint32]rs.Subscription
-	out                *output
-	initialRequestN    uint32
-	isFirstPayload     bool
+	p               *Protocol
+	stream          *stream
+	initialRequestN uint32
+	isFirstPayload  bool
 }
 
 func (s *requesterRemoteSubscriber) OnSubscribe(subscription rs.Subscription) {
-	s.localSubscriptions[s.streamId] = subscription
-	subscription.Request(1)
+	if s.p.attachSubscription(s.stream, subscription) {
+		subscription.Request(1)
+	}
 }
 func (s *requesterRemoteSubscriber) OnNext(val rs.Payload) {
+	if !s.p.isOutboundOpen(s.stream) {
+		return
+	}
 	if s.isFirstPayload {
 		s.isFirstPayload = false
-		s.out.sendRequestWithInitialN(s.streamId, s.initialRequestN, header.FTRequestChannel, val)
+		s.p.out.sendRequestWithInitialN(s.stream.id, s.initialRequestN, header.FTRequestChannel, val)
 	} else {
-		s.out.sendRequest(s.streamId, header.FTRequestChannel, val)
+		s.p.out.sendRequest(s.stream.id, header.FTRequestChannel, val)
 	}
 }
 func (s *requesterRemoteSubscriber) OnError(err error) {
-	s.out.sendError(s.streamId, err)
-	delete(s.localSubscriptions, s.streamId)
+	s.p.failStream(s.stream, err)
 }
 func (s *requesterRemoteSubscriber) OnComplete() {
-	s.out.sendRequestComplete(s.streamId)
-	delete(s.localSubscriptions, s.streamId)
+	if _, ok := s.p.closeOutbound(s.stream); ok {
+		s.p.out.sendRequestComplete(s.stream.id)
+	}
 }
 
 // Represents a remote request/response subscriber, waiting for its single response.
 type remoteRequestResponseSubscriber struct {
-	streamId uint32
-	out      *output
+	p      *Protocol
+	stream *stream
 }
 
 func (s *remoteRequestResponseSubscriber) OnSubscribe(subscription rs.Subscription) {
-	subscription.Request(1)
+	if s.p.attachSubscription(s.stream, subscription) {
+		subscription.Request(1)
+	}
 }
 func (s *remoteRequestResponseSubscriber) OnNext(val rs.Payload) {
-	s.out.sendResponseCompleteWithPayload(s.streamId, val)
+	if _, ok := s.p.closeOutbound(s.stream); ok {
+		s.p.out.sendResponseCompleteWithPayload(s.stream.id, val, s.p.MarkNext)
+	}
 }
 func (s *remoteRequestResponseSubscriber) OnError(err error) {
-	s.out.sendError(s.streamId, err)
+	s.p.failStream(s.stream, err)
+}
+func (s *remoteRequestResponseSubscriber) OnComplete() {
+	// Completing without a value still needs to end the stream remotely
+	if _, ok := s.p.closeOutbound(s.stream); ok {
+		s.p.out.sendResponseComplete(s.stream.id)
+	}
 }
-func (s *remoteRequestResponseSubscriber) OnComplete() {}
 
 // API to send outbound Frames. All methods on this struct can be expected to be called
-// by both Application and Transport goroutines
+// by both Application and Transport goroutines. Each frame is encoded into its own
+// pooled Frame, so there is no shared state to coordinate here.
 type output struct {
 	// Send any frame back to our remote counterpart.
-	// Memory semantics here are that as soon as this method call
-	// returns, the frame can be re-used. Any implementation of
-	// Send must copy the contents of Frame if it wishes to retain
-	// it beyond this call.
+	// Memory semantics here are that ownership of the frame passes
+	// to send; the implementation should Release it once it has been
+	// written, and must not expect it to stay valid beyond that. Send
+	// may be called concurrently.
 	send func(*frame.Frame) error
-
-	// This is to allow concurrent Application threads per connection;
-	// however, it'd be much better replaced by a ring buffer
-	lock sync.Mutex
-	f    *frame.Frame
+	// Called with the stream of a frame send failed on; the frame is dropped
+	failed func(streamId uint32, err error)
 }
 
 func (out *output) sendResponse(streamId uint32, val rs.Payload) {
-	out.lock.Lock()
-	defer out.lock.Unlock()
-	if err := out.send(frame.EncodeResponse(out.f, streamId, 0, val.Metadata(), val.Data())); err != nil {
-		panic(err.Error()) // TODO
-	}
+	out.emit(frame.EncodeResponse(frame.Get(), streamId, 0, val.Metadata(), val.Data()))
 }
 func (out *output) sendError(streamId uint32, err error) {
-	out.lock.Lock()
-	defer out.lock.Unlock()
-	if err := out.send(frame.EncodeError(out.f, streamId, errorc.ECApplicationError, nil, []byte(err.Error()))); err != nil {
-		panic(err.Error()) // TODO
+	if rsErr, ok := err.(*rs.Error); ok {
+		out.emit(frame.EncodeError(frame.Get(), streamId, rsErr.Code, nil, []byte(rsErr.Message)))
+		return
 	}
+	out.emit(frame.EncodeError(frame.Get(), streamId, errorc.ECApplicationError, nil, []byte(err.Error())))
 }
 func (out *output) sendResponseComplete(streamId uint32) {
-	out.lock.Lock()
-	defer out.lock.Unlock()
-	if err := out.send(frame.EncodeResponse(out.f, streamId, header.FlagResponseComplete, nil, nil)); err != nil {
-		panic(err.Error()) // TODO
-	}
+	out.emit(frame.EncodeResponse(frame.Get(), streamId, header.FlagResponseComplete, nil, nil))
 }
-func (out *output) sendResponseCompleteWithPayload(streamId uint32, val rs.Payload) {
-	out.lock.Lock()
-	defer out.lock.Unlock()
-	if err := out.send(frame.EncodeResponse(out.f, streamId, header.FlagResponseComplete, val.Metadata(), val.Data())); err != nil {
-		panic(err.Error()) // TODO
+func (out *output) sendResponseCompleteWithPayload(streamId uint32, val rs.Payload, markNext bool) {
+	var flags uint16 = header.FlagResponseComplete
+	if markNext && len(val.Metadata()) == 0 && len(val.Data()) == 0 {
+		// Otherwise indistinguishable from completing without a value
+		flags |= header.FlagNext
 	}
+	out.emit(frame.EncodeResponse(frame.Get(), streamId, flags, val.Metadata(), val.Data()))
 }
 func (out *output) sendRequestN(streamId, n uint32) {
-	out.lock.Lock()
-	defer out.lock.Unlock()
-	if err := out.send(frame.EncodeRequestN(out.f, streamId, n)); err != nil {
-		panic(err.Error()) // TODO
-	}
+	out.emit(frame.EncodeRequestN(frame.Get(), streamId, n))
 }
 func (out *output) sendRequest(streamId uint32, frameType uint16, val rs.Payload) {
-	out.lock.Lock()
-	defer out.lock.Unlock()
-	if err := out.send(frame.EncodeRequest(out.f, streamId, 0, frameType, val.Metadata(), val.Data())); err != nil {
-		panic(err.Error()) // TODO
-	}
+	out.emit(frame.EncodeRequest(frame.Get(), streamId, 0, frameType, val.Metadata(), val.Data()))
 }
 func (out *output) sendRequestComplete(streamId uint32) {
-	out.lock.Lock()
-	defer out.lock.Unlock()
-	if err := out.send(frame.EncodeRequest(out.f, streamId, header.FlagRequestChannelComplete,
-		header.FTRequestChannel, nil, nil)); err != nil {
-		panic(err.Error()) // TODO
-	}
+	out.emit(frame.EncodeRequest(frame.Get(), streamId, header.FlagRequestChannelComplete,
+		header.FTRequestChannel, nil, nil))
 }
 func (out *output) sendRequestWithInitialN(streamId, initialN uint32, frameType uint16, val rs.Payload) {
-	out.lock.Lock()
-	defer out.lock.Unlock()
-	if err := out.send(frame.EncodeRequestWithInitialN(out.f, streamId, initialN, 0, frameType, val.Metadata(), val.Data())); err != nil {
-		panic(err.Error()) // TODO
-	}
+	out.emit(frame.EncodeRequestWithInitialN(frame.Get(), streamId, initialN, 0, frameType, val.Metadata(), val.Data()))
 }
 func (out *output) sendCancel(streamId uint32) {
-	out.lock.Lock()
-	defer out.lock.Unlock()
-	if err := out.send(frame.EncodeCancel(out.f, streamId)); err != nil {
-		panic(err.Error()) // TODO
-	}
+	out.emit(frame.EncodeCancel(frame.Get(), streamId))
 }
 func (out *output) sendKeepAlive() {
-	out.lock.Lock()
-	defer out.lock.Unlock()
-	if err := out.send(frame.EncodeKeepalive(out.f, false)); err != nil {
-		panic(err.Error()) // TODO
+	out.emit(frame.EncodeKeepalive(frame.Get(), false))
+}
+func (out *output) emit(f *frame.Frame) {
+	streamId := f.StreamID()
+	if err := out.send(f); err != nil && out.failed != nil {
+		out.failed(streamId, err)
 	}
 }
@@ -0,0 +1,197 @@
+package proto_test
+
+import (
+	"errors"
+	"github.com/jakewins/reactivesocket-go/pkg/internal/frame"
+	"github.com/jakewins/reactivesocket-go/pkg/internal/proto"
+	"github.com/jakewins/reactivesocket-go/pkg/rs"
+	"sync"
+	"testing"
+	"time"
+)
+
+// These are meant to be run with `go test -race`; they hammer a pair of
+// connected protocols from many application goroutines at once.
+
+func TestConcurrentRequestsCancelsAndResponses(t *testing.T) {
+	client, server := connectedPair(&rs.RequestHandler{
+		HandleRequestStream:   func(p rs.Payload) rs.Publisher { return sequencer(0, infinity)() },
+		HandleRequestResponse: requestResponseSuccess(1),
+		HandleChannel: func(in rs.Publisher) rs.Publisher {
+			blackhole(4, 1000)(in)
+			return countdown(16)
+		},
+	})
+	defer client.close()
+	defer server.close()
+
+	var workers, iterations = 16, 200
+	if testing.Short() {
+		iterations = 20
+	}
+
+	var wg sync.WaitGroup
+	for w := 0; w < workers; w++ {
+		wg.Add(1)
+		go func(w int) {
+			defer wg.Done()
+			for i := 0; i < iterations; i++ {
+				switch (w + i) % 3 {
+				case 0:
+					// Cancel while responses may be in flight on the transport goroutine
+					client.p.RequestStream(rs.NewPayload(nil, []byte{1})).Subscribe(rs.NewSubscriber(func(s rs.Subscription) {
+						s.Request(32)
+						s.Cancel()
+					}, nil, nil, nil))
+				case 1:
+					awaitTerminal(t, client.p.RequestResponse(rs.NewPayload(nil, []byte{2})))
+				case 2:
+					client.p.RequestChannel(countdown(8)).Subscribe(rs.NewSubscriber(func(s rs.Subscription) {
+						s.Request(4)
+						s.Cancel()
+					}, nil, nil, nil))
+				}
+			}
+		}(w)
+	}
+	wg.Wait()
+
+	awaitNoActiveStreams(t, "client", client.p)
+}
+
+func TestConcurrentTerminateWhileRequesting(t *testing.T) {
+	client, server := connectedPair(&rs.RequestHandler{
+		HandleRequestStream: func(p rs.Payload) rs.Publisher { return sequencer(0, infinity)() },
+	})
+	defer client.close()
+	defer server.close()
+
+	var wg sync.WaitGroup
+	for w := 0; w < 8; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := 0; i < 100; i++ {
+				client.p.RequestStream(rs.NewPayload(nil, nil)).Subscribe(rs.NewSubscriber(func(s rs.Subscription) {
+					s.Request(2)
+				}, nil, func(err error) {}, nil))
+			}
+		}()
+	}
+	for i := 0; i < 10; i++ {
+		client.p.Terminate(errTerminated)
+		server.p.Terminate(errTerminated)
+	}
+	wg.Wait()
+}
+
+var errTerminated = errors.New("terminated")
+
+// Publisher emitting n values and then completing; unlike sequencer, it is
+// safe to drive from different goroutines.
+func countdown(n int) rs.Publisher {
+	return rs.NewPublisher(func(s rs.Subscriber) {
+		var lock sync.Mutex
+		var remaining, done = n, false
+		s.OnSubscribe(rs.NewSubscription(func(requested int) {
+			lock.Lock()
+			defer lock.Unlock()
+			for ; requested > 0 && remaining > 0; requested-- {
+				remaining--
+				s.OnNext(rs.NewPayload(nil, []byte{byte(remaining)}))
+			}
+			if remaining == 0 && !done {
+				done = true
+				s.OnComplete()
+			}
+		}, func() {
+			lock.Lock()
+			defer lock.Unlock()
+			done = true
+		}))
+	})
+}
+
+func awaitTerminal(t *testing.T, pub rs.Publisher) {
+	done := make(chan struct{})
+	pub.Subscribe(rs.NewSubscriber(func(s rs.Subscription) {
+		s.Request(1)
+	}, nil, func(err error) {
+		close(done)
+	}, func() {
+		close(done)
+	}))
+	select {
+	case <-done:
+	case <-time.After(10 * time.Second):
+		t.Fatal("Timed out waiting for request to terminate")
+	}
+}
+
+func awaitNoActiveStreams(t *testing.T, name string, p *proto.Protocol) {
+	deadline := time.Now().Add(10 * time.Second)
+	for p.ActiveStreams() > 0 {
+		if time.Now().After(deadline) {
+			t.Fatalf("Expected %s to release all streams, %d remain", name, p.ActiveStreams())
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+// One side of an in-memory connection; frames sent by the other side are
+// queued without bound and handed to p by a single transport goroutine.
+type peer struct {
+	p      *proto.Protocol
+	lock   sync.Mutex
+	cond   *sync.Cond
+	queue  []*frame.Frame
+	closed bool
+}
+
+func connectedPair(serverHandler *rs.RequestHandler) (*peer, *peer) {
+	client, server := newPeer(), newPeer()
+	client.p = proto.NewProtocol(noopHandler, 1, server.deliver)
+	server.p = proto.NewProtocol(serverHandler, 2, client.deliver)
+	go client.serve()
+	go server.serve()
+	return client, server
+}
+
+func newPeer() *peer {
+	p := &peer{}
+	p.cond = sync.NewCond(&p.lock)
+	return p
+}
+
+func (p *peer) deliver(f *frame.Frame) error {
+	p.lock.Lock()
+	p.queue = append(p.queue, f.Copy(nil))
+	p.lock.Unlock()
+	p.cond.Signal()
+	return nil
+}
+
+func (p *peer) serve() {
+	for {
+		p.lock.Lock()
+		for len(p.queue) == 0 && !p.closed {
+			p.cond.Wait()
+		}
+		if p.closed {
+			p.lock.Unlock()
+			return
+		}
+		f := p.queue[0]
+		p.queue = p.queue[1:]
+		p.lock.Unlock()
+
+		p.p.HandleFrame(f)
+	}
+}
+
+func (p *peer) close() {
+	p.lock.Lock()
+	p.closed = true
+	p.lock.Unlock()
+	p.cond.Broadcast()
+}
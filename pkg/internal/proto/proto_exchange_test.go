@@ -58,14 +58,14 @@ var scenarios = []scenario{
 			HandleChannel: channelFactory(blackhole(2, 1000), sequencer(0, infinity)),
 		}, nil, exchanges{
 			exchange{
-				in{frame.Request(1337, 0, header.FTRequestChannel, nil, nil)},
-				out{frame.RequestN(1337, 1)}, // NOTE: First Payload is bundled in the request, so just 1 here
+				in{frame.Request(1338, 0, header.FTRequestChannel, nil, nil)},
+				out{frame.RequestN(1338, 1)}, // NOTE: First Payload is bundled in the request, so just 1 here
 			},
 			exchange{
 				in{ // Our stub client fulfills the request
-					frame.Request(1337, 0, header.FTRequestChannel, nil, nil)},
+					frame.Request(1338, 0, header.FTRequestChannel, nil, nil)},
 				out{ // Server should have seen them, and blackhole will req 2 more
-					frame.RequestN(1337, 2)},
+					frame.RequestN(1338, 2)},
 			},
 		},
 	},
@@ -74,11 +74,11 @@ var scenarios = []scenario{
 			HandleChannel: channelFactory(wall, sequencer(0, infinity)),
 		}, nil, exchanges{
 			exchange{
-				in{frame.Request(1337, 0, header.FTRequestChannel, nil, nil),
-					frame.RequestN(1337, 2)},
+				in{frame.Request(1338, 0, header.FTRequestChannel, nil, nil),
+					frame.RequestN(1338, 2)},
 				out{ // Our sequencer should immediately yield the two requested values:
-					frame.Response(1337, 0, nil, []byte{0, 0, 0, 0}),
-					frame.Response(1337, 0, nil, []byte{0, 0, 0, 1})},
+					frame.Response(1338, 0, nil, []byte{0, 0, 0, 0}),
+					frame.Response(1338, 0, nil, []byte{0, 0, 0, 1})},
 			},
 		},
 	},
@@ -87,7 +87,7 @@ var scenarios = []scenario{
 			HandleFireAndForget: fireAndForgetSuccess,
 		}, nil, exchanges{
 			exchange{
-				in{frame.Request(1337, 0, header.FTFireAndForget, nil, nil)},
+				in{frame.Request(1338, 0, header.FTFireAndForget, nil, nil)},
 				out{},
 			},
 		},
@@ -97,8 +97,8 @@ var scenarios = []scenario{
 			HandleRequestResponse: requestResponseSuccess(1),
 		}, nil, exchanges{
 			exchange{
-				in{frame.Request(1337, 0, header.FTRequestResponse, nil, nil)},
-				out{frame.Response(1337, header.FlagResponseComplete, nil, []byte{0, 0, 0, 1})},
+				in{frame.Request(1338, 0, header.FTRequestResponse, nil, nil)},
+				out{frame.Response(1338, header.FlagResponseComplete, nil, []byte{0, 0, 0, 1})},
 			},
 		},
 	},
@@ -107,7 +107,7 @@ var scenarios = []scenario{
 			HandleMetadataPush: func(p rs.Payload) {},
 		}, nil, exchanges{
 			exchange{
-				in{frame.Request(1337, 0, header.FTMetadataPush, nil, nil)},
+				in{frame.Request(0, 0, header.FTMetadataPush, nil, nil)},
 				out{},
 			},
 		},
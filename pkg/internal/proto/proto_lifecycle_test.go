@@ -0,0 +1,162 @@
+package proto_test
+
+import (
+	"errors"
+	"github.com/jakewins/reactivesocket-go/pkg/internal/codec/errorc"
+	"github.com/jakewins/reactivesocket-go/pkg/internal/codec/header"
+	"github.com/jakewins/reactivesocket-go/pkg/internal/frame"
+	"github.com/jakewins/reactivesocket-go/pkg/internal/proto"
+	"github.com/jakewins/reactivesocket-go/pkg/rs"
+	"testing"
+)
+
+func discard(f *frame.Frame) error {
+	return nil
+}
+
+func streamCount(t *testing.T) int {
+	if testing.Short() {
+		return 10000
+	}
+	return 1000000
+}
+
+func TestCancelledRequesterStreamsAreReleased(t *testing.T) {
+	p := proto.NewProtocol(noopHandler, 1, discard)
+	payload := rs.NewPayload(nil, []byte{1})
+
+	for i := 0; i < streamCount(t); i++ {
+		p.RequestStream(payload).Subscribe(rs.NewSubscriber(func(s rs.Subscription) {
+			s.Request(8)
+			s.Cancel()
+		}, nil, nil, nil))
+	}
+
+	if n := p.ActiveStreams(); n != 0 {
+		t.Errorf("Expected all cancelled streams to be released, found %d", n)
+	}
+}
+
+func TestCancelledResponderStreamsAreReleased(t *testing.T) {
+	p := proto.NewProtocol(&rs.RequestHandler{
+		HandleRequestStream: func(p rs.Payload) rs.Publisher {
+			return sequencer(0, infinity)()
+		},
+	}, 2, discard)
+
+	for i := 0; i < streamCount(t); i++ {
+		streamId := uint32(2*i + 1)
+		p.HandleFrame(frame.RequestWithInitialN(streamId, 1, 0, header.FTRequestStream, nil, nil))
+		p.HandleFrame(frame.Cancel(streamId))
+	}
+
+	if n := p.ActiveStreams(); n != 0 {
+		t.Errorf("Expected all cancelled streams to be released, found %d", n)
+	}
+}
+
+func TestRequestResponseStreamsAreReleased(t *testing.T) {
+	responder := proto.NewProtocol(&rs.RequestHandler{
+		HandleRequestResponse: requestResponseSuccess(1),
+	}, 2, discard)
+	requester := proto.NewProtocol(noopHandler, 1, discard)
+
+	responder.HandleFrame(frame.Request(1, 0, header.FTRequestResponse, nil, nil))
+	blackhole(1, 1000)(requester.RequestResponse(rs.NewPayload(nil, nil)))
+	requester.HandleFrame(frame.Response(1, header.FlagResponseComplete, nil, []byte{1}))
+
+	if n := responder.ActiveStreams(); n != 0 {
+		t.Errorf("Expected responder to have released the stream, found %d", n)
+	}
+	if n := requester.ActiveStreams(); n != 0 {
+		t.Errorf("Expected requester to have released the stream, found %d", n)
+	}
+}
+
+func TestChannelIsReleasedOnlyOnceBothHalvesTerminate(t *testing.T) {
+	p := proto.NewProtocol(&rs.RequestHandler{
+		HandleChannel: channelFactory(blackhole(1, 1000), sequencer(0, infinity)),
+	}, 2, discard)
+
+	p.HandleFrame(frame.RequestWithInitialN(1, 1, 0, header.FTRequestChannel, nil, nil))
+	p.HandleFrame(frame.Request(1, header.FlagRequestChannelComplete, header.FTRequestChannel, nil, nil))
+
+	if n := p.ActiveStreams(); n != 1 {
+		t.Errorf("Expected the outbound half to keep the channel alive, found %d streams", n)
+	}
+
+	p.HandleFrame(frame.Cancel(1))
+
+	if n := p.ActiveStreams(); n != 0 {
+		t.Errorf("Expected the channel to be released, found %d streams", n)
+	}
+}
+
+func TestErrorReleasesBothHalvesOfChannel(t *testing.T) {
+	p := proto.NewProtocol(noopHandler, 1, discard)
+	var failed error
+
+	p.RequestChannel(sequencer(0, infinity)()).Subscribe(rs.NewSubscriber(func(s rs.Subscription) {
+		s.Request(1)
+	}, nil, func(err error) {
+		failed = err
+	}, nil))
+	p.HandleFrame(frame.Error(1, errorc.ECApplicationError, nil, []byte("boom")))
+
+	if failed == nil {
+		t.Error("Expected subscriber to be signalled the error")
+	}
+	if n := p.ActiveStreams(); n != 0 {
+		t.Errorf("Expected the channel to be released, found %d streams", n)
+	}
+}
+
+func TestConnectionErrorFailsStreamsAndLaterRequests(t *testing.T) {
+	p := proto.NewProtocol(noopHandler, 1, discard)
+	var errs []error
+	request := func() {
+		p.RequestStream(rs.NewPayload(nil, nil)).Subscribe(rs.NewSubscriber(func(s rs.Subscription) {
+			s.Request(1)
+		}, nil, func(err error) {
+			errs = append(errs, err)
+		}, nil))
+	}
+
+	request()
+	p.HandleFrame(frame.Error(0, errorc.ECRejectedSetup, nil, []byte("go away")))
+	request()
+
+	if len(errs) != 2 {
+		t.Fatalf("Expected both requests to fail, got %v", errs)
+	}
+	for _, err := range errs {
+		if rsErr, ok := err.(*rs.Error); !ok || rsErr.Code != rs.ErrorCodeRejectedSetup || rsErr.Message != "go away" {
+			t.Errorf("Expected the setup rejection, got %v", err)
+		}
+	}
+	if n := p.ActiveStreams(); n != 0 {
+		t.Errorf("Expected all streams to be released, found %d", n)
+	}
+}
+
+func TestStreamsFailWhenFramesCannotBeSent(t *testing.T) {
+	gone := errors.New("Connection is gone")
+	p := proto.NewProtocol(noopHandler, 1, func(f *frame.Frame) error {
+		f.Release()
+		return gone
+	})
+
+	var failed error
+	p.RequestStream(rs.NewPayload(nil, nil)).Subscribe(rs.NewSubscriber(func(s rs.Subscription) {
+		s.Request(1)
+	}, nil, func(err error) {
+		failed = err
+	}, nil))
+
+	if failed != gone {
+		t.Errorf("Expected the stream to fail with the send error, got %v", failed)
+	}
+	if n := p.ActiveStreams(); n != 0 {
+		t.Errorf("Expected the failed stream to be released, found %d", n)
+	}
+}
@@ -0,0 +1,139 @@
+package proto_test
+
+import (
+	"errors"
+	"github.com/jakewins/reactivesocket-go/pkg/internal/codec/errorc"
+	"github.com/jakewins/reactivesocket-go/pkg/internal/codec/header"
+	"github.com/jakewins/reactivesocket-go/pkg/internal/frame"
+	"github.com/jakewins/reactivesocket-go/pkg/internal/limit"
+	"github.com/jakewins/reactivesocket-go/pkg/internal/proto"
+	"github.com/jakewins/reactivesocket-go/pkg/rs"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestStreamsOverLimitAreRejected(t *testing.T) {
+	sent := &sentFrames{}
+	p := limitedProtocol(sent, 0)
+
+	p.HandleFrame(frame.RequestWithInitialN(1, 1, 0, header.FTRequestStream, nil, nil))
+	p.HandleFrame(frame.RequestWithInitialN(3, 1, 0, header.FTRequestStream, nil, nil))
+	sent.await(t, 3, header.FTError)
+	if code := errorc.ErrorCode(sent.last(3).Buf); code != errorc.ECRejected {
+		t.Errorf("Expected the stream over the limit to be rejected, got error code %d", code)
+	}
+
+	// Fire and forget doesn't count
+	p.HandleFrame(frame.Request(5, 0, header.FTFireAndForget, nil, nil))
+
+	// Once the first ends, there is room again
+	p.HandleFrame(frame.Cancel(1))
+	p.HandleFrame(frame.RequestWithInitialN(7, 1, 0, header.FTRequestStream, nil, nil))
+	sent.await(t, 7, header.FTResponse)
+}
+
+func TestQueuedStreamsAreAdmittedInOrder(t *testing.T) {
+	sent := &sentFrames{}
+	p := limitedProtocol(sent, 5*time.Second)
+
+	p.HandleFrame(frame.RequestWithInitialN(1, 1, 0, header.FTRequestStream, nil, nil))
+	p.HandleFrame(frame.RequestWithInitialN(3, 1, 0, header.FTRequestStream, nil, nil))
+	p.HandleFrame(frame.RequestN(3, 2))
+	if n := sent.count(3); n != 0 {
+		t.Fatalf("Expected the queued stream to wait, got %d frames", n)
+	}
+
+	p.HandleFrame(frame.Cancel(1))
+	for deadline := time.Now().Add(5 * time.Second); sent.count(3) < 3; time.Sleep(time.Millisecond) {
+		if time.Now().After(deadline) {
+			t.Fatalf("Expected the queued stream to get its initial and later demand, got %d frames", sent.count(3))
+		}
+	}
+}
+
+func TestQueuedStreamsAreRejectedAfterTimeout(t *testing.T) {
+	sent := &sentFrames{}
+	p := limitedProtocol(sent, 10*time.Millisecond)
+
+	p.HandleFrame(frame.RequestWithInitialN(1, 1, 0, header.FTRequestStream, nil, nil))
+	p.HandleFrame(frame.Request(3, 0, header.FTRequestResponse, nil, nil))
+	sent.await(t, 3, header.FTError)
+}
+
+func TestTerminateReleasesStreamSlots(t *testing.T) {
+	sent := &sentFrames{}
+	server := limit.New(10)
+	p := limitedProtocol(sent, time.Hour)
+	p.StreamLimits = append(p.StreamLimits, server)
+
+	p.HandleFrame(frame.RequestWithInitialN(1, 1, 0, header.FTRequestStream, nil, nil))
+	p.HandleFrame(frame.RequestWithInitialN(3, 1, 0, header.FTRequestStream, nil, nil))
+	p.Terminate(errors.New("Connection reset"))
+
+	for deadline := time.Now().Add(5 * time.Second); server.InUse() != 0; time.Sleep(time.Millisecond) {
+		if time.Now().After(deadline) {
+			t.Fatalf("Expected all slots to be released, %d in use", server.InUse())
+		}
+	}
+}
+
+// Allows one stream at a time, answering each request with an endless stream
+func limitedProtocol(sent *sentFrames, timeout time.Duration) *proto.Protocol {
+	p := proto.NewProtocol(&rs.RequestHandler{
+		HandleRequestStream: func(p rs.Payload) rs.Publisher {
+			return sequencer(0, infinity)()
+		},
+		HandleRequestResponse: requestResponseSuccess(1),
+		HandleFireAndForget:   fireAndForgetSuccess,
+	}, 2, sent.record)
+	p.StreamLimits = []*limit.Limit{limit.New(1)}
+	p.AdmissionTimeout = timeout
+	return p
+}
+
+type sentFrames struct {
+	lock   sync.Mutex
+	frames []*frame.Frame
+}
+
+func (s *sentFrames) record(f *frame.Frame) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.frames = append(s.frames, f.Copy(nil))
+	return nil
+}
+
+func (s *sentFrames) count(streamId uint32) int {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	n := 0
+	for _, f := range s.frames {
+		if f.StreamID() == streamId {
+			n++
+		}
+	}
+	return n
+}
+
+func (s *sentFrames) last(streamId uint32) *frame.Frame {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	for i := len(s.frames) - 1; i >= 0; i-- {
+		if s.frames[i].StreamID() == streamId {
+			return s.frames[i]
+		}
+	}
+	return nil
+}
+
+func (s *sentFrames) await(t *testing.T, streamId uint32, frameType uint16) {
+	for deadline := time.Now().Add(5 * time.Second); ; time.Sleep(time.Millisecond) {
+		if f := s.last(streamId); f != nil && f.Type() == frameType {
+			return
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("Expected a frame of type %d on stream %d", frameType, streamId)
+		}
+	}
+}
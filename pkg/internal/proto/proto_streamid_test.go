@@ -0,0 +1,128 @@
+package proto_test
+
+import (
+	"github.com/jakewins/reactivesocket-go/pkg/internal/codec/errorc"
+	"github.com/jakewins/reactivesocket-go/pkg/internal/codec/header"
+	"github.com/jakewins/reactivesocket-go/pkg/internal/frame"
+	"github.com/jakewins/reactivesocket-go/pkg/internal/proto"
+	"github.com/jakewins/reactivesocket-go/pkg/rs"
+	"testing"
+)
+
+func TestStreamIdsWrapAroundSkippingOpenStreams(t *testing.T) {
+	sent := &sentFrames{}
+	p := proto.NewProtocol(&rs.RequestHandler{}, 1, sent.record)
+	proto.SetMaxStreamId(p, 7)
+
+	// Ids 1, 3, 5 and 7 are all there is
+	subscriptions := make([]rs.Subscription, 0, 4)
+	for _, id := range []uint32{1, 3, 5, 7} {
+		subscriptions = append(subscriptions, requestStream(p, nil))
+		if sent.count(id) != 1 || sent.last(id).Type() != header.FTRequestStream {
+			t.Fatalf("Expected a request on stream %d", id)
+		}
+	}
+
+	var err error
+	requestStream(p, &err)
+	if err != proto.ErrStreamIdsExhausted {
+		t.Fatalf("Expected requests to fail once ids run out, got %v", err)
+	}
+	if sent.count(0) != 0 || sent.count(9) != 0 {
+		t.Fatalf("Expected no ids past the max, nor zero")
+	}
+
+	// Once stream 3 ends, its id is free again; 1 is still in use
+	subscriptions[1].Cancel()
+	requestStream(p, &err)
+	if f := sent.last(3); f == nil || f.Type() != header.FTRequestStream || sent.count(3) != 3 {
+		t.Fatalf("Expected the freed id to be reused, got %d frames on stream 3", sent.count(3))
+	}
+	if sent.count(1) != 1 {
+		t.Errorf("Expected the open stream's id to be skipped")
+	}
+}
+
+func requestStream(p *proto.Protocol, err *error) rs.Subscription {
+	var subscription rs.Subscription
+	p.RequestStream(rs.NewPayload(nil, nil)).Subscribe(rs.NewSubscriber(func(s rs.Subscription) {
+		subscription = s
+		s.Request(1)
+	}, nil, func(e error) {
+		if err != nil {
+			*err = e
+		}
+	}, nil))
+	return subscription
+}
+
+func TestRequestsOnTheWrongStreamIdsAreInvalid(t *testing.T) {
+	sent := &sentFrames{}
+	p := proto.NewProtocol(&rs.RequestHandler{
+		HandleRequestStream: func(p rs.Payload) rs.Publisher {
+			return sequencer(0, infinity)()
+		},
+	}, 2, sent.record)
+
+	// The remote opens odd streams only
+	p.HandleFrame(frame.RequestWithInitialN(4, 1, 0, header.FTRequestStream, nil, nil))
+	sent.await(t, 4, header.FTError)
+	if code := errorc.ErrorCode(sent.last(4).Buf); code != errorc.ECInvalid {
+		t.Errorf("Expected a stream id of ours to be invalid, got error code %d", code)
+	}
+
+	// Reusing an open stream's id ends both
+	p.HandleFrame(frame.RequestWithInitialN(1, 1, 0, header.FTRequestStream, nil, nil))
+	sent.await(t, 1, header.FTResponse)
+	p.HandleFrame(frame.RequestWithInitialN(1, 1, 0, header.FTRequestStream, nil, nil))
+	sent.await(t, 1, header.FTError)
+	if code := errorc.ErrorCode(sent.last(1).Buf); code != errorc.ECInvalid {
+		t.Errorf("Expected a duplicate stream id to be invalid, got error code %d", code)
+	}
+	if n := p.ActiveStreams(); n != 0 {
+		t.Errorf("Expected the stream using the id to end, %d streams open", n)
+	}
+	if err := p.Err(); err != nil {
+		t.Errorf("Expected the connection to carry on, got %v", err)
+	}
+}
+
+func TestMisusingStreamZeroFailsTheConnection(t *testing.T) {
+	for _, f := range []*frame.Frame{
+		frame.RequestWithInitialN(0, 1, 0, header.FTRequestStream, nil, nil),
+		frame.RequestN(0, 1),
+		frame.Request(3, 0, header.FTMetadataPush, nil, nil),
+	} {
+		sent := &sentFrames{}
+		p := proto.NewProtocol(&rs.RequestHandler{}, 2, sent.record)
+		description := f.Describe()
+
+		p.HandleFrame(f)
+		if last := sent.last(0); last == nil || errorc.ErrorCode(last.Buf) != errorc.ECConnectionError {
+			t.Errorf("Expected %s to fail the connection", description)
+		}
+		if p.Err() == nil {
+			t.Errorf("Expected %s to terminate the protocol", description)
+		}
+	}
+}
+
+func TestLateFramesForClosedStreamsAreIgnored(t *testing.T) {
+	sent := &sentFrames{}
+	p := proto.NewProtocol(&rs.RequestHandler{}, 1, sent.record)
+
+	subscription := requestStream(p, nil)
+	subscription.Cancel()
+	p.HandleFrame(frame.Response(1, 0, nil, []byte("late")))
+	p.HandleFrame(frame.Response(1, header.FlagResponseComplete, nil, nil))
+	if f := sent.last(1); f.Type() != header.FTCancel {
+		t.Errorf("Expected frames for the cancelled stream to be dropped, got %s", f.Describe())
+	}
+
+	// Never opened
+	p.HandleFrame(frame.Response(3, 0, nil, nil))
+	sent.await(t, 3, header.FTError)
+	if code := errorc.ErrorCode(sent.last(3).Buf); code != errorc.ECInvalid {
+		t.Errorf("Expected frames for unknown streams to be invalid, got error code %d", code)
+	}
+}
@@ -0,0 +1,62 @@
+package proto_test
+
+import (
+	"github.com/jakewins/reactivesocket-go/pkg/internal/codec/errorc"
+	"github.com/jakewins/reactivesocket-go/pkg/internal/codec/header"
+	"github.com/jakewins/reactivesocket-go/pkg/internal/frame"
+	"github.com/jakewins/reactivesocket-go/pkg/internal/proto"
+	"github.com/jakewins/reactivesocket-go/pkg/rs"
+	"testing"
+)
+
+func TestStrictModeFailsTheConnectionOnDeviations(t *testing.T) {
+	for _, c := range []struct {
+		name   string
+		frames func() []*frame.Frame
+	}{
+		{"unexpected frame type", func() []*frame.Frame {
+			return []*frame.Frame{frame.Setup(0, 1000, 0, "a", "b", nil, nil)}
+		}},
+		{"metadata where none belongs", func() []*frame.Frame {
+			return []*frame.Frame{withFlags(frame.RequestN(1, 1), header.FlagHasMetadata)}
+		}},
+		{"unknown flags", func() []*frame.Frame {
+			return []*frame.Frame{withFlags(frame.Request(1, 0, header.FTRequestResponse, nil, nil), header.FlagNext)}
+		}},
+		{"request-N of zero", func() []*frame.Frame {
+			return []*frame.Frame{frame.RequestN(2, 0)}
+		}},
+		{"payloads not asked for", func() []*frame.Frame {
+			return []*frame.Frame{frame.Response(2, 0, nil, nil), frame.Response(2, 0, nil, nil)}
+		}},
+	} {
+		for _, strict := range []bool{true, false} {
+			sent := &sentFrames{}
+			p := proto.NewProtocol(&rs.RequestHandler{
+				HandleRequestStream: func(p rs.Payload) rs.Publisher {
+					return sequencer(0, infinity)()
+				},
+				HandleRequestResponse: requestResponseSuccess(1),
+			}, 2, sent.record)
+			p.Strict = strict
+			// Stream 2 asks for a single payload
+			requestStream(p, nil)
+
+			for _, f := range c.frames() {
+				p.HandleFrame(f)
+			}
+			failed := sent.last(0) != nil && errorc.ErrorCode(sent.last(0).Buf) == errorc.ECConnectionError
+			if strict && (!failed || p.Err() == nil) {
+				t.Errorf("%s: Expected a connection error in strict mode", c.name)
+			}
+			if !strict && (failed || p.Err() != nil) {
+				t.Errorf("%s: Expected the deviation to be let go otherwise, got %v", c.name, p.Err())
+			}
+		}
+	}
+}
+
+func withFlags(f *frame.Frame, flags uint16) *frame.Frame {
+	header.EncodeHeader(f.Buf, f.Flags()|flags, f.Type(), f.StreamID())
+	return f
+}
@@ -1,10 +1,12 @@
 package proto_test
 
 import (
+	"bytes"
 	"github.com/jakewins/reactivesocket-go/pkg/internal/codec/header"
 	"github.com/jakewins/reactivesocket-go/pkg/internal/frame"
 	"github.com/jakewins/reactivesocket-go/pkg/internal/proto"
 	"github.com/jakewins/reactivesocket-go/pkg/rs"
+	"math"
 	"testing"
 )
 
@@ -24,3 +26,136 @@ func TestRequestWithInitialNLeadsToRequestN(t *testing.T) {
 		t.Error(err)
 	}
 }
+
+func TestCompletingResponseDeliversItsValue(t *testing.T) {
+	for _, c := range []struct {
+		response *frame.Frame
+		values   int
+	}{
+		{frame.Response(1, header.FlagResponseComplete, nil, []byte{7}), 1},
+		{frame.Response(1, header.FlagResponseComplete|header.FlagNext, nil, nil), 1},
+		{frame.Response(1, header.FlagResponseComplete, nil, nil), 0},
+	} {
+		p := proto.NewProtocol(noopHandler, 1, discard)
+		var values int
+		var completed bool
+		p.RequestResponse(rs.NewPayload(nil, nil)).Subscribe(rs.NewSubscriber(func(s rs.Subscription) {
+			s.Request(1)
+		}, func(v rs.Payload) {
+			values++
+		}, nil, func() {
+			completed = true
+		}))
+
+		p.HandleFrame(c.response)
+
+		if values != c.values || !completed {
+			t.Errorf("Expected %s to deliver %d values and complete, got %d values, completed=%v",
+				c.response.Describe(), c.values, values, completed)
+		}
+	}
+}
+
+func TestEmptyResponsesOnlyCarryNextWhereTheFormatHasIt(t *testing.T) {
+	for _, markNext := range []bool{false, true} {
+		r := recorder{}
+		p := proto.NewProtocol(&rs.RequestHandler{
+			HandleRequestResponse: func(rs.Payload) rs.Publisher {
+				return rs.NewPublisher(func(s rs.Subscriber) {
+					s.OnSubscribe(rs.NewSubscription(func(n int) {
+						s.OnNext(rs.NewPayload(nil, nil))
+						s.OnComplete()
+					}, func() {}))
+				})
+			},
+		}, 2, r.Record)
+		p.MarkNext = markNext
+
+		p.HandleFrame(frame.Request(1, 0, header.FTRequestResponse, nil, nil))
+
+		flags := uint16(header.FlagResponseComplete)
+		if markNext {
+			flags |= header.FlagNext
+		}
+		if err := r.AssertRecorded([]*frame.Frame{
+			frame.Response(1, flags, nil, nil),
+		}); err != nil {
+			t.Errorf("MarkNext=%v: %s", markNext, err)
+		}
+	}
+}
+
+func TestChannelOpenedWithCompleteDeliversValueAndCompletes(t *testing.T) {
+	var values int
+	var completed bool
+	p := proto.NewProtocol(&rs.RequestHandler{
+		HandleChannel: func(in rs.Publisher) rs.Publisher {
+			in.Subscribe(rs.NewSubscriber(func(s rs.Subscription) {
+				s.Request(10)
+			}, func(v rs.Payload) {
+				values++
+			}, nil, func() {
+				completed = true
+			}))
+			return rs.NewEmptyPublisher()
+		},
+	}, 2, discard)
+
+	p.HandleFrame(frame.RequestWithInitialN(1, 1, header.FlagRequestChannelComplete,
+		header.FTRequestChannel, nil, []byte{1}))
+
+	if values != 1 || !completed {
+		t.Errorf("Expected one value and completion, got %d values, completed=%v", values, completed)
+	}
+}
+
+func BenchmarkHandleResponse(b *testing.B) {
+	p := proto.NewProtocol(noopHandler, 1, discard)
+	p.RequestStream(rs.NewPayload(nil, nil)).Subscribe(rs.NewSubscriber(func(s rs.Subscription) {
+		s.Request(math.MaxInt32)
+	}, nil, nil, nil))
+	f := frame.Response(1, 0, nil, make([]byte, 16))
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		p.HandleFrame(f)
+	}
+}
+
+func TestPoisonExposesPayloadsRetainedWithoutRetain(t *testing.T) {
+	frame.Poison = true
+	defer func() { frame.Poison = false }()
+
+	var borrowed, retained []byte
+	var retainedPayload rs.Payload
+	p := proto.NewProtocol(noopHandler, 1, discard)
+	p.RequestStream(rs.NewPayload(nil, nil)).Subscribe(rs.NewSubscriber(func(s rs.Subscription) {
+		s.Request(2)
+	}, func(v rs.Payload) {
+		if borrowed == nil {
+			borrowed = v.Data()
+		} else {
+			retainedPayload = rs.Retain(v)
+			retained = retainedPayload.Data()
+		}
+	}, nil, nil))
+
+	// Deliver the frames the way the transport does
+	for i := 0; i < 2; i++ {
+		f := frame.EncodeResponse(frame.Get(), 1, 0, nil, []byte{1, 2, 3})
+		p.HandleFrame(f)
+		f.Release()
+	}
+
+	if !bytes.Equal(borrowed, []byte{frame.PoisonByte, frame.PoisonByte, frame.PoisonByte}) {
+		t.Errorf("Expected payload held past OnNext to be poisoned, found % x", borrowed)
+	}
+	if !bytes.Equal(retained, []byte{1, 2, 3}) {
+		t.Errorf("Expected retained payload to be intact, found % x", retained)
+	}
+	rs.Release(retainedPayload)
+	if !bytes.Equal(retained, []byte{frame.PoisonByte, frame.PoisonByte, frame.PoisonByte}) {
+		t.Errorf("Expected payload to be poisoned once released, found % x", retained)
+	}
+}
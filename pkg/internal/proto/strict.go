@@ -0,0 +1,98 @@
+package proto
+
+import (
+	"fmt"
+	"github.com/jakewins/reactivesocket-go/pkg/internal/codec/header"
+	"github.com/jakewins/reactivesocket-go/pkg/internal/frame"
+	"github.com/jakewins/reactivesocket-go/pkg/internal/frame/requestn"
+)
+
+// Request-N values from here on mean "no bound"
+const maxDemand = 1<<31 - 1
+
+// The frame types the protocol handles, and the flags each may carry
+var allowedFlags = map[uint16]uint16{
+	header.FTKeepAlive:           header.FlagKeepaliveRespond,
+	header.FTRequestResponse:     header.FlagHasMetadata,
+	header.FTFireAndForget:       header.FlagHasMetadata,
+	header.FTRequestStream:       header.FlagHasMetadata | header.FlagRequestChannelInitialN,
+	header.FTRequestSubscription: header.FlagHasMetadata | header.FlagRequestChannelInitialN,
+	header.FTRequestChannel: header.FlagHasMetadata | header.FlagRequestChannelInitialN |
+		header.FlagRequestChannelComplete | header.FlagNext,
+	header.FTRequestN:     0,
+	header.FTCancel:       0,
+	header.FTResponse:     header.FlagHasMetadata | header.FlagResponseComplete | header.FlagNext,
+	header.FTError:        header.FlagHasMetadata,
+	header.FTMetadataPush: header.FlagHasMetadata,
+}
+
+// Check the type, flags and request-N of f; see deviation for what happens
+// if they are off. Returns false if f must not be handled any further.
+func (p *Protocol) conforms(f *frame.Frame) bool {
+	allowed, known := allowedFlags[f.Type()]
+	if !known {
+		// Nothing to handle it with, strict or not
+		p.deviation(fmt.Sprintf("Unexpected frame of type %d on stream %d.", f.Type(), f.StreamID()))
+		return false
+	}
+	flags := f.Flags()
+	if flags&header.FlagHasMetadata&^allowed != 0 &&
+		!p.deviation(fmt.Sprintf("%s must not carry metadata.", f.Describe())) {
+		return false
+	}
+	if unknown := flags &^ allowed &^ header.FlagHasMetadata; unknown != 0 &&
+		!p.deviation(fmt.Sprintf("%s has unknown flags %#04x.", f.Describe(), unknown)) {
+		return false
+	}
+	switch f.Type() {
+	case header.FTRequestN:
+		if n := requestn.RequestN(f); (n == 0 || n > maxDemand) &&
+			!p.deviation(fmt.Sprintf("%s must ask for 1 to %d payloads.", f.Describe(), maxDemand)) {
+			return false
+		}
+	case header.FTResponse:
+		if f.StreamID()%2 != p.firstStreamId%2 &&
+			!p.deviation(fmt.Sprintf("%s is on a stream the remote opened.", f.Describe())) {
+			return false
+		}
+	}
+	return true
+}
+
+// Deal with the remote deviating from the protocol as msg describes. In
+// strict mode that fails the connection, otherwise it is let go, and
+// printed if tracing. Returns whether to carry on handling the frame at hand.
+func (p *Protocol) deviation(msg string) bool {
+	if p.Strict {
+		p.failConnection(msg)
+		return false
+	}
+	if p.Trace {
+		fmt.Printf("Ignoring protocol deviation: %s\n", msg)
+	}
+	return true
+}
+
+// Count n more payloads the subscriber of the inbound half of s asked for
+func (p *Protocol) addDemand(s *stream, n int) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	if s.demand += int64(n); s.demand > maxDemand {
+		s.demand = maxDemand
+	}
+}
+
+// Count the payload in f against what the subscriber of the inbound half of
+// s asked for. Returns false if f must not be delivered.
+func (p *Protocol) takeDemand(s *stream, f *frame.Frame) bool {
+	p.lock.Lock()
+	over := s.demand == 0
+	if s.demand > 0 && s.demand < maxDemand {
+		s.demand--
+	}
+	p.lock.Unlock()
+	if over {
+		return p.deviation(fmt.Sprintf("%s was not asked for.", f.Describe()))
+	}
+	return true
+}
@@ -0,0 +1,49 @@
+package proto
+
+// Closed streams remembered at once; frames for streams closed longer ago
+// than this are treated as if the stream never existed
+const maxTombstones = 1024
+
+// Ids of the streams closed most recently, so frames the remote sent before
+// it learned of the close can be told from frames for streams that were never
+// open. Once full, the oldest id is forgotten. Guarded by Protocol.lock.
+type tombstones struct {
+	size int
+	// Slot in ring, by id
+	ids  map[uint32]int
+	ring []uint32
+	// The oldest slot, once ring is full
+	next int
+}
+
+func newTombstones(size int) *tombstones {
+	return &tombstones{size: size, ids: make(map[uint32]int)}
+}
+
+func (t *tombstones) add(id uint32) {
+	if _, ok := t.ids[id]; ok {
+		return
+	}
+	if len(t.ring) < t.size {
+		t.ring = append(t.ring, id)
+		t.ids[id] = len(t.ring) - 1
+		return
+	}
+	slot := t.next
+	if old := t.ring[slot]; t.ids[old] == slot {
+		delete(t.ids, old)
+	}
+	t.ring[slot] = id
+	t.ids[id] = slot
+	t.next = (slot + 1) % t.size
+}
+
+func (t *tombstones) has(id uint32) bool {
+	_, ok := t.ids[id]
+	return ok
+}
+
+// Forget id, once it is in use again
+func (t *tombstones) remove(id uint32) {
+	delete(t.ids, id)
+}
@@ -0,0 +1,261 @@
+package rsocket
+
+import (
+	"github.com/jakewins/reactivesocket-go/pkg/internal/codec/header"
+	"github.com/jakewins/reactivesocket-go/pkg/internal/codec/setup"
+	"github.com/jakewins/reactivesocket-go/pkg/internal/frame"
+	"io"
+)
+
+// Reads RSocket 1.0 frames, with 24-bit length prefixes, translating each into
+// the internal frame layout. Not goroutine safe; meant to be driven by the
+// goroutine reading frames off a connection.
+type Decoder struct {
+	source       io.Reader
+	maxFrameSize int
+	// Stream ids with this parity were allocated by us
+	localParity uint32
+	prefix      [lengthPrefixSize]byte
+	// The raw frame, before translation
+	buf []byte
+	// Internal type of requests being received in fragments, by stream id
+	fragments map[uint32]uint16
+}
+
+// firstStreamId is the first id the local side of the connection allocates,
+// see trans.ReactiveConn#Initialize.
+func NewDecoder(source io.Reader, maxFrameSize int, firstStreamId uint32) *Decoder {
+	if maxFrameSize > MaxFrameSize {
+		maxFrameSize = MaxFrameSize
+	}
+	return &Decoder{
+		source:       source,
+		maxFrameSize: maxFrameSize,
+		localParity:  firstStreamId % 2,
+		fragments:    make(map[uint32]uint16),
+	}
+}
+
+func (d *Decoder) Read(target *frame.Frame) error {
+	for {
+		if _, err := io.ReadFull(d.source, d.prefix[:]); err != nil {
+			return err
+		}
+		length := uint24(d.prefix[:], 0)
+		if length < headerLength || length > d.maxFrameSize {
+			return malformed("length %d is outside of the allowed %d to %d bytes.",
+				length, headerLength, d.maxFrameSize)
+		}
+
+		buf := header.ResizeSlice(&d.buf, length)
+		if _, err := io.ReadFull(d.source, buf); err != nil {
+			if err == io.EOF {
+				err = io.ErrUnexpectedEOF
+			}
+			return err
+		}
+
+		if decoded, err := d.decode(buf, target); decoded || err != nil {
+			return err
+		}
+		// Otherwise it was a frame we don't understand, flagged as ignorable
+	}
+}
+
+// Size of the frame Read last returned, as it was on the wire, not counting
+// its length prefix
+func (d *Decoder) Length() int {
+	return len(d.buf)
+}
+
+// Translate the frame in b into target. Returns false if the frame should be
+// ignored.
+func (d *Decoder) decode(b []byte, target *frame.Frame) (bool, error) {
+	streamId := header.Uint32(b, 0) & streamIdMask
+	typeAndFlags := header.Uint16(b, typeAndFlagsOffset)
+	frameType, flags := typeAndFlags>>flagBits, typeAndFlags&flagMask
+	body := b[headerLength:]
+
+	switch frameType {
+	case ftSetup:
+		return true, d.decodeSetup(body, flags, target)
+	case ftKeepalive:
+		if len(body) < sizeOfPosition {
+			return false, malformed("KEEPALIVE is missing its position field.")
+		}
+		// Any data after the position is echoed back by the remote only,
+		// so we've no use for it
+		frame.EncodeKeepaliveWithPosition(target, flags&flagRespond != 0, header.Uint64(body, 0))
+	case ftRequestResponse:
+		return true, d.decodeRequest(streamId, header.FTRequestResponse, flags, body, false, target)
+	case ftRequestFnf:
+		return true, d.decodeRequest(streamId, header.FTFireAndForget, flags, body, false, target)
+	case ftRequestStream:
+		return true, d.decodeRequest(streamId, header.FTRequestStream, flags, body, true, target)
+	case ftRequestChannel:
+		return true, d.decodeRequest(streamId, header.FTRequestChannel, flags, body, true, target)
+	case ftPayload:
+		return true, d.decodePayload(streamId, flags, body, target)
+	case ftRequestN:
+		if len(body) < header.SizeOfInt {
+			return false, malformed("REQUEST_N is missing its request N field.")
+		}
+		frame.EncodeRequestN(target, streamId, header.Uint32(body, 0))
+	case ftCancel:
+		delete(d.fragments, streamId)
+		frame.EncodeCancel(target, streamId)
+	case ftError:
+		if len(body) < header.SizeOfInt {
+			return false, malformed("ERROR is missing its error code.")
+		}
+		delete(d.fragments, streamId)
+		frame.EncodeError(target, streamId, header.Uint32(body, 0), nil, body[header.SizeOfInt:])
+	case ftMetadataPush:
+		// The metadata is the rest of the frame, without a length field
+		frame.EncodeRequest(target, 0, 0, header.FTMetadataPush, body, nil)
+	case ftResume:
+		// Version, token and the two positions
+		if len(body) < header.SizeOfInt+header.SizeOfShort ||
+			len(body) < header.SizeOfInt+header.SizeOfShort+int(header.Uint16(body, header.SizeOfInt))+2*sizeOfPosition {
+			return false, malformed("RESUME is too short.")
+		}
+		offset := header.SizeOfInt + header.SizeOfShort
+		token := body[offset : offset+int(header.Uint16(body, header.SizeOfInt))]
+		offset += len(token)
+		frame.EncodeResume(target, header.Uint32(body, 0), token,
+			header.Uint64(body, offset), header.Uint64(body, offset+sizeOfPosition))
+	case ftResumeOK:
+		if len(body) < sizeOfPosition {
+			return false, malformed("RESUME_OK is missing its position field.")
+		}
+		frame.EncodeResumeOK(target, header.Uint64(body, 0))
+	default:
+		// Includes LEASE and extensions, which we don't support yet
+		if flags&flagIgnore != 0 {
+			return false, nil
+		}
+		return false, malformed("unsupported frame type %d on stream %d.", frameType, streamId)
+	}
+	return true, nil
+}
+
+func (d *Decoder) decodeSetup(body []byte, flags uint16, target *frame.Frame) error {
+	// Major and minor version, keepalive interval and max lifetime
+	offset := 3 * header.SizeOfInt
+	if len(body) < offset {
+		return malformed("SETUP is too short.")
+	}
+	var resumeToken []byte
+	if flags&flagResume != 0 {
+		if len(body) < offset+header.SizeOfShort {
+			return malformed("SETUP is missing its resume token.")
+		}
+		length := int(header.Uint16(body, offset))
+		offset += header.SizeOfShort
+		if offset+length > len(body) {
+			return malformed("SETUP resume token exceeds the frame.")
+		}
+		resumeToken = body[offset : offset+length]
+		offset += length
+	}
+	metadataMimeType, offset, err := mimeType(body, offset)
+	if err != nil {
+		return err
+	}
+	dataMimeType, offset, err := mimeType(body, offset)
+	if err != nil {
+		return err
+	}
+	metadata, data, err := payload(body[offset:], flags)
+	if err != nil {
+		return err
+	}
+
+	var legacyFlags uint16
+	if flags&flagLease != 0 {
+		legacyFlags |= setup.SetupFlagWillHonorLease
+	}
+	frame.EncodeResumableSetup(target, legacyFlags, header.Uint32(body, 4), header.Uint32(body, 8),
+		resumeToken, metadataMimeType, dataMimeType, metadata, data)
+	setup.SetVersion(target.Buf, header.Uint32(body, 0))
+	return nil
+}
+
+func (d *Decoder) decodeRequest(streamId uint32, frameType, flags uint16, body []byte, withInitialN bool, target *frame.Frame) error {
+	var initialN uint32
+	if withInitialN {
+		if len(body) < header.SizeOfInt {
+			return malformed("request on stream %d is missing its initial request N.", streamId)
+		}
+		initialN, body = header.Uint32(body, 0), body[header.SizeOfInt:]
+	}
+	metadata, data, err := payload(body, flags)
+	if err != nil {
+		return err
+	}
+	if flags&flagFollows != 0 {
+		d.fragments[streamId] = frameType
+	}
+	frame.EncodeRequestWithInitialN(target, streamId, initialN, legacyFlags(flags), frameType, metadata, data)
+	return nil
+}
+
+func (d *Decoder) decodePayload(streamId uint32, flags uint16, body []byte, target *frame.Frame) error {
+	if flags&(flagNext|flagComplete|flagFollows) == 0 {
+		return malformed("PAYLOAD on stream %d has neither NEXT nor COMPLETE set.", streamId)
+	}
+	metadata, data, err := payload(body, flags)
+	if err != nil {
+		return err
+	}
+
+	if frameType, ok := d.fragments[streamId]; ok {
+		// A follow-up fragment of a request
+		if flags&flagFollows == 0 {
+			delete(d.fragments, streamId)
+		}
+		frame.EncodeRequest(target, streamId, legacyFlags(flags), frameType, metadata, data)
+	} else if streamId%2 == d.localParity {
+		// We requested this stream, so this is a response
+		frame.EncodeResponse(target, streamId, legacyFlags(flags), metadata, data)
+	} else {
+		frame.EncodeRequest(target, streamId, legacyFlags(flags), header.FTRequestChannel, metadata, data)
+	}
+	return nil
+}
+
+func legacyFlags(flags uint16) uint16 {
+	var legacy uint16
+	if flags&flagFollows != 0 {
+		legacy |= header.FlagFollows
+	}
+	if flags&flagComplete != 0 {
+		legacy |= header.FlagResponseComplete
+	}
+	if flags&flagNext != 0 {
+		legacy |= header.FlagNext
+	}
+	return legacy
+}
+
+// Split b into metadata and data; metadata is prefixed by a 24-bit length.
+func payload(b []byte, flags uint16) ([]byte, []byte, error) {
+	if flags&flagMetadata == 0 {
+		return nil, b, nil
+	}
+	if len(b) < lengthPrefixSize {
+		return nil, nil, malformed("metadata length is missing.")
+	}
+	length := uint24(b, 0)
+	if lengthPrefixSize+length > len(b) {
+		return nil, nil, malformed("metadata length %d exceeds the frame.", length)
+	}
+	return b[lengthPrefixSize : lengthPrefixSize+length], b[lengthPrefixSize+length:], nil
+}
+
+func mimeType(b []byte, offset int) (string, int, error) {
+	if offset >= len(b) || offset+1+int(b[offset]) > len(b) {
+		return "", 0, malformed("SETUP MIME type exceeds the frame.")
+	}
+	return header.MimeType(b, offset), offset + 1 + int(b[offset]), nil
+}
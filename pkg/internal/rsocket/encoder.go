@@ -0,0 +1,234 @@
+package rsocket
+
+import (
+	"fmt"
+	"github.com/jakewins/reactivesocket-go/pkg/internal/codec/header"
+	"github.com/jakewins/reactivesocket-go/pkg/internal/codec/keepalive"
+	"github.com/jakewins/reactivesocket-go/pkg/internal/codec/request"
+	"github.com/jakewins/reactivesocket-go/pkg/internal/codec/resume"
+	"github.com/jakewins/reactivesocket-go/pkg/internal/codec/setup"
+	"github.com/jakewins/reactivesocket-go/pkg/internal/frame"
+	frequest "github.com/jakewins/reactivesocket-go/pkg/internal/frame/request"
+	"github.com/jakewins/reactivesocket-go/pkg/internal/frame/response"
+	"io"
+)
+
+// Writes frames in the internal layout as RSocket 1.0 frames, with 24-bit
+// length prefixes. Not goroutine safe; meant to be driven by the goroutine
+// writing frames to a connection.
+type Encoder struct {
+	sink   io.Writer
+	prefix [lengthPrefixSize]byte
+	// The translated frame
+	buf []byte
+	// Streams whose request is being sent in fragments
+	fragments map[uint32]bool
+}
+
+func NewEncoder(sink io.Writer) *Encoder {
+	return &Encoder{
+		sink:      sink,
+		fragments: make(map[uint32]bool),
+	}
+}
+
+func (e *Encoder) Write(f *frame.Frame) error {
+	b, err := e.encode(f)
+	if err != nil {
+		return err
+	}
+	if len(b) > MaxFrameSize {
+		return fmt.Errorf("Cannot send %s, it is larger than the %d byte RSocket frame limit.", f.Describe(), MaxFrameSize)
+	}
+	putUint24(e.prefix[:], 0, len(b))
+	if _, err := e.sink.Write(e.prefix[:]); err != nil {
+		return err
+	}
+	_, err = e.sink.Write(b)
+	return err
+}
+
+func (e *Encoder) encode(f *frame.Frame) ([]byte, error) {
+	streamId := f.StreamID()
+	switch f.Type() {
+	case header.FTSetup:
+		return e.encodeSetup(f), nil
+	case header.FTKeepAlive:
+		var flags uint16
+		if f.Flags()&header.FlagKeepaliveRespond != 0 {
+			flags |= flagRespond
+		}
+		data := f.Buf[header.FrameHeaderLength:]
+		if len(data) >= sizeOfPosition {
+			// Our keepalives only ever carry the position
+			data = data[sizeOfPosition:]
+		}
+		b := e.header(headerLength+sizeOfPosition+len(data), 0, ftKeepalive, flags)
+		header.PutUint64(b, headerLength, keepalive.Position(f.Buf))
+		copy(b[headerLength+sizeOfPosition:], data)
+		return b, nil
+	case header.FTResume:
+		if !resume.IsWellFormed(f.Buf) {
+			return nil, fmt.Errorf("Cannot send %s, it is malformed.", f.Describe())
+		}
+		body := resume.Body(f.Buf)
+		b := e.header(headerLength+len(body), 0, ftResume, 0)
+		copy(b[headerLength:], body)
+		header.PutUint32(b, headerLength, setup.Version1)
+		return b, nil
+	case header.FTResumeOK:
+		b := e.header(headerLength+sizeOfPosition, 0, ftResumeOK, 0)
+		header.PutUint64(b, headerLength, resume.OKPosition(f.Buf))
+		return b, nil
+	case header.FTRequestResponse:
+		return e.encodeRequest(f, ftRequestResponse, false), nil
+	case header.FTFireAndForget:
+		return e.encodeRequest(f, ftRequestFnf, false), nil
+	case header.FTRequestStream, header.FTRequestSubscription:
+		return e.encodeRequest(f, ftRequestStream, true), nil
+	case header.FTRequestChannel:
+		if !e.fragments[streamId] && f.Flags()&header.FlagRequestChannelInitialN == 0 {
+			// Only the frame opening the channel carries initial request N,
+			// the rest are the requesters payloads.
+			return e.encodePayload(f, frequest.IsNext(f)), nil
+		}
+		return e.encodeRequest(f, ftRequestChannel, true), nil
+	case header.FTResponse:
+		return e.encodePayload(f, response.IsNext(f)), nil
+	case header.FTRequestN:
+		b := e.header(headerLength+header.SizeOfInt, streamId, ftRequestN, 0)
+		header.PutUint32(b, headerLength, header.Uint32(f.Buf, header.FrameHeaderLength))
+		return b, nil
+	case header.FTCancel:
+		delete(e.fragments, streamId)
+		return e.header(headerLength, streamId, ftCancel, 0), nil
+	case header.FTError:
+		// RSocket 1.0 errors carry no metadata
+		delete(e.fragments, streamId)
+		data := f.Data()
+		b := e.header(headerLength+header.SizeOfInt+len(data), streamId, ftError, 0)
+		header.PutUint32(b, headerLength, header.Uint32(f.Buf, header.FrameHeaderLength))
+		copy(b[headerLength+header.SizeOfInt:], data)
+		return b, nil
+	case header.FTMetadataPush:
+		// The metadata is the rest of the frame, without a length field
+		metadata := f.Metadata()
+		b := e.header(headerLength+len(metadata), 0, ftMetadataPush, flagMetadata)
+		copy(b[headerLength:], metadata)
+		return b, nil
+	}
+	return nil, fmt.Errorf("Cannot send %s, it has no RSocket 1.0 equivalent.", f.Describe())
+}
+
+func (e *Encoder) encodeSetup(f *frame.Frame) []byte {
+	metadataMimeType, dataMimeType := setup.MetadataMimeType(f.Buf), setup.DataMimeType(f.Buf)
+	metadata, data := f.Metadata(), f.Data()
+
+	resumeToken := setup.ResumeToken(f.Buf)
+
+	var flags uint16
+	if setup.Flags(f.Buf)&setup.SetupFlagWillHonorLease != 0 {
+		flags |= flagLease
+	}
+	fixed := 3*header.SizeOfInt + 2 + len(metadataMimeType) + len(dataMimeType)
+	if resumeToken != nil {
+		flags |= flagResume
+		fixed += header.SizeOfShort + len(resumeToken)
+	}
+	b := e.header(headerLength+fixed+payloadLength(f, metadata, data), 0, ftSetup, flags|payloadFlags(f))
+
+	offset := headerLength
+	header.PutUint32(b, offset, setup.Version1)
+	header.PutUint32(b, offset+4, setup.KeepaliveInterval(f.Buf))
+	header.PutUint32(b, offset+8, setup.MaxLifetime(f.Buf))
+	offset += 3 * header.SizeOfInt
+	if resumeToken != nil {
+		header.PutUint16(b, offset, uint16(len(resumeToken)))
+		offset += header.SizeOfShort
+		offset += copy(b[offset:], resumeToken)
+	}
+	offset += header.PutMimeType(b, offset, metadataMimeType)
+	offset += header.PutMimeType(b, offset, dataMimeType)
+	putPayload(b, offset, f, metadata, data)
+	return b
+}
+
+func (e *Encoder) encodeRequest(f *frame.Frame, frameType uint16, withInitialN bool) []byte {
+	streamId := f.StreamID()
+	if e.fragments[streamId] {
+		// A follow-up fragment of a request
+		if f.Flags()&header.FlagFollows == 0 {
+			delete(e.fragments, streamId)
+		}
+		return e.encodePayload(f, true)
+	}
+	if f.Flags()&header.FlagFollows != 0 {
+		e.fragments[streamId] = true
+	}
+
+	flags := payloadFlags(f)
+	if frameType == ftRequestChannel && frequest.IsCompleteStream(f) {
+		flags |= flagComplete
+	}
+	metadata, data := f.Metadata(), f.Data()
+	offset := headerLength
+	if withInitialN {
+		offset += header.SizeOfInt
+	}
+	b := e.header(offset+payloadLength(f, metadata, data), streamId, frameType, flags)
+	if withInitialN {
+		header.PutUint32(b, headerLength, request.InitialRequestN(f.Buf))
+	}
+	putPayload(b, offset, f, metadata, data)
+	return b
+}
+
+func (e *Encoder) encodePayload(f *frame.Frame, next bool) []byte {
+	flags := payloadFlags(f)
+	if f.Flags()&header.FlagResponseComplete != 0 {
+		flags |= flagComplete
+	}
+	if next {
+		flags |= flagNext
+	}
+	metadata, data := f.Metadata(), f.Data()
+	b := e.header(headerLength+payloadLength(f, metadata, data), f.StreamID(), ftPayload, flags)
+	putPayload(b, headerLength, f, metadata, data)
+	return b
+}
+
+// Size the buffer to length bytes and write the frame header to it
+func (e *Encoder) header(length int, streamId uint32, frameType, flags uint16) []byte {
+	b := header.ResizeSlice(&e.buf, length)
+	header.PutUint32(b, 0, streamId)
+	header.PutUint16(b, typeAndFlagsOffset, frameType<<flagBits|flags)
+	return b
+}
+
+// Flags describing the payload of f
+func payloadFlags(f *frame.Frame) uint16 {
+	var flags uint16
+	if f.Flags()&header.FlagHasMetadata != 0 {
+		flags |= flagMetadata
+	}
+	if f.Type() != header.FTSetup && f.Flags()&header.FlagFollows != 0 {
+		flags |= flagFollows
+	}
+	return flags
+}
+
+func payloadLength(f *frame.Frame, metadata, data []byte) int {
+	if f.Flags()&header.FlagHasMetadata != 0 {
+		return lengthPrefixSize + len(metadata) + len(data)
+	}
+	return len(data)
+}
+
+func putPayload(b []byte, offset int, f *frame.Frame, metadata, data []byte) {
+	if f.Flags()&header.FlagHasMetadata != 0 {
+		putUint24(b, offset, len(metadata))
+		offset += lengthPrefixSize
+		offset += copy(b[offset:], metadata)
+	}
+	copy(b[offset:], data)
+}
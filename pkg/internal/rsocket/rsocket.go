@@ -0,0 +1,86 @@
+// Support for the RSocket 1.0 wire format.
+//
+// Internally, frames always use the legacy ReactiveSocket layout that the
+// codec packages implement; the Decoder and Encoder here translate to and
+// from RSocket 1.0 at the edge of the connection, so the rest of the stack
+// is unaware of which format a connection speaks.
+//
+// The two formats mostly differ in layout, but also in a few semantics:
+//
+//   - RSocket 1.0 has a single PAYLOAD frame, where the legacy format has
+//     RESPONSE frames for responders and REQUEST_CHANNEL frames for
+//     requesters. Which one a PAYLOAD maps to depends on who opened the
+//     stream, so the Decoder needs to know which stream ids are local.
+//   - REQUEST_SUBSCRIPTION does not exist in RSocket 1.0, it is sent as
+//     REQUEST_STREAM.
+//   - Follow-up fragments of requests are PAYLOAD frames in RSocket 1.0,
+//     but keep the request type in the legacy format.
+package rsocket
+
+import (
+	"fmt"
+	"github.com/jakewins/reactivesocket-go/pkg/internal/codec/header"
+)
+
+const (
+	// Largest frame the 24-bit length prefix can describe
+	MaxFrameSize = 1<<24 - 1
+	// Bytes of the length prefix in front of each frame
+	FrameLengthSize = 3
+
+	lengthPrefixSize   = 3
+	streamIdMask       = 0x7FFFFFFF
+	typeAndFlagsOffset = header.SizeOfInt
+	headerLength       = typeAndFlagsOffset + header.SizeOfShort
+	flagBits           = 10
+	flagMask           = 1<<flagBits - 1
+	// Implied positions in KEEPALIVE, RESUME and RESUME_OK frames
+	sizeOfPosition = header.SizeOfLong
+)
+
+// Frame types
+const (
+	ftSetup           uint16 = 0x01
+	ftLease                  = 0x02
+	ftKeepalive              = 0x03
+	ftRequestResponse        = 0x04
+	ftRequestFnf             = 0x05
+	ftRequestStream          = 0x06
+	ftRequestChannel         = 0x07
+	ftRequestN               = 0x08
+	ftCancel                 = 0x09
+	ftPayload                = 0x0A
+	ftError                  = 0x0B
+	ftMetadataPush           = 0x0C
+	ftResume                 = 0x0D
+	ftResumeOK               = 0x0E
+	ftExt                    = 0x3F
+)
+
+// Flags
+const (
+	flagIgnore   uint16 = 1 << 9
+	flagMetadata        = 1 << 8
+	flagFollows         = 1 << 7
+	flagComplete        = 1 << 6
+	flagNext            = 1 << 5
+	// KEEPALIVE only
+	flagRespond = 1 << 7
+	// SETUP only
+	flagResume = 1 << 7
+	flagLease  = 1 << 6
+)
+
+func putUint24(b []byte, offset int, v int) {
+	b[offset] = byte(v >> 16)
+	b[offset+1] = byte(v >> 8)
+	b[offset+2] = byte(v)
+}
+
+func uint24(b []byte, offset int) int {
+	return int(b[offset])<<16 | int(b[offset+1])<<8 | int(b[offset+2])
+}
+
+func malformed(format string, args ...interface{}) error {
+	return fmt.Errorf("Malformed RSocket frame: "+format, args...)
+}
@@ -0,0 +1,319 @@
+package rsocket_test
+
+import (
+	"bytes"
+	"github.com/jakewins/reactivesocket-go/pkg/internal/codec/errorc"
+	"github.com/jakewins/reactivesocket-go/pkg/internal/codec/header"
+	"github.com/jakewins/reactivesocket-go/pkg/internal/fragment"
+	"github.com/jakewins/reactivesocket-go/pkg/internal/frame"
+	"github.com/jakewins/reactivesocket-go/pkg/internal/frame/setup"
+	"github.com/jakewins/reactivesocket-go/pkg/internal/rsocket"
+	"testing"
+)
+
+const (
+	client uint32 = 1
+	server uint32 = 2
+)
+
+// Frames laid out per the RSocket 1.0 spec, without length prefix
+var goldenFrames = []struct {
+	name string
+	// The internal frame that's encoded to wire
+	frame *frame.Frame
+	wire  []byte
+	// The internal frame wire decodes to, if not frame
+	decoded *frame.Frame
+	// Which side of the connection decodes the frame
+	receiver uint32
+}{
+	{
+		name:  "SETUP",
+		frame: frame.Setup(0, 30000, 90000, "text/plain", "text/plain", nil, []byte("hi")),
+		wire: []byte{
+			0x00, 0x00, 0x00, 0x00, 0x04, 0x00, // Stream 0, SETUP
+			0x00, 0x01, 0x00, 0x00, // Version 1.0
+			0x00, 0x00, 0x75, 0x30, // Keepalive interval
+			0x00, 0x01, 0x5f, 0x90, // Max lifetime
+			0x0a, 't', 'e', 'x', 't', '/', 'p', 'l', 'a', 'i', 'n',
+			0x0a, 't', 'e', 'x', 't', '/', 'p', 'l', 'a', 'i', 'n',
+			'h', 'i',
+		},
+		decoded:  setupVersion1(frame.Setup(0, 30000, 90000, "text/plain", "text/plain", nil, []byte("hi"))),
+		receiver: server,
+	},
+	{
+		name:     "KEEPALIVE with respond",
+		frame:    frame.Keepalive(true),
+		wire:     []byte{0x00, 0x00, 0x00, 0x00, 0x0c, 0x80, 0, 0, 0, 0, 0, 0, 0, 0},
+		decoded:  frame.KeepaliveWithPosition(true, 0),
+		receiver: server,
+	},
+	{
+		name:     "KEEPALIVE with position",
+		frame:    frame.KeepaliveWithPosition(false, 0x0102),
+		wire:     []byte{0x00, 0x00, 0x00, 0x00, 0x0c, 0x00, 0, 0, 0, 0, 0, 0, 0x01, 0x02},
+		receiver: client,
+	},
+	{
+		name:  "SETUP with resume token",
+		frame: frame.EncodeResumableSetup(&frame.Frame{}, 0, 30000, 90000, []byte{7, 8}, "", "", nil, nil),
+		wire: []byte{
+			0x00, 0x00, 0x00, 0x00, 0x04, 0x80, // Stream 0, SETUP, resume
+			0x00, 0x01, 0x00, 0x00, // Version 1.0
+			0x00, 0x00, 0x75, 0x30, // Keepalive interval
+			0x00, 0x01, 0x5f, 0x90, // Max lifetime
+			0x00, 0x02, 7, 8, // Resume token
+			0x00, 0x00,
+		},
+		decoded:  setupVersion1(frame.EncodeResumableSetup(&frame.Frame{}, 0, 30000, 90000, []byte{7, 8}, "", "", nil, nil)),
+		receiver: server,
+	},
+	{
+		name:  "RESUME",
+		frame: frame.Resume(setup.Version1, []byte{7, 8}, 0x10, 0x04),
+		wire: []byte{
+			0x00, 0x00, 0x00, 0x00, 0x34, 0x00, // Stream 0, RESUME
+			0x00, 0x01, 0x00, 0x00, // Version 1.0
+			0x00, 0x02, 7, 8, // Resume token
+			0, 0, 0, 0, 0, 0, 0, 0x10, // Last received server position
+			0, 0, 0, 0, 0, 0, 0, 0x04, // First available client position
+		},
+		receiver: server,
+	},
+	{
+		name:     "RESUME_OK",
+		frame:    frame.ResumeOK(0x20),
+		wire:     []byte{0x00, 0x00, 0x00, 0x00, 0x38, 0x00, 0, 0, 0, 0, 0, 0, 0, 0x20},
+		receiver: client,
+	},
+	{
+		name:     "REQUEST_RESPONSE with metadata",
+		frame:    frame.Request(1, 0, header.FTRequestResponse, []byte("m"), []byte("d")),
+		wire:     []byte{0x00, 0x00, 0x00, 0x01, 0x11, 0x00, 0x00, 0x00, 0x01, 'm', 'd'},
+		receiver: server,
+	},
+	{
+		name:     "REQUEST_FNF",
+		frame:    frame.Request(3, 0, header.FTFireAndForget, nil, []byte("d")),
+		wire:     []byte{0x00, 0x00, 0x00, 0x03, 0x14, 0x00, 'd'},
+		receiver: server,
+	},
+	{
+		name:     "REQUEST_STREAM",
+		frame:    frame.RequestWithInitialN(1, 8, 0, header.FTRequestStream, nil, []byte("x")),
+		wire:     []byte{0x00, 0x00, 0x00, 0x01, 0x18, 0x00, 0x00, 0x00, 0x00, 0x08, 'x'},
+		receiver: server,
+	},
+	{
+		name:     "REQUEST_SUBSCRIPTION is sent as REQUEST_STREAM",
+		frame:    frame.RequestWithInitialN(1, 8, 0, header.FTRequestSubscription, nil, []byte("x")),
+		wire:     []byte{0x00, 0x00, 0x00, 0x01, 0x18, 0x00, 0x00, 0x00, 0x00, 0x08, 'x'},
+		decoded:  frame.RequestWithInitialN(1, 8, 0, header.FTRequestStream, nil, []byte("x")),
+		receiver: server,
+	},
+	{
+		name: "REQUEST_CHANNEL with complete",
+		frame: frame.RequestWithInitialN(1, 2, header.FlagRequestChannelComplete,
+			header.FTRequestChannel, nil, []byte("x")),
+		wire:     []byte{0x00, 0x00, 0x00, 0x01, 0x1c, 0x40, 0x00, 0x00, 0x00, 0x02, 'x'},
+		receiver: server,
+	},
+	{
+		name:     "PAYLOAD from a channel requester",
+		frame:    frame.Request(1, 0, header.FTRequestChannel, nil, []byte("v")),
+		wire:     []byte{0x00, 0x00, 0x00, 0x01, 0x28, 0x20, 'v'},
+		decoded:  frame.Request(1, header.FlagNext, header.FTRequestChannel, nil, []byte("v")),
+		receiver: server,
+	},
+	{
+		name:     "PAYLOAD completing a channel requester",
+		frame:    frame.Request(1, header.FlagRequestChannelComplete, header.FTRequestChannel, nil, nil),
+		wire:     []byte{0x00, 0x00, 0x00, 0x01, 0x28, 0x40},
+		receiver: server,
+	},
+	{
+		name:     "PAYLOAD with NEXT",
+		frame:    frame.Response(1, 0, nil, []byte("v")),
+		wire:     []byte{0x00, 0x00, 0x00, 0x01, 0x28, 0x20, 'v'},
+		decoded:  frame.Response(1, header.FlagNext, nil, []byte("v")),
+		receiver: client,
+	},
+	{
+		name:     "PAYLOAD with NEXT and COMPLETE",
+		frame:    frame.Response(1, header.FlagResponseComplete, []byte("m"), []byte("v")),
+		wire:     []byte{0x00, 0x00, 0x00, 0x01, 0x29, 0x60, 0x00, 0x00, 0x01, 'm', 'v'},
+		decoded:  frame.Response(1, header.FlagResponseComplete|header.FlagNext, []byte("m"), []byte("v")),
+		receiver: client,
+	},
+	{
+		name:     "PAYLOAD with an empty final value",
+		frame:    frame.Response(1, header.FlagResponseComplete|header.FlagNext, nil, nil),
+		wire:     []byte{0x00, 0x00, 0x00, 0x01, 0x28, 0x60},
+		receiver: client,
+	},
+	{
+		name:     "PAYLOAD with COMPLETE",
+		frame:    frame.Response(1, header.FlagResponseComplete, nil, nil),
+		wire:     []byte{0x00, 0x00, 0x00, 0x01, 0x28, 0x40},
+		receiver: client,
+	},
+	{
+		name:     "REQUEST_N",
+		frame:    frame.RequestN(1, 5),
+		wire:     []byte{0x00, 0x00, 0x00, 0x01, 0x20, 0x00, 0x00, 0x00, 0x00, 0x05},
+		receiver: server,
+	},
+	{
+		name:     "CANCEL",
+		frame:    frame.Cancel(1),
+		wire:     []byte{0x00, 0x00, 0x00, 0x01, 0x24, 0x00},
+		receiver: server,
+	},
+	{
+		name:     "ERROR",
+		frame:    frame.Error(1, errorc.ECApplicationError, nil, []byte("boom")),
+		wire:     []byte{0x00, 0x00, 0x00, 0x01, 0x2c, 0x00, 0x00, 0x00, 0x02, 0x01, 'b', 'o', 'o', 'm'},
+		receiver: client,
+	},
+	{
+		name:     "ERROR closing the connection",
+		frame:    frame.Error(0, errorc.ECConnectionClose, nil, nil),
+		wire:     []byte{0x00, 0x00, 0x00, 0x00, 0x2c, 0x00, 0x00, 0x00, 0x01, 0x02},
+		receiver: client,
+	},
+	{
+		name:     "METADATA_PUSH",
+		frame:    frame.Request(0, 0, header.FTMetadataPush, []byte("md"), nil),
+		wire:     []byte{0x00, 0x00, 0x00, 0x00, 0x31, 0x00, 'm', 'd'},
+		receiver: server,
+	},
+}
+
+func setupVersion1(f *frame.Frame) *frame.Frame {
+	header.PutUint32(f.Buf, header.FrameHeaderLength, setup.Version1)
+	return f
+}
+
+func withLengthPrefix(b []byte) []byte {
+	return append([]byte{byte(len(b) >> 16), byte(len(b) >> 8), byte(len(b))}, b...)
+}
+
+func TestEncodeGoldenFrames(t *testing.T) {
+	for _, golden := range goldenFrames {
+		out := &bytes.Buffer{}
+		if err := rsocket.NewEncoder(out).Write(golden.frame); err != nil {
+			t.Errorf("%s: %s", golden.name, err)
+			continue
+		}
+		if expected := withLengthPrefix(golden.wire); !bytes.Equal(out.Bytes(), expected) {
+			t.Errorf("%s:\nExpected: % x\nFound:    % x", golden.name, expected, out.Bytes())
+		}
+	}
+}
+
+func TestDecodeGoldenFrames(t *testing.T) {
+	for _, golden := range goldenFrames {
+		expected := golden.decoded
+		if expected == nil {
+			expected = golden.frame
+		}
+		decoder := rsocket.NewDecoder(bytes.NewReader(withLengthPrefix(golden.wire)), rsocket.MaxFrameSize, golden.receiver)
+
+		found := &frame.Frame{}
+		if err := decoder.Read(found); err != nil {
+			t.Errorf("%s: %s", golden.name, err)
+			continue
+		}
+		if !bytes.Equal(found.Buf, expected.Buf) {
+			t.Errorf("%s:\nExpected: %s\nFound:    %s\nExpected: % x\nFound:    % x",
+				golden.name, expected.Describe(), found.Describe(), expected.Buf, found.Buf)
+		}
+	}
+}
+
+func TestFragmentedRequestIsContinuedInPayloadFrames(t *testing.T) {
+	original := frame.RequestWithInitialN(1, 4, 0, header.FTRequestStream, bytes.Repeat([]byte{1}, 100), bytes.Repeat([]byte{2}, 200))
+	wire := &bytes.Buffer{}
+	encoder := rsocket.NewEncoder(wire)
+	var fragments int
+	fragment.Split(original.Copy(nil), fragment.MinMTU, func(f *frame.Frame) error {
+		fragments++
+		return encoder.Write(f)
+	})
+
+	// Check the frame types and flags on the wire
+	raw := bytes.NewReader(wire.Bytes())
+	for i := 0; i < fragments; i++ {
+		prefix := make([]byte, 3)
+		raw.Read(prefix)
+		f := make([]byte, int(prefix[0])<<16|int(prefix[1])<<8|int(prefix[2]))
+		raw.Read(f)
+
+		frameType, follows := f[4]>>2, f[5]&0x80 != 0
+		if i == 0 && frameType != 0x06 || i > 0 && frameType != 0x0a {
+			t.Errorf("Unexpected frame type %#x for fragment %d", frameType, i)
+		}
+		if follows != (i < fragments-1) {
+			t.Errorf("Expected follows flag to be set on all but the last fragment, fragment %d: %v", i, follows)
+		}
+	}
+
+	// And that it reassembles into the original
+	decoder := rsocket.NewDecoder(bytes.NewReader(wire.Bytes()), rsocket.MaxFrameSize, server)
+	reassembler := fragment.NewReassembler(1 << 20)
+	var whole *frame.Frame
+	for i := 0; i < fragments; i++ {
+		f := &frame.Frame{}
+		if err := decoder.Read(f); err != nil {
+			t.Fatal(err)
+		}
+		out, err := reassembler.Reassemble(f)
+		if err != nil {
+			t.Fatal(err)
+		}
+		whole = out
+	}
+	if whole == nil || !bytes.Equal(whole.Buf, original.Buf) {
+		t.Errorf("Expected %s, got %v", original.Describe(), whole)
+	}
+}
+
+func TestDecoderRejectsMalformedFrames(t *testing.T) {
+	for _, wire := range [][]byte{
+		{0x00, 0x00, 0x00, 0x01, 0x28},                         // Shorter than a header
+		{0x00, 0x00, 0x00, 0x01, 0x29, 0x20, 0x00, 0x00, 0x09}, // Metadata beyond the frame
+		{0x00, 0x00, 0x00, 0x01, 0x20, 0x00, 0x00},             // REQUEST_N without N
+		{0x00, 0x00, 0x00, 0x01, 0x28, 0x00, 'v'},              // PAYLOAD with no NEXT or COMPLETE
+		{0x00, 0x00, 0x00, 0x00, 0x08, 0x00, 0, 0, 0, 0, 0, 0}, // LEASE
+		{0x00, 0x00, 0x00, 0x00, 0x34, 0x00, 0, 1, 0, 0, 0, 9}, // RESUME with token beyond the frame
+	} {
+		decoder := rsocket.NewDecoder(bytes.NewReader(withLengthPrefix(wire)), rsocket.MaxFrameSize, client)
+		if err := decoder.Read(&frame.Frame{}); err == nil {
+			t.Errorf("Expected % x to be rejected", wire)
+		}
+	}
+}
+
+func TestDecoderRejectsFramesBeyondMaxSize(t *testing.T) {
+	wire := withLengthPrefix(append([]byte{0x00, 0x00, 0x00, 0x01, 0x28, 0x20}, make([]byte, 100)...))
+	decoder := rsocket.NewDecoder(bytes.NewReader(wire), 64, client)
+
+	if err := decoder.Read(&frame.Frame{}); err == nil {
+		t.Error("Expected oversized frame to be rejected")
+	}
+}
+
+func TestDecoderSkipsIgnorableFrames(t *testing.T) {
+	wire := withLengthPrefix([]byte{0x00, 0x00, 0x00, 0x00, 0xfe, 0x00, 1, 2, 3}) // EXT, with ignore
+	wire = append(wire, withLengthPrefix([]byte{0x00, 0x00, 0x00, 0x01, 0x24, 0x00})...)
+	decoder := rsocket.NewDecoder(bytes.NewReader(wire), rsocket.MaxFrameSize, server)
+
+	f := &frame.Frame{}
+	if err := decoder.Read(f); err != nil {
+		t.Fatal(err)
+	}
+	if f.Type() != header.FTCancel {
+		t.Errorf("Expected the ignorable frame to be skipped, got %s", f.Describe())
+	}
+}
@@ -1,59 +1,211 @@
 package trans
 
 import (
+	"bufio"
+	"errors"
 	"fmt"
 	"github.com/jakewins/reactivesocket-go/pkg/internal/codec/header"
+	"github.com/jakewins/reactivesocket-go/pkg/internal/codec/resume"
+	codecsetup "github.com/jakewins/reactivesocket-go/pkg/internal/codec/setup"
+	"github.com/jakewins/reactivesocket-go/pkg/internal/fragment"
 	"github.com/jakewins/reactivesocket-go/pkg/internal/frame"
 	"github.com/jakewins/reactivesocket-go/pkg/internal/frame/setup"
+	"github.com/jakewins/reactivesocket-go/pkg/internal/limit"
 	"github.com/jakewins/reactivesocket-go/pkg/internal/proto"
+	"github.com/jakewins/reactivesocket-go/pkg/internal/rsocket"
 	"github.com/jakewins/reactivesocket-go/pkg/rs"
+	"github.com/jakewins/reactivesocket-go/pkg/transport"
 	"io"
 	"net"
+	"os"
+	"time"
 )
 
+// Print every frame sent, received and ignored. Off by default, since it costs a
+// write to stdout per frame; set REACTIVESOCKET_TRACE to turn it on.
+var Trace = os.Getenv("REACTIVESOCKET_TRACE") != ""
+
+// Size of the buffer inbound frames are read through
+const readBufferSize = 64 * 1024
+
+// Returned by ReadSetupFrame when the client resumed an earlier session
+// rather than setting up a new one
+var errResumed = errors.New("Connection resumed an existing session.")
+
 // Exposes proto.Protocol over a net.Conn
 type ReactiveConn struct {
-	Id       int
-	Rwc      net.Conn
-	Setup    func(*ReactiveConn) (*rs.RequestHandler, error)
-	frame    frame.Frame
+	Id      int
+	Rwc     net.Conn
+	Setup   func(*ReactiveConn) (*rs.RequestHandler, error)
+	Options *transport.Options // Defaults are used if nil
+	// Server side; sessions clients may resume. Nil if resumption is not
+	// supported. Shared by all connections of a server.
+	Sessions *SessionStore
+	// Client side; dials a new connection to resume the session over, if
+	// Options enables resumption.
+	Redial func() (net.Conn, error)
+	// Server side; bounds streams across all connections of a server. Nil
+	// for no limit.
+	ServerStreams *limit.Limit
+	// Handed to the application with each request; set once the SETUP frame
+	// is read or written. A resumed session keeps the context of the
+	// connection that set it up.
+	Context rs.ConnectionContext
+
+	frame    frame.Frame // Only used during setup
 	Protocol *proto.Protocol
-	enc      *frame.FrameEncoder
-	dec      *frame.FrameDecoder
+	out      *frameWriter
+	dec      frame.Decoder
+	inbound  *fragment.Reassembler
+	// Set if the connection runs a resumable session
+	session     *session
+	resumeToken []byte
+	// Client side; as told to the server in SETUP
+	keepaliveInterval time.Duration
+
+	firstStreamId uint32
+	// Whether SETUP asked for the strict interpretation of the protocol
+	strict bool
+	// How requests made through Socket fare
+	health *health
 }
 
 // firstStreamId is used to start the stream id generator - you should set this
 // to 2 if you are implementing a server and 1 if you are implementing a client,
 // this maintains the odd/even invariant to separate clients and servers.
-func (c *ReactiveConn) Initialize(firstStreamId uint32) {
-	// TODO This should wrap in buffered io
-	c.dec = frame.NewFrameDecoder(c.Rwc)
-	c.enc = frame.NewFrameEncoder(c.Rwc)
+//
+// If Setup fails, the connection is closed and the error returned; Serve
+// must not be called. If the error is an *rs.Error, it is sent to the remote
+// on stream 0 before closing, see SetupRejected.
+func (c *ReactiveConn) Initialize(firstStreamId uint32) error {
+	if c.Options == nil {
+		c.Options, _ = transport.NewOptions()
+	}
+	c.firstStreamId = firstStreamId
+	c.health = newHealth()
+	c.open(firstStreamId)
+	// Ready before Setup, so the socket can be used from the setup handler;
+	// the request handler is filled in once Setup returns it
+	c.Protocol = proto.NewProtocol(&rs.RequestHandler{}, firstStreamId, c.sendOrRetain)
+	c.Protocol.StreamLimits = c.streamLimits()
+	c.Protocol.Trace = Trace
+	c.Protocol.MarkNext = c.Options.Format == transport.FormatRSocket1
+	c.Protocol.AdmissionTimeout = c.Options.AdmissionTimeout
 
 	// Handle Setup
 	handler, err := c.Setup(c)
+	if err == errResumed {
+		// ReadSetupFrame attached us to the session, which brings its own protocol
+		c.Protocol = c.session.protocol
+		c.start()
+		return nil
+	}
 	if err != nil {
-		// TODO: Note that c.Setup can fail either with an application code error,
-		// or with a network error from eg. ReadSetupFrame, below; we need to implement
-		// some sort of scheme to track the state of the conn, handling errors based on
-		// where we are at.
-		c.fatalError(err)
+		if rsErr, ok := err.(*rs.Error); ok {
+			// Tell the remote why; best effort, as we're closing regardless
+			c.out.writeNow(frame.Error(0, rsErr.Code, nil, []byte(rsErr.Message)))
+		}
+		c.Rwc.Close()
+		c.Protocol.Terminate(err)
+		return err
+	}
+
+	c.Protocol.Handler = handler
+	c.Protocol.Context = c.Context
+	c.Protocol.Strict = c.strict
+	if c.session != nil {
+		c.session.protocol = c.Protocol
+		if c.Sessions != nil {
+			c.Sessions.add(c.session)
+		} else {
+			c.session.redial = c.Redial
+			go c.session.keepalive(c.keepaliveInterval)
+		}
+	}
+
+	c.start()
+	return nil
+}
+
+// Frames of resumable sessions go through the session, which keeps them for
+// replay. The session is set up along with the SETUP frame, before the
+// protocol sends anything.
+func (c *ReactiveConn) sendOrRetain(f *frame.Frame) error {
+	if c.session != nil {
+		return c.session.send(f)
+	}
+	return c.sendFrame(f)
+}
+
+func (c *ReactiveConn) streamLimits() []*limit.Limit {
+	var limits []*limit.Limit
+	if l := limit.New(c.Options.MaxStreamsPerConnection); l != nil {
+		limits = append(limits, l)
+	}
+	if c.ServerStreams != nil {
+		limits = append(limits, c.ServerStreams)
+	}
+	return limits
+}
+
+// Refuse the connection, telling the remote why; for servers over their
+// connection limit. The connection must not be initialized.
+func (c *ReactiveConn) Reject(err *rs.Error) {
+	if c.Options == nil {
+		c.Options, _ = transport.NewOptions()
+	}
+	c.out = newFrameWriter(c.Rwc, c.Options.Format)
+	// Best effort, as we're closing regardless
+	c.out.writeNow(frame.Error(0, err.Code, nil, []byte(err.Message)))
+	c.Rwc.Close()
+}
+
+// Set up reading and writing frames, before any are exchanged
+func (c *ReactiveConn) open(firstStreamId uint32) {
+	in := bufio.NewReaderSize(c.Rwc, readBufferSize)
+	if c.Options.Format == transport.FormatRSocket1 {
+		c.dec = rsocket.NewDecoder(in, c.Options.MaxFrameSize, firstStreamId)
+	} else {
+		c.dec = frame.NewLimitedFrameDecoder(in, c.Options.MaxFrameSize)
 	}
+	c.out = newFrameWriter(c.Rwc, c.Options.Format)
+	c.inbound = fragment.NewReassembler(c.Options.MaxReassemblySize)
+}
 
-	c.Protocol = proto.NewProtocol(
-		handler,
-		firstStreamId,
-		func(f *frame.Frame) error {
-			fmt.Printf("[C%d] -> %s\n", c.Id, f.Describe())
-			return c.enc.Write(f)
-		},
-	)
+// Start writing queued frames, once setup is done
+func (c *ReactiveConn) start() {
+	if c.session != nil {
+		// Resume positions are fixed as frames are sent, and only agree with
+		// the remote if it reads them in that order. So sessions go without
+		// the scheduler, and streams don't get a fair share of the connection.
+		c.out.sched = nil
+	}
+	go func() {
+		if err := c.out.run(); err != nil {
+			// Closing the conn makes Serve see the failure and terminate the protocol
+			c.Rwc.Close()
+		}
+	}()
+	go func() {
+		// Once the protocol is done, eg. on a connection error, so is the
+		// conn; the error telling the remote why goes out first
+		select {
+		case <-c.Protocol.Done():
+			c.out.closeWhenWritten()
+		case <-c.out.closed:
+		}
+	}()
 }
 
+// Reads inbound frames and hands them to the protocol until the connection
+// fails. Each frame is read into a pooled buffer, which is released once the
+// protocol is done with it, unless the application has retained it.
 func (c *ReactiveConn) Serve() {
-	f := &c.frame
+	defer c.out.close()
 	for {
+		f := frame.Get()
 		if err := c.dec.Read(f); err != nil {
+			f.Release()
 			if err == io.EOF {
 				fmt.Printf("[C%d] <- EOF\n", c.Id)
 			}
@@ -63,49 +215,237 @@ func (c *ReactiveConn) Serve() {
 				}
 			}
 
-			c.Protocol.Terminate(err)
+			c.fail(err)
+			return
+		}
+
+		if Trace {
+			fmt.Printf("[C%d] <- %s\n", c.Id, f.Describe())
+		}
+
+		whole, err := c.inbound.Reassemble(f)
+		if err == nil && whole != nil && (whole.Type() == header.FTResume || whole.Type() == header.FTResumeOK) {
+			err = fmt.Errorf("Unexpected %s on an established connection.", whole.Describe())
+		}
+		if err != nil {
+			if whole != nil && whole != f {
+				whole.Release()
+			}
+			f.Release()
+			c.fail(err)
+			return
+		}
+		if c.session != nil && isResumable(f) {
+			c.session.read(c.wireLength(f), c.inbound.Buffered() == 0)
+		}
+		if whole != nil {
+			if c.session != nil {
+				c.session.receive(whole)
+			} else {
+				c.Protocol.HandleFrame(whole)
+			}
+			if whole != f {
+				whole.Release()
+			}
+		}
+		f.Release()
+	}
+}
+
+// Close the connection after it failed with err. Streams fail with it, unless
+// the connection runs a session that may be resumed.
+func (c *ReactiveConn) fail(err error) {
+	c.Rwc.Close()
+	if c.session != nil {
+		if c.Protocol.Err() == nil {
+			c.session.disconnected(c, err)
+			return
 		}
+		// Nothing left to resume
+		c.session.close(err)
+	}
+	c.Protocol.Terminate(err)
+}
+
+// Close the connection for good, failing open streams with
+// rs.ErrSocketClosed. A resumable session is closed too, rather than resumed.
+func (c *ReactiveConn) Close() error {
+	if c.session != nil {
+		// Before closing the conn, so its failure doesn't trigger a resume
+		c.session.close(rs.ErrSocketClosed)
+	}
+	err := c.Rwc.Close()
+	c.Protocol.Terminate(rs.ErrSocketClosed)
+	return err
+}
+
+// The client side socket of the connection
+func (c *ReactiveConn) Socket() rs.ClosableSocket {
+	return &socket{c.Protocol, c}
+}
+
+type socket struct {
+	*proto.Protocol
+	conn *ReactiveConn
+}
+
+func (s *socket) Close() error {
+	return s.conn.Close()
+}
+
+// None once closed, and half while waiting to resume a session; requests made
+// meanwhile go out only if it resumes. Scaled down by how many requests fail
+// lately, and by how much slower they are answered than usual.
+// TODO: Factor in leases, once we honor them
+func (s *socket) Availability() float64 {
+	select {
+	case <-s.Done():
+		return 0
+	default:
+	}
+	score := s.conn.health.score()
+	if s.conn.session != nil && !s.conn.session.isConnected() {
+		score *= 0.5
+	}
+	return score
+}
+
+// Only responses and streams are answered at the remote's pace; subscriptions
+// answer when there is something to publish, and channels at the requester's
+// pace, so their timing says nothing of the remote.
+func (s *socket) RequestResponse(p rs.Payload) rs.Publisher {
+	return s.conn.health.track(s.Protocol.RequestResponse(p), true)
+}
+func (s *socket) RequestStream(p rs.Payload) rs.Publisher {
+	return s.conn.health.track(s.Protocol.RequestStream(p), true)
+}
+func (s *socket) RequestSubscription(p rs.Payload) rs.Publisher {
+	return s.conn.health.track(s.Protocol.RequestSubscription(p), false)
+}
+func (s *socket) RequestChannel(p rs.Publisher) rs.Publisher {
+	return s.conn.health.track(s.Protocol.RequestChannel(p), false)
+}
+
+// Size of f, just read, as it was on the wire
+func (c *ReactiveConn) wireLength(f *frame.Frame) int {
+	if dec, ok := c.dec.(*rsocket.Decoder); ok {
+		return dec.Length()
+	}
+	return len(f.Buf)
+}
 
-		fmt.Printf("[C%d] <- %s\n", c.Id, f.Describe())
+// Send f, split into fragments if it exceeds the MTU
+func (c *ReactiveConn) sendFrame(f *frame.Frame) error {
+	if c.Options.MTU > 0 {
+		return fragment.Split(f, c.Options.MTU, c.send)
+	}
+	return c.send(f)
+}
 
-		c.Protocol.HandleFrame(f)
+func (c *ReactiveConn) send(f *frame.Frame) error {
+	if Trace {
+		fmt.Printf("[C%d] -> %s\n", c.Id, f.Describe())
 	}
+	return c.out.send(f)
 }
 
-// When implementing a server, this reads the initial setup frame
+// When implementing a server, this reads the initial setup frame. If the
+// client instead resumes an earlier session, the connection is attached to it
+// and an error is returned that Setup should return as-is; no handler is
+// needed, the session keeps the one it was set up with.
 func (c *ReactiveConn) ReadSetupFrame() (rs.ConnectionSetupPayload, error) {
 	f := &c.frame
 	if err := c.dec.Read(f); err != nil {
 		return nil, err
 	}
-	if f.Type() != header.FTSetup {
-		return nil, fmt.Errorf("Expected first frame to be SETUP, got %d.", f.Type())
+	if f.Type() == header.FTResume {
+		return nil, c.resumeSession(f)
+	}
+	if f.Type() != header.FTSetup || !codecsetup.IsWellFormed(f.Buf) {
+		return nil, rs.NewError(rs.ErrorCodeInvalidSetup,
+			fmt.Sprintf("Expected first frame to be a valid SETUP, got type %d.", f.Type()))
+	}
+	var version uint32
+	if c.Options.Format == transport.FormatRSocket1 {
+		version = setup.Version1
 	}
-	if setup.Version(f) != 0 {
-		return nil, fmt.Errorf("Expected version to be 0, got %d", setup.Version(f))
+	if setup.Version(f) != version {
+		return nil, rs.NewError(rs.ErrorCodeUnsupportedSetup,
+			fmt.Sprintf("Expected version to be %d, got %d", version, setup.Version(f)))
 	}
+	if token := setup.ResumeToken(f); token != nil {
+		if c.Sessions == nil {
+			return nil, rs.NewError(rs.ErrorCodeUnsupportedSetup, "Resumption is not supported.")
+		}
+		if c.Sessions.get(token) != nil {
+			return nil, rs.NewError(rs.ErrorCodeRejectedSetup, "Resume token is already in use.")
+		}
+		c.resumeToken = append([]byte{}, token...)
+		c.newSession()
+	}
+	c.strict = setup.Flags(f)&setup.FlagStrictInterpretation != 0
 
-	return rs.NewSetupPayload(
+	c.Context = rs.NewConnectionContext(c.Id, c.Rwc.LocalAddr(), c.Rwc.RemoteAddr(), rs.NewSetupPayload(
 		setup.MetadataMimeType(f),
 		setup.DataMimeType(f),
 		f.Metadata(),
 		f.Data(),
-	), nil
+	))
+	return c.Context.Setup(), nil
 }
 
-// When implementing a client, this writes the initial setup frame
+// Server side; attach to the session the client asks to resume
+func (c *ReactiveConn) resumeSession(f *frame.Frame) error {
+	if c.Sessions == nil {
+		return rs.NewError(rs.ErrorCodeRejectedResume, "Resumption is not supported.")
+	}
+	if !resume.IsWellFormed(f.Buf) {
+		return rs.NewError(rs.ErrorCodeInvalid, "Malformed RESUME frame.")
+	}
+	s := c.Sessions.get(resume.ResumeToken(f.Buf))
+	if s == nil {
+		return rs.NewError(rs.ErrorCodeRejectedResume, "No session to resume for the given token.")
+	}
+	if err := s.resume(c, resume.LastReceivedPosition(f.Buf), resume.FirstAvailablePosition(f.Buf), f); err != nil {
+		return err
+	}
+	return errResumed
+}
+
+// When implementing a client, this writes the initial setup frame. If Options
+// enables resumption and Redial is set, the client asks for a resumable
+// session.
 func (c *ReactiveConn) WriteSetupFrame(keepaliveInterval, maxLifetime uint32, setupPayload rs.ConnectionSetupPayload) error {
+	if c.Options.ResumeTimeout > 0 && c.Redial != nil {
+		c.resumeToken = newResumeToken()
+		c.keepaliveInterval = time.Duration(keepaliveInterval) * time.Millisecond
+		c.newSession()
+	}
+	var flags uint16
+	if c.Options.StrictInterpretation {
+		c.strict = true
+		flags |= setup.FlagStrictInterpretation
+	}
 	f := &c.frame
-	if err := c.enc.Write(frame.EncodeSetup(f, 0, keepaliveInterval, maxLifetime,
+	if err := c.out.writeNow(frame.EncodeResumableSetup(f, flags, keepaliveInterval, maxLifetime, c.resumeToken,
 		setupPayload.MetadataMimeType(), setupPayload.DataMimeType(),
 		setupPayload.Metadata(), setupPayload.Data())); err != nil {
 		return err
 	}
+	c.Context = rs.NewConnectionContext(c.Id, c.Rwc.LocalAddr(), c.Rwc.RemoteAddr(), setupPayload)
 	return nil
 }
 
-func (c *ReactiveConn) fatalError(err error) {
-	fmt.Println("Programmer failed to write error handling")
-	c.Rwc.Close()
-	panic(err) // TODO
+func (c *ReactiveConn) newSession() {
+	c.session = newSession(c.resumeToken, c.firstStreamId, c.Options)
+	c.session.conn = c
+}
+
+// Wrap an error returned by a ConnectionSetupHandler, so the client is told its
+// setup was rejected. Errors that already are *rs.Error are sent as-is.
+func SetupRejected(err error) error {
+	if _, ok := err.(*rs.Error); ok {
+		return err
+	}
+	return rs.NewError(rs.ErrorCodeRejectedSetup, err.Error())
 }
@@ -0,0 +1,274 @@
+package trans
+
+import (
+	"errors"
+	"fmt"
+	"github.com/jakewins/reactivesocket-go/pkg/internal/codec/errorc"
+	"github.com/jakewins/reactivesocket-go/pkg/internal/codec/header"
+	codecsetup "github.com/jakewins/reactivesocket-go/pkg/internal/codec/setup"
+	"github.com/jakewins/reactivesocket-go/pkg/internal/frame"
+	"github.com/jakewins/reactivesocket-go/pkg/rs"
+	"github.com/jakewins/reactivesocket-go/pkg/transport"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestOversizedFrameFailsConnection(t *testing.T) {
+	local, remote := net.Pipe()
+	defer remote.Close()
+	options, _ := transport.NewOptions(transport.WithMaxFrameSize(1024))
+	c := &ReactiveConn{
+		Rwc:     local,
+		Options: options,
+		Setup: func(*ReactiveConn) (*rs.RequestHandler, error) {
+			return &rs.RequestHandler{}, nil
+		},
+	}
+	c.Initialize(2)
+
+	var failed error
+	c.Protocol.RequestStream(rs.NewPayload(nil, nil)).Subscribe(rs.NewSubscriber(func(s rs.Subscription) {
+		s.Request(1)
+	}, func(p rs.Payload) {}, func(err error) {
+		failed = err
+	}, func() {}))
+
+	served := make(chan struct{})
+	go func() {
+		c.Serve()
+		close(served)
+	}()
+	go remote.Read(make([]byte, 64)) // Drain the request
+	remote.Write([]byte{0xff, 0xff, 0xff, 0xff})
+
+	select {
+	case <-served:
+	case <-time.After(5 * time.Second):
+		t.Fatal("Expected connection to fail on an oversized frame")
+	}
+	if _, ok := failed.(*frame.MalformedFrameError); !ok {
+		t.Errorf("Expected open streams to fail with a malformed frame error, got %v", failed)
+	}
+}
+
+func TestServerTellsClientWhySetupFailed(t *testing.T) {
+	unsupportedVersion := frame.Setup(0, 1000, 0, "a", "b", nil, nil)
+	codecsetup.SetVersion(unsupportedVersion.Buf, 5)
+	truncated := frame.Setup(0, 1000, 0, "a", "b", nil, nil)
+	truncated.Buf = truncated.Buf[:header.FrameHeaderLength+4]
+
+	for _, c := range []struct {
+		setup *frame.Frame
+		code  uint32
+	}{
+		{frame.Setup(0, 1000, 0, "a", "b", nil, nil), errorc.ECRejectedSetup},
+		{unsupportedVersion, errorc.ECUnsupportedSetup},
+		{truncated, errorc.ECInvalidSetup},
+		{frame.Keepalive(false), errorc.ECInvalidSetup},
+	} {
+		local, remote := net.Pipe()
+		conn := &ReactiveConn{
+			Rwc: local,
+			Setup: func(c *ReactiveConn) (*rs.RequestHandler, error) {
+				if _, err := c.ReadSetupFrame(); err != nil {
+					return nil, err
+				}
+				return nil, SetupRejected(errors.New("go away"))
+			},
+		}
+		initialized := make(chan error, 1)
+		go func() { initialized <- conn.Initialize(2) }()
+
+		frame.NewFrameEncoder(remote).Write(c.setup)
+		reply := &frame.Frame{}
+		if err := frame.NewFrameDecoder(remote).Read(reply); err != nil {
+			t.Fatal(err)
+		}
+		remote.Close()
+
+		if reply.Type() != header.FTError || reply.StreamID() != 0 || errorc.ErrorCode(reply.Buf) != c.code {
+			t.Errorf("Expected ERROR[%d] on stream 0, got %s", c.code, reply.Describe())
+		}
+		if c.code == errorc.ECRejectedSetup && string(reply.Data()) != "go away" {
+			t.Errorf("Expected rejection to carry the handlers message, got %q", reply.Data())
+		}
+		if err, ok := (<-initialized).(*rs.Error); !ok || err.Code != c.code {
+			t.Errorf("Expected Initialize to fail with code %d, got %v", c.code, err)
+		}
+	}
+}
+
+func TestHandlersSeeTheConnectionContext(t *testing.T) {
+	local, remote := net.Pipe()
+	defer remote.Close()
+	contexts := make(chan rs.ConnectionContext, 1)
+	c := &ReactiveConn{
+		Id:  7,
+		Rwc: local,
+		Setup: func(c *ReactiveConn) (*rs.RequestHandler, error) {
+			sp, err := c.ReadSetupFrame()
+			if err != nil {
+				return nil, err
+			}
+			rs.ContextOf(sp).SetValue("tenant", string(sp.Data()))
+			return &rs.RequestHandler{
+				HandleRequestResponse: func(p rs.Payload) rs.Publisher {
+					contexts <- rs.ContextOf(p)
+					return rs.NewEmptyPublisher()
+				},
+			}, nil
+		},
+	}
+	go func() {
+		if c.Initialize(2) == nil {
+			c.Serve()
+		}
+	}()
+	go func() {
+		for {
+			if _, err := remote.Read(make([]byte, 64)); err != nil {
+				return
+			}
+		}
+	}()
+	enc := frame.NewFrameEncoder(remote)
+	enc.Write(frame.Setup(0, 1000, 0, "meta", "data", nil, []byte("acme")))
+	enc.Write(frame.Request(1, 0, header.FTRequestResponse, nil, nil))
+
+	var ctx rs.ConnectionContext
+	select {
+	case ctx = <-contexts:
+	case <-time.After(5 * time.Second):
+		t.Fatal("Expected the request to be handled")
+	}
+	if ctx == nil || ctx.Id() != 7 || ctx.RemoteAddr() == nil {
+		t.Fatalf("Expected the context of connection 7, got %v", ctx)
+	}
+	if ctx.Setup().DataMimeType() != "data" || string(ctx.Setup().Data()) != "acme" {
+		t.Errorf("Expected the setup payload, got %s and %s", ctx.Setup().DataMimeType(), ctx.Setup().Data())
+	}
+	if ctx.Value("tenant") != "acme" {
+		t.Errorf("Expected the value set during setup, got %v", ctx.Value("tenant"))
+	}
+}
+
+func TestSetupHandlerCanRequestFromClient(t *testing.T) {
+	local, remote := net.Pipe()
+	values := make(chan string, 10)
+	server := &ReactiveConn{
+		Rwc: remote,
+		Setup: func(c *ReactiveConn) (*rs.RequestHandler, error) {
+			if _, err := c.ReadSetupFrame(); err != nil {
+				return nil, err
+			}
+			c.Socket().RequestStream(rs.NewPayload(nil, nil)).Subscribe(rs.NewSubscriber(func(s rs.Subscription) {
+				s.Request(10)
+			}, func(p rs.Payload) {
+				values <- string(p.Data())
+			}, nil, nil))
+			return &rs.RequestHandler{}, nil
+		},
+	}
+	go func() {
+		if err := server.Initialize(2); err == nil {
+			server.Serve()
+		}
+	}()
+	client := &ReactiveConn{
+		Rwc: local,
+		Setup: func(c *ReactiveConn) (*rs.RequestHandler, error) {
+			return &rs.RequestHandler{HandleRequestStream: countToTen}, c.WriteSetupFrame(1000, 0, rs.NewSetupPayload("", "", nil, nil))
+		},
+	}
+	if err := client.Initialize(1); err != nil {
+		t.Fatal(err)
+	}
+	go client.Serve()
+	defer client.Close()
+
+	for i := 0; i < 10; i++ {
+		expectValue(t, values, fmt.Sprintf("%d", i))
+	}
+}
+
+func TestStrictSetupFailsConnectionOnDeviation(t *testing.T) {
+	for _, strict := range []bool{true, false} {
+		local, remote := net.Pipe()
+		c := &ReactiveConn{
+			Rwc: local,
+			Setup: func(c *ReactiveConn) (*rs.RequestHandler, error) {
+				if _, err := c.ReadSetupFrame(); err != nil {
+					return nil, err
+				}
+				return &rs.RequestHandler{
+					HandleRequestResponse: func(p rs.Payload) rs.Publisher {
+						return rs.NewEmptyPublisher()
+					},
+				}, nil
+			},
+		}
+		go func() {
+			if c.Initialize(2) == nil {
+				c.Serve()
+			}
+		}()
+
+		var flags uint16
+		if strict {
+			flags = codecsetup.SetupFlagStrictInterpretation
+		}
+		enc := frame.NewFrameEncoder(remote)
+		enc.Write(frame.Setup(flags, 1000, 0, "a", "b", nil, nil))
+		enc.Write(frame.Request(1, 0, header.FTRequestResponse, nil, nil))
+		// Asking for nothing is not allowed
+		enc.Write(frame.RequestN(1, 0))
+		enc.Write(frame.Request(3, 0, header.FTRequestResponse, nil, nil))
+
+		// Replies by stream, until stream 3 is answered or the connection closes
+		replies := make(map[uint32]uint32)
+		dec := frame.NewFrameDecoder(remote)
+		for replies[3] == 0 {
+			reply := &frame.Frame{}
+			if err := dec.Read(reply); err != nil {
+				break
+			}
+			replies[reply.StreamID()] = uint32(reply.Type())
+			if reply.Type() == header.FTError {
+				replies[reply.StreamID()] = errorc.ErrorCode(reply.Buf)
+			}
+		}
+		if strict && (replies[0] != errorc.ECConnectionError || replies[3] != 0) {
+			t.Errorf("Expected a connection error in strict mode, and no more requests handled, got %v", replies)
+		}
+		if !strict && (replies[0] != 0 || replies[3] == 0) {
+			t.Errorf("Expected the deviation to be let go otherwise, got %v", replies)
+		}
+		remote.Close()
+	}
+}
+
+func TestRequestsAfterCloseFail(t *testing.T) {
+	local, remote := net.Pipe()
+	defer remote.Close()
+	c := &ReactiveConn{
+		Rwc: local,
+		Setup: func(*ReactiveConn) (*rs.RequestHandler, error) {
+			return &rs.RequestHandler{}, nil
+		},
+	}
+	c.Initialize(1)
+	go c.Serve()
+	socket := c.Socket()
+	socket.Close()
+
+	var failed error
+	socket.FireAndForget(rs.NewPayload(nil, nil)).Subscribe(rs.NewSubscriber(func(s rs.Subscription) {
+		s.Request(1)
+	}, nil, func(err error) {
+		failed = err
+	}, nil))
+	if failed != rs.ErrSocketClosed {
+		t.Errorf("Expected fire and forget on a closed socket to fail, got %v", failed)
+	}
+}
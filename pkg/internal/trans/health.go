@@ -0,0 +1,147 @@
+package trans
+
+import (
+	"github.com/jakewins/reactivesocket-go/pkg/rs"
+	"math"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	// Weight of the newest outcome in the error rate
+	errorDecay = 0.2
+	// Weights of the newest latency sample in the recent and long run
+	// latency averages
+	recentLatencyDecay   = 0.5
+	baselineLatencyDecay = 0.05
+	// How long it takes for a bad spell to be half forgotten, so a socket
+	// nobody sends to, for being unavailable, gets another chance
+	healthHalfLife = 10 * time.Second
+)
+
+// How requests on a connection fare: the share that fail, and how much
+// slower they are answered lately than in the long run. Both fade back to
+// healthy over time.
+type health struct {
+	now func() time.Time
+
+	lock      sync.Mutex
+	updated   time.Time
+	errorRate float64
+	// Time to first response, recently and in the long run; zero until the
+	// first response
+	recent   float64
+	baseline float64
+}
+
+func newHealth() *health {
+	return &health{now: time.Now}
+}
+
+// From 0, every request fails, to 1, none do and they are as fast as ever
+func (h *health) score() float64 {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	h.fade()
+	score := 1 - h.errorRate
+	if h.recent > h.baseline {
+		score *= h.baseline / h.recent
+	}
+	return score
+}
+
+func (h *health) succeeded(latency time.Duration) {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	h.fade()
+	h.errorRate *= 1 - errorDecay
+	h.sample(latency)
+}
+
+// Like succeeded, for requests whose latency says nothing of the remote
+func (h *health) succeededUntimed() {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	h.fade()
+	h.errorRate *= 1 - errorDecay
+}
+
+// Add latency to the averages. Must hold lock.
+func (h *health) sample(latency time.Duration) {
+	sample := float64(latency)
+	if h.baseline == 0 {
+		h.recent, h.baseline = sample, sample
+		return
+	}
+	h.recent = h.recent*(1-recentLatencyDecay) + sample*recentLatencyDecay
+	h.baseline = h.baseline*(1-baselineLatencyDecay) + sample*baselineLatencyDecay
+}
+
+func (h *health) failed() {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	h.fade()
+	h.errorRate = h.errorRate*(1-errorDecay) + errorDecay
+}
+
+// Move towards healthy for the time since the last update. Must hold lock.
+func (h *health) fade() {
+	now := h.now()
+	if !h.updated.IsZero() {
+		keep := math.Pow(0.5, float64(now.Sub(h.updated))/float64(healthHalfLife))
+		h.errorRate *= keep
+		h.recent = h.baseline + (h.recent-h.baseline)*keep
+	}
+	h.updated = now
+}
+
+// Note whether pub fails, timing its first response if timed is set
+func (h *health) track(pub rs.Publisher, timed bool) rs.Publisher {
+	return rs.NewPublisher(func(s rs.Subscriber) {
+		pub.Subscribe(&trackedSubscriber{health: h, subscriber: s, start: h.now(), timed: timed})
+	})
+}
+
+type trackedSubscriber struct {
+	health     *health
+	subscriber rs.Subscriber
+	start      time.Time
+	timed      bool
+	observed   int32
+}
+
+func (t *trackedSubscriber) OnSubscribe(s rs.Subscription) {
+	t.subscriber.OnSubscribe(s)
+}
+func (t *trackedSubscriber) OnNext(p rs.Payload) {
+	t.answered(nil)
+	t.subscriber.OnNext(p)
+}
+func (t *trackedSubscriber) OnError(err error) {
+	t.answered(err)
+	t.subscriber.OnError(err)
+}
+func (t *trackedSubscriber) OnComplete() {
+	t.answered(nil)
+	t.subscriber.OnComplete()
+}
+
+func (t *trackedSubscriber) answered(err error) {
+	if !atomic.CompareAndSwapInt32(&t.observed, 0, 1) {
+		return
+	}
+	if e, ok := err.(*rs.Error); ok && e.Code == rs.ErrorCodeApplicationError {
+		// The application failing the request says nothing of the connection
+		err = nil
+	}
+	if err != nil {
+		t.health.failed()
+		return
+	}
+	if !t.timed {
+		t.health.succeededUntimed()
+		return
+	}
+	t.health.succeeded(t.health.now().Sub(t.start))
+}
@@ -0,0 +1,102 @@
+package trans
+
+import (
+	"errors"
+	"github.com/jakewins/reactivesocket-go/pkg/rs"
+	"testing"
+	"time"
+)
+
+func TestFailuresLowerHealthUntilTheyFade(t *testing.T) {
+	h, clock := fakeHealth()
+	h.succeeded(time.Millisecond)
+	if score := h.score(); score != 1 {
+		t.Fatalf("Expected a healthy score, got %f", score)
+	}
+
+	last := 1.0
+	for i := 0; i < 5; i++ {
+		h.failed()
+		score := h.score()
+		if score >= last {
+			t.Fatalf("Expected every failure to lower the score, went from %f to %f", last, score)
+		}
+		last = score
+	}
+
+	*clock = clock.Add(healthHalfLife)
+	if score := h.score(); score <= last {
+		t.Errorf("Expected the score to recover over time, went from %f to %f", last, score)
+	}
+}
+
+func TestSlowResponsesLowerHealth(t *testing.T) {
+	h, clock := fakeHealth()
+	for i := 0; i < 10; i++ {
+		h.succeeded(time.Millisecond)
+	}
+	h.succeeded(100 * time.Millisecond)
+	slow := h.score()
+	if slow >= 0.5 {
+		t.Errorf("Expected a latency spike to lower the score, got %f", slow)
+	}
+
+	*clock = clock.Add(5 * healthHalfLife)
+	if score := h.score(); score <= slow {
+		t.Errorf("Expected the score to recover over time, went from %f to %f", slow, score)
+	}
+}
+
+func TestTrackedRequestsThatFailLowerHealth(t *testing.T) {
+	h, _ := fakeHealth()
+
+	failing := h.track(rs.NewErrorPublisher(errors.New("Connection reset.")), true)
+	failing.Subscribe(rs.NewSubscriber(func(s rs.Subscription) { s.Request(1) },
+		func(rs.Payload) {}, func(error) {}, func() {}))
+	afterFailure := h.score()
+	if afterFailure >= 1 {
+		t.Errorf("Expected a failed request to lower the score, got %f", afterFailure)
+	}
+
+	rejected := h.track(rs.NewErrorPublisher(rs.NewError(rs.ErrorCodeApplicationError, "No such thing.")), true)
+	rejected.Subscribe(rs.NewSubscriber(func(s rs.Subscription) { s.Request(1) },
+		func(rs.Payload) {}, func(error) {}, func() {}))
+	if score := h.score(); score < afterFailure {
+		t.Errorf("Expected application errors not to lower the score, went from %f to %f", afterFailure, score)
+	}
+}
+
+func TestIdleSubscriptionsLeaveHealthAlone(t *testing.T) {
+	h, clock := fakeHealth()
+	h.succeeded(time.Millisecond)
+
+	// Publishes a minute after being subscribed to
+	var subscription rs.Subscription
+	idle := h.track(rs.NewPublisher(func(s rs.Subscriber) {
+		s.OnSubscribe(rs.NewSubscription(func(n int) {
+			s.OnNext(rs.NewPayload(nil, []byte("news")))
+		}, func() {}))
+	}), false)
+	idle.Subscribe(rs.NewSubscriber(func(s rs.Subscription) { subscription = s },
+		func(rs.Payload) {}, func(error) {}, func() {}))
+	*clock = clock.Add(time.Minute)
+	subscription.Request(1)
+	if score := h.score(); score != 1 {
+		t.Errorf("Expected an idle subscription to leave the score alone, got %f", score)
+	}
+
+	failing := h.track(rs.NewErrorPublisher(errors.New("Connection reset.")), false)
+	failing.Subscribe(rs.NewSubscriber(func(s rs.Subscription) { s.Request(1) },
+		func(rs.Payload) {}, func(error) {}, func() {}))
+	if score := h.score(); score >= 1 {
+		t.Errorf("Expected a failed subscription to lower the score, got %f", score)
+	}
+}
+
+// Health on a clock that only moves when told to
+func fakeHealth() (*health, *time.Time) {
+	clock := time.Unix(0, 0)
+	h := newHealth()
+	h.now = func() time.Time { return clock }
+	return h, &clock
+}
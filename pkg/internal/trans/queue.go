@@ -0,0 +1,73 @@
+package trans
+
+import (
+	"github.com/jakewins/reactivesocket-go/pkg/internal/frame"
+	"sync"
+	"sync/atomic"
+	"unsafe"
+)
+
+// Unbounded multi-producer, single-consumer queue of frames. Producers never
+// block or take locks; a push is a single atomic swap. This is the intrusive
+// MPSC queue described by Dmitry Vyukov, with nodes recycled through a pool.
+//
+// Producers call push, one consumer goroutine calls pop and waits on ready
+// when the queue appears empty.
+type frameQueue struct {
+	// Most recently pushed node, swapped in by producers
+	head unsafe.Pointer
+	// Consumer-owned; a dummy node whose successor is the next frame to pop
+	tail *node
+	// Signalled after each push, so the consumer knows to look again
+	ready chan struct{}
+}
+
+type node struct {
+	next unsafe.Pointer
+	f    *frame.Frame
+}
+
+var nodes = sync.Pool{
+	New: func() interface{} {
+		return &node{}
+	},
+}
+
+func newFrameQueue() *frameQueue {
+	dummy := &node{}
+	return &frameQueue{
+		head:  unsafe.Pointer(dummy),
+		tail:  dummy,
+		ready: make(chan struct{}, 1),
+	}
+}
+
+// Called by any goroutine
+func (q *frameQueue) push(f *frame.Frame) {
+	n := nodes.Get().(*node)
+	n.f = f
+	atomic.StorePointer(&n.next, nil)
+	prev := (*node)(atomic.SwapPointer(&q.head, unsafe.Pointer(n)))
+	atomic.StorePointer(&prev.next, unsafe.Pointer(n))
+
+	select {
+	case q.ready <- struct{}{}:
+	default:
+	}
+}
+
+// Called only by the consumer goroutine. Returns nil if the queue is empty,
+// or if a producer is midway through a push; that producer will signal ready
+// once it is done.
+func (q *frameQueue) pop() *frame.Frame {
+	tail := q.tail
+	next := (*node)(atomic.LoadPointer(&tail.next))
+	if next == nil {
+		return nil
+	}
+	q.tail = next
+	f := next.f
+	next.f = nil
+	nodes.Put(tail)
+	return f
+}
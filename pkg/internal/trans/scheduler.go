@@ -0,0 +1,89 @@
+package trans
+
+import (
+	"github.com/jakewins/reactivesocket-go/pkg/internal/codec/header"
+	"github.com/jakewins/reactivesocket-go/pkg/internal/frame"
+)
+
+// Bytes each stream with frames queued gets to write per round
+const schedulerQuantum = 16 * 1024
+
+// Decides the order queued frames are written in, so one stream sending a
+// burst of large frames doesn't hold up the others. Streams take turns,
+// each writing up to a quantum of bytes per round (deficit round robin), so
+// streams get an equal share of bytes whatever their frame sizes. Control
+// frames jump the line, unless frames of their own stream are still queued,
+// in which case they wait behind those to keep the order within the stream.
+//
+// Only used by the writer goroutine.
+type scheduler struct {
+	urgent []*frame.Frame
+	// Streams with frames queued, by id, and in the order of their turns
+	streams map[uint32]*streamQueue
+	turns   []*streamQueue
+}
+
+type streamQueue struct {
+	id      uint32
+	frames  []*frame.Frame
+	deficit int
+}
+
+func newScheduler() *scheduler {
+	return &scheduler{streams: make(map[uint32]*streamQueue)}
+}
+
+func (s *scheduler) add(f *frame.Frame) {
+	id := f.StreamID()
+	q := s.streams[id]
+	if q == nil && (id == 0 || isControl(f)) {
+		s.urgent = append(s.urgent, f)
+		return
+	}
+	if q == nil {
+		q = &streamQueue{id: id}
+		s.streams[id] = q
+		s.turns = append(s.turns, q)
+	}
+	q.frames = append(q.frames, f)
+}
+
+// The next frame to write, or nil if there are none
+func (s *scheduler) next() *frame.Frame {
+	if len(s.urgent) > 0 {
+		f := s.urgent[0]
+		s.urgent[0] = nil
+		s.urgent = s.urgent[1:]
+		return f
+	}
+	for len(s.turns) > 0 {
+		q := s.turns[0]
+		f := q.frames[0]
+		if len(f.Buf) > q.deficit {
+			// Out of bytes this round; go to the back, with more for next round
+			q.deficit += schedulerQuantum
+			s.turns[0] = nil
+			s.turns = append(s.turns[1:], q)
+			continue
+		}
+		q.deficit -= len(f.Buf)
+		q.frames[0] = nil
+		q.frames = q.frames[1:]
+		if len(q.frames) == 0 {
+			s.turns[0] = nil
+			s.turns = s.turns[1:]
+			delete(s.streams, q.id)
+		}
+		return f
+	}
+	return nil
+}
+
+// Small frames that steer streams or the connection, rather than carry data
+func isControl(f *frame.Frame) bool {
+	switch f.Type() {
+	case header.FTCancel, header.FTRequestN, header.FTKeepAlive, header.FTError, header.FTLease:
+		return true
+	}
+	return false
+}
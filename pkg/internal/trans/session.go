@@ -0,0 +1,455 @@
+package trans
+
+import (
+	"bytes"
+	"crypto/rand"
+	"errors"
+	"fmt"
+	"github.com/jakewins/reactivesocket-go/pkg/internal/codec/header"
+	"github.com/jakewins/reactivesocket-go/pkg/internal/codec/keepalive"
+	"github.com/jakewins/reactivesocket-go/pkg/internal/codec/resume"
+	"github.com/jakewins/reactivesocket-go/pkg/internal/fragment"
+	"github.com/jakewins/reactivesocket-go/pkg/internal/frame"
+	"github.com/jakewins/reactivesocket-go/pkg/internal/frame/errorc"
+	"github.com/jakewins/reactivesocket-go/pkg/internal/frame/setup"
+	"github.com/jakewins/reactivesocket-go/pkg/internal/proto"
+	"github.com/jakewins/reactivesocket-go/pkg/internal/rsocket"
+	"github.com/jakewins/reactivesocket-go/pkg/rs"
+	"github.com/jakewins/reactivesocket-go/pkg/transport"
+	"net"
+	"sync"
+	"time"
+)
+
+// How long a client waits between attempts to resume a session
+const resumeRetryInterval = 250 * time.Millisecond
+
+var errSessionClosed = errors.New("Session was closed by the remote.")
+
+// A resumable session sits between a Protocol and the connection it runs on,
+// letting the protocol outlive the connection. Every resumable frame sent is
+// retained until the remote acknowledges it, so a new connection can pick up
+// where the old one left off by replaying what the remote missed.
+//
+// Like in RSocket, progress is tracked by implied positions: the total size of
+// resumable frames sent or received on the session so far. Frames are counted
+// as they are on the wire, fragment by fragment and without their length
+// prefixes, so positions agree with any RSocket 1.0 peer. Each end tells the
+// other how far it has read in every keepalive, and in the RESUME/RESUME_OK
+// handshake when reconnecting.
+//
+// Sent frames are retained as encoded for the wire, and replayed as-is, so a
+// resume may start part way through a fragmented frame.
+type session struct {
+	token         []byte
+	firstStreamId uint32
+	options       *transport.Options
+	protocol      *proto.Protocol
+	// Client side; dials a new connection to resume over
+	redial func() (net.Conn, error)
+	// Server side; where the session is kept while disconnected
+	store *SessionStore
+
+	lock sync.Mutex
+	// Nil while disconnected
+	conn   *ReactiveConn
+	closed bool
+	// Encodes sent frames into encoded, to be retained
+	enc          frame.Encoder
+	encoded      bytes.Buffer
+	prefixLength int
+	// Sent frames the remote has not acknowledged, oldest first
+	retained      []wireFrame
+	retainedBytes int
+	// Position of retained[0], and of the next frame to be sent
+	firstAvailable, sent uint64
+	// Position of the next frame to be received
+	received uint64
+	// Received since the last point no frame was partly reassembled; only
+	// counted once there is such a point again
+	unconfirmed uint64
+	// Server side; closes the session if it isn't resumed in time
+	expiry *time.Timer
+}
+
+// A sent frame as it went on the wire, length prefix included
+type wireFrame struct {
+	buf []byte
+	// What it moves the implied position by
+	size int
+}
+
+func newSession(token []byte, firstStreamId uint32, options *transport.Options) *session {
+	s := &session{
+		token:         token,
+		firstStreamId: firstStreamId,
+		options:       options,
+	}
+	if options.Format == transport.FormatRSocket1 {
+		s.enc, s.prefixLength = rsocket.NewEncoder(&s.encoded), rsocket.FrameLengthSize
+	} else {
+		s.enc, s.prefixLength = frame.NewFrameEncoder(&s.encoded), header.SizeOfInt
+	}
+	return s
+}
+
+func newResumeToken() []byte {
+	token := make([]byte, 16)
+	if _, err := rand.Read(token); err != nil {
+		panic(err.Error())
+	}
+	return token
+}
+
+// Frames that count towards the implied position, and are replayed on resume
+func isResumable(f *frame.Frame) bool {
+	switch f.Type() {
+	case header.FTRequestResponse, header.FTFireAndForget, header.FTRequestStream,
+		header.FTRequestSubscription, header.FTRequestChannel, header.FTRequestN,
+		header.FTCancel, header.FTResponse:
+		return true
+	case header.FTError:
+		return f.StreamID() != 0
+	}
+	return false
+}
+
+// Used as the protocols send function. Resumable frames are retained for
+// replay, and sent once the session is resumed if it is disconnected; other
+// frames sent while disconnected are dropped.
+func (s *session) send(f *frame.Frame) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	// Holding the lock while sending keeps the wire order the same as the
+	// retained order, which replay relies on.
+	if isResumable(f) && !s.closed {
+		if s.options.MTU > 0 {
+			return fragment.Split(f, s.options.MTU, s.sendResumable)
+		}
+		return s.sendResumable(f)
+	}
+	if f.Type() == header.FTKeepAlive {
+		respond := f.Flags()&header.FlagKeepaliveRespond != 0
+		frame.EncodeKeepaliveWithPosition(f, respond, s.received)
+	}
+	if s.conn == nil {
+		f.Release()
+		return nil
+	}
+	s.conn.sendFrame(f)
+	return nil
+}
+
+// Retain f, a whole frame or a fragment, as encoded for the wire, and send it
+// if connected. Must hold lock.
+func (s *session) sendResumable(f *frame.Frame) error {
+	err := s.enc.Write(f)
+	wire := append([]byte(nil), s.encoded.Bytes()...)
+	s.encoded.Reset()
+	if err != nil {
+		f.Release()
+		return err
+	}
+	size := len(wire) - s.prefixLength
+	s.retained = append(s.retained, wireFrame{buf: wire, size: size})
+	s.retainedBytes += size
+	s.sent += uint64(size)
+	for s.retainedBytes > s.options.ResumeBufferSize {
+		s.dropOldest()
+	}
+	if s.conn == nil {
+		f.Release()
+		return nil
+	}
+	// If this fails the connection is going down; the frame is replayed
+	// on resume if it matters.
+	s.conn.send(f)
+	return nil
+}
+
+// Called by the connection for each resumable frame it reads, whole or a
+// fragment, with its size on the wire. whole is set if no frame is partly
+// reassembled after it. The received position only moves at such points, so
+// after a reconnect the remote replays fragments we have discarded.
+func (s *session) read(size int, whole bool) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.unconfirmed += uint64(size)
+	if whole {
+		s.received += s.unconfirmed
+		s.unconfirmed = 0
+	}
+}
+
+// Called by the connection for each whole frame it receives
+func (s *session) receive(f *frame.Frame) {
+	if f.Type() == header.FTKeepAlive {
+		s.lock.Lock()
+		s.acknowledge(keepalive.Position(f.Buf))
+		s.lock.Unlock()
+	}
+	s.protocol.HandleFrame(f)
+	if f.Type() == header.FTError && f.StreamID() == 0 {
+		// The protocol is terminated, there's nothing left to resume
+		s.close(errSessionClosed)
+	}
+}
+
+// Drop retained frames the remote has received, up to position.
+// Must hold lock.
+func (s *session) acknowledge(position uint64) {
+	for len(s.retained) > 0 && s.firstAvailable+uint64(s.retained[0].size) <= position {
+		s.dropOldest()
+	}
+}
+
+// Must hold lock.
+func (s *session) dropOldest() {
+	f := s.retained[0]
+	s.retained[0] = wireFrame{}
+	s.retained = s.retained[1:]
+	s.retainedBytes -= f.size
+	s.firstAvailable += uint64(f.size)
+}
+
+// Attach the session to c. remoteReceived is the position the remote has read
+// up to, remoteFirstAvailable the oldest position it can replay; clients
+// aren't told the latter and pass 0. When ok is set, it is written to c
+// before the frames the remote missed.
+func (s *session) resume(c *ReactiveConn, remoteReceived, remoteFirstAvailable uint64, ok *frame.Frame) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if s.closed {
+		return rs.NewError(rs.ErrorCodeRejectedResume, "Session has expired.")
+	}
+	if remoteReceived < s.firstAvailable || remoteReceived > s.sent {
+		return rs.NewError(rs.ErrorCodeRejectedResume, fmt.Sprintf(
+			"Cannot resume from position %d, positions %d to %d are available.", remoteReceived, s.firstAvailable, s.sent))
+	}
+	if remoteFirstAvailable > s.received {
+		return rs.NewError(rs.ErrorCodeRejectedResume, fmt.Sprintf(
+			"Cannot resume, frames from position %d to %d are no longer available.", s.received, remoteFirstAvailable))
+	}
+	s.acknowledge(remoteReceived)
+	if s.firstAvailable != remoteReceived {
+		return rs.NewError(rs.ErrorCodeRejectedResume, fmt.Sprintf(
+			"Cannot resume from position %d, it is not at a frame boundary.", remoteReceived))
+	}
+
+	if s.conn != nil {
+		// The remote gave up on a connection we haven't noticed failing yet
+		s.conn.Rwc.Close()
+	}
+	if ok != nil {
+		frame.EncodeResumeOK(ok, s.received)
+		if err := c.out.writeNow(ok); err != nil {
+			return err
+		}
+	}
+	replay := make([][]byte, len(s.retained))
+	for i, f := range s.retained {
+		replay[i] = f.buf
+	}
+	if err := c.out.writeNowEncoded(replay); err != nil {
+		return err
+	}
+	// Fragments read since the last whole frame are lost with the old
+	// connection; the remote replays them
+	s.unconfirmed = 0
+	s.conn = c
+	c.session = s
+	if s.expiry != nil {
+		s.expiry.Stop()
+		s.expiry = nil
+	}
+	return nil
+}
+
+// Called by c once it has failed; the session waits to be resumed
+func (s *session) disconnected(c *ReactiveConn, err error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if s.conn != c || s.closed {
+		return
+	}
+	s.conn = nil
+	if s.redial != nil {
+		go s.reconnect(err)
+		return
+	}
+	s.expiry = time.AfterFunc(s.options.ResumeTimeout, func() {
+		s.expire(err)
+	})
+}
+
+// Close the session unless it has been resumed since
+func (s *session) expire(err error) {
+	s.lock.Lock()
+	resumed := s.conn != nil
+	s.lock.Unlock()
+	if !resumed {
+		s.close(err)
+	}
+}
+
+// Close the session for good, failing all its streams with err
+func (s *session) close(err error) {
+	s.lock.Lock()
+	if s.closed {
+		s.lock.Unlock()
+		return
+	}
+	s.closed = true
+	for len(s.retained) > 0 {
+		s.dropOldest()
+	}
+	if s.expiry != nil {
+		s.expiry.Stop()
+		s.expiry = nil
+	}
+	if s.conn != nil {
+		s.conn.Rwc.Close()
+		s.conn = nil
+	}
+	s.lock.Unlock()
+
+	if s.store != nil {
+		s.store.remove(s)
+	}
+	s.protocol.Terminate(err)
+}
+
+func (s *session) isConnected() bool {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return s.conn != nil
+}
+
+func (s *session) isClosed() bool {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return s.closed
+}
+
+// Client side; keep trying to resume the session over a new connection until
+// the resume timeout runs out or the server rejects us.
+func (s *session) reconnect(cause error) {
+	deadline := time.Now().Add(s.options.ResumeTimeout)
+	for !s.isClosed() {
+		rwc, err := s.redial()
+		if err == nil {
+			err = s.resumeOver(rwc)
+			if err == nil {
+				return
+			}
+			if _, rejected := err.(*rs.Error); rejected {
+				s.close(err)
+				return
+			}
+		}
+		if time.Now().Add(resumeRetryInterval).After(deadline) {
+			s.close(cause)
+			return
+		}
+		time.Sleep(resumeRetryInterval)
+	}
+}
+
+// Client side; perform the RESUME handshake over rwc and attach to it
+func (s *session) resumeOver(rwc net.Conn) error {
+	c := &ReactiveConn{Rwc: rwc, Options: s.options}
+	c.open(s.firstStreamId)
+
+	var version uint32
+	if s.options.Format == transport.FormatRSocket1 {
+		version = setup.Version1
+	}
+	s.lock.Lock()
+	f := frame.EncodeResume(&c.frame, version, s.token, s.received, s.firstAvailable)
+	s.lock.Unlock()
+
+	// Don't wait forever on a server that doesn't answer
+	rwc.SetDeadline(time.Now().Add(s.options.ResumeTimeout))
+	if err := c.out.writeNow(f); err != nil {
+		rwc.Close()
+		return err
+	}
+	if err := c.dec.Read(f); err != nil {
+		rwc.Close()
+		return err
+	}
+	rwc.SetDeadline(time.Time{})
+
+	var err error
+	switch {
+	case f.Type() == header.FTError && f.StreamID() == 0:
+		err = rs.NewError(errorc.ErrorCode(f), string(f.Data()))
+	case f.Type() != header.FTResumeOK || !resume.IsWellFormed(f.Buf):
+		err = rs.NewError(rs.ErrorCodeInvalid, fmt.Sprintf("Expected RESUME_OK, got %s.", f.Describe()))
+	default:
+		if err = s.resume(c, resume.OKPosition(f.Buf), 0, nil); err != nil {
+			rsErr := err.(*rs.Error)
+			c.out.writeNow(frame.Error(0, rsErr.Code, nil, []byte(rsErr.Message)))
+		}
+	}
+	if err != nil {
+		rwc.Close()
+		return err
+	}
+	c.Protocol = s.protocol
+	c.start()
+	go c.Serve()
+	return nil
+}
+
+// Client side; acknowledge received frames every interval, so the server can
+// drop them. The server answers with its own position, letting us do the same.
+func (s *session) keepalive(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for range ticker.C {
+		if s.isClosed() {
+			return
+		}
+		s.send(frame.EncodeKeepalive(frame.Get(), true))
+	}
+}
+
+// Sessions a server holds on to, for clients to resume. Share one between all
+// connections of a server.
+type SessionStore struct {
+	lock     sync.Mutex
+	sessions map[string]*session
+}
+
+func NewSessionStore() *SessionStore {
+	return &SessionStore{sessions: make(map[string]*session)}
+}
+
+// Number of sessions held, connected or not
+func (st *SessionStore) Len() int {
+	st.lock.Lock()
+	defer st.lock.Unlock()
+	return len(st.sessions)
+}
+
+func (st *SessionStore) get(token []byte) *session {
+	st.lock.Lock()
+	defer st.lock.Unlock()
+	return st.sessions[string(token)]
+}
+
+func (st *SessionStore) add(s *session) {
+	st.lock.Lock()
+	defer st.lock.Unlock()
+	s.store = st
+	st.sessions[string(s.token)] = s
+}
+
+func (st *SessionStore) remove(s *session) {
+	st.lock.Lock()
+	defer st.lock.Unlock()
+	if st.sessions[string(s.token)] == s {
+		delete(st.sessions, string(s.token))
+	}
+}
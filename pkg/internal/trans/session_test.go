@@ -0,0 +1,396 @@
+package trans
+
+import (
+	"bytes"
+	"fmt"
+	"github.com/jakewins/reactivesocket-go/pkg/internal/codec/errorc"
+	"github.com/jakewins/reactivesocket-go/pkg/internal/codec/header"
+	"github.com/jakewins/reactivesocket-go/pkg/internal/frame"
+	"github.com/jakewins/reactivesocket-go/pkg/internal/proto"
+	"github.com/jakewins/reactivesocket-go/pkg/rs"
+	"github.com/jakewins/reactivesocket-go/pkg/transport"
+	"io"
+	"net"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestStreamSurvivesReconnect(t *testing.T) {
+	options, _ := transport.NewOptions(transport.WithResumption(5 * time.Second))
+	sessions := NewSessionStore()
+	client, current := dialResumable(t, options, sessions)
+
+	values := make(chan string, 10)
+	done := make(chan error, 1)
+	var subscription rs.Subscription
+	client.Protocol.RequestStream(rs.NewPayload(nil, nil)).Subscribe(rs.NewSubscriber(func(s rs.Subscription) {
+		subscription = s
+		s.Request(2)
+	}, func(p rs.Payload) {
+		values <- string(p.Data())
+	}, func(err error) {
+		done <- err
+	}, func() {
+		done <- nil
+	}))
+	for i := 0; i < 2; i++ {
+		expectValue(t, values, fmt.Sprintf("%d", i))
+	}
+
+	// Drop the connection; the client resumes over a new one
+	(<-current).Close()
+	subscription.Request(8)
+
+	for i := 2; i < 10; i++ {
+		expectValue(t, values, fmt.Sprintf("%d", i))
+	}
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Errorf("Expected stream to complete, got %s", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Expected stream to complete")
+	}
+	if len(values) != 0 {
+		t.Errorf("Expected no values to be delivered twice, got %d more", len(values))
+	}
+}
+
+func TestSessionFailsWhenNotResumedInTime(t *testing.T) {
+	options, _ := transport.NewOptions(transport.WithResumption(50 * time.Millisecond))
+	sessions := NewSessionStore()
+	client, current := dialResumable(t, options, sessions)
+	client.Redial = nil
+	client.session.redial = func() (net.Conn, error) {
+		return nil, fmt.Errorf("Network is down")
+	}
+
+	failed := make(chan error, 1)
+	client.Protocol.RequestStream(rs.NewPayload(nil, nil)).Subscribe(rs.NewSubscriber(func(s rs.Subscription) {
+		s.Request(1)
+	}, func(p rs.Payload) {}, func(err error) {
+		failed <- err
+	}, func() {}))
+	if got := rs.Availability(client.Socket()); got != 1 {
+		t.Errorf("Expected full availability while connected, got %f", got)
+	}
+
+	(<-current).Close()
+	select {
+	case <-failed:
+	case <-time.After(5 * time.Second):
+		t.Fatal("Expected stream to fail once the session timed out")
+	}
+	if got := rs.Availability(client.Socket()); got != 0 {
+		t.Errorf("Expected no availability once the session failed, got %f", got)
+	}
+	for deadline := time.Now().Add(5 * time.Second); sessions.Len() > 0; time.Sleep(time.Millisecond) {
+		if time.Now().After(deadline) {
+			t.Fatal("Expected the server to drop the session once it timed out")
+		}
+	}
+}
+
+func TestServerRejectsResumingUnknownSession(t *testing.T) {
+	options, _ := transport.NewOptions(transport.WithResumption(time.Second))
+	local, remote := net.Pipe()
+	defer remote.Close()
+	conn := &ReactiveConn{
+		Rwc:      local,
+		Options:  options,
+		Sessions: NewSessionStore(),
+		Setup: func(c *ReactiveConn) (*rs.RequestHandler, error) {
+			if _, err := c.ReadSetupFrame(); err != nil {
+				return nil, err
+			}
+			return &rs.RequestHandler{}, nil
+		},
+	}
+	go conn.Initialize(2)
+
+	frame.NewFrameEncoder(remote).Write(frame.Resume(0, []byte("nope"), 0, 0))
+	reply := &frame.Frame{}
+	if err := frame.NewFrameDecoder(remote).Read(reply); err != nil {
+		t.Fatal(err)
+	}
+	if reply.Type() != header.FTError || reply.StreamID() != 0 || errorc.ErrorCode(reply.Buf) != errorc.ECRejectedResume {
+		t.Errorf("Expected ERROR[REJECTED_RESUME] on stream 0, got %s", reply.Describe())
+	}
+}
+
+func TestRetainedFramesAreBoundedAndAcknowledged(t *testing.T) {
+	options, _ := transport.NewOptions(transport.WithResumption(time.Second), transport.WithResumeBufferSize(100))
+	s := newSession([]byte("t"), 1, options)
+	s.protocol = proto.NewProtocol(&rs.RequestHandler{}, 1, s.send)
+
+	for i := 0; i < 10; i++ {
+		s.send(frame.RequestN(1, 1)) // 12 bytes each
+	}
+	if s.retainedBytes > 100 || s.sent != 120 || s.firstAvailable != 120-uint64(s.retainedBytes) {
+		t.Errorf("Expected the oldest frames to be dropped past the bound, retained %d, first available %d",
+			s.retainedBytes, s.firstAvailable)
+	}
+
+	s.receive(frame.KeepaliveWithPosition(false, 108))
+	if len(s.retained) != 1 || s.firstAvailable != 108 {
+		t.Errorf("Expected frames up to the acknowledged position to be dropped, %d left from %d",
+			len(s.retained), s.firstAvailable)
+	}
+}
+
+func TestClientResumesAtRSocket1WirePositions(t *testing.T) {
+	options, _ := transport.NewOptions(transport.WithResumption(5*time.Second),
+		transport.WithWireFormat(transport.FormatRSocket1))
+	dialed := make(chan net.Conn, 2)
+	dial := func() (net.Conn, error) {
+		local, remote := net.Pipe()
+		dialed <- remote
+		return local, nil
+	}
+	rwc, _ := dial()
+	client := &ReactiveConn{
+		Rwc:     rwc,
+		Options: options,
+		Redial:  dial,
+		Setup: func(c *ReactiveConn) (*rs.RequestHandler, error) {
+			return &rs.RequestHandler{}, c.WriteSetupFrame(60000, 0, rs.NewSetupPayload("", "", nil, nil))
+		},
+	}
+	initialized := make(chan error, 1)
+	go func() { initialized <- client.Initialize(1) }()
+	server := <-dialed
+	readRSocket(t, server) // SETUP
+	if err := <-initialized; err != nil {
+		t.Fatal(err)
+	}
+	go client.Serve()
+
+	values := make(chan string, 3)
+	done := make(chan error, 1)
+	client.Protocol.RequestStream(rs.NewPayload(nil, []byte("hello"))).Subscribe(rs.NewSubscriber(func(s rs.Subscription) {
+		s.Request(3)
+	}, func(p rs.Payload) {
+		values <- string(p.Data())
+	}, func(err error) {
+		done <- err
+	}, func() {
+		done <- nil
+	}))
+	// REQUEST_STREAM, stream 1, initial request N 3; 15 bytes
+	request := []byte{0, 0, 0, 1, 0x18, 0x00, 0, 0, 0, 3, 'h', 'e', 'l', 'l', 'o'}
+	if got := readRSocket(t, server); !bytes.Equal(got, request) {
+		t.Fatalf("Expected REQUEST_STREAM % x, got % x", request, got)
+	}
+	// Two PAYLOAD[NEXT] frames of 7 bytes each
+	server.Write([]byte{0, 0, 7, 0, 0, 0, 1, 0x28, 0x20, 'a'})
+	server.Write([]byte{0, 0, 7, 0, 0, 0, 1, 0x28, 0x20, 'b'})
+	expectValue(t, values, "a")
+	expectValue(t, values, "b")
+
+	server.Close()
+	server = <-dialed
+	resume := []byte{0, 0, 0, 0, 0x34, 0x00, 0, 1, 0, 0, 0, byte(len(client.resumeToken))}
+	resume = append(resume, client.resumeToken...)
+	resume = append(resume, 0, 0, 0, 0, 0, 0, 0, 14) // Last received server position
+	resume = append(resume, 0, 0, 0, 0, 0, 0, 0, 0)  // First available client position
+	if got := readRSocket(t, server); !bytes.Equal(got, resume) {
+		t.Fatalf("Expected RESUME % x, got % x", resume, got)
+	}
+
+	// RESUME_OK at position 0; the request was lost, so it is replayed
+	server.Write([]byte{0, 0, 14, 0, 0, 0, 0, 0x38, 0x00, 0, 0, 0, 0, 0, 0, 0, 0})
+	if got := readRSocket(t, server); !bytes.Equal(got, request) {
+		t.Fatalf("Expected REQUEST_STREAM to be replayed as % x, got % x", request, got)
+	}
+	server.Write([]byte{0, 0, 7, 0, 0, 0, 1, 0x28, 0x60, 'c'})
+	expectValue(t, values, "c")
+	if err := <-done; err != nil {
+		t.Errorf("Expected the stream to complete, got %s", err)
+	}
+}
+
+func TestServerResumesAtRSocket1WirePositions(t *testing.T) {
+	options, _ := transport.NewOptions(transport.WithResumption(5*time.Second),
+		transport.WithWireFormat(transport.FormatRSocket1))
+	sessions := NewSessionStore()
+	serve := func() net.Conn {
+		local, remote := net.Pipe()
+		server := &ReactiveConn{
+			Rwc:      remote,
+			Options:  options,
+			Sessions: sessions,
+			Setup: func(c *ReactiveConn) (*rs.RequestHandler, error) {
+				if _, err := c.ReadSetupFrame(); err != nil {
+					return nil, err
+				}
+				return &rs.RequestHandler{HandleRequestStream: countToTen}, nil
+			},
+		}
+		go func() {
+			if err := server.Initialize(2); err == nil {
+				server.Serve()
+			}
+		}()
+		return local
+	}
+	token := []byte("0123456789abcdef")
+
+	client := serve()
+	// SETUP with the resume flag, version 1.0, a token and empty mime types
+	setup := []byte{0, 0, 0, 0, 0x04, 0x80, 0, 1, 0, 0, 0, 0, 0xea, 0x60, 0, 0, 0, 0, 0, byte(len(token))}
+	setup = append(setup, token...)
+	writeRSocket(client, append(setup, 0, 0))
+	// REQUEST_STREAM, stream 1, initial request N 2; 15 bytes
+	writeRSocket(client, []byte{0, 0, 0, 1, 0x18, 0x00, 0, 0, 0, 2, 'h', 'e', 'l', 'l', 'o'})
+	first := []byte{0, 0, 0, 1, 0x28, 0x20, '0'}
+	second := []byte{0, 0, 0, 1, 0x28, 0x20, '1'}
+	if got := readRSocket(t, client); !bytes.Equal(got, first) {
+		t.Fatalf("Expected PAYLOAD % x, got % x", first, got)
+	}
+	if got := readRSocket(t, client); !bytes.Equal(got, second) {
+		t.Fatalf("Expected PAYLOAD % x, got % x", second, got)
+	}
+	client.Close()
+
+	// Resume having only received the first payload, 7 bytes
+	client = serve()
+	resume := []byte{0, 0, 0, 0, 0x34, 0x00, 0, 1, 0, 0, 0, byte(len(token))}
+	resume = append(resume, token...)
+	resume = append(resume, 0, 0, 0, 0, 0, 0, 0, 7)  // Last received server position
+	resume = append(resume, 0, 0, 0, 0, 0, 0, 0, 15) // First available client position
+	writeRSocket(client, resume)
+	resumeOK := []byte{0, 0, 0, 0, 0x38, 0x00, 0, 0, 0, 0, 0, 0, 0, 15}
+	if got := readRSocket(t, client); !bytes.Equal(got, resumeOK) {
+		t.Fatalf("Expected RESUME_OK % x, got % x", resumeOK, got)
+	}
+	if got := readRSocket(t, client); !bytes.Equal(got, second) {
+		t.Fatalf("Expected the missed PAYLOAD to be replayed as % x, got % x", second, got)
+	}
+	client.Close()
+}
+
+func TestSessionsWriteFramesInSendOrder(t *testing.T) {
+	local, remote := net.Pipe()
+	defer remote.Close()
+	options, _ := transport.NewOptions(transport.WithResumption(time.Second))
+	c := &ReactiveConn{Rwc: local, Options: options}
+	c.open(1)
+	c.session = newSession([]byte("t"), 1, options)
+	c.session.conn = c
+	c.Protocol = proto.NewProtocol(&rs.RequestHandler{}, 1, c.sendOrRetain)
+	c.session.protocol = c.Protocol
+
+	// Without a session, the scheduler would put the REQUEST_N first
+	c.sendOrRetain(frame.Response(1, 0, nil, make([]byte, 1024)))
+	c.sendOrRetain(frame.RequestN(3, 1))
+	c.start()
+	defer c.Close()
+
+	dec := frame.NewFrameDecoder(remote)
+	for _, expected := range []uint16{header.FTResponse, header.FTRequestN} {
+		f := frame.Get()
+		if err := dec.Read(f); err != nil {
+			t.Fatal(err)
+		}
+		if f.Type() != expected {
+			t.Errorf("Expected frames in the order sent, got %s", f.Describe())
+		}
+		f.Release()
+	}
+}
+
+// Read an RSocket 1.0 frame, without its length prefix, skipping keepalives
+func readRSocket(t *testing.T, r io.Reader) []byte {
+	for {
+		prefix := make([]byte, 3)
+		if _, err := io.ReadFull(r, prefix); err != nil {
+			t.Fatal(err)
+		}
+		b := make([]byte, int(prefix[0])<<16|int(prefix[1])<<8|int(prefix[2]))
+		if _, err := io.ReadFull(r, b); err != nil {
+			t.Fatal(err)
+		}
+		if b[4]>>2 != 0x03 {
+			return b
+		}
+	}
+}
+
+// Write b as an RSocket 1.0 frame, adding its length prefix
+func writeRSocket(w io.Writer, b []byte) {
+	w.Write(append([]byte{byte(len(b) >> 16), byte(len(b) >> 8), byte(len(b))}, b...))
+}
+
+// Dial a client that resumes over in-memory pipes, each served by a server
+// connection sharing sessions. The client side of each pipe is sent on the
+// returned channel as it is dialed. The server streams "0" to "9".
+func dialResumable(t *testing.T, options *transport.Options, sessions *SessionStore) (*ReactiveConn, chan net.Conn) {
+	current := make(chan net.Conn, 10)
+	dial := func() (net.Conn, error) {
+		local, remote := net.Pipe()
+		server := &ReactiveConn{
+			Rwc:      remote,
+			Options:  options,
+			Sessions: sessions,
+			Setup: func(c *ReactiveConn) (*rs.RequestHandler, error) {
+				if _, err := c.ReadSetupFrame(); err != nil {
+					return nil, err
+				}
+				return &rs.RequestHandler{HandleRequestStream: countToTen}, nil
+			},
+		}
+		go func() {
+			if err := server.Initialize(2); err == nil {
+				server.Serve()
+			}
+		}()
+		current <- local
+		return local, nil
+	}
+
+	rwc, _ := dial()
+	client := &ReactiveConn{
+		Rwc:     rwc,
+		Options: options,
+		Redial:  dial,
+		Setup: func(c *ReactiveConn) (*rs.RequestHandler, error) {
+			return &rs.RequestHandler{}, c.WriteSetupFrame(1000, 0, rs.NewSetupPayload("", "", nil, nil))
+		},
+	}
+	if err := client.Initialize(1); err != nil {
+		t.Fatal(err)
+	}
+	go client.Serve()
+	return client, current
+}
+
+func countToTen(rs.Payload) rs.Publisher {
+	return rs.NewPublisher(func(s rs.Subscriber) {
+		var lock sync.Mutex
+		next := 0
+		s.OnSubscribe(rs.NewSubscription(func(n int) {
+			lock.Lock()
+			defer lock.Unlock()
+			for ; n > 0 && next < 10; n-- {
+				s.OnNext(rs.NewPayload(nil, []byte(fmt.Sprintf("%d", next))))
+				next++
+				if next == 10 {
+					s.OnComplete()
+				}
+			}
+		}, func() {}))
+	})
+}
+
+func expectValue(t *testing.T, values chan string, expected string) {
+	select {
+	case v := <-values:
+		if v != expected {
+			t.Fatalf("Expected %s, got %s", expected, v)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("Expected %s, got nothing", expected)
+	}
+}
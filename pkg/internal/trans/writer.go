@@ -0,0 +1,154 @@
+package trans
+
+import (
+	"bufio"
+	"errors"
+	"github.com/jakewins/reactivesocket-go/pkg/internal/frame"
+	"github.com/jakewins/reactivesocket-go/pkg/internal/rsocket"
+	"github.com/jakewins/reactivesocket-go/pkg/transport"
+	"io"
+	"sync"
+)
+
+var errWriterClosed = errors.New("Connection is closed, cannot send frame.")
+
+// Size of the buffer outbound frames are coalesced into before hitting the
+// connection; frames larger than this are written straight through.
+const writeBufferSize = 64 * 1024
+
+// Owns the write side of a connection. Any goroutine may send frames; a single
+// writer goroutine drains them into a buffer, and flushes the buffer to the
+// connection whenever it runs out of queued frames. Queued frames are
+// written in the order the scheduler picks, or as sent if it is nil.
+type frameWriter struct {
+	queue  *frameQueue
+	sched  *scheduler
+	buf    *bufio.Writer
+	enc    frame.Encoder
+	closed chan struct{}
+	once   sync.Once
+	// Closed to stop once what is queued has been written
+	finish     chan struct{}
+	finishOnce sync.Once
+	// Set before closed is closed, if writing failed
+	err error
+}
+
+func newFrameWriter(sink io.Writer, format transport.WireFormat) *frameWriter {
+	buf := bufio.NewWriterSize(sink, writeBufferSize)
+	var enc frame.Encoder = frame.NewFrameEncoder(buf)
+	if format == transport.FormatRSocket1 {
+		enc = rsocket.NewEncoder(buf)
+	}
+	return &frameWriter{
+		queue:  newFrameQueue(),
+		sched:  newScheduler(),
+		buf:    buf,
+		enc:    enc,
+		closed: make(chan struct{}),
+		finish: make(chan struct{}),
+	}
+}
+
+// Queue f to be written; ownership of f passes to the writer, which releases
+// it once written. Called by any goroutine.
+func (w *frameWriter) send(f *frame.Frame) error {
+	select {
+	case <-w.closed:
+		f.Release()
+		return errWriterClosed
+	default:
+	}
+	w.queue.push(f)
+	return nil
+}
+
+// Write f and flush immediately, bypassing the queue. Only for use before
+// run has been started, eg. for the setup handshake.
+func (w *frameWriter) writeNow(f *frame.Frame) error {
+	if err := w.enc.Write(f); err != nil {
+		return err
+	}
+	return w.buf.Flush()
+}
+
+// Write frames already encoded for the wire, length prefixes included, and
+// flush. Only for use before run has been started, eg. to replay a session.
+func (w *frameWriter) writeNowEncoded(frames [][]byte) error {
+	for _, b := range frames {
+		if _, err := w.buf.Write(b); err != nil {
+			return err
+		}
+	}
+	return w.buf.Flush()
+}
+
+// The writer loop, run this in its own goroutine. Returns once the writer is
+// closed or writing to the connection fails.
+func (w *frameWriter) run() error {
+	for {
+		// Out of work; put what we have on the wire before going idle
+		if err := w.writeQueued(); err != nil {
+			return w.fail(err)
+		}
+
+		select {
+		case <-w.queue.ready:
+		case <-w.finish:
+			// Frames may have been queued since we went idle
+			if err := w.writeQueued(); err != nil {
+				return w.fail(err)
+			}
+			return w.fail(errWriterClosed)
+		case <-w.closed:
+			return w.err
+		}
+	}
+}
+
+// Write and flush every queued frame
+func (w *frameWriter) writeQueued() error {
+	for f := w.next(); f != nil; f = w.next() {
+		err := w.enc.Write(f)
+		f.Release()
+		if err != nil {
+			return err
+		}
+	}
+	return w.buf.Flush()
+}
+
+// The next frame to write; nil if there are none
+func (w *frameWriter) next() *frame.Frame {
+	if w.sched == nil {
+		return w.queue.pop()
+	}
+	// Let frames sent meanwhile have their say in what goes next
+	for f := w.queue.pop(); f != nil; f = w.queue.pop() {
+		w.sched.add(f)
+	}
+	return w.sched.next()
+}
+
+func (w *frameWriter) fail(err error) error {
+	w.once.Do(func() {
+		w.err = err
+		close(w.closed)
+	})
+	return err
+}
+
+// Stop the writer loop once the frames queued so far are written; run then
+// returns errWriterClosed. Frames sent after are dropped.
+func (w *frameWriter) closeWhenWritten() {
+	w.finishOnce.Do(func() {
+		close(w.finish)
+	})
+}
+
+// Stop the writer loop; frames still queued are dropped.
+func (w *frameWriter) close() {
+	w.once.Do(func() {
+		close(w.closed)
+	})
+}
@@ -0,0 +1,225 @@
+package trans
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"github.com/jakewins/reactivesocket-go/pkg/internal/codec/header"
+	"github.com/jakewins/reactivesocket-go/pkg/internal/frame"
+	"github.com/jakewins/reactivesocket-go/pkg/transport"
+	"io"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestQueueDeliversEveryFrameInProducerOrder(t *testing.T) {
+	var producers, perProducer = 8, 10000
+	q := newFrameQueue()
+
+	var wg sync.WaitGroup
+	for p := 0; p < producers; p++ {
+		wg.Add(1)
+		go func(p int) {
+			defer wg.Done()
+			for i := 0; i < perProducer; i++ {
+				q.push(frame.RequestN(uint32(p), uint32(i)))
+			}
+		}(p)
+	}
+
+	next := make([]uint32, producers)
+	for received := 0; received < producers*perProducer; {
+		f := q.pop()
+		if f == nil {
+			<-q.ready
+			continue
+		}
+		producer, seq := f.StreamID(), header.Uint32(f.Buf, header.FrameHeaderLength)
+		if seq != next[producer] {
+			t.Fatalf("Expected frame %d from producer %d, got %d", next[producer], producer, seq)
+		}
+		next[producer]++
+		received++
+	}
+	wg.Wait()
+
+	if f := q.pop(); f != nil {
+		t.Errorf("Expected queue to be drained, found %s", f.Describe())
+	}
+}
+
+func TestWriterCoalescesQueuedFrames(t *testing.T) {
+	sink := &countingWriter{}
+	w := newFrameWriter(sink, transport.FormatReactiveSocket)
+	for i := 0; i < 100; i++ {
+		w.send(frame.RequestN(1, uint32(i)))
+	}
+
+	go w.run()
+	defer w.close()
+	awaitBytes(t, sink, 100*(4+header.FrameHeaderLength+4))
+
+	if writes := sink.writeCount(); writes != 1 {
+		t.Errorf("Expected queued frames to go out in a single write, got %d writes", writes)
+	}
+
+	dec := frame.NewFrameDecoder(bytes.NewReader(sink.bytes()))
+	f := &frame.Frame{}
+	for i := 0; i < 100; i++ {
+		if err := dec.Read(f); err != nil {
+			t.Fatal(err)
+		}
+		if n := binary.BigEndian.Uint32(f.Buf[header.FrameHeaderLength:]); n != uint32(i) {
+			t.Fatalf("Expected frame %d, found %s", i, f.Describe())
+		}
+	}
+}
+
+func TestWriterRejectsFramesOnceClosed(t *testing.T) {
+	w := newFrameWriter(&countingWriter{}, transport.FormatReactiveSocket)
+	w.close()
+
+	if err := w.send(frame.Cancel(1)); err != errWriterClosed {
+		t.Errorf("Expected send on closed writer to fail, got %v", err)
+	}
+	if err := w.run(); err != nil {
+		t.Errorf("Expected closed writer to stop cleanly, got %v", err)
+	}
+}
+
+func TestWriterStopsOnWriteFailure(t *testing.T) {
+	w := newFrameWriter(failingWriter{}, transport.FormatReactiveSocket)
+	w.send(frame.Cancel(1))
+
+	if err := w.run(); err != io.ErrClosedPipe {
+		t.Errorf("Expected writer to surface the write error, got %v", err)
+	}
+	if err := w.send(frame.Cancel(1)); err != errWriterClosed {
+		t.Errorf("Expected send after failure to fail, got %v", err)
+	}
+}
+
+func TestWriterFinishesQueuedFramesBeforeClosing(t *testing.T) {
+	sink := &countingWriter{}
+	w := newFrameWriter(sink, transport.FormatReactiveSocket)
+	w.send(frame.Cancel(1))
+	w.send(frame.Error(0, 0x0101, nil, nil))
+	w.closeWhenWritten()
+
+	if err := w.run(); err != errWriterClosed {
+		t.Errorf("Expected the writer to stop once done, got %v", err)
+	}
+	if n := len(sink.bytes()); n != 2*4+2*header.FrameHeaderLength+4 {
+		t.Errorf("Expected both frames to be written first, got %d bytes", n)
+	}
+}
+
+func TestSchedulerSharesBytesBetweenStreams(t *testing.T) {
+	s := newScheduler()
+	large := make([]byte, schedulerQuantum)
+	for i := 0; i < 10; i++ {
+		s.add(frame.Response(1, 0, nil, large))
+	}
+	for i := 0; i < 10; i++ {
+		s.add(frame.Response(3, 0, nil, []byte{byte(i)}))
+	}
+
+	var order []uint32
+	for f := s.next(); f != nil; f = s.next() {
+		order = append(order, f.StreamID())
+	}
+	if len(order) != 20 {
+		t.Fatalf("Expected all 20 frames, got %d", len(order))
+	}
+	// A round is enough for all the small frames, so at most one large
+	// frame goes out ahead of them
+	ahead := 0
+	for _, id := range order[:11] {
+		if id == 1 {
+			ahead++
+		}
+	}
+	if ahead > 1 {
+		t.Errorf("Expected the small frames to go out within a round, got %v", order)
+	}
+}
+
+func TestSchedulerPutsControlFramesFirst(t *testing.T) {
+	s := newScheduler()
+	s.add(frame.Response(1, 0, nil, []byte("a")))
+	s.add(frame.Response(1, 0, nil, []byte("b")))
+	s.add(frame.Cancel(1))
+	s.add(frame.RequestN(3, 10))
+	s.add(frame.Keepalive(true))
+
+	var order []string
+	for f := s.next(); f != nil; f = s.next() {
+		order = append(order, fmt.Sprintf("%d:%d", f.StreamID(), f.Type()))
+	}
+	expected := []string{
+		fmt.Sprintf("3:%d", header.FTRequestN),
+		fmt.Sprintf("0:%d", header.FTKeepAlive),
+		fmt.Sprintf("1:%d", header.FTResponse),
+		fmt.Sprintf("1:%d", header.FTResponse),
+		// Behind the frames of its own stream
+		fmt.Sprintf("1:%d", header.FTCancel),
+	}
+	if strings.Join(order, ",") != strings.Join(expected, ",") {
+		t.Errorf("Expected %v, got %v", expected, order)
+	}
+}
+
+func BenchmarkConcurrentSend(b *testing.B) {
+	w := newFrameWriter(io.Discard, transport.FormatReactiveSocket)
+	go w.run()
+	defer w.close()
+
+	payload := make([]byte, 128)
+	b.ReportAllocs()
+	b.RunParallel(func(pb *testing.PB) {
+		for pb.Next() {
+			w.send(frame.EncodeResponse(frame.Get(), 1, 0, nil, payload))
+		}
+	})
+}
+
+type countingWriter struct {
+	lock   sync.Mutex
+	buf    bytes.Buffer
+	writes int
+}
+
+func (w *countingWriter) Write(p []byte) (int, error) {
+	w.lock.Lock()
+	defer w.lock.Unlock()
+	w.writes++
+	return w.buf.Write(p)
+}
+func (w *countingWriter) writeCount() int {
+	w.lock.Lock()
+	defer w.lock.Unlock()
+	return w.writes
+}
+func (w *countingWriter) bytes() []byte {
+	w.lock.Lock()
+	defer w.lock.Unlock()
+	return append([]byte(nil), w.buf.Bytes()...)
+}
+
+type failingWriter struct{}
+
+func (failingWriter) Write(p []byte) (int, error) {
+	return 0, io.ErrClosedPipe
+}
+
+func awaitBytes(t *testing.T, w *countingWriter, n int) {
+	deadline := time.Now().Add(5 * time.Second)
+	for len(w.bytes()) < n {
+		if time.Now().After(deadline) {
+			t.Fatalf("Expected %d bytes to be written, got %d", n, len(w.bytes()))
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
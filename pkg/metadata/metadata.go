@@ -0,0 +1,210 @@
+// Encoding and decoding of the metadata formats from the RSocket extensions:
+// composite metadata, which packs several kinds of metadata into one, and
+// authentication.
+package metadata
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+)
+
+const (
+	MimeTypeComposite      = "message/x.rsocket.composite-metadata.v0"
+	MimeTypeAuthentication = "message/x.rsocket.authentication.v0"
+	MimeTypeRouting        = "message/x.rsocket.routing.v0"
+)
+
+// Well known mime types, sent as a single byte id in composite metadata
+var wellKnown = map[byte]string{
+	0x00: "application/avro",
+	0x01: "application/cbor",
+	0x02: "application/graphql",
+	0x03: "application/gzip",
+	0x04: "application/javascript",
+	0x05: "application/json",
+	0x06: "application/octet-stream",
+	0x07: "application/pdf",
+	0x08: "application/vnd.apache.thrift.binary",
+	0x09: "application/vnd.google.protobuf",
+	0x0A: "application/xml",
+	0x0B: "application/zip",
+	0x7A: "message/x.rsocket.mime-type.v0",
+	0x7B: "message/x.rsocket.accept-mime-types.v0",
+	0x7C: MimeTypeAuthentication,
+	0x7D: "message/x.rsocket.tracing-zipkin.v0",
+	0x7E: MimeTypeRouting,
+	0x7F: MimeTypeComposite,
+}
+
+var wellKnownIds = make(map[string]byte)
+
+func init() {
+	for id, mimeType := range wellKnown {
+		wellKnownIds[mimeType] = id
+	}
+}
+
+const (
+	wellKnownFlag     = 0x80
+	maxMimeTypeLength = 128
+	maxEntryLength    = 1<<24 - 1
+)
+
+var ErrMalformed = errors.New("Malformed metadata.")
+
+// One kind of metadata in composite metadata
+type Entry struct {
+	// Empty for well known mime types this package doesn't know by name
+	MimeType string
+	Content  []byte
+}
+
+// Pack entries into composite metadata
+func EncodeComposite(entries ...Entry) ([]byte, error) {
+	var out []byte
+	for _, e := range entries {
+		if id, ok := wellKnownIds[e.MimeType]; ok {
+			out = append(out, wellKnownFlag|id)
+		} else if len(e.MimeType) == 0 || len(e.MimeType) > maxMimeTypeLength {
+			return nil, fmt.Errorf("Mime types must be 1 to %d bytes, got %q.", maxMimeTypeLength, e.MimeType)
+		} else {
+			out = append(out, byte(len(e.MimeType)-1))
+			out = append(out, e.MimeType...)
+		}
+		if len(e.Content) > maxEntryLength {
+			return nil, fmt.Errorf("Metadata entries must be at most %d bytes, got %d.", maxEntryLength, len(e.Content))
+		}
+		out = append(out, byte(len(e.Content)>>16), byte(len(e.Content)>>8), byte(len(e.Content)))
+		out = append(out, e.Content...)
+	}
+	return out, nil
+}
+
+// Unpack composite metadata. Entries share memory with b.
+func DecodeComposite(b []byte) ([]Entry, error) {
+	var entries []Entry
+	for len(b) > 0 {
+		var e Entry
+		if b[0]&wellKnownFlag != 0 {
+			e.MimeType = wellKnown[b[0]&^wellKnownFlag]
+			b = b[1:]
+		} else {
+			length := int(b[0]) + 1
+			if len(b) < 1+length {
+				return nil, ErrMalformed
+			}
+			e.MimeType = string(b[1 : 1+length])
+			b = b[1+length:]
+		}
+		if len(b) < 3 {
+			return nil, ErrMalformed
+		}
+		length := int(b[0])<<16 | int(b[1])<<8 | int(b[2])
+		if len(b) < 3+length {
+			return nil, ErrMalformed
+		}
+		e.Content = b[3 : 3+length]
+		b = b[3+length:]
+		entries = append(entries, e)
+	}
+	return entries, nil
+}
+
+// Find metadata of mimeType in metadata sent as metadataMimeType, which is
+// either that mime type itself or composite metadata with an entry of it
+func Find(metadataMimeType string, metadata []byte, mimeType string) ([]byte, bool, error) {
+	if metadataMimeType == mimeType {
+		return metadata, true, nil
+	}
+	if metadataMimeType != MimeTypeComposite {
+		return nil, false, nil
+	}
+	entries, err := DecodeComposite(metadata)
+	if err != nil {
+		return nil, false, err
+	}
+	for _, e := range entries {
+		if e.MimeType == mimeType {
+			return e.Content, true, nil
+		}
+	}
+	return nil, false, nil
+}
+
+// Authentication types
+const (
+	AuthSimple = "simple"
+	AuthBearer = "bearer"
+)
+
+var wellKnownAuth = map[byte]string{
+	0x00: AuthSimple,
+	0x01: AuthBearer,
+}
+
+// Authentication metadata of authType, with payload in its format
+func EncodeAuth(authType string, payload []byte) ([]byte, error) {
+	var out []byte
+	switch authType {
+	case AuthSimple:
+		out = []byte{wellKnownFlag | 0x00}
+	case AuthBearer:
+		out = []byte{wellKnownFlag | 0x01}
+	default:
+		if len(authType) == 0 || len(authType) > maxMimeTypeLength {
+			return nil, fmt.Errorf("Authentication types must be 1 to %d bytes, got %q.", maxMimeTypeLength, authType)
+		}
+		out = append([]byte{byte(len(authType) - 1)}, authType...)
+	}
+	return append(out, payload...), nil
+}
+
+// Authentication metadata with a username and password
+func EncodeSimpleAuth(username, password string) ([]byte, error) {
+	if len(username) > 0xFFFF {
+		return nil, fmt.Errorf("Usernames must be at most %d bytes, got %d.", 0xFFFF, len(username))
+	}
+	payload := make([]byte, 2, 2+len(username)+len(password))
+	binary.BigEndian.PutUint16(payload, uint16(len(username)))
+	payload = append(payload, username...)
+	payload = append(payload, password...)
+	return EncodeAuth(AuthSimple, payload)
+}
+
+// Authentication metadata with a bearer token
+func EncodeBearerAuth(token string) ([]byte, error) {
+	return EncodeAuth(AuthBearer, []byte(token))
+}
+
+// Split authentication metadata into its type and payload. The payload
+// shares memory with b.
+func DecodeAuth(b []byte) (string, []byte, error) {
+	if len(b) == 0 {
+		return "", nil, ErrMalformed
+	}
+	if b[0]&wellKnownFlag != 0 {
+		authType, ok := wellKnownAuth[b[0]&^wellKnownFlag]
+		if !ok {
+			return "", nil, fmt.Errorf("Unknown authentication type %d.", b[0]&^wellKnownFlag)
+		}
+		return authType, b[1:], nil
+	}
+	length := int(b[0]) + 1
+	if len(b) < 1+length {
+		return "", nil, ErrMalformed
+	}
+	return string(b[1 : 1+length]), b[1+length:], nil
+}
+
+// The username and password of a simple authentication payload
+func DecodeSimpleAuth(payload []byte) (string, string, error) {
+	if len(payload) < 2 {
+		return "", "", ErrMalformed
+	}
+	length := int(binary.BigEndian.Uint16(payload))
+	if len(payload) < 2+length {
+		return "", "", ErrMalformed
+	}
+	return string(payload[2 : 2+length]), string(payload[2+length:]), nil
+}
@@ -0,0 +1,83 @@
+package metadata
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestCompositeRoundTrip(t *testing.T) {
+	entries := []Entry{
+		{MimeTypeRouting, []byte{5, 'h', 'e', 'l', 'l', 'o'}},
+		{"application/x.custom", []byte("custom")},
+		{"application/json", []byte{}},
+	}
+	encoded, err := EncodeComposite(entries...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if encoded[0] != 0xFE {
+		t.Errorf("Expected well known mime types to be sent by id, got %#x", encoded[0])
+	}
+
+	decoded, err := DecodeComposite(encoded)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(decoded) != len(entries) {
+		t.Fatalf("Expected %d entries, got %d", len(entries), len(decoded))
+	}
+	for i, e := range entries {
+		if decoded[i].MimeType != e.MimeType || !bytes.Equal(decoded[i].Content, e.Content) {
+			t.Errorf("Expected %v, got %v", e, decoded[i])
+		}
+	}
+}
+
+func TestDecodeCompositeRejectsTruncatedMetadata(t *testing.T) {
+	encoded, _ := EncodeComposite(Entry{"application/x.custom", []byte("custom")})
+	for i := 1; i < len(encoded); i++ {
+		if _, err := DecodeComposite(encoded[:i]); err != ErrMalformed {
+			t.Errorf("Expected %d of %d bytes to be malformed, got %v", i, len(encoded), err)
+		}
+	}
+}
+
+func TestFindsAuthenticationInCompositeMetadata(t *testing.T) {
+	auth, _ := EncodeBearerAuth("token")
+	composite, _ := EncodeComposite(Entry{MimeTypeRouting, nil}, Entry{MimeTypeAuthentication, auth})
+
+	found, ok, err := Find(MimeTypeComposite, composite, MimeTypeAuthentication)
+	if err != nil || !ok || !bytes.Equal(found, auth) {
+		t.Errorf("Expected to find %v, got %v, %v, %v", auth, found, ok, err)
+	}
+	found, ok, err = Find(MimeTypeAuthentication, auth, MimeTypeAuthentication)
+	if err != nil || !ok || !bytes.Equal(found, auth) {
+		t.Errorf("Expected plain authentication metadata to be found, got %v, %v, %v", found, ok, err)
+	}
+	if _, ok, _ := Find("application/json", auth, MimeTypeAuthentication); ok {
+		t.Errorf("Expected nothing in metadata of another type")
+	}
+}
+
+func TestSimpleAuthRoundTrip(t *testing.T) {
+	encoded, _ := EncodeSimpleAuth("user", "pass:word")
+	if !bytes.Equal(encoded, []byte{0x80, 0, 4, 'u', 's', 'e', 'r', 'p', 'a', 's', 's', ':', 'w', 'o', 'r', 'd'}) {
+		t.Errorf("Unexpected encoding %v", encoded)
+	}
+	authType, payload, err := DecodeAuth(encoded)
+	if err != nil || authType != AuthSimple {
+		t.Fatalf("Expected simple authentication, got %q, %v", authType, err)
+	}
+	username, password, err := DecodeSimpleAuth(payload)
+	if err != nil || username != "user" || password != "pass:word" {
+		t.Errorf("Expected user and pass:word, got %q, %q, %v", username, password, err)
+	}
+}
+
+func TestCustomAuthRoundTrip(t *testing.T) {
+	encoded, _ := EncodeAuth("hmac", []byte("signature"))
+	authType, payload, err := DecodeAuth(encoded)
+	if err != nil || authType != "hmac" || string(payload) != "signature" {
+		t.Errorf("Expected hmac and signature, got %q, %q, %v", authType, payload, err)
+	}
+}
@@ -0,0 +1,136 @@
+package rs
+
+import (
+	"net"
+	"sync"
+)
+
+// What is known about a connection, for handlers to tell where requests came
+// from. Payloads handed to RequestHandler functions carry the context of the
+// connection they arrived on, as do setup payloads and the Publisher handed
+// to HandleChannel; see ContextOf. Values attached by the setup handler are
+// visible to every request on the connection.
+type ConnectionContext interface {
+	// Unique per server
+	Id() int
+	LocalAddr() net.Addr
+	RemoteAddr() net.Addr
+	// The payload the client set the connection up with, including its mime
+	// types. Unlike other payloads, it stays valid for as long as the
+	// connection.
+	Setup() ConnectionSetupPayload
+	// A value attached with SetValue, or nil
+	Value(key interface{}) interface{}
+	SetValue(key, value interface{})
+}
+
+// A context for a connection set up with setup, which is copied
+func NewConnectionContext(id int, local, remote net.Addr, setup ConnectionSetupPayload) ConnectionContext {
+	c := &connectionContext{
+		id:     id,
+		local:  local,
+		remote: remote,
+		values: make(map[interface{}]interface{}),
+	}
+	if setup != nil {
+		p := CopyPayload(setup)
+		c.setup = &contextSetupPayload{
+			NewSetupPayload(setup.MetadataMimeType(), setup.DataMimeType(), p.Metadata(), p.Data()),
+			c,
+		}
+	}
+	return c
+}
+
+// The connection context v carries, where v is a payload or Publisher handed
+// to a RequestHandler or ConnectionSetupHandler; nil if it has none
+func ContextOf(v interface{}) ConnectionContext {
+	if c, ok := v.(interface {
+		Context() ConnectionContext
+	}); ok {
+		return c.Context()
+	}
+	return nil
+}
+
+// Attach ctx to p. The result is retainable if p was.
+func WithContext(p Payload, ctx ConnectionContext) Payload {
+	if rp, ok := p.(RetainablePayload); ok {
+		return &retainableContextPayload{rp, ctx}
+	}
+	return &contextPayload{p, ctx}
+}
+
+// Attach ctx to pub
+func WithPublisherContext(pub Publisher, ctx ConnectionContext) Publisher {
+	return &contextPublisher{pub, ctx}
+}
+
+type connectionContext struct {
+	id     int
+	local  net.Addr
+	remote net.Addr
+	setup  ConnectionSetupPayload
+
+	lock   sync.Mutex
+	values map[interface{}]interface{}
+}
+
+func (c *connectionContext) Id() int {
+	return c.id
+}
+func (c *connectionContext) LocalAddr() net.Addr {
+	return c.local
+}
+func (c *connectionContext) RemoteAddr() net.Addr {
+	return c.remote
+}
+func (c *connectionContext) Setup() ConnectionSetupPayload {
+	return c.setup
+}
+func (c *connectionContext) Value(key interface{}) interface{} {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	return c.values[key]
+}
+func (c *connectionContext) SetValue(key, value interface{}) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.values[key] = value
+}
+
+type contextSetupPayload struct {
+	ConnectionSetupPayload
+	ctx ConnectionContext
+}
+
+func (p *contextSetupPayload) Context() ConnectionContext {
+	return p.ctx
+}
+
+type contextPayload struct {
+	Payload
+	ctx ConnectionContext
+}
+
+func (p *contextPayload) Context() ConnectionContext {
+	return p.ctx
+}
+
+type retainableContextPayload struct {
+	RetainablePayload
+	ctx ConnectionContext
+}
+
+func (p *retainableContextPayload) Context() ConnectionContext {
+	return p.ctx
+}
+
+type contextPublisher struct {
+	Publisher
+	ctx ConnectionContext
+}
+
+func (p *contextPublisher) Context() ConnectionContext {
+	return p.ctx
+}
@@ -14,6 +14,35 @@ type ReactiveSocket interface {
 	//MetadataPush(Payload) Publisher
 }
 
+// A ReactiveSocket bound to a connection, like the ones clients Dial. Once
+// closed, or once the connection fails for good, open streams fail and new
+// requests fail straight away.
+type ClosableSocket interface {
+	ReactiveSocket
+	// Close the connection
+	Close() error
+	// Closed once the socket has closed, for whatever reason
+	Done() <-chan struct{}
+	// Why the socket closed; nil while it is open
+	Err() error
+}
+
+// A ReactiveSocket that can tell how likely requests on it are to succeed,
+// so callers can steer clear of degraded connections.
+type AvailableSocket interface {
+	ReactiveSocket
+	// From 0, requests will fail, to 1, no reason to think they won't
+	Availability() float64
+}
+
+// The availability of s, if it reports one; 1 otherwise
+func Availability(s ReactiveSocket) float64 {
+	if as, ok := s.(AvailableSocket); ok {
+		return as.Availability()
+	}
+	return 1
+}
+
 func NewPayload(metadata, data []byte) Payload {
 	return &anonymousPayload{metadata, data}
 }
@@ -33,6 +62,35 @@ func CopyPayload(p Payload) Payload {
 	return &anonymousPayload{meta, data}
 }
 
+// Payloads handed to Subscriber#OnNext and to RequestHandler functions are
+// borrowed; their contents are only valid until the call returns, after which
+// the underlying buffer may be reused for the next inbound frame. Payloads that
+// implement RetainablePayload can be kept valid beyond that by calling Retain,
+// and must then be Released exactly once when no longer needed. See Retain.
+type RetainablePayload interface {
+	Payload
+	Retain()
+	Release()
+}
+
+// Keep a borrowed payload valid beyond the call it was handed to. This avoids
+// copying when the payload supports it, falling back to CopyPayload otherwise.
+// Pair each call with a call to Release on the returned payload.
+func Retain(p Payload) Payload {
+	if rp, ok := p.(RetainablePayload); ok {
+		rp.Retain()
+		return rp
+	}
+	return CopyPayload(p)
+}
+
+// Release a payload previously returned from Retain.
+func Release(p Payload) {
+	if rp, ok := p.(RetainablePayload); ok {
+		rp.Release()
+	}
+}
+
 type anonymousPayload struct {
 	metadata []byte
 	data     []byte
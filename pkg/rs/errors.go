@@ -0,0 +1,39 @@
+package rs
+
+import (
+	"errors"
+	"fmt"
+)
+
+// Error codes, as defined by the protocol
+const (
+	ErrorCodeInvalidSetup     uint32 = 0x0001
+	ErrorCodeUnsupportedSetup uint32 = 0x0002
+	ErrorCodeRejectedSetup    uint32 = 0x0003
+	ErrorCodeRejectedResume   uint32 = 0x0004
+	ErrorCodeConnectionError  uint32 = 0x0101
+	ErrorCodeConnectionClose  uint32 = 0x0102
+	ErrorCodeApplicationError uint32 = 0x0201
+	ErrorCodeRejected         uint32 = 0x0202
+	ErrorCodeCanceled         uint32 = 0x0203
+	ErrorCodeInvalid          uint32 = 0x0204
+)
+
+// Signalled to streams of a socket the application closed
+var ErrSocketClosed = errors.New("Socket is closed.")
+
+// An error as sent over the wire. Errors the remote sends are signalled to
+// subscribers as *Error; errors of this type that the application signals are
+// sent with their code intact, other errors are sent as application errors.
+type Error struct {
+	Code    uint32
+	Message string
+}
+
+func NewError(code uint32, message string) *Error {
+	return &Error{code, message}
+}
+
+func (e *Error) Error() string {
+	return fmt.Sprintf("Error %d: %s", e.Code, e.Message)
+}
@@ -37,6 +37,8 @@ type Subscriber interface {
 	//       I need in this library, rather than try and export dumb copies of
 	//       the java interface..
 
+	// The payload is borrowed, it is only valid until OnNext returns. Use
+	// Retain or CopyPayload to hold on to it, see RetainablePayload.
 	OnNext(v Payload)
 	OnError(e error)
 	OnComplete()
@@ -134,3 +136,11 @@ func NewEmptyPublisher() Publisher {
 		}, func() {}))
 	})
 }
+
+// Publisher that signals err to each subscriber as soon as it subscribes
+func NewErrorPublisher(err error) Publisher {
+	return NewPublisher(func(s Subscriber) {
+		s.OnSubscribe(NewSubscription(func(n int) {}, func() {}))
+		s.OnError(err)
+	})
+}
@@ -4,7 +4,9 @@ package rs
 // is established. It's purpose is to look at the setup payload the
 // client sent, and return a RequestHandler of its choice to handle
 // requests on the new connection. It is also given a ReactiveSocket
-// instance, which can be used for server-initiated exchanges.
+// instance, which can be used for server-initiated exchanges, both during
+// setup and for as long as the connection lasts. Server transports hand
+// over a ClosableSocket, to tell when the client goes away.
 type ConnectionSetupHandler func(setup ConnectionSetupPayload, socket ReactiveSocket) (*RequestHandler, error)
 
 type ConnectionSetupPayload interface {
@@ -13,6 +15,10 @@ type ConnectionSetupPayload interface {
 	DataMimeType() string
 }
 
+// Initial payloads passed to these functions are borrowed; they stay valid
+// while the function runs and while the returned Publisher is subscribed to
+// and receives its initial request, but not beyond that. Use Retain or
+// CopyPayload to hold on to one for longer, see RetainablePayload.
 type RequestHandler struct {
 	HandleRequestResponse     func(Payload) Publisher
 	HandleRequestStream       func(Payload) Publisher
@@ -0,0 +1,271 @@
+package server
+
+import (
+	"github.com/jakewins/reactivesocket-go/pkg/metadata"
+	"github.com/jakewins/reactivesocket-go/pkg/rs"
+)
+
+// Requests that fail to authenticate fail with this
+var ErrUnauthenticated = rs.NewError(rs.ErrorCodeRejected, "Not authenticated.")
+
+// Credentials as sent in authentication metadata
+type Credentials struct {
+	// metadata.AuthSimple, metadata.AuthBearer or a custom type
+	Type string
+	// Simple authentication only
+	Username string
+	Password string
+	// Bearer authentication only
+	Token string
+	// As sent, for custom types
+	Payload []byte
+}
+
+// Who a connection or request was authenticated as
+type Principal interface {
+	Name() string
+}
+
+// Checks credentials, returning who they belong to, or an error if they
+// are not valid
+type Authenticator func(Credentials) (Principal, error)
+
+type AuthOptions struct {
+	// Authenticate requests that carry their own credentials, and let setups
+	// without credentials through; their requests must then carry credentials
+	PerRequest bool
+}
+
+type AuthOption func(*AuthOptions)
+
+// Accept credentials on each request, not just on setup
+func WithRequestCredentials() AuthOption {
+	return func(o *AuthOptions) {
+		o.PerRequest = true
+	}
+}
+
+// Authenticate connections from the credentials in their setup metadata,
+// which is either authentication metadata or composite metadata with an
+// authentication entry. Setups without valid credentials are rejected with
+// REJECTED_SETUP. The principal is available from the setup payload, from
+// the payloads of requests on the connection and from the connection context,
+// see PrincipalOf and ConnectionPrincipal.
+//
+// Requests may carry their own credentials, in the same metadata format, if
+// WithRequestCredentials is given. Channels need an authenticated connection,
+// since the credentials of their first payload are only known once the
+// handler is subscribed to.
+func Authenticate(authenticator Authenticator, setup rs.ConnectionSetupHandler, opts ...AuthOption) rs.ConnectionSetupHandler {
+	o := AuthOptions{}
+	for _, opt := range opts {
+		opt(&o)
+	}
+	return func(payload rs.ConnectionSetupPayload, socket rs.ReactiveSocket) (*rs.RequestHandler, error) {
+		mimeType := payload.MetadataMimeType()
+		principal, err := authenticate(authenticator, mimeType, payload.Metadata())
+		if err != nil {
+			return nil, rs.NewError(rs.ErrorCodeRejectedSetup, err.Error())
+		}
+		if principal == nil && !o.PerRequest {
+			return nil, rs.NewError(rs.ErrorCodeRejectedSetup, "Authentication required.")
+		}
+		if ctx := rs.ContextOf(payload); ctx != nil && principal != nil {
+			ctx.SetValue(principalKey{}, principal)
+		}
+		handler, err := setup(&authenticatedSetupPayload{payload, principal}, socket)
+		if err != nil {
+			return nil, err
+		}
+		a := &authenticatingHandler{authenticator, mimeType, principal, o.PerRequest}
+		return a.wrap(handler), nil
+	}
+}
+
+// Key of the principal in connection contexts
+type principalKey struct{}
+
+// The principal p was authenticated as, or failing that, the one its
+// connection was; nil if p didn't come through Authenticate
+func PrincipalOf(p rs.Payload) Principal {
+	if ap, ok := p.(interface {
+		Principal() Principal
+	}); ok {
+		return ap.Principal()
+	}
+	return ConnectionPrincipal(rs.ContextOf(p))
+}
+
+// The principal a connection was authenticated as on setup; nil if none
+func ConnectionPrincipal(ctx rs.ConnectionContext) Principal {
+	if ctx == nil {
+		return nil
+	}
+	principal, _ := ctx.Value(principalKey{}).(Principal)
+	return principal
+}
+
+// Check the credentials in metadata, if any. Returns a nil principal if
+// there were none.
+func authenticate(authenticator Authenticator, mimeType string, md []byte) (Principal, error) {
+	auth, found, err := metadata.Find(mimeType, md, metadata.MimeTypeAuthentication)
+	if err != nil || !found || len(auth) == 0 {
+		return nil, err
+	}
+	creds, err := credentials(auth)
+	if err != nil {
+		return nil, err
+	}
+	return authenticator(creds)
+}
+
+func credentials(auth []byte) (Credentials, error) {
+	authType, payload, err := metadata.DecodeAuth(auth)
+	if err != nil {
+		return Credentials{}, err
+	}
+	creds := Credentials{Type: authType, Payload: payload}
+	switch authType {
+	case metadata.AuthSimple:
+		creds.Username, creds.Password, err = metadata.DecodeSimpleAuth(payload)
+	case metadata.AuthBearer:
+		creds.Token = string(payload)
+	}
+	return creds, err
+}
+
+type authenticatingHandler struct {
+	authenticator Authenticator
+	mimeType      string
+	// Who the connection authenticated as, if anyone
+	principal  Principal
+	perRequest bool
+}
+
+// The principal of a request, or nil if it isn't authenticated
+func (a *authenticatingHandler) principalOf(p rs.Payload) Principal {
+	if a.perRequest {
+		principal, err := authenticate(a.authenticator, a.mimeType, p.Metadata())
+		if err != nil {
+			return nil
+		}
+		if principal != nil {
+			return principal
+		}
+	}
+	return a.principal
+}
+
+func (a *authenticatingHandler) wrap(handler *rs.RequestHandler) *rs.RequestHandler {
+	authenticated := *handler
+	if h := handler.HandleRequestResponse; h != nil {
+		authenticated.HandleRequestResponse = func(p rs.Payload) rs.Publisher {
+			principal := a.principalOf(p)
+			if principal == nil {
+				return rs.NewErrorPublisher(ErrUnauthenticated)
+			}
+			return h(withPrincipal(p, principal))
+		}
+	}
+	if h := handler.HandleRequestStream; h != nil {
+		authenticated.HandleRequestStream = func(p rs.Payload) rs.Publisher {
+			principal := a.principalOf(p)
+			if principal == nil {
+				return rs.NewErrorPublisher(ErrUnauthenticated)
+			}
+			return h(withPrincipal(p, principal))
+		}
+	}
+	if h := handler.HandleRequestSubscription; h != nil {
+		authenticated.HandleRequestSubscription = func(p rs.Payload) rs.Publisher {
+			principal := a.principalOf(p)
+			if principal == nil {
+				return rs.NewErrorPublisher(ErrUnauthenticated)
+			}
+			return h(withPrincipal(p, principal))
+		}
+	}
+	if h := handler.HandleChannel; h != nil {
+		authenticated.HandleChannel = func(in rs.Publisher) rs.Publisher {
+			if a.principal == nil {
+				return rs.NewErrorPublisher(ErrUnauthenticated)
+			}
+			return h(&principalPublisher{in, a.principal})
+		}
+	}
+	if h := handler.HandleFireAndForget; h != nil {
+		authenticated.HandleFireAndForget = func(p rs.Payload) {
+			if principal := a.principalOf(p); principal != nil {
+				h(withPrincipal(p, principal))
+			}
+		}
+	}
+	if h := handler.HandleMetadataPush; h != nil {
+		authenticated.HandleMetadataPush = func(p rs.Payload) {
+			if principal := a.principalOf(p); principal != nil {
+				h(withPrincipal(p, principal))
+			}
+		}
+	}
+	return &authenticated
+}
+
+type authenticatedSetupPayload struct {
+	rs.ConnectionSetupPayload
+	principal Principal
+}
+
+func (p *authenticatedSetupPayload) Principal() Principal {
+	return p.principal
+}
+func (p *authenticatedSetupPayload) Context() rs.ConnectionContext {
+	return rs.ContextOf(p.ConnectionSetupPayload)
+}
+
+// Keeps p retainable if it was, so handlers can still avoid copying it
+func withPrincipal(p rs.Payload, principal Principal) rs.Payload {
+	if rp, ok := p.(rs.RetainablePayload); ok {
+		return &retainablePrincipalPayload{rp, principal}
+	}
+	return &principalPayload{p, principal}
+}
+
+type principalPayload struct {
+	rs.Payload
+	principal Principal
+}
+
+func (p *principalPayload) Principal() Principal {
+	return p.principal
+}
+func (p *principalPayload) Context() rs.ConnectionContext {
+	return rs.ContextOf(p.Payload)
+}
+
+type retainablePrincipalPayload struct {
+	rs.RetainablePayload
+	principal Principal
+}
+
+func (p *retainablePrincipalPayload) Principal() Principal {
+	return p.principal
+}
+func (p *retainablePrincipalPayload) Context() rs.ConnectionContext {
+	return rs.ContextOf(p.RetainablePayload)
+}
+
+// Hands on payloads with the principal attached
+type principalPublisher struct {
+	source    rs.Publisher
+	principal Principal
+}
+
+func (p *principalPublisher) Context() rs.ConnectionContext {
+	return rs.ContextOf(p.source)
+}
+
+func (p *principalPublisher) Subscribe(s rs.Subscriber) {
+	p.source.Subscribe(rs.NewSubscriber(s.OnSubscribe, func(payload rs.Payload) {
+		s.OnNext(withPrincipal(payload, p.principal))
+	}, s.OnError, s.OnComplete))
+}
@@ -0,0 +1,139 @@
+package server
+
+import (
+	"errors"
+	"github.com/jakewins/reactivesocket-go/pkg/metadata"
+	"github.com/jakewins/reactivesocket-go/pkg/rs"
+	"testing"
+)
+
+func TestAuthenticatesSetupWithSimpleCredentials(t *testing.T) {
+	var setupPrincipal, requestPrincipal Principal
+	setup := Authenticate(passwords, func(p rs.ConnectionSetupPayload, _ rs.ReactiveSocket) (*rs.RequestHandler, error) {
+		setupPrincipal = PrincipalOf(p)
+		return principalHandler(&requestPrincipal), nil
+	})
+	auth, _ := metadata.EncodeSimpleAuth("alice", "secret")
+
+	handler, err := setup(rs.NewSetupPayload(metadata.MimeTypeAuthentication, "", auth, nil), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := requestResponse(handler, "hi"); err != nil {
+		t.Fatal(err)
+	}
+	if setupPrincipal == nil || setupPrincipal.Name() != "alice" {
+		t.Errorf("Expected the setup to be authenticated as alice, got %v", setupPrincipal)
+	}
+	if requestPrincipal == nil || requestPrincipal.Name() != "alice" {
+		t.Errorf("Expected requests to be authenticated as alice, got %v", requestPrincipal)
+	}
+}
+
+func TestRejectsSetupsWithoutValidCredentials(t *testing.T) {
+	setup := Authenticate(passwords, func(rs.ConnectionSetupPayload, rs.ReactiveSocket) (*rs.RequestHandler, error) {
+		t.Errorf("Expected the setup handler not to be called")
+		return nil, nil
+	})
+	wrong, _ := metadata.EncodeSimpleAuth("alice", "guess")
+	bearer, _ := metadata.EncodeBearerAuth("alice")
+	composite, _ := metadata.EncodeComposite(metadata.Entry{MimeType: metadata.MimeTypeAuthentication, Content: wrong})
+
+	for _, p := range []rs.ConnectionSetupPayload{
+		rs.NewSetupPayload(metadata.MimeTypeAuthentication, "", nil, nil),
+		rs.NewSetupPayload(metadata.MimeTypeAuthentication, "", []byte{0x85}, nil),
+		rs.NewSetupPayload(metadata.MimeTypeAuthentication, "", wrong, nil),
+		rs.NewSetupPayload(metadata.MimeTypeAuthentication, "", bearer, nil),
+		rs.NewSetupPayload(metadata.MimeTypeComposite, "", composite, nil),
+		rs.NewSetupPayload(metadata.MimeTypeComposite, "", []byte{1, 2}, nil),
+	} {
+		_, err := setup(p, nil)
+		if e, ok := err.(*rs.Error); !ok || e.Code != rs.ErrorCodeRejectedSetup {
+			t.Errorf("Expected setup with %v to be rejected, got %v", p.Metadata(), err)
+		}
+	}
+}
+
+func TestAuthenticatesRequestsWithTheirOwnCredentials(t *testing.T) {
+	var principal Principal
+	setup := Authenticate(passwords, func(rs.ConnectionSetupPayload, rs.ReactiveSocket) (*rs.RequestHandler, error) {
+		return principalHandler(&principal), nil
+	}, WithRequestCredentials())
+	handler, err := setup(rs.NewSetupPayload(metadata.MimeTypeComposite, "", nil, nil), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := requestResponse(handler, "hi"); err != ErrUnauthenticated {
+		t.Errorf("Expected requests without credentials to be rejected, got %v", err)
+	}
+
+	auth, _ := metadata.EncodeSimpleAuth("bob", "hunter2")
+	composite, _ := metadata.EncodeComposite(metadata.Entry{MimeType: metadata.MimeTypeAuthentication, Content: auth})
+	var err2 error
+	handler.HandleRequestResponse(rs.NewPayload(composite, nil)).Subscribe(rs.NewSubscriber(func(s rs.Subscription) {
+		s.Request(1)
+	}, nil, func(e error) { err2 = e }, nil))
+	if err2 != nil || principal == nil || principal.Name() != "bob" {
+		t.Errorf("Expected the request to be authenticated as bob, got %v, %v", principal, err2)
+	}
+}
+
+func TestChannelsNeedAnAuthenticatedConnection(t *testing.T) {
+	setup := Authenticate(passwords, func(rs.ConnectionSetupPayload, rs.ReactiveSocket) (*rs.RequestHandler, error) {
+		return &rs.RequestHandler{HandleChannel: func(in rs.Publisher) rs.Publisher {
+			return in
+		}}, nil
+	}, WithRequestCredentials())
+	handler, _ := setup(rs.NewSetupPayload(metadata.MimeTypeAuthentication, "", nil, nil), nil)
+
+	var err error
+	handler.HandleChannel(rs.NewEmptyPublisher()).Subscribe(rs.NewSubscriber(func(s rs.Subscription) {
+		s.Request(1)
+	}, nil, func(e error) { err = e }, nil))
+	if err != ErrUnauthenticated {
+		t.Errorf("Expected the channel to be rejected, got %v", err)
+	}
+}
+
+type user string
+
+func (u user) Name() string {
+	return string(u)
+}
+
+func passwords(c Credentials) (Principal, error) {
+	if c.Type == metadata.AuthSimple && (c.Username == "alice" && c.Password == "secret" ||
+		c.Username == "bob" && c.Password == "hunter2") {
+		return user(c.Username), nil
+	}
+	return nil, errors.New("Invalid username or password.")
+}
+
+// Records the principal of each request
+func principalHandler(principal *Principal) *rs.RequestHandler {
+	return &rs.RequestHandler{
+		HandleRequestResponse: func(p rs.Payload) rs.Publisher {
+			*principal = PrincipalOf(p)
+			return rs.NewEmptyPublisher()
+		},
+	}
+}
+
+func TestConnectionContextCarriesThePrincipal(t *testing.T) {
+	setup := Authenticate(passwords, func(rs.ConnectionSetupPayload, rs.ReactiveSocket) (*rs.RequestHandler, error) {
+		return &rs.RequestHandler{}, nil
+	})
+	auth, _ := metadata.EncodeSimpleAuth("alice", "secret")
+	ctx := rs.NewConnectionContext(1, nil, nil, rs.NewSetupPayload(metadata.MimeTypeAuthentication, "", auth, nil))
+
+	if _, err := setup(ctx.Setup(), nil); err != nil {
+		t.Fatal(err)
+	}
+	if p := ConnectionPrincipal(ctx); p == nil || p.Name() != "alice" {
+		t.Errorf("Expected the connection to be authenticated as alice, got %v", p)
+	}
+	if p := PrincipalOf(rs.WithContext(rs.NewPayload(nil, nil), ctx)); p == nil || p.Name() != "alice" {
+		t.Errorf("Expected payloads on the connection to be authenticated as alice, got %v", p)
+	}
+}
@@ -0,0 +1,314 @@
+package server
+
+import (
+	"fmt"
+	"github.com/jakewins/reactivesocket-go/pkg/rs"
+	"math"
+	"sync"
+)
+
+// Subscribers dropped by the Disconnect overflow strategy fail with this
+var ErrSlowConsumer = rs.NewError(rs.ErrorCodeApplicationError, "Subscriber fell too far behind.")
+
+// Subscriptions to a hub that has been closed fail with this
+var ErrHubClosed = rs.NewError(rs.ErrorCodeApplicationError, "Hub is closed.")
+
+// What to do with a payload published to a subscriber that hasn't asked
+// for more, once its buffer is full
+type Overflow int
+
+const (
+	// Make room by dropping the oldest buffered payload
+	DropOldest Overflow = iota
+	// Drop the payload
+	DropNewest
+	// Grow the buffer without bound
+	Buffer
+	// Fail the subscription with ErrSlowConsumer
+	Disconnect
+)
+
+func (o Overflow) String() string {
+	switch o {
+	case DropOldest:
+		return "DropOldest"
+	case DropNewest:
+		return "DropNewest"
+	case Buffer:
+		return "Buffer"
+	case Disconnect:
+		return "Disconnect"
+	}
+	return fmt.Sprintf("Overflow(%d)", int(o))
+}
+
+type HubOptions struct {
+	// Payloads held per subscriber until it asks for them
+	BufferSize int
+	Overflow   Overflow
+	// Names the topic a subscription request is for; by default its data
+	TopicOf func(rs.Payload) string
+}
+
+type HubOption func(*HubOptions)
+
+// Hold up to size payloads per subscriber, dealing with more as overflow says
+func WithSubscriberBuffer(size int, overflow Overflow) HubOption {
+	return func(o *HubOptions) {
+		o.BufferSize, o.Overflow = size, overflow
+	}
+}
+
+// Name the topic of subscription requests
+func WithTopicOf(topicOf func(rs.Payload) string) HubOption {
+	return func(o *HubOptions) {
+		o.TopicOf = topicOf
+	}
+}
+
+// Fans payloads published to a topic out to everyone subscribed to it. Plug
+// HandleRequestSubscription into a RequestHandler to let remote subscribers
+// in. Subscribers only get payloads published after they subscribed, and
+// only as many as they ask for; the rest wait in a buffer per subscriber.
+type Hub struct {
+	options HubOptions
+
+	lock   sync.Mutex
+	topics map[string]map[*hubSubscription]bool
+	closed bool
+}
+
+func NewHub(opts ...HubOption) (*Hub, error) {
+	o := HubOptions{
+		BufferSize: 256,
+		Overflow:   DropOldest,
+		TopicOf: func(p rs.Payload) string {
+			return string(p.Data())
+		},
+	}
+	for _, opt := range opts {
+		opt(&o)
+	}
+	if o.BufferSize < 1 && o.Overflow != Buffer {
+		return nil, fmt.Errorf("Subscriber buffers must hold at least 1 payload, got %d.", o.BufferSize)
+	}
+	if o.Overflow < DropOldest || o.Overflow > Disconnect {
+		return nil, fmt.Errorf("Unknown overflow strategy %s.", o.Overflow)
+	}
+	return &Hub{
+		options: o,
+		topics:  make(map[string]map[*hubSubscription]bool),
+	}, nil
+}
+
+// For RequestHandler.HandleRequestSubscription
+func (h *Hub) HandleRequestSubscription(p rs.Payload) rs.Publisher {
+	return h.Subscribe(h.options.TopicOf(p))
+}
+
+// A Publisher of what is published to topic
+func (h *Hub) Subscribe(topic string) rs.Publisher {
+	return rs.NewPublisher(func(s rs.Subscriber) {
+		sub := &hubSubscription{hub: h, topic: topic, subscriber: s}
+		s.OnSubscribe(sub)
+		h.add(sub)
+	})
+}
+
+// Send p to every subscriber of topic. p is copied, so it may be reused once
+// this returns.
+func (h *Hub) Publish(topic string, p rs.Payload) {
+	h.lock.Lock()
+	subs := make([]*hubSubscription, 0, len(h.topics[topic]))
+	for sub := range h.topics[topic] {
+		subs = append(subs, sub)
+	}
+	h.lock.Unlock()
+	if len(subs) == 0 {
+		return
+	}
+
+	// Shared by all subscribers, none of whom may change it
+	p = rs.CopyPayload(p)
+	for _, sub := range subs {
+		sub.push(p)
+	}
+}
+
+// Subscribers to topic
+func (h *Hub) Subscribers(topic string) int {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	return len(h.topics[topic])
+}
+
+// Complete every subscription, once it has been sent what it has buffered.
+// Later subscriptions fail with ErrHubClosed.
+func (h *Hub) Close() {
+	h.lock.Lock()
+	h.closed = true
+	var subs []*hubSubscription
+	for _, topic := range h.topics {
+		for sub := range topic {
+			subs = append(subs, sub)
+		}
+	}
+	h.topics = make(map[string]map[*hubSubscription]bool)
+	h.lock.Unlock()
+
+	for _, sub := range subs {
+		sub.terminate(nil)
+	}
+}
+
+func (h *Hub) add(sub *hubSubscription) {
+	h.lock.Lock()
+	if h.closed {
+		h.lock.Unlock()
+		sub.terminate(ErrHubClosed)
+		return
+	}
+	sub.lock.Lock()
+	cancelled := sub.done
+	sub.lock.Unlock()
+	if !cancelled {
+		if h.topics[sub.topic] == nil {
+			h.topics[sub.topic] = make(map[*hubSubscription]bool)
+		}
+		h.topics[sub.topic][sub] = true
+	}
+	h.lock.Unlock()
+}
+
+func (h *Hub) remove(sub *hubSubscription) {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	if topic, ok := h.topics[sub.topic]; ok {
+		delete(topic, sub)
+		if len(topic) == 0 {
+			delete(h.topics, sub.topic)
+		}
+	}
+}
+
+// One subscriber. Payloads are delivered by whichever goroutine finds
+// there is both demand and something to send, one goroutine at a time, so
+// the subscriber is never called concurrently.
+type hubSubscription struct {
+	hub        *Hub
+	topic      string
+	subscriber rs.Subscriber
+
+	lock     sync.Mutex
+	buffer   []rs.Payload
+	demand   int
+	draining bool
+	// Set once cancelled, or once a terminal signal is due
+	done bool
+	// Signalled once the buffer is sent; nil for completion
+	err         error
+	terminating bool
+}
+
+func (s *hubSubscription) Request(n int) {
+	if n <= 0 {
+		return
+	}
+	s.lock.Lock()
+	if s.demand > math.MaxInt32-n {
+		s.demand = math.MaxInt32
+	} else {
+		s.demand += n
+	}
+	s.lock.Unlock()
+	s.drain()
+}
+
+func (s *hubSubscription) Cancel() {
+	s.lock.Lock()
+	s.done, s.terminating, s.buffer = true, false, nil
+	s.lock.Unlock()
+	s.hub.remove(s)
+}
+
+func (s *hubSubscription) push(p rs.Payload) {
+	o := s.hub.options
+	s.lock.Lock()
+	if s.done {
+		s.lock.Unlock()
+		return
+	}
+	// Whatever the demand, as the buffer also fills while a slow subscriber
+	// is handed earlier payloads
+	if len(s.buffer) >= o.BufferSize && o.Overflow != Buffer {
+		switch o.Overflow {
+		case DropOldest:
+			s.buffer[0] = nil
+			s.buffer = s.buffer[1:]
+		case DropNewest:
+			s.lock.Unlock()
+			return
+		case Disconnect:
+			s.lock.Unlock()
+			s.hub.remove(s)
+			s.terminate(ErrSlowConsumer)
+			return
+		}
+	}
+	s.buffer = append(s.buffer, p)
+	s.lock.Unlock()
+	s.drain()
+}
+
+// End the subscription; errors are signalled straight away, completion once
+// the buffer has been sent
+func (s *hubSubscription) terminate(err error) {
+	s.lock.Lock()
+	if s.done {
+		s.lock.Unlock()
+		return
+	}
+	s.done, s.terminating, s.err = true, true, err
+	if err != nil {
+		s.buffer = nil
+	}
+	s.lock.Unlock()
+	s.drain()
+}
+
+func (s *hubSubscription) drain() {
+	s.lock.Lock()
+	if s.draining {
+		// Whoever is draining will pick up what we added
+		s.lock.Unlock()
+		return
+	}
+	s.draining = true
+	for {
+		if s.demand > 0 && len(s.buffer) > 0 {
+			p := s.buffer[0]
+			s.buffer[0] = nil
+			s.buffer = s.buffer[1:]
+			s.demand--
+			s.lock.Unlock()
+			s.subscriber.OnNext(p)
+			s.lock.Lock()
+			continue
+		}
+		if s.terminating && len(s.buffer) == 0 {
+			s.terminating = false
+			s.draining = false
+			err := s.err
+			s.lock.Unlock()
+			if err != nil {
+				s.subscriber.OnError(err)
+			} else {
+				s.subscriber.OnComplete()
+			}
+			return
+		}
+		s.draining = false
+		s.lock.Unlock()
+		return
+	}
+}
@@ -0,0 +1,222 @@
+package server
+
+import (
+	"fmt"
+	"github.com/jakewins/reactivesocket-go/pkg/rs"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestFansOutToSubscribersOfATopic(t *testing.T) {
+	hub, _ := NewHub()
+	a, b, other := subscribe(hub, "prices", 10), subscribe(hub, "prices", 10), subscribe(hub, "news", 10)
+
+	publish(hub, "prices", 3)
+
+	for _, s := range []*recorder{a, b} {
+		if got := s.values(); !reflect.DeepEqual(got, []string{"0", "1", "2"}) {
+			t.Errorf("Expected every subscriber to get 0 to 2, got %v", got)
+		}
+	}
+	if got := other.values(); len(got) != 0 {
+		t.Errorf("Expected subscribers of other topics to get nothing, got %v", got)
+	}
+}
+
+func TestRespectsDemand(t *testing.T) {
+	hub, _ := NewHub(WithSubscriberBuffer(10, DropOldest))
+	s := subscribe(hub, "prices", 1)
+
+	publish(hub, "prices", 3)
+	if got := s.values(); !reflect.DeepEqual(got, []string{"0"}) {
+		t.Fatalf("Expected only what was asked for, got %v", got)
+	}
+	s.subscription.Request(5)
+	if got := s.values(); !reflect.DeepEqual(got, []string{"0", "1", "2"}) {
+		t.Errorf("Expected the buffered payloads once asked for, got %v", got)
+	}
+}
+
+func TestOverflowStrategies(t *testing.T) {
+	for _, c := range []struct {
+		overflow Overflow
+		expected []string
+		err      error
+	}{
+		{DropOldest, []string{"3", "4"}, nil},
+		{DropNewest, []string{"0", "1"}, nil},
+		{Buffer, []string{"0", "1", "2", "3", "4"}, nil},
+		{Disconnect, nil, ErrSlowConsumer},
+	} {
+		hub, _ := NewHub(WithSubscriberBuffer(2, c.overflow))
+		s := subscribe(hub, "prices", 0)
+
+		publish(hub, "prices", 5)
+		s.subscription.Request(10)
+
+		if got := s.values(); !reflect.DeepEqual(got, c.expected) {
+			t.Errorf("%s: Expected %v, got %v", c.overflow, c.expected, got)
+		}
+		if s.err != c.err {
+			t.Errorf("%s: Expected %v, got %v", c.overflow, c.err, s.err)
+		}
+		if c.err != nil && hub.Subscribers("prices") != 0 {
+			t.Errorf("%s: Expected the slow subscriber to be removed", c.overflow)
+		}
+	}
+}
+
+func TestSlowConsumerIsDisconnectedDespiteDemand(t *testing.T) {
+	hub, _ := NewHub(WithSubscriberBuffer(2, Disconnect))
+	s := subscribe(hub, "prices", 0)
+	s.hold, s.entered = make(chan struct{}), make(chan struct{}, 10)
+	s.subscription.Request(1000)
+
+	// Delivered straight away, and stuck there
+	go publish(hub, "prices", 1)
+	<-s.entered
+	publish(hub, "prices", 3)
+	if hub.Subscribers("prices") != 0 {
+		t.Errorf("Expected the slow subscriber to be removed")
+	}
+
+	close(s.hold)
+	for deadline := time.Now().Add(5 * time.Second); s.error() != ErrSlowConsumer; time.Sleep(time.Millisecond) {
+		if time.Now().After(deadline) {
+			t.Fatalf("Expected %s, got %v", ErrSlowConsumer, s.error())
+		}
+	}
+}
+
+func TestCancelledSubscribersAreRemoved(t *testing.T) {
+	hub, _ := NewHub()
+	s := subscribe(hub, "prices", 10)
+	s.subscription.Cancel()
+
+	publish(hub, "prices", 1)
+	if hub.Subscribers("prices") != 0 || len(s.values()) != 0 {
+		t.Errorf("Expected the cancelled subscriber to be gone")
+	}
+}
+
+func TestCloseCompletesOnceBufferIsSent(t *testing.T) {
+	hub, _ := NewHub()
+	s := subscribe(hub, "prices", 0)
+	publish(hub, "prices", 2)
+
+	hub.Close()
+	if s.completed() {
+		t.Fatalf("Expected completion to wait for the buffer to be sent")
+	}
+	s.subscription.Request(2)
+	if !s.completed() || len(s.values()) != 2 {
+		t.Errorf("Expected the buffer and then completion, got %v", s.values())
+	}
+
+	late := subscribe(hub, "prices", 1)
+	if late.err != ErrHubClosed {
+		t.Errorf("Expected subscribing to a closed hub to fail, got %v", late.err)
+	}
+}
+
+func TestHandlesSubscriptionRequests(t *testing.T) {
+	hub, _ := NewHub()
+	s := &recorder{}
+	hub.HandleRequestSubscription(rs.NewPayload(nil, []byte("prices"))).Subscribe(s)
+	s.subscription.Request(1)
+
+	publish(hub, "prices", 1)
+	if got := s.values(); !reflect.DeepEqual(got, []string{"0"}) {
+		t.Errorf("Expected the subscription request to be for its topic, got %v", got)
+	}
+}
+
+func TestConcurrentPublishersDeliverEverything(t *testing.T) {
+	hub, _ := NewHub(WithSubscriberBuffer(1, Buffer))
+	s := subscribe(hub, "prices", 0)
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			publish(hub, "prices", 100)
+		}()
+		go s.subscription.Request(100)
+	}
+	wg.Wait()
+	// The last requests may still be on their way
+	for deadline := time.Now().Add(5 * time.Second); len(s.values()) < 400; time.Sleep(time.Millisecond) {
+		if time.Now().After(deadline) {
+			t.Fatalf("Expected 400 payloads, got %d", len(s.values()))
+		}
+	}
+}
+
+func subscribe(hub *Hub, topic string, n int) *recorder {
+	r := &recorder{}
+	hub.Subscribe(topic).Subscribe(r)
+	if n > 0 {
+		r.subscription.Request(n)
+	}
+	return r
+}
+
+func publish(hub *Hub, topic string, n int) {
+	for i := 0; i < n; i++ {
+		hub.Publish(topic, rs.NewPayload(nil, []byte(fmt.Sprintf("%d", i))))
+	}
+}
+
+type recorder struct {
+	subscription rs.Subscription
+	// If set, OnNext signals entered and waits for hold to close
+	hold, entered chan struct{}
+
+	lock     sync.Mutex
+	received []string
+	err      error
+	complete bool
+}
+
+func (r *recorder) values() []string {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	return append([]string(nil), r.received...)
+}
+
+func (r *recorder) error() error {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	return r.err
+}
+
+func (r *recorder) completed() bool {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	return r.complete
+}
+
+func (r *recorder) OnSubscribe(s rs.Subscription) {
+	r.subscription = s
+}
+func (r *recorder) OnNext(p rs.Payload) {
+	if r.hold != nil {
+		r.entered <- struct{}{}
+		<-r.hold
+	}
+	r.lock.Lock()
+	r.received = append(r.received, string(p.Data()))
+	r.lock.Unlock()
+}
+func (r *recorder) OnError(err error) {
+	r.lock.Lock()
+	r.err = err
+	r.lock.Unlock()
+}
+func (r *recorder) OnComplete() {
+	r.lock.Lock()
+	r.complete = true
+	r.lock.Unlock()
+}
@@ -0,0 +1,261 @@
+// Helpers for serving requests: limiting, authenticating and fanning out.
+package server
+
+import (
+	"fmt"
+	"github.com/jakewins/reactivesocket-go/pkg/rs"
+	"sync"
+	"time"
+)
+
+// Requests over a rate limit fail with this
+var ErrRateLimited = rs.NewError(rs.ErrorCodeRejected, "Rate limit exceeded.")
+
+// Buckets are swept of idle entries once there are this many
+const minSweep = 1024
+
+// A token bucket: Rate requests a second on average, in bursts of up to Burst
+type Rate struct {
+	Rate  float64
+	Burst int
+}
+
+type RateLimitOptions struct {
+	// Shared by all requests; zero for no limit
+	Global Rate
+	// Shared by all connections with the same identity; zero for no limit
+	PerConnection Rate
+	// Identifies the peer from its setup payload; by default its data
+	Identity func(rs.ConnectionSetupPayload) string
+	// Per route, shared by all connections; routes not listed are not limited
+	PerRoute map[string]Rate
+	// Names the route of a request; required for PerRoute
+	Route func(rs.Payload) string
+	// For tests
+	now func() time.Time
+}
+
+type RateLimitOption func(*RateLimitOptions)
+
+// Limit all requests to the server
+func WithGlobalRate(rate float64, burst int) RateLimitOption {
+	return func(o *RateLimitOptions) {
+		o.Global = Rate{rate, burst}
+	}
+}
+
+// Limit requests from each peer, as told apart by identity; if nil, peers
+// are told apart by their setup data
+func WithConnectionRate(rate float64, burst int, identity func(rs.ConnectionSetupPayload) string) RateLimitOption {
+	return func(o *RateLimitOptions) {
+		o.PerConnection = Rate{rate, burst}
+		if identity != nil {
+			o.Identity = identity
+		}
+	}
+}
+
+// Limit requests to one route, as named by the function given to WithRouter
+func WithRouteRate(route string, rate float64, burst int) RateLimitOption {
+	return func(o *RateLimitOptions) {
+		if o.PerRoute == nil {
+			o.PerRoute = make(map[string]Rate)
+		}
+		o.PerRoute[route] = Rate{rate, burst}
+	}
+}
+
+// Name the route of each request, for WithRouteRate
+func WithRouter(route func(rs.Payload) string) RateLimitOption {
+	return func(o *RateLimitOptions) {
+		o.Route = route
+	}
+}
+
+// Rejects requests over any of its limits with ErrRateLimited; fire and
+// forget requests over the limits are dropped. A request takes from every
+// limit that applies to it, or from none if one is exhausted. Channels are
+// limited when opened, before their route is known, so only the global and
+// per connection limits apply to them.
+//
+// Leases are not supported yet, so peers that would honour them are rejected
+// like any other, rather than being issued leases that shrink as their
+// bucket drains.
+type RateLimiter struct {
+	options RateLimitOptions
+
+	lock      sync.Mutex
+	global    *bucket
+	buckets   map[string]*bucket
+	nextSweep int
+}
+
+func NewRateLimiter(opts ...RateLimitOption) (*RateLimiter, error) {
+	o := RateLimitOptions{
+		Identity: func(setup rs.ConnectionSetupPayload) string {
+			return string(setup.Data())
+		},
+		now: time.Now,
+	}
+	for _, opt := range opts {
+		opt(&o)
+	}
+	rates := []Rate{o.Global, o.PerConnection}
+	for _, r := range o.PerRoute {
+		rates = append(rates, r)
+	}
+	for _, r := range rates {
+		if r.Rate < 0 || r.Burst < 0 || (r.Rate > 0) != (r.Burst > 0) {
+			return nil, fmt.Errorf("Rates need both a positive rate and burst, or neither, got %f and %d.", r.Rate, r.Burst)
+		}
+	}
+	if len(o.PerRoute) > 0 && o.Route == nil {
+		return nil, fmt.Errorf("Route limits need a router, see WithRouter.")
+	}
+	l := &RateLimiter{
+		options:   o,
+		buckets:   make(map[string]*bucket),
+		nextSweep: minSweep,
+	}
+	if o.Global.Rate > 0 {
+		l.global = newBucket(o.Global, o.now())
+	}
+	return l, nil
+}
+
+// Limit the requests of every connection setup accepts
+func (l *RateLimiter) Wrap(setup rs.ConnectionSetupHandler) rs.ConnectionSetupHandler {
+	return func(payload rs.ConnectionSetupPayload, socket rs.ReactiveSocket) (*rs.RequestHandler, error) {
+		handler, err := setup(payload, socket)
+		if err != nil {
+			return nil, err
+		}
+		return l.Handler(l.options.Identity(payload), handler), nil
+	}
+}
+
+// Limit the requests handler gets from the peer named identity
+func (l *RateLimiter) Handler(identity string, handler *rs.RequestHandler) *rs.RequestHandler {
+	limited := *handler
+	if h := handler.HandleRequestResponse; h != nil {
+		limited.HandleRequestResponse = func(p rs.Payload) rs.Publisher {
+			if !l.allow(identity, p) {
+				return rs.NewErrorPublisher(ErrRateLimited)
+			}
+			return h(p)
+		}
+	}
+	if h := handler.HandleRequestStream; h != nil {
+		limited.HandleRequestStream = func(p rs.Payload) rs.Publisher {
+			if !l.allow(identity, p) {
+				return rs.NewErrorPublisher(ErrRateLimited)
+			}
+			return h(p)
+		}
+	}
+	if h := handler.HandleRequestSubscription; h != nil {
+		limited.HandleRequestSubscription = func(p rs.Payload) rs.Publisher {
+			if !l.allow(identity, p) {
+				return rs.NewErrorPublisher(ErrRateLimited)
+			}
+			return h(p)
+		}
+	}
+	if h := handler.HandleChannel; h != nil {
+		limited.HandleChannel = func(in rs.Publisher) rs.Publisher {
+			if !l.allow(identity, nil) {
+				return rs.NewErrorPublisher(ErrRateLimited)
+			}
+			return h(in)
+		}
+	}
+	if h := handler.HandleFireAndForget; h != nil {
+		limited.HandleFireAndForget = func(p rs.Payload) {
+			if l.allow(identity, p) {
+				h(p)
+			}
+		}
+	}
+	return &limited
+}
+
+// Take a token from each bucket p falls under, if they all have one. p is
+// nil for channels.
+func (l *RateLimiter) allow(identity string, p rs.Payload) bool {
+	o := l.options
+	now := o.now()
+
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	buckets := make([]*bucket, 0, 3)
+	if l.global != nil {
+		buckets = append(buckets, l.global)
+	}
+	if o.PerConnection.Rate > 0 {
+		buckets = append(buckets, l.bucket("connection:"+identity, o.PerConnection, now))
+	}
+	if p != nil && len(o.PerRoute) > 0 {
+		route := o.Route(p)
+		if r, ok := o.PerRoute[route]; ok {
+			buckets = append(buckets, l.bucket("route:"+route, r, now))
+		}
+	}
+
+	for _, b := range buckets {
+		if b.fill(now) < 1 {
+			return false
+		}
+	}
+	for _, b := range buckets {
+		b.tokens--
+	}
+	return true
+}
+
+func (l *RateLimiter) bucket(key string, rate Rate, now time.Time) *bucket {
+	if b, ok := l.buckets[key]; ok {
+		return b
+	}
+	if len(l.buckets) >= l.nextSweep {
+		l.sweep(now)
+	}
+	b := newBucket(rate, now)
+	l.buckets[key] = b
+	return b
+}
+
+// Forget buckets that have filled up, since they are as good as new; keeps
+// peers that come and go from piling up
+func (l *RateLimiter) sweep(now time.Time) {
+	for key, b := range l.buckets {
+		if b.fill(now) >= float64(b.rate.Burst) {
+			delete(l.buckets, key)
+		}
+	}
+	l.nextSweep = 2 * len(l.buckets)
+	if l.nextSweep < minSweep {
+		l.nextSweep = minSweep
+	}
+}
+
+type bucket struct {
+	rate   Rate
+	tokens float64
+	filled time.Time
+}
+
+func newBucket(rate Rate, now time.Time) *bucket {
+	return &bucket{rate, float64(rate.Burst), now}
+}
+
+// Top up with the tokens earned since last time, returning how many there are
+func (b *bucket) fill(now time.Time) float64 {
+	if now.After(b.filled) {
+		b.tokens += now.Sub(b.filled).Seconds() * b.rate.Rate
+		if max := float64(b.rate.Burst); b.tokens > max {
+			b.tokens = max
+		}
+		b.filled = now
+	}
+	return b.tokens
+}
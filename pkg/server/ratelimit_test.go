@@ -0,0 +1,143 @@
+package server
+
+import (
+	"github.com/jakewins/reactivesocket-go/pkg/rs"
+	"testing"
+	"time"
+)
+
+func TestRejectsRequestsOverTheConnectionRate(t *testing.T) {
+	clock := &fakeClock{time.Unix(0, 0)}
+	limiter, _ := NewRateLimiter(WithConnectionRate(1, 2, nil), withClock(clock))
+	alice := limiter.Handler("alice", echoHandler())
+	bob := limiter.Handler("bob", echoHandler())
+
+	for i := 0; i < 2; i++ {
+		if err := requestResponse(alice, "hi"); err != nil {
+			t.Fatalf("Expected request %d to be let through, got %s", i, err)
+		}
+	}
+	if err := requestResponse(alice, "hi"); err != ErrRateLimited {
+		t.Errorf("Expected the burst to be used up, got %v", err)
+	}
+	if err := requestResponse(bob, "hi"); err != nil {
+		t.Errorf("Expected other peers to be unaffected, got %s", err)
+	}
+
+	clock.advance(time.Second)
+	if err := requestResponse(alice, "hi"); err != nil {
+		t.Errorf("Expected a token after a second, got %s", err)
+	}
+}
+
+func TestLimitsRoutesAcrossConnections(t *testing.T) {
+	clock := &fakeClock{time.Unix(0, 0)}
+	limiter, _ := NewRateLimiter(WithRouteRate("slow", 1, 1), withClock(clock),
+		WithRouter(func(p rs.Payload) string { return string(p.Data()) }))
+	alice := limiter.Handler("alice", echoHandler())
+	bob := limiter.Handler("bob", echoHandler())
+
+	if err := requestResponse(alice, "slow"); err != nil {
+		t.Fatalf("Expected the first request to be let through, got %s", err)
+	}
+	if err := requestResponse(bob, "slow"); err != ErrRateLimited {
+		t.Errorf("Expected the route to be limited for everyone, got %v", err)
+	}
+	if err := requestResponse(bob, "fast"); err != nil {
+		t.Errorf("Expected other routes to be unaffected, got %s", err)
+	}
+}
+
+func TestTakesFromAllLimitsOrNone(t *testing.T) {
+	clock := &fakeClock{time.Unix(0, 0)}
+	limiter, _ := NewRateLimiter(WithGlobalRate(1, 2), WithConnectionRate(1, 1, nil), withClock(clock))
+	alice := limiter.Handler("alice", echoHandler())
+	bob := limiter.Handler("bob", echoHandler())
+
+	requestResponse(alice, "hi")
+	// Alice is out, which must not cost the global limit anything
+	requestResponse(alice, "hi")
+	if err := requestResponse(bob, "hi"); err != nil {
+		t.Errorf("Expected a global token left for bob, got %s", err)
+	}
+	if err := requestResponse(bob, "hi"); err != ErrRateLimited {
+		t.Errorf("Expected the global limit to be used up, got %v", err)
+	}
+}
+
+func TestWrapKeysConnectionsBySetup(t *testing.T) {
+	limiter, _ := NewRateLimiter(WithConnectionRate(1, 1, func(setup rs.ConnectionSetupPayload) string {
+		return string(setup.Metadata())
+	}))
+	setup := limiter.Wrap(func(rs.ConnectionSetupPayload, rs.ReactiveSocket) (*rs.RequestHandler, error) {
+		return echoHandler(), nil
+	})
+	first, _ := setup(rs.NewSetupPayload("", "", []byte("tenant-a"), []byte("1")), nil)
+	second, _ := setup(rs.NewSetupPayload("", "", []byte("tenant-a"), []byte("2")), nil)
+
+	requestResponse(first, "hi")
+	if err := requestResponse(second, "hi"); err != ErrRateLimited {
+		t.Errorf("Expected connections of the same tenant to share a limit, got %v", err)
+	}
+}
+
+func TestRejectsInvalidRates(t *testing.T) {
+	if _, err := NewRateLimiter(WithGlobalRate(1, 0)); err == nil {
+		t.Errorf("Expected a rate without a burst to be refused")
+	}
+	if _, err := NewRateLimiter(WithRouteRate("a", 1, 1)); err == nil {
+		t.Errorf("Expected route limits without a router to be refused")
+	}
+}
+
+func TestSweepsFullBuckets(t *testing.T) {
+	clock := &fakeClock{time.Unix(0, 0)}
+	limiter, _ := NewRateLimiter(WithConnectionRate(1, 1, nil), withClock(clock))
+	for i := 0; i < minSweep; i++ {
+		limiter.allow(string(rune(i)), nil)
+	}
+	clock.advance(time.Second)
+	limiter.allow("latecomer", nil)
+	if len(limiter.buckets) != 1 {
+		t.Errorf("Expected refilled buckets to be swept, got %d left", len(limiter.buckets))
+	}
+}
+
+func echoHandler() *rs.RequestHandler {
+	return &rs.RequestHandler{
+		HandleRequestResponse: func(p rs.Payload) rs.Publisher {
+			data := string(p.Data())
+			return rs.NewPublisher(func(s rs.Subscriber) {
+				s.OnSubscribe(rs.NewSubscription(func(n int) {
+					s.OnNext(rs.NewPayload(nil, []byte(data)))
+					s.OnComplete()
+				}, func() {}))
+			})
+		},
+	}
+}
+
+// Make a request, returning the error it failed with, if any
+func requestResponse(h *rs.RequestHandler, data string) error {
+	var err error
+	h.HandleRequestResponse(rs.NewPayload(nil, []byte(data))).Subscribe(rs.NewSubscriber(func(s rs.Subscription) {
+		s.Request(1)
+	}, nil, func(e error) {
+		err = e
+	}, nil))
+	return err
+}
+
+type fakeClock struct {
+	now time.Time
+}
+
+func (c *fakeClock) advance(d time.Duration) {
+	c.now = c.now.Add(d)
+}
+
+func withClock(c *fakeClock) RateLimitOption {
+	return func(o *RateLimitOptions) {
+		o.now = func() time.Time { return c.now }
+	}
+}
@@ -0,0 +1,101 @@
+package server
+
+import (
+	"github.com/jakewins/reactivesocket-go/pkg/rs"
+	"sort"
+	"sync"
+)
+
+// A connected client
+type Client struct {
+	// Where it connected from and what it set up with; see Context.Setup
+	Context rs.ConnectionContext
+	// For requests to the client; closing it disconnects the client
+	Socket rs.ClosableSocket
+}
+
+// Keeps track of the clients connected to a server, for pushing requests to
+// them. Clients are added once their setup is accepted, and removed once
+// their connection closes.
+type Registry struct {
+	lock    sync.Mutex
+	clients map[*Client]bool
+}
+
+func NewRegistry() *Registry {
+	return &Registry{clients: make(map[*Client]bool)}
+}
+
+// Register every connection setup accepts
+func (r *Registry) Wrap(setup rs.ConnectionSetupHandler) rs.ConnectionSetupHandler {
+	return func(payload rs.ConnectionSetupPayload, socket rs.ReactiveSocket) (*rs.RequestHandler, error) {
+		handler, err := setup(payload, socket)
+		if err != nil {
+			return nil, err
+		}
+		if closable, ok := socket.(rs.ClosableSocket); ok {
+			r.add(&Client{rs.ContextOf(payload), closable})
+		}
+		return handler, nil
+	}
+}
+
+// The clients connected right now, in the order they connected
+func (r *Registry) Clients() []*Client {
+	r.lock.Lock()
+	clients := make([]*Client, 0, len(r.clients))
+	for c := range r.clients {
+		clients = append(clients, c)
+	}
+	r.lock.Unlock()
+	sort.Sort(byId(clients))
+	return clients
+}
+
+// The client on connection id, or nil if it isn't connected
+func (r *Registry) Get(id int) *Client {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	for c := range r.clients {
+		if c.Context != nil && c.Context.Id() == id {
+			return c
+		}
+	}
+	return nil
+}
+
+// Send p to every connected client as fire and forget
+func (r *Registry) Broadcast(p rs.Payload) {
+	for _, c := range r.Clients() {
+		if c.Socket.Err() != nil {
+			// Disconnected, but not removed yet
+			continue
+		}
+		c.Socket.FireAndForget(p).Subscribe(rs.NewSubscriber(func(s rs.Subscription) {
+			s.Request(1)
+		}, nil, func(error) {}, nil))
+	}
+}
+
+func (r *Registry) add(c *Client) {
+	r.lock.Lock()
+	r.clients[c] = true
+	r.lock.Unlock()
+	go func() {
+		<-c.Socket.Done()
+		r.lock.Lock()
+		delete(r.clients, c)
+		r.lock.Unlock()
+	}()
+}
+
+type byId []*Client
+
+func (c byId) Len() int      { return len(c) }
+func (c byId) Swap(i, j int) { c[i], c[j] = c[j], c[i] }
+func (c byId) Less(i, j int) bool {
+	if c[i].Context == nil || c[j].Context == nil {
+		return c[j].Context != nil
+	}
+	return c[i].Context.Id() < c[j].Context.Id()
+}
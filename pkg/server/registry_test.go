@@ -0,0 +1,119 @@
+package server
+
+import (
+	"github.com/jakewins/reactivesocket-go/pkg/rs"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestRegistersAcceptedClientsUntilTheyDisconnect(t *testing.T) {
+	registry := NewRegistry()
+	setup := registry.Wrap(func(p rs.ConnectionSetupPayload, _ rs.ReactiveSocket) (*rs.RequestHandler, error) {
+		if string(p.Data()) == "rejected" {
+			return nil, rs.NewError(rs.ErrorCodeRejectedSetup, "Go away.")
+		}
+		return &rs.RequestHandler{}, nil
+	})
+	first, second, rejected := connect(t, setup, 2, "first"), connect(t, setup, 1, "second"), connect(t, setup, 3, "rejected")
+
+	clients := registry.Clients()
+	if len(clients) != 2 || clients[0].Socket != second || clients[1].Socket != first {
+		t.Fatalf("Expected the two accepted clients by connection id, got %v", clients)
+	}
+	if c := registry.Get(2); c == nil || string(c.Context.Setup().Data()) != "first" {
+		t.Errorf("Expected to find the first client with its setup, got %v", c)
+	}
+	if registry.Get(3) != nil {
+		t.Errorf("Expected the rejected client not to be registered")
+	}
+
+	registry.Broadcast(rs.NewPayload(nil, []byte("news")))
+	if first.pushed() != 1 || second.pushed() != 1 || rejected.pushed() != 0 {
+		t.Errorf("Expected the broadcast to reach every client once")
+	}
+
+	first.Close()
+	for deadline := time.Now().Add(5 * time.Second); len(registry.Clients()) != 1; time.Sleep(time.Millisecond) {
+		if time.Now().After(deadline) {
+			t.Fatalf("Expected the disconnected client to be removed")
+		}
+	}
+}
+
+func TestBroadcastSkipsClientsThatJustDisconnected(t *testing.T) {
+	registry := NewRegistry()
+	setup := registry.Wrap(func(rs.ConnectionSetupPayload, rs.ReactiveSocket) (*rs.RequestHandler, error) {
+		return &rs.RequestHandler{}, nil
+	})
+	gone, staying := connect(t, setup, 1, "gone"), connect(t, setup, 2, "staying")
+
+	// Before the registry has had a chance to notice
+	gone.Close()
+	registry.Broadcast(rs.NewPayload(nil, []byte("news")))
+
+	if gone.pushed() != 0 || staying.pushed() != 1 {
+		t.Errorf("Expected only the connected client to get the broadcast, got %d and %d", gone.pushed(), staying.pushed())
+	}
+}
+
+// Run setup as a connection with id and setup data would
+func connect(t *testing.T, setup rs.ConnectionSetupHandler, id int, data string) *clientSocket {
+	socket := &clientSocket{done: make(chan struct{})}
+	ctx := rs.NewConnectionContext(id, nil, nil, rs.NewSetupPayload("", "", nil, []byte(data)))
+	setup(ctx.Setup(), socket)
+	return socket
+}
+
+type clientSocket struct {
+	lock   sync.Mutex
+	pushes int
+	closed bool
+	done   chan struct{}
+}
+
+func (s *clientSocket) pushed() int {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return s.pushes
+}
+
+func (s *clientSocket) FireAndForget(rs.Payload) rs.Publisher {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if s.closed {
+		return rs.NewErrorPublisher(rs.ErrSocketClosed)
+	}
+	s.pushes++
+	return rs.NewEmptyPublisher()
+}
+func (s *clientSocket) RequestResponse(rs.Payload) rs.Publisher {
+	return rs.NewEmptyPublisher()
+}
+func (s *clientSocket) RequestStream(rs.Payload) rs.Publisher {
+	return rs.NewEmptyPublisher()
+}
+func (s *clientSocket) RequestSubscription(rs.Payload) rs.Publisher {
+	return rs.NewEmptyPublisher()
+}
+func (s *clientSocket) RequestChannel(rs.Publisher) rs.Publisher {
+	return rs.NewEmptyPublisher()
+}
+func (s *clientSocket) Close() error {
+	s.lock.Lock()
+	s.closed = true
+	s.lock.Unlock()
+	close(s.done)
+	return nil
+}
+func (s *clientSocket) Done() <-chan struct{} {
+	return s.done
+}
+func (s *clientSocket) Err() error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if s.closed {
+		return rs.ErrSocketClosed
+	}
+	return nil
+}
@@ -0,0 +1,184 @@
+package transport
+
+import (
+	"fmt"
+	"github.com/jakewins/reactivesocket-go/pkg/internal/codec/header"
+	"github.com/jakewins/reactivesocket-go/pkg/internal/fragment"
+	"github.com/jakewins/reactivesocket-go/pkg/internal/frame"
+	"time"
+)
+
+// Per-connection settings, shared by all transports. Pass any number of
+// Option to Dial or Listen to change the defaults.
+type Options struct {
+	// Largest frame to send, in bytes, not counting any length prefix. Larger
+	// request and response frames are split into fragments. Zero means frames
+	// are never fragmented.
+	MTU int
+	// Most bytes to buffer in partially received fragmented frames, across all
+	// streams on a connection. Exceeding this fails the connection.
+	MaxReassemblySize int
+	// Largest frame to accept, in bytes, not counting any length prefix. A
+	// peer sending a larger frame fails the connection.
+	MaxFrameSize int
+	// Layout of frames on the wire; both ends of a connection must agree.
+	Format WireFormat
+	// How long a session outlives its connection, waiting to be resumed over
+	// a new one. Clients keep trying to reconnect for this long, servers
+	// keep the session state for this long. Zero disables resumption.
+	ResumeTimeout time.Duration
+	// Most bytes of sent frames to retain for replay on resumption, until
+	// the remote acknowledges them. Once exceeded the oldest are dropped,
+	// and resuming fails if the remote turns out to have missed them.
+	ResumeBufferSize int
+	// Servers; most connections a listener serves at once. Zero is no limit.
+	MaxConnections int
+	// Most streams the remote may have open on a connection at once, and,
+	// for servers, across all its connections. Zero is no limit.
+	MaxStreamsPerConnection int
+	MaxStreams              int
+	// How long connections and requests over the limits wait for room,
+	// before being rejected. Zero rejects them straight away.
+	AdmissionTimeout time.Duration
+	// Clients; ask for the strict interpretation of the protocol, so both
+	// ends fail the connection when the other deviates from it, rather than
+	// logging and carrying on. Not part of RSocket 1.0.
+	StrictInterpretation bool
+}
+
+type WireFormat int
+
+const (
+	// The pre-1.0 ReactiveSocket format, the default
+	FormatReactiveSocket WireFormat = iota
+	// RSocket 1.0, as spoken by current RSocket implementations. Only
+	// supported over TCP for now.
+	FormatRSocket1
+)
+
+type Option func(*Options)
+
+const (
+	DefaultMaxReassemblySize = 16 * 1024 * 1024
+	DefaultResumeBufferSize  = 1024 * 1024
+)
+
+func NewOptions(opts ...Option) (*Options, error) {
+	o := &Options{
+		MaxReassemblySize: DefaultMaxReassemblySize,
+		MaxFrameSize:      frame.DefaultMaxFrameSize,
+		ResumeBufferSize:  DefaultResumeBufferSize,
+	}
+	for _, opt := range opts {
+		opt(o)
+	}
+	if o.MTU != 0 && o.MTU < fragment.MinMTU {
+		return nil, fmt.Errorf("MTU must be at least %d bytes, got %d.", fragment.MinMTU, o.MTU)
+	}
+	if o.MaxReassemblySize <= 0 {
+		return nil, fmt.Errorf("Max reassembly size must be positive, got %d.", o.MaxReassemblySize)
+	}
+	if o.Format != FormatReactiveSocket && o.Format != FormatRSocket1 {
+		return nil, fmt.Errorf("Unknown wire format: %d.", o.Format)
+	}
+	if o.MaxFrameSize < header.FrameHeaderLength {
+		return nil, fmt.Errorf("Max frame size must be at least %d bytes, got %d.", header.FrameHeaderLength, o.MaxFrameSize)
+	}
+	if o.ResumeTimeout < 0 {
+		return nil, fmt.Errorf("Resume timeout must not be negative, got %s.", o.ResumeTimeout)
+	}
+	if o.ResumeBufferSize <= 0 {
+		return nil, fmt.Errorf("Resume buffer size must be positive, got %d.", o.ResumeBufferSize)
+	}
+	if o.MaxConnections < 0 || o.MaxStreamsPerConnection < 0 || o.MaxStreams < 0 {
+		return nil, fmt.Errorf("Connection and stream limits must not be negative.")
+	}
+	if o.AdmissionTimeout < 0 {
+		return nil, fmt.Errorf("Admission timeout must not be negative, got %s.", o.AdmissionTimeout)
+	}
+	if o.StrictInterpretation && o.Format == FormatRSocket1 {
+		return nil, fmt.Errorf("Strict interpretation is not supported by RSocket 1.0.")
+	}
+	return o, nil
+}
+
+// Fragment frames larger than mtu bytes
+func WithMTU(mtu int) Option {
+	return func(o *Options) {
+		o.MTU = mtu
+	}
+}
+
+// Limit the memory used to reassemble inbound fragmented frames
+func WithMaxReassemblySize(size int) Option {
+	return func(o *Options) {
+		o.MaxReassemblySize = size
+	}
+}
+
+// Reject inbound frames larger than size bytes
+func WithMaxFrameSize(size int) Option {
+	return func(o *Options) {
+		o.MaxFrameSize = size
+	}
+}
+
+// Speak the given wire format on the connection
+func WithWireFormat(format WireFormat) Option {
+	return func(o *Options) {
+		o.Format = format
+	}
+}
+
+// Let sessions be resumed over a new connection for up to timeout after the
+// one they were on fails
+func WithResumption(timeout time.Duration) Option {
+	return func(o *Options) {
+		o.ResumeTimeout = timeout
+	}
+}
+
+// Retain up to size bytes of sent frames for resumption
+func WithResumeBufferSize(size int) Option {
+	return func(o *Options) {
+		o.ResumeBufferSize = size
+	}
+}
+
+// Serve at most max connections at once
+func WithMaxConnections(max int) Option {
+	return func(o *Options) {
+		o.MaxConnections = max
+	}
+}
+
+// Let the remote have at most max streams open on each connection
+func WithMaxStreamsPerConnection(max int) Option {
+	return func(o *Options) {
+		o.MaxStreamsPerConnection = max
+	}
+}
+
+// Let clients have at most max streams open across all of a servers
+// connections
+func WithMaxStreams(max int) Option {
+	return func(o *Options) {
+		o.MaxStreams = max
+	}
+}
+
+// Hold connections and requests over the limits for up to timeout, waiting
+// for room, rather than rejecting them straight away
+func WithAdmissionQueue(timeout time.Duration) Option {
+	return func(o *Options) {
+		o.AdmissionTimeout = timeout
+	}
+}
+
+// Clients; fail the connection on any deviation from the protocol, by either
+// end, eg. for conformance testing
+func WithStrictInterpretation() Option {
+	return func(o *Options) {
+		o.StrictInterpretation = true
+	}
+}
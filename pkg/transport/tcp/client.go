@@ -3,28 +3,46 @@ package tcp
 import (
 	"github.com/jakewins/reactivesocket-go/pkg/internal/trans"
 	"github.com/jakewins/reactivesocket-go/pkg/rs"
+	"github.com/jakewins/reactivesocket-go/pkg/transport"
 	"net"
 )
 
 // Connect to a TCP Reactive Socket identified by address
-func Dial(address string, setup rs.ConnectionSetupPayload) (rs.ReactiveSocket, error) {
-	return DialAndHandle(address, setup, &rs.RequestHandler{})
+//
+// The server may reject the setup payload once connected; requests on the
+// returned socket then fail with an *rs.Error saying why.
+//
+// With transport.WithResumption, a failed connection is not the end of the
+// socket: the client reconnects and resumes the session where it left off,
+// if the server supports it. Streams only fail once the resume timeout runs
+// out or the server refuses to resume.
+func Dial(address string, setup rs.ConnectionSetupPayload, opts ...transport.Option) (rs.ClosableSocket, error) {
+	return DialAndHandle(address, setup, &rs.RequestHandler{}, opts...)
 }
 
 // Same as Dial, adding the ability to handle requests coming from the server
-func DialAndHandle(address string, setup rs.ConnectionSetupPayload, handler *rs.RequestHandler) (rs.ReactiveSocket, error) {
+func DialAndHandle(address string, setup rs.ConnectionSetupPayload, handler *rs.RequestHandler, opts ...transport.Option) (rs.ClosableSocket, error) {
+	options, err := transport.NewOptions(opts...)
+	if err != nil {
+		return nil, err
+	}
 	addr, err := net.ResolveTCPAddr("tcp", address)
 	if err != nil {
 		return nil, err
 	}
-	rwc, err := net.DialTCP("tcp", nil, addr)
+	redial := func() (net.Conn, error) {
+		return net.DialTCP("tcp", nil, addr)
+	}
+	rwc, err := redial()
 	if err != nil {
 		return nil, err
 	}
 
 	c := &trans.ReactiveConn{
-		Id:  0,
-		Rwc: rwc,
+		Id:      0,
+		Rwc:     rwc,
+		Options: options,
+		Redial:  redial,
 		Setup: func(c *trans.ReactiveConn) (*rs.RequestHandler, error) {
 			if err := c.WriteSetupFrame(1000, 0, setup); err != nil {
 				return nil, err
@@ -34,8 +52,10 @@ func DialAndHandle(address string, setup rs.ConnectionSetupPayload, handler *rs.
 		},
 	}
 
-	c.Initialize(1)
+	if err := c.Initialize(1); err != nil {
+		return nil, err
+	}
 	go c.Serve()
 
-	return c.Protocol, nil
+	return c.Socket(), nil
 }
@@ -1,14 +1,30 @@
 package tcp
 
 import (
+	"github.com/jakewins/reactivesocket-go/pkg/internal/limit"
 	"github.com/jakewins/reactivesocket-go/pkg/internal/trans"
 	"github.com/jakewins/reactivesocket-go/pkg/rs"
+	"github.com/jakewins/reactivesocket-go/pkg/transport"
 	"net"
 	"sync"
 	"time"
 )
 
-func Listen(address string, setup rs.ConnectionSetupHandler) (Server, error) {
+// Listen for TCP Reactive Socket connections on address. With
+// transport.WithResumption, clients may resume their sessions after their
+// connection fails, for up to the given timeout.
+//
+// Connections and streams over the limits set with
+// transport.WithMaxConnections, WithMaxStreamsPerConnection and WithMaxStreams
+// are rejected, with ERROR[REJECTED_SETUP] and ERROR[REJECTED] respectively,
+// unless transport.WithAdmissionQueue lets them wait for room. Connections
+// wait in the listen backlog, not yet accepted, so a storm of them costs the
+// server nothing until there is room.
+func Listen(address string, setup rs.ConnectionSetupHandler, opts ...transport.Option) (Server, error) {
+	options, err := transport.NewOptions(opts...)
+	if err != nil {
+		return nil, err
+	}
 	laddr, err := net.ResolveTCPAddr("tcp", address)
 	if err != nil {
 		return nil, err
@@ -21,8 +37,14 @@ func Listen(address string, setup rs.ConnectionSetupHandler) (Server, error) {
 	s := &server{
 		listener:        listener,
 		setup:           setup,
-		control:         make(chan string, 2),
+		options:         options,
+		control:         make(chan struct{}),
 		shutdownWaiters: &sync.WaitGroup{},
+		connections:     limit.New(options.MaxConnections),
+		streams:         limit.New(options.MaxStreams),
+	}
+	if options.ResumeTimeout > 0 {
+		s.sessions = trans.NewSessionStore()
 	}
 	s.shutdownWaiters.Add(1)
 	return s, nil
@@ -40,8 +62,15 @@ type Server interface {
 type server struct {
 	listener        *net.TCPListener
 	setup           rs.ConnectionSetupHandler
-	control         chan string
+	options         *transport.Options
+	sessions        *trans.SessionStore // Nil unless resumption is enabled
+	control         chan struct{}
 	shutdownWaiters *sync.WaitGroup
+	connections     *limit.Limit // Nil unless limited
+	streams         *limit.Limit // Across all connections, nil unless limited
+
+	// Connections being served
+	serving sync.WaitGroup
 }
 
 func (s *server) Serve() error {
@@ -53,9 +82,15 @@ func (s *server) Serve() error {
 		if s.checkForShutdown() {
 			return nil
 		}
+		// Take the slot before accepting, so connections waiting for one
+		// queue up in the listen backlog rather than as goroutines here
+		admitted := s.connections.Acquire(s.options.AdmissionTimeout, s.control)
 		s.listener.SetDeadline(time.Now().Add(1e9))
 		rwc, err := s.listener.Accept()
 		if err != nil {
+			if admitted {
+				s.connections.Release()
+			}
 			if opErr, ok := err.(*net.OpError); ok && opErr.Temporary() {
 				continue
 			}
@@ -65,16 +100,42 @@ func (s *server) Serve() error {
 		// TODO: Proper resource handling - close these guys on server close
 		connIds += 1
 		c := &trans.ReactiveConn{
-			Id:    connIds,
-			Rwc:   rwc,
-			Setup: s.setupConnection,
+			Id:            connIds,
+			Rwc:           rwc,
+			Setup:         s.setupConnection,
+			Options:       s.options,
+			Sessions:      s.sessions,
+			ServerStreams: s.streams,
+		}
+		if !admitted {
+			// A slot may have freed up while we waited to accept
+			admitted = s.connections.TryAcquire()
 		}
+		if !admitted {
+			// Right here, so a storm of connections costs no more than one
+			// at a time; the deadline keeps a stalled client from holding
+			// up the accept loop
+			rwc.SetWriteDeadline(time.Now().Add(rejectTimeout))
+			c.Reject(errTooManyConnections)
+			continue
+		}
+		s.serving.Add(1)
 		go func() {
-			c.Initialize(2)
+			defer s.serving.Done()
+			defer s.connections.Release()
+			if err := c.Initialize(2); err != nil {
+				return
+			}
 			c.Serve()
 		}()
 	}
 }
+
+// How long a connection over the limit gets to take its rejection
+const rejectTimeout = 100 * time.Millisecond
+
+var errTooManyConnections = rs.NewError(rs.ErrorCodeRejectedSetup, "Too many connections.")
+
 func (s *server) Shutdown() {
 	close(s.control)
 }
@@ -86,7 +147,11 @@ func (s *server) setupConnection(c *trans.ReactiveConn) (*rs.RequestHandler, err
 	if err != nil {
 		return nil, err
 	}
-	return s.setup(sp, c.Protocol)
+	handler, err := s.setup(sp, c.Socket())
+	if err != nil {
+		return nil, trans.SetupRejected(err)
+	}
+	return handler, nil
 }
 func (s *server) checkForShutdown() bool {
 	select {
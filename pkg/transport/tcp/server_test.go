@@ -0,0 +1,126 @@
+package tcp
+
+import (
+	"github.com/jakewins/reactivesocket-go/pkg/rs"
+	"github.com/jakewins/reactivesocket-go/pkg/transport"
+	"io/ioutil"
+	"net"
+	"runtime"
+	"testing"
+	"time"
+)
+
+func TestConnectionStormWaitsInBacklogOnceFull(t *testing.T) {
+	listening, err := Listen("127.0.0.1:0", func(rs.ConnectionSetupPayload, rs.ReactiveSocket) (*rs.RequestHandler, error) {
+		return &rs.RequestHandler{}, nil
+	}, transport.WithMaxConnections(2), transport.WithAdmissionQueue(time.Minute))
+	if err != nil {
+		t.Fatal(err)
+	}
+	go listening.Serve()
+	defer awaitServed(t, listening.(*server))
+	defer listening.AwaitShutdown()
+	defer listening.Shutdown()
+	address := listening.(*server).listener.Addr().String()
+
+	for i := 0; i < 2; i++ {
+		socket, err := Dial(address, rs.NewSetupPayload("", "", nil, nil))
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer socket.Close()
+	}
+	awaitInUse(t, listening.(*server), 2)
+	goroutines, sockets := runtime.NumGoroutine(), openFiles()
+
+	const storm = 200
+	for i := 0; i < storm; i++ {
+		rwc, err := net.Dial("tcp", address)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer rwc.Close()
+	}
+	time.Sleep(100 * time.Millisecond)
+
+	if grown := runtime.NumGoroutine() - goroutines; grown > 10 {
+		t.Errorf("Expected no goroutines for connections waiting for room, got %d more", grown)
+	}
+	// Only our ends of the connections, the server has not accepted them
+	if sockets >= 0 {
+		if grown := openFiles() - sockets; grown > storm+10 {
+			t.Errorf("Expected the server not to open connections waiting for room, got %d more files for %d connections", grown, storm)
+		}
+	}
+}
+
+func TestConnectionStormIsRejectedOnceFull(t *testing.T) {
+	listening, err := Listen("127.0.0.1:0", func(rs.ConnectionSetupPayload, rs.ReactiveSocket) (*rs.RequestHandler, error) {
+		return &rs.RequestHandler{}, nil
+	}, transport.WithMaxConnections(1))
+	if err != nil {
+		t.Fatal(err)
+	}
+	go listening.Serve()
+	defer awaitServed(t, listening.(*server))
+	defer listening.AwaitShutdown()
+	defer listening.Shutdown()
+	address := listening.(*server).listener.Addr().String()
+
+	socket, err := Dial(address, rs.NewSetupPayload("", "", nil, nil))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer socket.Close()
+	awaitInUse(t, listening.(*server), 1)
+	goroutines := runtime.NumGoroutine()
+
+	for i := 0; i < 50; i++ {
+		rwc, err := net.Dial("tcp", address)
+		if err != nil {
+			t.Fatal(err)
+		}
+		// The server closes it once it has said why
+		rwc.SetReadDeadline(time.Now().Add(5 * time.Second))
+		if _, err := ioutil.ReadAll(rwc); err != nil {
+			t.Fatalf("Expected the server to close the connection, got %s", err)
+		}
+		rwc.Close()
+	}
+
+	if grown := runtime.NumGoroutine() - goroutines; grown > 10 {
+		t.Errorf("Expected rejected connections not to leave goroutines behind, got %d more", grown)
+	}
+}
+
+func awaitInUse(t *testing.T, s *server, n int) {
+	for deadline := time.Now().Add(5 * time.Second); s.connections.InUse() != n; time.Sleep(time.Millisecond) {
+		if time.Now().After(deadline) {
+			t.Fatalf("Expected %d connections to be served, got %d", n, s.connections.InUse())
+		}
+	}
+}
+
+// Wait for the connections s served to be done with, once their clients
+// are closed
+func awaitServed(t *testing.T, s *server) {
+	served := make(chan struct{})
+	go func() {
+		s.serving.Wait()
+		close(served)
+	}()
+	select {
+	case <-served:
+	case <-time.After(5 * time.Second):
+		t.Error("Expected connections to be done with once closed")
+	}
+}
+
+// Files this process has open, or -1 if that can't be told
+func openFiles() int {
+	files, err := ioutil.ReadDir("/proc/self/fd")
+	if err != nil {
+		return -1
+	}
+	return len(files)
+}
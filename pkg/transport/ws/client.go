@@ -4,24 +4,33 @@ import (
 	"fmt"
 	"github.com/jakewins/reactivesocket-go/pkg/internal/trans"
 	"github.com/jakewins/reactivesocket-go/pkg/rs"
+	"github.com/jakewins/reactivesocket-go/pkg/transport"
 	"golang.org/x/net/websocket"
 )
 
 // Connect to a TCP Reactive Socket identified by address, formatted as hostname:port
-func Dial(address string, setup rs.ConnectionSetupPayload) (rs.ReactiveSocket, error) {
-	return DialAndHandle(address, setup, &rs.RequestHandler{})
+//
+// The server may reject the setup payload once connected; requests on the
+// returned socket then fail with an *rs.Error saying why.
+func Dial(address string, setup rs.ConnectionSetupPayload, opts ...transport.Option) (rs.ClosableSocket, error) {
+	return DialAndHandle(address, setup, &rs.RequestHandler{}, opts...)
 }
 
 // Same as Dial, adding the ability to handle requests coming from the server
-func DialAndHandle(address string, setup rs.ConnectionSetupPayload, handler *rs.RequestHandler) (rs.ReactiveSocket, error) {
+func DialAndHandle(address string, setup rs.ConnectionSetupPayload, handler *rs.RequestHandler, opts ...transport.Option) (rs.ClosableSocket, error) {
+	options, err := newOptions(opts)
+	if err != nil {
+		return nil, err
+	}
 	rwc, err := websocket.Dial(fmt.Sprintf("ws://%s/ws", address), "", fmt.Sprintf("http://%s/", address))
 	if err != nil {
 		return nil, err
 	}
 
 	c := &trans.ReactiveConn{
-		Id:  0,
-		Rwc: rwc,
+		Id:      0,
+		Rwc:     rwc,
+		Options: options,
 		Setup: func(c *trans.ReactiveConn) (*rs.RequestHandler, error) {
 			if err := c.WriteSetupFrame(1000, 0, setup); err != nil {
 				return nil, err
@@ -31,8 +40,26 @@ func DialAndHandle(address string, setup rs.ConnectionSetupPayload, handler *rs.
 		},
 	}
 
-	c.Initialize(1)
+	if err := c.Initialize(1); err != nil {
+		return nil, err
+	}
 	go c.Serve()
 
-	return c.Protocol, nil
+	return c.Socket(), nil
+}
+
+func newOptions(opts []transport.Option) (*transport.Options, error) {
+	options, err := transport.NewOptions(opts...)
+	if err != nil {
+		return nil, err
+	}
+	if options.Format != transport.FormatReactiveSocket {
+		// RSocket 1.0 puts one frame in each websocket message, without a
+		// length prefix, which our framing doesn't do yet.
+		return nil, fmt.Errorf("Only the ReactiveSocket wire format is supported over websockets.")
+	}
+	if options.ResumeTimeout > 0 {
+		return nil, fmt.Errorf("Resumption is not supported over websockets.")
+	}
+	return options, nil
 }
@@ -2,6 +2,7 @@ package ws
 
 import (
 	"errors"
+	"github.com/jakewins/reactivesocket-go/pkg/internal/limit"
 	"github.com/jakewins/reactivesocket-go/pkg/internal/trans"
 	"github.com/jakewins/reactivesocket-go/pkg/rs"
 	"github.com/jakewins/reactivesocket-go/pkg/transport"
@@ -13,7 +14,11 @@ import (
 	"time"
 )
 
-func Listen(address string, setup rs.ConnectionSetupHandler) (transport.Server, error) {
+func Listen(address string, setup rs.ConnectionSetupHandler, opts ...transport.Option) (transport.Server, error) {
+	options, err := newOptions(opts)
+	if err != nil {
+		return nil, err
+	}
 	laddr, err := net.ResolveTCPAddr("tcp", address)
 	if err != nil {
 		return nil, err
@@ -29,14 +34,20 @@ func Listen(address string, setup rs.ConnectionSetupHandler) (transport.Server,
 			make(chan int, 2),
 		},
 		setup:           setup,
+		options:         options,
 		shutdownWaiters: &sync.WaitGroup{},
+		connections:     limit.New(options.MaxConnections),
+		streams:         limit.New(options.MaxStreams),
 	}, nil
 }
 
 type wssServer struct {
 	listener        *interruptibleListener
 	setup           rs.ConnectionSetupHandler
+	options         *transport.Options
 	shutdownWaiters *sync.WaitGroup
+	connections     *limit.Limit // Nil unless limited
+	streams         *limit.Limit // Across all connections, nil unless limited
 }
 
 func (s *wssServer) Serve() error {
@@ -48,12 +59,21 @@ func (s *wssServer) Serve() error {
 		Handler: func(rwc *websocket.Conn) {
 			connId := atomic.AddInt64(&connIds, 1) - 1
 			c := &trans.ReactiveConn{
-				Id:    int(connId),
-				Rwc:   rwc,
-				Setup: s.setupConnection,
+				Id:            int(connId),
+				Rwc:           rwc,
+				Setup:         s.setupConnection,
+				Options:       s.options,
+				ServerStreams: s.streams,
 			}
 			go func() {
-				c.Initialize(2)
+				if !s.connections.Acquire(s.options.AdmissionTimeout, nil) {
+					c.Reject(rs.NewError(rs.ErrorCodeRejectedSetup, "Too many connections."))
+					return
+				}
+				defer s.connections.Release()
+				if err := c.Initialize(2); err != nil {
+					return
+				}
 				c.Serve()
 			}()
 		},
@@ -80,7 +100,11 @@ func (s *wssServer) setupConnection(c *trans.ReactiveConn) (*rs.RequestHandler,
 	if err != nil {
 		return nil, err
 	}
-	return s.setup(sp, c.Protocol)
+	handler, err := s.setup(sp, c.Socket())
+	if err != nil {
+		return nil, trans.SetupRejected(err)
+	}
+	return handler, nil
 }
 
 var shutdownToken = errors.New("induced shutdown")